@@ -1,6 +1,7 @@
 package autounlock
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -117,6 +118,12 @@ func (daemon *Daemon) Stop() {
 	}
 }
 
+// Shutdown stops the periodic unlocking attempts. An ongoing attempt is allowed to finish by itself.
+func (daemon *Daemon) Shutdown(_ context.Context) error {
+	daemon.Stop()
+	return nil
+}
+
 func TestAutoUnlock(daemon *Daemon, t testingstub.T) {
 	var unlocked bool
 	// Start a web server that behaves somewhat similar to the real password input server
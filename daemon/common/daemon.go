@@ -0,0 +1,60 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ShutdownPollIntervalMilli is the interval at which a server shutting down checks whether its ongoing conversations have completed.
+const ShutdownPollIntervalMilli = 100
+
+/*
+Daemon is the uniform lifecycle of laitos daemons. Each daemon is initialised from its configuration using its own
+Initialise function, whose parameters vary from daemon to daemon. After initialisation, the daemon is started by
+StartAndBlock, and either stopped right away by Stop, or shut down gracefully by Shutdown.
+*/
+type Daemon interface {
+	// StartAndBlock starts the daemon and blocks until the daemon is stopped.
+	StartAndBlock() error
+	// Stop stops the daemon from accepting new clients right away, ongoing conversations may continue nonetheless.
+	Stop()
+	/*
+		Shutdown stops the daemon from accepting new clients, and then waits for ongoing conversations and pending work
+		to complete. If the context is done before then, the function gives up waiting and returns an error.
+	*/
+	Shutdown(context.Context) error
+}
+
+// waitUntil calls the condition function at regular interval, and returns when the condition is met or the context is done.
+func waitUntil(ctx context.Context, condition func() bool) error {
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ShutdownPollIntervalMilli * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+/*
+ShutdownConcurrently calls all of the shutdown functions at once with the same context, and waits for them to return.
+It returns the first error among the functions' return values.
+*/
+func ShutdownConcurrently(ctx context.Context, shutdownFuns ...func(context.Context) error) error {
+	errs := make(chan error, len(shutdownFuns))
+	wg := new(sync.WaitGroup)
+	for _, fun := range shutdownFuns {
+		wg.Add(1)
+		go func(fun func(context.Context) error) {
+			defer wg.Done()
+			if err := fun(ctx); err != nil {
+				errs <- err
+			}
+		}(fun)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -52,6 +53,7 @@ type TCPServer struct {
 	logger    lalog.Logger
 	rateLimit *misc.RateLimit
 	listener  net.Listener
+	conns     map[*net.TCPConn]struct{} // conns are the ongoing client connections
 }
 
 // NewTCPServer constructs a new TCP server and initialises its internal structures.
@@ -70,6 +72,7 @@ func NewTCPServer(listenAddr string, listenPort int, appName string, app TCPApp,
 // Initialise initialises the internal structures of the TCP server, preparing it for accepting clients.
 func (srv *TCPServer) Initialise() {
 	srv.mutex = new(sync.Mutex)
+	srv.conns = make(map[*net.TCPConn]struct{})
 	srv.logger = lalog.Logger{
 		ComponentName: srv.AppName,
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: srv.ListenAddr}, {Key: "TCPPort", Value: srv.ListenPort}},
@@ -89,8 +92,11 @@ func (srv *TCPServer) StartAndBlock() error {
 		return fmt.Errorf("TCPServer.StartAndBlock(%s): listener on port %d must not be started a second time", srv.AppName, srv.ListenPort)
 	}
 	srv.logger.Info("StartAndBlock", "", nil, "starting TCP listener")
-	var err error
-	srv.listener, err = net.Listen("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	// Stop may clear the listener in the meanwhile, the loop below therefore keeps a reference of its own.
+	listener, err := net.Listen("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	if err == nil {
+		srv.listener = listener
+	}
 	srv.mutex.Unlock()
 	if err != nil {
 		return fmt.Errorf("TCPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
@@ -100,7 +106,7 @@ func (srv *TCPServer) StartAndBlock() error {
 			srv.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
 			return misc.ErrEmergencyLockDown
 		}
-		client, err := srv.listener.Accept()
+		client, err := listener.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "closed") {
 				return nil
@@ -114,6 +120,9 @@ func (srv *TCPServer) StartAndBlock() error {
 			srv.logger.MaybeMinorError(tcpClient.Close())
 			continue
 		}
+		srv.mutex.Lock()
+		srv.conns[tcpClient] = struct{}{}
+		srv.mutex.Unlock()
 		go srv.handleConnection(clientIP, tcpClient)
 	}
 }
@@ -129,6 +138,9 @@ func (srv *TCPServer) handleConnection(clientIP string, client *net.TCPConn) {
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
 		srv.logger.MaybeMinorError(client.Close())
+		srv.mutex.Lock()
+		delete(srv.conns, client)
+		srv.mutex.Unlock()
 		srv.App.GetTCPStatsCollector().Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
 	srv.logger.Info("handleConnection", clientIP, nil, "connection is accepted")
@@ -165,3 +177,25 @@ func (srv *TCPServer) Stop() {
 	}
 	srv.logger.Info("Stop", "", nil, "TCP server has shut down successfully")
 }
+
+/*
+Shutdown stops the TCP server from accepting new connections, and then waits for ongoing connections to complete. If
+the context is done before then, the remaining connections are closed.
+*/
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	srv.Stop()
+	err := waitUntil(ctx, func() bool {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		return len(srv.conns) == 0
+	})
+	if err != nil {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		for conn := range srv.conns {
+			srv.logger.MaybeMinorError(conn.Close())
+		}
+		return fmt.Errorf("TCPServer.Shutdown(%s): closed %d ongoing connections on port %d - %v", srv.AppName, len(srv.conns), srv.ListenPort, err)
+	}
+	return nil
+}
@@ -2,10 +2,12 @@ package common
 
 import (
 	"bufio"
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -51,7 +53,7 @@ func TestTCPServer(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// Connect to the server and expect a hello response
-	client, err := net.Dial("tcp", fmt.Sprintf("%s:%d", srv.ListenAddr, srv.ListenPort))
+	client, err := net.Dial("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +75,7 @@ func TestTCPServer(t *testing.T) {
 	// Attempt to exceed the rate limit via connection attempts
 	var success int
 	for i := 0; i < 10; i++ {
-		client, err := net.Dial("tcp", fmt.Sprintf("%s:%d", srv.ListenAddr, srv.ListenPort))
+		client, err := net.Dial("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -111,3 +113,65 @@ func TestTCPServer(t *testing.T) {
 	srv.Stop()
 	srv.Stop()
 }
+
+// SlowTCPTestApp says hello to its client after a delay.
+type SlowTCPTestApp struct {
+	delay time.Duration
+	stats *misc.Stats
+}
+
+func (app *SlowTCPTestApp) GetTCPStatsCollector() *misc.Stats {
+	return app.stats
+}
+
+func (app *SlowTCPTestApp) HandleTCPConnection(logger lalog.Logger, clientIP string, conn *net.TCPConn) {
+	time.Sleep(app.delay)
+	_, _ = conn.Write([]byte("hello"))
+}
+
+func TestTCPServer_Shutdown(t *testing.T) {
+	app := &SlowTCPTestApp{delay: 1 * time.Second, stats: misc.NewStats()}
+	srv := NewTCPServer("127.0.0.1", 62173, "TestTCPServer_Shutdown", app, 5)
+	startAndConnect := func() *bufio.Reader {
+		go func() {
+			if err := srv.StartAndBlock(); err != nil {
+				panic(err)
+			}
+		}()
+		time.Sleep(1 * time.Second)
+		client, err := net.Dial("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return bufio.NewReader(client)
+	}
+
+	// Shutdown waits for the ongoing connection to complete
+	reader := startAndConnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if str, _ := reader.ReadString(0); str != "hello" {
+		t.Fatal(str)
+	}
+	// New connections are no longer accepted
+	if _, err := net.Dial("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort))); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Shutdown closes the ongoing connection after the deadline
+	app.delay = 10 * time.Second
+	reader = startAndConnect()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := srv.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "closed 1 ongoing connections") {
+		t.Fatal(err)
+	}
+	if str, _ := reader.ReadString(0); str != "" || time.Since(begin) > 3*time.Second {
+		t.Fatal(str, time.Since(begin))
+	}
+}
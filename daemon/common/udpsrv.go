@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -15,6 +16,8 @@ import (
 const (
 	// MaxPacketSize is the maximum acceptable size for a single UDP packet
 	MaxUDPPacketSize = 9038
+	// UDPStopTimeoutSec is the maximum amount of time Stop waits for ongoing conversations to reply to their clients.
+	UDPStopTimeoutSec = 10
 )
 
 // UDPApp defines routines for a UDP server to read, process, and interact with UDP clients.
@@ -46,6 +49,8 @@ type UDPServer struct {
 	logger    lalog.Logger
 	rateLimit *misc.RateLimit
 	udpServer *net.UDPConn
+	ongoing   int  // ongoing is the number of conversations being processed
+	draining  bool // draining is true when the server drops new clients while waiting for ongoing conversations to complete
 }
 
 // NewUDPServer constructs a new UDP server and initialises its internal structures.
@@ -93,7 +98,9 @@ func (srv *UDPServer) StartAndBlock() error {
 	if err != nil {
 		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to resolve listning address %s - %v", srv.AppName, srv.ListenAddr, err)
 	}
-	srv.udpServer, err = net.ListenUDP("udp", listenUDPAddr)
+	udpServer, err := net.ListenUDP("udp", listenUDPAddr)
+	srv.udpServer = udpServer
+	srv.draining = false
 	srv.mutex.Unlock()
 	if err != nil {
 		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
@@ -104,7 +111,7 @@ func (srv *UDPServer) StartAndBlock() error {
 			srv.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
 			return misc.ErrEmergencyLockDown
 		}
-		packetLen, clientAddr, err := srv.udpServer.ReadFromUDP(packet)
+		packetLen, clientAddr, err := udpServer.ReadFromUDP(packet)
 		if err != nil {
 			if strings.Contains(err.Error(), "closed") {
 				return nil
@@ -122,7 +129,14 @@ func (srv *UDPServer) StartAndBlock() error {
 		// Make a copy of the packet for processing because multiple packets may be processed concurrently
 		packetCopy := make([]byte, packetLen)
 		copy(packetCopy, packet[:packetLen])
-		go srv.handleClient(srv.udpServer, clientIP, clientAddr, packetCopy)
+		srv.mutex.Lock()
+		if srv.draining {
+			srv.mutex.Unlock()
+			continue
+		}
+		srv.ongoing++
+		srv.mutex.Unlock()
+		go srv.handleClient(udpServer, clientIP, clientAddr, packetCopy)
 	}
 }
 
@@ -133,6 +147,11 @@ func (srv *UDPServer) AddAndCheckRateLimit(clientIP string) bool {
 
 // handleConnection is launched in an independent goroutine by StartAndBlock to interact with a connected client.
 func (srv *UDPServer) handleClient(udpServer *net.UDPConn, clientIP string, clientAddr *net.UDPAddr, packet []byte) {
+	defer func() {
+		srv.mutex.Lock()
+		srv.ongoing--
+		srv.mutex.Unlock()
+	}()
 	if udpServer == nil {
 		// Server has already shut down
 		return
@@ -158,8 +177,33 @@ func (srv *UDPServer) IsRunning() bool {
 	return srv.udpServer != nil
 }
 
-// Stop the UDP server from accepting new clients. Ongoing conversations will continue nonetheless.
+/*
+Stop the UDP server from accepting new clients. The ongoing conversations use the listener to reply to their clients,
+hence the listener is closed after they complete or UDPStopTimeoutSec elapses, whichever comes first.
+*/
 func (srv *UDPServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), UDPStopTimeoutSec*time.Second)
+	defer cancel()
+	if err := srv.drain(ctx); err != nil {
+		srv.logger.Warning("Stop", "", err, "closing the listener while conversations are still ongoing")
+	}
+	srv.closeListener()
+}
+
+// drain drops new clients and waits for ongoing conversations to complete until the context is done.
+func (srv *UDPServer) drain(ctx context.Context) error {
+	srv.mutex.Lock()
+	srv.draining = true
+	srv.mutex.Unlock()
+	return waitUntil(ctx, func() bool {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		return srv.ongoing == 0
+	})
+}
+
+// closeListener closes the UDP listener, which ends StartAndBlock.
+func (srv *UDPServer) closeListener() {
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
 	if srv.udpServer != nil {
@@ -170,3 +214,19 @@ func (srv *UDPServer) Stop() {
 	}
 	srv.logger.Info("Stop", "", nil, "UDP server has shut down successfully")
 }
+
+/*
+Shutdown stops the UDP server from accepting new clients, and then waits for ongoing conversations to complete until the
+context is done. The ongoing conversations use the listener to reply to their clients, hence the listener is closed
+afterwards.
+*/
+func (srv *UDPServer) Shutdown(ctx context.Context) error {
+	err := srv.drain(ctx)
+	srv.closeListener()
+	if err != nil {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		return fmt.Errorf("UDPServer.Shutdown(%s): %d conversations on port %d did not complete - %v", srv.AppName, srv.ongoing, srv.ListenPort, err)
+	}
+	return nil
+}
@@ -1,10 +1,12 @@
 package common
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -56,7 +58,7 @@ func TestUDPServer(t *testing.T) {
 	}
 
 	// Connect to the server and expect a hello response
-	client, err := net.Dial("udp", fmt.Sprintf("%s:%d", srv.ListenAddr, srv.ListenPort))
+	client, err := net.Dial("udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,7 +82,7 @@ func TestUDPServer(t *testing.T) {
 	// Attempt to exceed the rate limit via connection attempts
 	var success int
 	for i := 0; i < 10; i++ {
-		client, err := net.Dial("udp", fmt.Sprintf("%s:%d", srv.ListenAddr, srv.ListenPort))
+		client, err := net.Dial("udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -128,3 +130,77 @@ func TestUDPServer(t *testing.T) {
 		t.Fatal("must not be running anymore")
 	}
 }
+
+// SlowUDPTestApp says hello to its client after a delay.
+type SlowUDPTestApp struct {
+	delay time.Duration
+	stats *misc.Stats
+}
+
+func (app *SlowUDPTestApp) GetUDPStatsCollector() *misc.Stats {
+	return app.stats
+}
+
+func (app *SlowUDPTestApp) HandleUDPClient(logger lalog.Logger, clientIP string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	time.Sleep(app.delay)
+	_, _ = srv.WriteToUDP([]byte("hello"), client)
+}
+
+func TestUDPServer_Shutdown(t *testing.T) {
+	app := &SlowUDPTestApp{delay: 1 * time.Second, stats: misc.NewStats()}
+	srv := NewUDPServer("127.0.0.1", 12383, "TestUDPServer_Shutdown", app, 5)
+	startAndSend := func() net.Conn {
+		go func() {
+			if err := srv.StartAndBlock(); err != nil {
+				panic(err)
+			}
+		}()
+		time.Sleep(1 * time.Second)
+		client, err := net.Dial("udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return client
+	}
+
+	// Shutdown waits for the ongoing conversation to reply to its client
+	client := startAndSend()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil || srv.IsRunning() {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if err := client.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal(n, err)
+	}
+
+	// Stop lets the ongoing conversation reply to its client before closing the listener, as it does during a reload
+	client = startAndSend()
+	srv.Stop()
+	if srv.IsRunning() {
+		t.Fatal("must not be running anymore")
+	}
+	if err := client.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal(n, err)
+	}
+
+	// Shutdown gives up waiting after the deadline
+	app.delay = 3 * time.Second
+	startAndSend()
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "1 conversations") || srv.IsRunning() {
+		t.Fatal(err)
+	}
+}
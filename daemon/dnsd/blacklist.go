@@ -1,8 +1,11 @@
 package dnsd
 
 import (
+	"io/ioutil"
+	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -71,29 +74,69 @@ var Whitelist = []string{
 	"xbox.ipv6.microsoft.com", "xboxexperiencesprod.experimentation.xboxlive.com", "xflight.xboxlive.com", "xkms.xboxlive.com", "xsts.auth.xboxlive.com",
 }
 
+// BlacklistSourceReport describes the latest refresh of a blacklist source.
+type BlacklistSourceReport struct {
+	Source      string    // Source is the URL or file path of the blacklist.
+	NumNames    int       // NumNames is the number of names the source contributed in its latest refresh.
+	LastRefresh time.Time // LastRefresh is the time of the latest successful refresh, it is zero if the source has never been refreshed.
+	LastError   string    // LastError describes why the latest refresh failed, it is empty if the refresh succeeded.
+}
+
 /*
 DownloadAllBlacklists attempts to download all hosts files and return combined list of domain names to block.
 The special cases of white listed names are removed from return value.
 */
 func DownloadAllBlacklists(logger lalog.Logger) []string {
-	wg := new(sync.WaitGroup)
-	wg.Add(len(HostsFileURLs))
+	names, _ := LoadBlacklists(logger, HostsFileURLs, nil, nil)
+	return names
+}
+
+/*
+LoadBlacklists downloads the blacklists from the URLs and reads the blacklists from local files, then returns the
+combined list of names to block along with a report of each source, in the order of URLs followed by file paths.
+The names from the built-in Whitelist, the additional whitelist, and AdBlock exception rules are removed from the
+return value.
+*/
+func LoadBlacklists(logger lalog.Logger, urls, filePaths, whitelist []string) ([]string, []BlacklistSourceReport) {
+	sources := make([]string, 0, len(urls)+len(filePaths))
+	sources = append(sources, urls...)
+	sources = append(sources, filePaths...)
+	reports := make([]BlacklistSourceReport, len(sources))
+	lists := make([][]string, len(sources))
+	exceptionLists := make([][]string, len(sources))
 
-	// Download all lists in parallel
-	lists := make([][]string, len(HostsFileURLs))
-	for i, url := range HostsFileURLs {
-		go func(i int, url string) {
-			resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec}, url)
-			if err == nil {
-				names := ExtractNamesFromHostsContent(string(resp.Body))
-				logger.Info("DownloadAllBlacklists", url, err, "downloaded %d names, please obey the license in which the list author publishes the data.", len(names))
-				lists[i] = names
+	// Download and read all lists in parallel
+	wg := new(sync.WaitGroup)
+	wg.Add(len(sources))
+	for i, source := range sources {
+		go func(i int, source string, isURL bool) {
+			defer wg.Done()
+			reports[i].Source = source
+			var content []byte
+			var err error
+			if isURL {
+				var resp inet.HTTPResponse
+				if resp, err = inet.DoHTTP(inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec}, source); err == nil {
+					err = resp.Non2xxToError()
+					content = resp.Body
+				}
 			} else {
-				logger.Warning("DownloadAllBlacklists", url, err, "failed to download blacklist")
-				lists[i] = []string{}
+				content, err = ioutil.ReadFile(source)
 			}
-			defer wg.Done()
-		}(i, url)
+			if err != nil {
+				logger.Warning("LoadBlacklists", source, err, "failed to load blacklist")
+				reports[i].LastError = err.Error()
+				return
+			}
+			lists[i], exceptionLists[i] = ExtractNamesFromBlacklistContent(string(content))
+			reports[i].NumNames = len(lists[i])
+			reports[i].LastRefresh = time.Now()
+			if isURL {
+				logger.Info("LoadBlacklists", source, nil, "downloaded %d names, please obey the license in which the list author publishes the data.", len(lists[i]))
+			} else {
+				logger.Info("LoadBlacklists", source, nil, "read %d names", len(lists[i]))
+			}
+		}(i, source, i < len(urls))
 	}
 	wg.Wait()
 	// Calculate unique set of domain names
@@ -107,13 +150,21 @@ func DownloadAllBlacklists(logger lalog.Logger) []string {
 	for _, toRemove := range Whitelist {
 		delete(set, toRemove)
 	}
+	for _, toRemove := range whitelist {
+		delete(set, strings.TrimSuffix(strings.ToLower(strings.TrimSpace(toRemove)), "."))
+	}
+	for _, list := range exceptionLists {
+		for _, toRemove := range list {
+			delete(set, toRemove)
+		}
+	}
 
 	ret := make([]string, 0, len(set))
 	for str := range set {
 		ret = append(ret, str)
 	}
-	logger.Info("DownloadAllBlacklists", "", nil, "downloaded %d unique names in total", len(ret))
-	return ret
+	logger.Info("LoadBlacklists", "", nil, "loaded %d unique names in total", len(ret))
+	return ret, reports
 }
 
 /*
@@ -121,7 +172,23 @@ ExtractNamesFromHostsContent extracts domain names from hosts file content. It w
 illegal domain names.
 */
 func ExtractNamesFromHostsContent(content string) []string {
-	ret := make([]string, 0, 16384)
+	names, _ := ExtractNamesFromBlacklistContent(content)
+	return names
+}
+
+/*
+ExtractNamesFromBlacklistContent extracts the names to block from blacklist content, as well as the names exempted by
+AdBlock exception rules. Each line of the content may be written in any of these formats:
+- Hosts file entry, e.g. "0.0.0.0 ads.example.com".
+- Plain domain name, e.g. "ads.example.com".
+- AdBlock rule, e.g. "||ads.example.com^", or exception rule "@@||ads.example.com^". Rules with modifiers are skipped.
+- Wildcard rule, e.g. "*.example.com" or ".example.com", which blocks the sub-domains but not the domain itself.
+Blocking a domain name also blocks all of its sub-domains. Comments, blank lines, and potentially illegal names are
+skipped.
+*/
+func ExtractNamesFromBlacklistContent(content string) (names, exceptions []string) {
+	names = make([]string, 0, 16384)
+	exceptions = make([]string, 0)
 	for _, line := range strings.Split(content, "\n") {
 		if strings.ContainsRune(line, 0) {
 			/*
@@ -131,35 +198,80 @@ func ExtractNamesFromHostsContent(content string) []string {
 			continue
 		}
 		line = strings.TrimSpace(line)
-		if len(line) == 0 || line[0] == '#' {
-			// Skip blank and comments
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			// Skip blank lines, comments, and AdBlock headers
 			continue
 		}
-		// Find the second field
-		space := strings.IndexRune(line, ' ')
-		if space == -1 {
-			// Skip malformed line
-			continue
-		}
-		line = strings.TrimSpace(line[space:])
-		nameEnd := strings.IndexRune(line, '#')
+		fields := strings.Fields(line)
 		// Name may be followed by a comment
-		if nameEnd == -1 {
-			nameEnd = len(line)
+		for i, field := range fields {
+			if field[0] == '#' {
+				fields = fields[:i]
+				break
+			}
 		}
-		// Extract the name itself. Matching of black list name always takes place in lower case.
-		aName := strings.ToLower(strings.TrimSpace(line[:nameEnd]))
-		if aName == "" || strings.HasSuffix(aName, "localhost") || strings.HasSuffix(aName, "localdomain") ||
-			len(aName) < 4 || len(aName) > 253 {
-			// Skip empty names, local names, and overly short names
-			// Also, domain name length may not exceed 253 characters according to various technical documents in the public domain.
-			continue
+		var candidates []string
+		isException := false
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			// Hosts file entry
+			candidates = fields[1:]
+		} else if len(fields) == 1 {
+			rule := fields[0]
+			if strings.HasPrefix(rule, "@@") {
+				isException = true
+				rule = rule[2:]
+			}
+			if strings.HasPrefix(rule, "||") {
+				if !strings.HasSuffix(rule, "^") {
+					// Skip rules with modifiers and URL patterns
+					continue
+				}
+				rule = rule[2 : len(rule)-1]
+			} else if strings.HasPrefix(rule, ".") {
+				rule = "*" + rule
+			}
+			candidates = []string{rule}
+		}
+		for _, candidate := range candidates {
+			// Matching of black list name always takes place in lower case.
+			aName := strings.TrimSuffix(strings.ToLower(candidate), ".")
+			if !isValidBlacklistName(aName) {
+				continue
+			}
+			if isException {
+				exceptions = append(exceptions, aName)
+			} else {
+				names = append(names, aName)
+			}
 		}
-		ret = append(ret, aName)
-		if len(ret) > MaxNameEntriesToExtract {
+		if len(names) > MaxNameEntriesToExtract {
 			// Avoid taking in too many names
 			break
 		}
 	}
-	return ret
+	return
+}
+
+/*
+isValidBlacklistName returns true only if the name looks like a legal domain name or a wildcard rule, and it is
+neither an IP address nor a local name.
+*/
+func isValidBlacklistName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	// Domain name length may not exceed 253 characters according to various technical documents in the public domain.
+	if len(name) < 4 || len(name) > 253 || net.ParseIP(name) != nil ||
+		strings.HasSuffix(name, "localhost") || strings.HasSuffix(name, "localdomain") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -2,7 +2,13 @@ package dnsd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -42,3 +48,70 @@ func TestExtractNamesFromHostsContent(t *testing.T) {
 		t.Fatal(names)
 	}
 }
+
+func TestExtractNamesFromBlacklistContent(t *testing.T) {
+	names, exceptions := ExtractNamesFromBlacklistContent(`[Adblock Plus 2.0]
+! AdBlock comment
+||ads.example.com^
+||Tracker.Example.com^$third-party
+@@||cdn.example.com^
+example.com##.banner
+/banner/*/img^
+# plain list
+plain.example.org
+plain.example.net. # comment
+*.wild.example.com
+.suffix.example.com
+0.0.0.0 a.example.com b.example.com
+0.0.0.0 0.0.0.0
+localhost.localdomain
+bad..example.com
+bad name.example.com
+`)
+	if !reflect.DeepEqual(names, []string{"ads.example.com", "plain.example.org", "plain.example.net", "*.wild.example.com", "*.suffix.example.com", "a.example.com", "b.example.com"}) {
+		t.Fatal(names)
+	}
+	if !reflect.DeepEqual(exceptions, []string{"cdn.example.com"}) {
+		t.Fatal(exceptions)
+	}
+}
+
+func TestLoadBlacklists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("||ads.example.com^\n||cdn.example.com^\n||s.youtube.com^\n"))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "laitos-dnsd-blacklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listFile := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(listFile, []byte("0.0.0.0 tracker.example.com\n@@||cdn.example.com^\nallowed.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{server.URL + "/list", server.URL + "/does-not-exist"}
+	files := []string{listFile, filepath.Join(dir, "does-not-exist")}
+	names, reports := LoadBlacklists(lalog.Logger{}, urls, files, []string{"Allowed.Example.com."})
+	sort.Strings(names)
+	// Built-in whitelist, additional whitelist, and exception rules all take effect
+	if !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	if len(reports) != 4 {
+		t.Fatal(reports)
+	}
+	for i, expectedNames := range []int{3, 0, 2, 0} {
+		report := reports[i]
+		if report.Source != append(urls, files...)[i] || report.NumNames != expectedNames {
+			t.Fatalf("%+v", report)
+		}
+		if succeeded := expectedNames > 0; succeeded != (report.LastError == "") || succeeded == report.LastRefresh.IsZero() {
+			t.Fatalf("%+v", report)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package dnsd
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	DefaultResponseCacheSize       = 4096      // DefaultResponseCacheSize is the default maximum number of responses to keep in cache
+	ResponseCacheMaxTTLSec         = 24 * 3600 // ResponseCacheMaxTTLSec is the longest duration a positive response may stay in cache
+	ResponseCacheMaxNegativeTTLSec = 3 * 3600  // ResponseCacheMaxNegativeTTLSec is the longest duration a negative response may stay in cache, as recommended by RFC 2308.
+)
+
+// responseCacheKey identifies a cached response by the question it answers.
+type responseCacheKey struct {
+	name     string
+	qType    uint16
+	qClass   uint16
+	dnssecOK bool // dnssecOK separates the responses that carry DNSSEC records from those that do not
+}
+
+// responseCacheEntry is a response memorised by the cache along with the information necessary for adjusting its TTLs.
+type responseCacheEntry struct {
+	key        responseCacheKey
+	response   []byte
+	ttlOffsets []int
+	storedAt   time.Time
+	expiresAt  time.Time
+}
+
+/*
+ResponseCache memorises the responses from recursive resolvers, so that repeated queries made against the same name are
+answered without a round trip to the resolvers. A cached response is kept for no longer than the lowest TTL among its
+resource records, and negative responses (NXDOMAIN and no-data) are kept according to RFC 2308. When the cache is full,
+the least recently used response is evicted.
+A nil cache is valid to use, it never caches anything.
+*/
+type ResponseCache struct {
+	maxEntries int
+	entries    map[responseCacheKey]*list.Element
+	recentUse  *list.List
+	mutex      *sync.Mutex
+}
+
+// NewResponseCache constructs a new response cache that holds up to the specified number of responses.
+func NewResponseCache(maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		maxEntries: maxEntries,
+		entries:    make(map[responseCacheKey]*list.Element),
+		recentUse:  list.New(),
+		mutex:      new(sync.Mutex),
+	}
+}
+
+// getQuestionKey returns the cache key of the question carried by the DNS message.
+func getQuestionKey(msg dnsMessage) (key responseCacheKey, ok bool) {
+	if len(msg.Question) != 1 {
+		return
+	}
+	q := msg.Question[0]
+	return responseCacheKey{name: q.Name, qType: q.Type, qClass: q.Class, dnssecOK: msg.IsDNSSECOK()}, true
+}
+
+/*
+Get returns a cached response (without the length prefix) to the query, with its TTLs lowered by the time spent in
+cache and its question section matching letter case of the query. If the query is not answered from cache, or the
+cached response is larger than the maximum size, the function returns nil.
+*/
+func (cache *ResponseCache) Get(query []byte, maxSize int) []byte {
+	if cache == nil {
+		return nil
+	}
+	msg, err := parseMessage(query)
+	if err != nil || msg.IsResponse() {
+		return nil
+	}
+	key, ok := getQuestionKey(msg)
+	if !ok {
+		return nil
+	}
+	cache.mutex.Lock()
+	var entry *responseCacheEntry
+	if elem, found := cache.entries[key]; found {
+		entry = elem.Value.(*responseCacheEntry)
+		if time.Now().Before(entry.expiresAt) && len(entry.response) <= maxSize {
+			cache.recentUse.MoveToFront(elem)
+		} else {
+			if !time.Now().Before(entry.expiresAt) {
+				cache.recentUse.Remove(elem)
+				delete(cache.entries, key)
+			}
+			entry = nil
+		}
+	}
+	cache.mutex.Unlock()
+	if entry == nil {
+		atomic.AddInt64(&misc.DNSDResponseCacheMisses, 1)
+		return nil
+	}
+	atomic.AddInt64(&misc.DNSDResponseCacheHits, 1)
+	// Cached response is never modified, construct a copy with adjusted TTL.
+	resp := make([]byte, len(entry.response))
+	copy(resp, entry.response)
+	elapsed := uint32(time.Since(entry.storedAt) / time.Second)
+	for _, offset := range entry.ttlOffsets {
+		ttl := binary.BigEndian.Uint32(resp[offset:])
+		if ttl > elapsed {
+			ttl -= elapsed
+		} else {
+			ttl = 0
+		}
+		binary.BigEndian.PutUint32(resp[offset:], ttl)
+	}
+	// Some clients randomise letter case of the queried name, hence the question section should be that of the query.
+	if _, queryQuestionEnd, err := readName(query, dnsHeaderSize); err == nil {
+		if _, respQuestionEnd, err := readName(resp, dnsHeaderSize); err == nil && queryQuestionEnd == respQuestionEnd {
+			copy(resp[dnsHeaderSize:queryQuestionEnd], query[dnsHeaderSize:queryQuestionEnd])
+		}
+	}
+	return resp
+}
+
+/*
+getCacheTTL determines how long a response may stay in cache. A positive response may stay for the lowest TTL among its
+records, a negative response may stay for the lower of SOA record's TTL and its MINIMUM field. The TTL is 0 if the
+response must not be cached.
+*/
+func getCacheTTL(response []byte, msg dnsMessage) uint32 {
+	if !msg.IsResponse() || msg.IsTruncated() {
+		return 0
+	}
+	switch rcode := msg.RCode(); {
+	case rcode == rcodeNXDomain || rcode == rcodeNoError && len(msg.Answer) == 0:
+		// RFC 2308 - negative response without SOA record should not be cached
+		for _, rr := range msg.Authority {
+			if rr.Type == typeSOA && rr.RDataLen >= 22 {
+				ttl := rr.TTL
+				if minimum := binary.BigEndian.Uint32(response[rr.RDataOff+rr.RDataLen-4:]); minimum < ttl {
+					ttl = minimum
+				}
+				if ttl > ResponseCacheMaxNegativeTTLSec {
+					ttl = ResponseCacheMaxNegativeTTLSec
+				}
+				return ttl
+			}
+		}
+		return 0
+	case rcode == rcodeNoError:
+		var ttl uint32 = ResponseCacheMaxTTLSec
+		for _, section := range [][]dnsResourceRecord{msg.Answer, msg.Authority, msg.Additional} {
+			for _, rr := range section {
+				if rr.Type != typeOPT && rr.TTL < ttl {
+					ttl = rr.TTL
+				}
+			}
+		}
+		return ttl
+	default:
+		// Server failures and refusals are often temporary
+		return 0
+	}
+}
+
+// Put memorises the response (without the length prefix) to a query if the response is eligible for caching.
+func (cache *ResponseCache) Put(query, response []byte) {
+	if cache == nil || cache.maxEntries < 1 {
+		return
+	}
+	queryMsg, err := parseMessage(query)
+	if err != nil {
+		return
+	}
+	queryKey, ok := getQuestionKey(queryMsg)
+	if !ok {
+		return
+	}
+	respMsg, err := parseMessage(response)
+	if err != nil {
+		return
+	}
+	// Guard against a response that answers a different question, a forwarder does not always echo the DO bit.
+	respKey, ok := getQuestionKey(respMsg)
+	if respKey.dnssecOK = queryKey.dnssecOK; !ok || respKey != queryKey {
+		return
+	}
+	ttl := getCacheTTL(response, respMsg)
+	if ttl == 0 {
+		return
+	}
+	entry := &responseCacheEntry{
+		key:        queryKey,
+		response:   make([]byte, len(response)),
+		ttlOffsets: make([]int, 0, len(respMsg.Answer)+len(respMsg.Authority)+len(respMsg.Additional)),
+		storedAt:   time.Now(),
+		expiresAt:  time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	copy(entry.response, response)
+	for _, section := range [][]dnsResourceRecord{respMsg.Answer, respMsg.Authority, respMsg.Additional} {
+		for _, rr := range section {
+			// The TTL field of OPT pseudo record carries extended flags
+			if rr.Type != typeOPT {
+				entry.ttlOffsets = append(entry.ttlOffsets, rr.TTLOffset)
+			}
+		}
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if elem, found := cache.entries[queryKey]; found {
+		elem.Value = entry
+		cache.recentUse.MoveToFront(elem)
+		return
+	}
+	for cache.recentUse.Len() >= cache.maxEntries {
+		oldest := cache.recentUse.Back()
+		cache.recentUse.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+	cache.entries[queryKey] = cache.recentUse.PushFront(entry)
+}
+
+// Len returns the number of responses currently in cache, including those that have expired but not yet evicted.
+func (cache *ResponseCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.recentUse.Len()
+}
@@ -0,0 +1,261 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// makeTestQuery returns a query packet (without length prefix) that asks for the name and type in class IN.
+func makeTestQuery(id uint16, name string, qType uint16) []byte {
+	packet := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		packet = append(packet, byte(len(label)))
+		packet = append(packet, label...)
+	}
+	return append(packet, 0, byte(qType>>8), byte(qType), 0, 1)
+}
+
+/*
+makeTestResponse returns a response packet to the query. If answerTTL is greater than 0, the response carries an A
+record with that TTL. If soaTTL is greater than 0, the response carries an SOA record with the TTL and MINIMUM field.
+*/
+func makeTestResponse(query []byte, rcode byte, answerTTL, soaTTL, soaMinimum uint32) []byte {
+	resp := make([]byte, len(query))
+	copy(resp, query)
+	resp[2] = 0x81
+	resp[3] = 0x80 | rcode
+	if answerTTL > 0 {
+		resp[7] = 1
+		resp = append(resp, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 1, 2, 3, 4)
+		binary.BigEndian.PutUint32(resp[len(resp)-10:], answerTTL)
+	}
+	if soaTTL > 0 {
+		resp[9] = 1
+		resp = append(resp, 0xc0, 0x0c, 0, typeSOA, 0, 1, 0, 0, 0, 0, 0, 22, 0, 0)
+		binary.BigEndian.PutUint32(resp[len(resp)-8:], soaTTL)
+		// Serial, refresh, retry, expire, and minimum
+		for _, field := range []uint32{1, 7200, 3600, 1209600, soaMinimum} {
+			resp = append(resp, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(resp[len(resp)-4:], field)
+		}
+	}
+	return resp
+}
+
+func TestParseMessage(t *testing.T) {
+	msg, err := parseMessage(githubComUDPQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.IsResponse() || len(msg.Question) != 1 || msg.Question[0] != (dnsQuestion{Name: "github.com", Type: 1, Class: 1}) {
+		t.Fatalf("%+v", msg)
+	}
+	if len(msg.Additional) != 1 || msg.Additional[0].Type != typeOPT || getUDPPayloadSize(githubComUDPQuery) != 4096 {
+		t.Fatalf("%+v", msg)
+	}
+	if size := getUDPPayloadSize(makeTestQuery(1, "example.com", 1)); size != minUDPPayload {
+		t.Fatal(size)
+	}
+	// Malformed messages
+	for _, packet := range [][]byte{nil, {0, 1}, githubComUDPQuery[:20], {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 0x0c}} {
+		if _, err := parseMessage(packet); err == nil {
+			t.Fatal("did not error", packet)
+		}
+	}
+	// Compressed names in response
+	resp := makeTestResponse(makeTestQuery(1, "Example.COM", 1), rcodeNoError, 300, 0, 0)
+	msg, err = parseMessage(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsResponse() || msg.RCode() != rcodeNoError || len(msg.Answer) != 1 || msg.Answer[0].TTL != 300 || msg.Answer[0].RDataLen != 4 {
+		t.Fatalf("%+v", msg)
+	}
+	if name, _, err := readName(resp, msg.Answer[0].TTLOffset-6); err != nil || name != "example.com" {
+		t.Fatal(name, err)
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(2)
+	query := makeTestQuery(1, "example.com", 1)
+	// Nothing is cached at first
+	if resp := cache.Get(query, MaxPacketSize); resp != nil {
+		t.Fatal(resp)
+	}
+	// Cache a positive response and retrieve it using a query in different letter case
+	cache.Put(query, makeTestResponse(query, rcodeNoError, 300, 0, 0))
+	mixedCaseQuery := makeTestQuery(2, "eXaMpLe.com", 1)
+	resp := cache.Get(mixedCaseQuery, MaxPacketSize)
+	if resp == nil || !strings.Contains(string(resp), "eXaMpLe") {
+		t.Fatal(resp)
+	}
+	// The response does not fit into a small buffer
+	if resp := cache.Get(query, 20); resp != nil {
+		t.Fatal(resp)
+	}
+	// TTL decreases over time
+	cache.entries[responseCacheKey{name: "example.com", qType: 1, qClass: 1}].Value.(*responseCacheEntry).storedAt = time.Now().Add(-100 * time.Second)
+	resp = cache.Get(query, MaxPacketSize)
+	msg, err := parseMessage(resp)
+	if err != nil || msg.Answer[0].TTL != 200 {
+		t.Fatal(err, msg.Answer)
+	}
+	// Expired response is evicted
+	cache.entries[responseCacheKey{name: "example.com", qType: 1, qClass: 1}].Value.(*responseCacheEntry).expiresAt = time.Now()
+	if resp := cache.Get(query, MaxPacketSize); resp != nil || cache.Len() != 0 {
+		t.Fatal(resp, cache.Len())
+	}
+
+	// Negative response is cached for the lower of SOA TTL and MINIMUM field
+	nxQuery := makeTestQuery(3, "does-not-exist.example.com", 1)
+	cache.Put(nxQuery, makeTestResponse(nxQuery, rcodeNXDomain, 0, 900, 60))
+	if resp := cache.Get(nxQuery, MaxPacketSize); resp == nil {
+		t.Fatal("did not cache negative response")
+	}
+	if ttl := cache.entries[responseCacheKey{name: "does-not-exist.example.com", qType: 1, qClass: 1}].Value.(*responseCacheEntry).expiresAt.Sub(time.Now()); ttl > 60*time.Second || ttl < 55*time.Second {
+		t.Fatal(ttl)
+	}
+	// No-data response is also negative
+	aaaaQuery := makeTestQuery(4, "example.com", 28)
+	cache.Put(aaaaQuery, makeTestResponse(aaaaQuery, rcodeNoError, 0, 30, 600))
+	if resp := cache.Get(aaaaQuery, MaxPacketSize); resp == nil {
+		t.Fatal("did not cache no-data response")
+	}
+
+	// The least recently used response is evicted when cache is full
+	cache.Get(nxQuery, MaxPacketSize)
+	cache.Put(query, makeTestResponse(query, rcodeNoError, 300, 0, 0))
+	if cache.Len() != 2 || cache.Get(aaaaQuery, MaxPacketSize) != nil || cache.Get(nxQuery, MaxPacketSize) == nil || cache.Get(query, MaxPacketSize) == nil {
+		t.Fatal(cache.Len())
+	}
+
+	// Ineligible responses are not cached
+	cache = NewResponseCache(10)
+	failQuery := makeTestQuery(5, "fail.example.com", 1)
+	cache.Put(failQuery, makeTestResponse(failQuery, 2, 300, 0, 0))
+	cache.Put(failQuery, makeTestResponse(failQuery, rcodeNXDomain, 0, 0, 0))
+	cache.Put(failQuery, makeTestResponse(failQuery, rcodeNoError, 0, 0, 0))
+	cache.Put(failQuery, makeTestResponse(makeTestQuery(5, "other.example.com", 1), rcodeNoError, 300, 0, 0))
+	truncated := makeTestResponse(failQuery, rcodeNoError, 300, 0, 0)
+	truncated[2] |= 0x02
+	cache.Put(failQuery, truncated)
+	cache.Put(failQuery, []byte{1, 2, 3})
+	if cache.Len() != 0 {
+		t.Fatal(cache.Len())
+	}
+
+	// Nil cache does nothing
+	var nilCache *ResponseCache
+	nilCache.Put(query, makeTestResponse(query, rcodeNoError, 300, 0, 0))
+	if resp := nilCache.Get(query, MaxPacketSize); resp != nil || nilCache.Len() != 0 {
+		t.Fatal(resp)
+	}
+}
+
+// startStubForwarder starts a UDP and TCP DNS resolver on the same port that answers all queries with an A record.
+func startStubForwarder(t *testing.T, numQueries *int32) (addr string, stop func()) {
+	udpServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udpServer.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, client, err := udpServer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(numQueries, 1)
+			_, _ = udpServer.WriteToUDP(makeTestResponse(buf[:n], rcodeNoError, 300, 0, 0), client)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcpServer.Accept()
+			if err != nil {
+				return
+			}
+			queryLen := make([]byte, 2)
+			if _, err := io.ReadFull(conn, queryLen); err == nil {
+				query := make([]byte, int(queryLen[0])*256+int(queryLen[1]))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					atomic.AddInt32(numQueries, 1)
+					resp := makeTestResponse(query, rcodeNoError, 300, 0, 0)
+					_, _ = conn.Write(append([]byte{byte(len(resp) / 256), byte(len(resp) % 256)}, resp...))
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	return udpServer.LocalAddr().String(), func() {
+		_ = udpServer.Close()
+		_ = tcpServer.Close()
+	}
+}
+
+func TestResponseCache_StubForwarder(t *testing.T) {
+	var numQueries int32
+	forwarderAddr, stopForwarder := startStubForwarder(t, &numQueries)
+	defer stopForwarder()
+	daemon := Daemon{Address: "127.0.0.1", UDPPort: 1, Forwarders: []string{forwarderAddr}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	hitsBefore, missesBefore := atomic.LoadInt64(&misc.DNSDResponseCacheHits), atomic.LoadInt64(&misc.DNSDResponseCacheMisses)
+	// The first query goes to the forwarder, and subsequent queries over UDP and TCP are answered from cache.
+	query := makeTestQuery(1234, "example.com", 1)
+	respLen, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", query)
+	if respLen < len(query) || atomic.LoadInt32(&numQueries) != 1 {
+		t.Fatal(respLen, numQueries)
+	}
+	for i := 0; i < 3; i++ {
+		if respLen, cachedResp := daemon.handleUDPRecursiveQuery("127.0.0.1", query); respLen != len(cachedResp) || string(cachedResp[2:]) != string(resp[2:respLen]) {
+			t.Fatal(cachedResp, resp[:respLen])
+		}
+		queryLen := []byte{byte(len(query) / 256), byte(len(query) % 256)}
+		if tcpRespLen, cachedResp := daemon.handleTCPRecursiveQuery("127.0.0.1", queryLen, query); int(tcpRespLen[1]) != len(cachedResp) || string(cachedResp[2:]) != string(resp[2:respLen]) {
+			t.Fatal(cachedResp, resp[:respLen])
+		}
+	}
+	if atomic.LoadInt32(&numQueries) != 1 {
+		t.Fatal(numQueries)
+	}
+	if hits, misses := atomic.LoadInt64(&misc.DNSDResponseCacheHits)-hitsBefore, atomic.LoadInt64(&misc.DNSDResponseCacheMisses)-missesBefore; hits != 6 || misses != 1 {
+		t.Fatal(hits, misses)
+	}
+	// Query a different name over TCP, it goes to the forwarder.
+	query = makeTestQuery(1235, "example.org", 1)
+	queryLen := []byte{byte(len(query) / 256), byte(len(query) % 256)}
+	if _, resp := daemon.handleTCPRecursiveQuery("127.0.0.1", queryLen, query); len(resp) < len(query) || atomic.LoadInt32(&numQueries) != 2 {
+		t.Fatal(resp, numQueries)
+	}
+	if respLen, _ := daemon.handleUDPRecursiveQuery("127.0.0.1", query); respLen < len(query) || atomic.LoadInt32(&numQueries) != 2 {
+		t.Fatal(respLen, numQueries)
+	}
+
+	// Disable the cache, all queries go to the forwarder.
+	daemon.ResponseCacheSize = -1
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if respLen, _ := daemon.handleUDPRecursiveQuery("127.0.0.1", query); respLen < len(query) {
+			t.Fatal(respLen)
+		}
+	}
+	if atomic.LoadInt32(&numQueries) != 4 {
+		t.Fatal(numQueries)
+	}
+}
@@ -0,0 +1,205 @@
+package dnsd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DefaultCommandOutputRetentionSec = 600  // DefaultCommandOutputRetentionSec is the number of seconds to keep paged command output when CommandOutputRetentionSec is left unspecified.
+	MaxTextResponseLen               = 254  // MaxTextResponseLen is the maximum length of text carried by a TXT response.
+	CommandOutputChunkLen            = 220  // CommandOutputChunkLen is the maximum length of each chunk of paged command output.
+	CommandOutputIDLen               = 8    // CommandOutputIDLen is the length of the random ID that identifies a paged command output.
+	MaxCommandOutputPages            = 64   // MaxCommandOutputPages is the maximum number of paged command outputs to keep at a time.
+	MaxPagedCommandOutputLen         = 4096 // MaxPagedCommandOutputLen is the maximum length of command output to be retrieved in chunks.
+
+	// commandOutputIDChars are the characters of paged command output ID, they are all valid in a DNS label regardless of case.
+	commandOutputIDChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// pagedOutput is a command output that has been split into chunks for retrieval over several TXT queries.
+type pagedOutput struct {
+	id       string
+	clientIP string // clientIP is the client that ran the command, only the client may retrieve the chunks.
+	chunks   []string
+	expiry   time.Time
+}
+
+/*
+CommandOutputPages keeps the command outputs that are too long for a single TXT response, so that a DNS client may
+retrieve them chunk by chunk with follow-up queries. Each output belongs to the client that ran the command, other
+clients cannot retrieve it even if they guess the output ID. Methods of a nil CommandOutputPages do not page the output.
+*/
+type CommandOutputPages struct {
+	mutex     *sync.Mutex
+	retention time.Duration
+	outputs   map[string]*pagedOutput // outputs are keyed by their ID
+	idByText  map[string]string       // idByText gives the same ID to an output that is paged repeatedly for the same client
+}
+
+// NewCommandOutputPages constructs a new instance of CommandOutputPages that keeps each output for the retention period.
+func NewCommandOutputPages(retentionSec int) *CommandOutputPages {
+	return &CommandOutputPages{
+		mutex:     new(sync.Mutex),
+		retention: time.Duration(retentionSec) * time.Second,
+		outputs:   make(map[string]*pagedOutput),
+		idByText:  make(map[string]string),
+	}
+}
+
+// splitOutput splits the output into chunks of no more than the length, without breaking up a UTF-8 character.
+func splitOutput(output string, chunkLen int) []string {
+	chunks := make([]string, 0, len(output)/chunkLen+1)
+	for len(output) > chunkLen {
+		end := chunkLen
+		for end > 0 && !utf8.RuneStart(output[end]) {
+			end--
+		}
+		if end == 0 {
+			end = chunkLen
+		}
+		chunks = append(chunks, output[:end])
+		output = output[end:]
+	}
+	return append(chunks, output)
+}
+
+// formatChunk returns the text of a TXT response that carries the chunk, prefixed by the output ID and chunk number.
+func formatChunk(id string, n, numChunks int, chunk string) string {
+	return fmt.Sprintf("%s %d/%d %s", id, n, numChunks, chunk)
+}
+
+// textKey returns the key of idByText for the output of the client.
+func textKey(clientIP, output string) string {
+	return clientIP + "\x00" + output
+}
+
+// purgeExpired removes the outputs that have outlived the retention period. Caller must lock the mutex.
+func (pages *CommandOutputPages) purgeExpired() {
+	now := time.Now()
+	for id, output := range pages.outputs {
+		if now.After(output.expiry) {
+			pages.remove(id)
+		}
+	}
+}
+
+// remove removes an output by its ID. Caller must lock the mutex.
+func (pages *CommandOutputPages) remove(id string) {
+	if output, exists := pages.outputs[id]; exists {
+		delete(pages.idByText, textKey(output.clientIP, strings.Join(output.chunks, "")))
+		delete(pages.outputs, id)
+	}
+}
+
+/*
+Paginate returns the text of TXT response to a command output. If the output fits in a single TXT response, it is
+returned as-is. Otherwise, the output (up to MaxPagedCommandOutputLen) is kept for later retrieval by the client, and the
+function returns the first chunk prefixed by the output ID and number of chunks, e.g. "k3x9q2mf 0/5 first chunk".
+*/
+func (pages *CommandOutputPages) Paginate(clientIP, output string) string {
+	if pages == nil || len(output) <= MaxTextResponseLen {
+		return output
+	}
+	if len(output) > MaxPagedCommandOutputLen {
+		output = splitOutput(output, MaxPagedCommandOutputLen)[0]
+	}
+	pages.mutex.Lock()
+	defer pages.mutex.Unlock()
+	pages.purgeExpired()
+	// Repeated execution of the same command within TTL yields the same output, give it the same ID.
+	if id, exists := pages.idByText[textKey(clientIP, output)]; exists {
+		stored := pages.outputs[id]
+		stored.expiry = time.Now().Add(pages.retention)
+		return formatChunk(id, 0, len(stored.chunks), stored.chunks[0])
+	}
+	if len(pages.outputs) >= MaxCommandOutputPages {
+		// Make room by evicting the output that expires the soonest
+		var soonest *pagedOutput
+		for _, stored := range pages.outputs {
+			if soonest == nil || stored.expiry.Before(soonest.expiry) {
+				soonest = stored
+			}
+		}
+		pages.remove(soonest.id)
+	}
+	stored := &pagedOutput{
+		id:       pages.newID(),
+		clientIP: clientIP,
+		chunks:   splitOutput(output, CommandOutputChunkLen),
+		expiry:   time.Now().Add(pages.retention),
+	}
+	pages.outputs[stored.id] = stored
+	pages.idByText[textKey(clientIP, output)] = stored.id
+	return formatChunk(stored.id, 0, len(stored.chunks), stored.chunks[0])
+}
+
+// newID returns a random output ID that is not yet in use. Caller must lock the mutex.
+func (pages *CommandOutputPages) newID() string {
+	randBytes := make([]byte, CommandOutputIDLen)
+	for {
+		if _, err := rand.Read(randBytes); err != nil {
+			panic(err)
+		}
+		id := make([]byte, CommandOutputIDLen)
+		for i, b := range randBytes {
+			id[i] = commandOutputIDChars[int(b)%len(commandOutputIDChars)]
+		}
+		if _, exists := pages.outputs[string(id)]; !exists {
+			return string(id)
+		}
+	}
+}
+
+/*
+GetChunk returns the text of TXT response that carries a chunk of paged command output to the client that ran the
+command. If the output has expired, belongs to another client, or the chunk does not exist, the function returns an
+explanation.
+*/
+func (pages *CommandOutputPages) GetChunk(clientIP, id string, n int) string {
+	if pages == nil {
+		return "command output paging is disabled"
+	}
+	pages.mutex.Lock()
+	defer pages.mutex.Unlock()
+	pages.purgeExpired()
+	stored, exists := pages.outputs[strings.ToLower(id)]
+	// Do not tell another client that the output exists
+	if !exists || stored.clientIP != clientIP {
+		return "command output has expired"
+	}
+	if n < 0 || n >= len(stored.chunks) {
+		return fmt.Sprintf("%s has chunks 0 to %d", stored.id, len(stored.chunks)-1)
+	}
+	return formatChunk(stored.id, n, len(stored.chunks), stored.chunks[n])
+}
+
+/*
+ParseCommandOutputChunkQuery extracts the output ID and chunk number from a queried name that asks for a chunk of paged
+command output, in the format of "_.<id>.<n>.example.com".
+*/
+func ParseCommandOutputChunkQuery(queriedName string) (id string, n int, ok bool) {
+	if !strings.HasPrefix(queriedName, string(ToolboxCommandPrefix)+".") {
+		return
+	}
+	labels := strings.Split(strings.TrimSuffix(queriedName, "."), ".")
+	// The labels are the prefix, ID, chunk number, and at least two labels of domain name
+	if len(labels) < 5 || len(labels[1]) != CommandOutputIDLen {
+		return
+	}
+	for _, char := range strings.ToLower(labels[1]) {
+		if !strings.ContainsRune(commandOutputIDChars, char) {
+			return
+		}
+	}
+	n, err := strconv.Atoi(labels[2])
+	if err != nil || n < 0 {
+		return
+	}
+	return labels[1], n, true
+}
@@ -0,0 +1,196 @@
+package dnsd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestParseCommandOutputChunkQuery(t *testing.T) {
+	for _, name := range []string{"", "_", "_.apple.com", "_verysecret142s0date.example.com", "_.abcdefgh.1.com",
+		"_.abcdefg.1.example.com", "_.abcdefgh.x.example.com", "_.abcdefgh.-1.example.com", "_.abc-efgh.1.example.com", "a.abcdefgh.1.example.com"} {
+		if _, _, ok := ParseCommandOutputChunkQuery(name); ok {
+			t.Fatal(name)
+		}
+	}
+	if id, n, ok := ParseCommandOutputChunkQuery("_.AbCd1234.12.example.com."); !ok || id != "AbCd1234" || n != 12 {
+		t.Fatal(id, n, ok)
+	}
+}
+
+func TestCommandOutputPages(t *testing.T) {
+	var nilPages *CommandOutputPages
+	long := strings.Repeat("0123456789", 50)
+	if text := nilPages.Paginate("127.0.0.1", long); text != long {
+		t.Fatal(text)
+	}
+	if text := nilPages.GetChunk("127.0.0.1", "abcdefgh", 0); text != "command output paging is disabled" {
+		t.Fatal(text)
+	}
+
+	pages := NewCommandOutputPages(1)
+	// Short output is not paged
+	if text := pages.Paginate("127.0.0.1", "short"); text != "short" || len(pages.outputs) != 0 {
+		t.Fatal(text)
+	}
+	// Long output is split into chunks
+	first := pages.Paginate("127.0.0.1", long)
+	match := regexp.MustCompile(`^([a-z0-9]{8}) 0/3 (.*)$`).FindStringSubmatch(first)
+	if match == nil || match[2] != long[:CommandOutputChunkLen] || len(first) > MaxTextResponseLen {
+		t.Fatal(first)
+	}
+	id := match[1]
+	// Paging the same output again gives the same ID
+	if again := pages.Paginate("127.0.0.1", long); again != first || len(pages.outputs) != 1 {
+		t.Fatal(again)
+	}
+	// Another client running the same command gets its own ID
+	other := pages.Paginate("127.0.0.2", long)
+	if other[:CommandOutputIDLen] == id || len(pages.outputs) != 2 {
+		t.Fatal(other)
+	}
+	// The output cannot be retrieved by another client
+	if text := pages.GetChunk("127.0.0.2", id, 1); text != "command output has expired" {
+		t.Fatal(text)
+	}
+	for n, chunk := range []string{long[:CommandOutputChunkLen], long[CommandOutputChunkLen : 2*CommandOutputChunkLen], long[2*CommandOutputChunkLen:]} {
+		if text := pages.GetChunk("127.0.0.1", strings.ToUpper(id), n); text != fmt.Sprintf("%s %d/3 %s", id, n, chunk) {
+			t.Fatal(n, text)
+		}
+	}
+	if text := pages.GetChunk("127.0.0.1", id, 3); text != id+" has chunks 0 to 2" {
+		t.Fatal(text)
+	}
+	// Output expires after retention period
+	time.Sleep(1100 * time.Millisecond)
+	if text := pages.GetChunk("127.0.0.1", id, 0); text != "command output has expired" || len(pages.outputs) != 0 || len(pages.idByText) != 0 {
+		t.Fatal(text)
+	}
+
+	// The output that expires the soonest makes room for new output
+	pages = NewCommandOutputPages(100)
+	var firstID string
+	for i := 0; i < MaxCommandOutputPages+1; i++ {
+		text := pages.Paginate("127.0.0.1", fmt.Sprintf("%d %s", i, long))
+		if i == 0 {
+			firstID = text[:CommandOutputIDLen]
+		}
+	}
+	if len(pages.outputs) != MaxCommandOutputPages || pages.GetChunk("127.0.0.1", firstID, 0) != "command output has expired" {
+		t.Fatal(len(pages.outputs))
+	}
+
+	// Output beyond the maximum length is not kept
+	text := pages.Paginate("127.0.0.1", strings.Repeat("a", MaxPagedCommandOutputLen+1000))
+	if numChunks := (MaxPagedCommandOutputLen + CommandOutputChunkLen - 1) / CommandOutputChunkLen; !strings.HasPrefix(text[CommandOutputIDLen:], fmt.Sprintf(" 0/%d ", numChunks)) {
+		t.Fatal(text)
+	}
+
+	// UTF-8 characters are not split between chunks
+	chunks := splitOutput(strings.Repeat("a", CommandOutputChunkLen-1)+"ö"+"b", CommandOutputChunkLen)
+	if len(chunks) != 2 || chunks[0] != strings.Repeat("a", CommandOutputChunkLen-1) || chunks[1] != "öb" {
+		t.Fatal(chunks)
+	}
+}
+
+func TestDaemon_CommandOutputChunks(t *testing.T) {
+	processor := toolbox.GetTestCommandProcessor()
+	processor.ResultFilters[0] = &toolbox.LintText{TrimSpaces: true, CompressToSingleLine: true, MaxLength: 4096}
+	daemon := Daemon{
+		Address:    "127.0.0.1",
+		TCPPort:    36715,
+		Forwarders: []string{"127.0.0.1:9"},
+		Processor:  processor,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// "_verysecret.s seq 1 500"
+	cmdName := "_verysecret142s0seq011001501010.example.com"
+	if cmd := DecodeDTMFCommandInput(cmdName); cmd != toolbox.TestCommandProcessorPIN+".s seq 1 500" {
+		t.Fatal(cmd)
+	}
+	var expected []string
+	for i := 1; i <= 500; i++ {
+		expected = append(expected, fmt.Sprint(i))
+	}
+	fullOutput := strings.Join(expected, ";")
+	numChunks := (len(fullOutput) + CommandOutputChunkLen - 1) / CommandOutputChunkLen
+
+	getText := func(respBody []byte) string {
+		msg, err := parseMessage(respBody)
+		if err != nil || len(msg.Answer) != 1 {
+			t.Fatal(err, respBody)
+		}
+		txtLen := int(respBody[msg.Answer[0].RDataOff])
+		return string(respBody[msg.Answer[0].RDataOff+1 : msg.Answer[0].RDataOff+1+txtLen])
+	}
+	queryBody := makeTestQuery(1, cmdName, typeTXT)
+	_, respBody := daemon.processTCPQuery("127.0.0.1", []byte{0, byte(len(queryBody))}, queryBody)
+	first := getText(respBody)
+	match := regexp.MustCompile(fmt.Sprintf(`^([a-z0-9]{8}) 0/%d `, numChunks)).FindStringSubmatch(first)
+	if match == nil {
+		t.Fatal(first)
+	}
+	id := match[1]
+	retrieved := strings.TrimPrefix(first, match[0])
+	// Retrieve the remaining chunks alternately over TCP and UDP
+	for n := 1; n < numChunks; n++ {
+		queryBody := makeTestQuery(uint16(n), fmt.Sprintf("_.%s.%d.example.com", id, n), typeTXT)
+		if n%2 == 0 {
+			_, respBody = daemon.processTCPQuery("127.0.0.1", []byte{0, byte(len(queryBody))}, queryBody)
+		} else {
+			_, respBody, _ = daemon.handleUDPTextQuery("127.0.0.1", queryBody)
+		}
+		prefix := fmt.Sprintf("%s %d/%d ", id, n, numChunks)
+		if text := getText(respBody); !strings.HasPrefix(text, prefix) {
+			t.Fatal(n, text)
+		} else {
+			retrieved += strings.TrimPrefix(text, prefix)
+		}
+	}
+	if retrieved != fullOutput {
+		t.Fatal(retrieved)
+	}
+	// The output ID does not appear in query log
+	for _, entry := range daemon.queryLog.GetEntries() {
+		if entry.Verdict != QueryVerdictCommand || entry.Name != "" {
+			t.Fatalf("%+v", entry)
+		}
+	}
+	// Another allowed client cannot retrieve the output
+	daemon.AllowQueryIPPrefixes = []string{"10.1."}
+	daemon.allowQueryLastUpdate = time.Now().Unix()
+	queryBody = makeTestQuery(1, fmt.Sprintf("_.%s.1.example.com", id), typeTXT)
+	_, respBody = daemon.processTCPQuery("10.1.2.3", []byte{0, byte(len(queryBody))}, queryBody)
+	if text := getText(respBody); text != "command output has expired" {
+		t.Fatal(text)
+	}
+	// A client that is not allowed to query does not get a response
+	if _, respBody = daemon.processTCPQuery("192.0.2.1", []byte{0, byte(len(queryBody))}, queryBody); len(respBody) != 0 {
+		t.Fatal(respBody)
+	}
+	if _, respBody, verdict := daemon.handleUDPTextQuery("192.0.2.1", queryBody); len(respBody) != 0 || verdict != QueryVerdictRefused {
+		t.Fatal(respBody, verdict)
+	}
+
+	// Without paging the output is truncated into a single response
+	daemon.CommandOutputRetentionSec = -1
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	queryBody = makeTestQuery(1, cmdName, typeTXT)
+	_, respBody = daemon.processTCPQuery("127.0.0.1", []byte{0, byte(len(queryBody))}, queryBody)
+	if text := getText(respBody); text != fullOutput[:MaxTextResponseLen] {
+		t.Fatal(text)
+	}
+	queryBody = makeTestQuery(1, fmt.Sprintf("_.%s.1.example.com", id), typeTXT)
+	_, respBody = daemon.processTCPQuery("127.0.0.1", []byte{0, byte(len(queryBody))}, queryBody)
+	if text := getText(respBody); text != "command output paging is disabled" {
+		t.Fatal(text)
+	}
+}
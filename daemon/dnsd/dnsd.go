@@ -3,9 +3,11 @@ package dnsd
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
@@ -84,18 +86,35 @@ type TCPForwarderQuery struct {
 
 // A DNS forwarder daemon that selectively refuse to answer certain A record requests made against advertisement servers.
 type Daemon struct {
-	Address              string                    `json:"Address"`              // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
-	AllowQueryIPPrefixes []string                  `json:"AllowQueryIPPrefixes"` // AllowQueryIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to query the DNS server.
-	PerIPLimit           int                       `json:"PerIPLimit"`           // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
-	Forwarders           []string                  `json:"Forwarders"`           // DefaultForwarders are recursive DNS resolvers that will resolve name queries. They must support both TCP and UDP.
-	Processor            *toolbox.CommandProcessor `json:"-"`                    // Processor enables TXT queries to execute toolbox command
+	Address                   string                    `json:"Address"`                   // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
+	AllowQueryIPPrefixes      []string                  `json:"AllowQueryIPPrefixes"`      // AllowQueryIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to query the DNS server.
+	PerIPLimit                int                       `json:"PerIPLimit"`                // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
+	Forwarders                []string                  `json:"Forwarders"`                // DefaultForwarders are recursive DNS resolvers that will resolve name queries. They must support both TCP and UDP.
+	ForwarderMode             string                    `json:"ForwarderMode"`             // ForwarderMode is how forwarders are chosen for a query - "random" (default), "fastest", or "race".
+	ConditionalForwarders     map[string][]string       `json:"ConditionalForwarders"`     // ConditionalForwarders maps domain names to the forwarders dedicated to the domain and its sub-domains.
+	Processor                 *toolbox.CommandProcessor `json:"-"`                         // Processor enables TXT queries to execute toolbox command
+	ResponseCacheSize         int                       `json:"ResponseCacheSize"`         // ResponseCacheSize is the maximum number of forwarder responses to cache. Set it to a negative number to disable the cache.
+	QueryLogSize              int                       `json:"QueryLogSize"`              // QueryLogSize is the number of latest queries to remember for statistics. Set it to a negative number to disable the query log.
+	CommandOutputRetentionSec int                       `json:"CommandOutputRetentionSec"` // CommandOutputRetentionSec is the number of seconds to keep long command output for retrieval in chunks. Set it to a negative number to disable paging.
+	LocalZones                []LocalZone               `json:"LocalZones"`                // LocalZones are answered authoritatively by the daemon, rather than forwarded.
+	BlacklistURLs             []string                  `json:"BlacklistURLs"`             // BlacklistURLs are the URLs of blacklists to download periodically, they are HostsFileURLs by default.
+	BlacklistFilePaths        []string                  `json:"BlacklistFilePaths"`        // BlacklistFilePaths are the local blacklist files to read along with each download.
+	WhitelistNames            []string                  `json:"WhitelistNames"`            // WhitelistNames are never blocked, in addition to the built-in Whitelist.
 
 	UDPPort int `json:"UDPPort"` // UDP port to listen on
 	TCPPort int `json:"TCPPort"` // TCP port to listen on
+	DoTPort int `json:"DoTPort"` // DoTPort is the TCP port to listen on for DNS-over-TLS queries. This is optional.
+
+	TLSCertPath string `json:"TLSCertPath"` // TLSCertPath is the path to server's TLS certificate for DNS-over-TLS. It is mandatory when DoTPort is specified.
+	TLSKeyPath  string `json:"TLSKeyPath"`  // TLSKeyPath is the path to server's TLS certificate key for DNS-over-TLS. It is mandatory when DoTPort is specified.
 
 	tcpServer *common.TCPServer
 	udpServer *common.UDPServer
 
+	tlsCert     tls.Certificate // tlsCert is the certificate used by DNS-over-TLS listener
+	dotListener net.Listener    // dotListener accepts DNS-over-TLS connections
+	dotMutex    *sync.Mutex     // dotMutex guards against concurrent access to dotListener
+
 	/*
 		blackList is a map of domain names (in lower case) and their resolved IP addresses that should be blocked. In
 		the context of DNS, queries made against the domain names will be answered 0.0.0.0 (black hole).
@@ -104,6 +123,8 @@ type Daemon struct {
 	*/
 	blackList         map[string]struct{}
 	blackListUpdating int32 // blackListUpdating is set to 1 when black list is being updated, and 0 otherwise.
+	// blackListSources reports the latest refresh of each blacklist URL and file, it is protected by blackListMutex.
+	blackListSources []BlacklistSourceReport
 
 	myPublicIP           string          // myPublicIP is the latest public IP address of the laitos server.
 	blackListMutex       *sync.RWMutex   // Protect against concurrent access to black list
@@ -114,6 +135,16 @@ type Daemon struct {
 
 	// latestCommands remembers the result of most recently executed toolbox commands.
 	latestCommands *LatestCommands
+	// responseCache memorises the responses from forwarders, it is nil when caching is disabled.
+	responseCache *ResponseCache
+	// forwarders chooses forwarders for queries and keeps track of their health.
+	forwarders *forwarderPool
+	// commandOutputs keeps long command outputs for retrieval in chunks, it is nil when paging is disabled.
+	commandOutputs *CommandOutputPages
+	// queryLog remembers the latest queries for statistics, it is nil when the query log is disabled.
+	queryLog *QueryLog
+	// localZones are the compiled LocalZones, sorted from the most specific zone name to the least specific.
+	localZones []*localZoneData
 
 	// processQueryTestCaseFunc works along side DNS query processing routine, it offers queried name to test case for inspection.
 	processQueryTestCaseFunc func(string)
@@ -135,6 +166,15 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 48 // reasonable for a network of 3 users
 	}
+	if daemon.ResponseCacheSize == 0 {
+		daemon.ResponseCacheSize = DefaultResponseCacheSize
+	}
+	if daemon.QueryLogSize == 0 {
+		daemon.QueryLogSize = DefaultQueryLogSize
+	}
+	if daemon.CommandOutputRetentionSec == 0 {
+		daemon.CommandOutputRetentionSec = DefaultCommandOutputRetentionSec
+	}
 	if daemon.Forwarders == nil || len(daemon.Forwarders) == 0 {
 		daemon.Forwarders = make([]string, len(DefaultForwarders))
 		copy(daemon.Forwarders, DefaultForwarders)
@@ -143,6 +183,19 @@ func (daemon *Daemon) Initialise() error {
 		ComponentName: "dnsd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "TCP", Value: daemon.TCPPort}, {Key: "UDP", Value: daemon.UDPPort}},
 	}
+	if daemon.DoTPort > 0 {
+		if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
+			return errors.New("dnsd.Initialise: TLS certificate or key path is missing for DNS-over-TLS")
+		}
+		contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
+		if err != nil {
+			return err
+		}
+		daemon.tlsCert, err = tls.X509KeyPair(contents[0], contents[1])
+		if err != nil {
+			return fmt.Errorf("dnsd.Initialise: failed to load certificate or key - %v", err)
+		}
+	}
 	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
 		daemon.logger.Info("Initialise", "", nil, "daemon will not be able to execute toolbox commands due to lack of command processor filter configuration")
 		daemon.Processor = toolbox.GetEmptyCommandProcessor()
@@ -160,9 +213,40 @@ func (daemon *Daemon) Initialise() error {
 		}
 	}
 
+	if daemon.BlacklistURLs == nil {
+		daemon.BlacklistURLs = make([]string, len(HostsFileURLs))
+		copy(daemon.BlacklistURLs, HostsFileURLs)
+	}
+	for _, url := range daemon.BlacklistURLs {
+		if url == "" {
+			return errors.New("dnsd.Initialise: blacklist URLs may not contain empty string")
+		}
+	}
+	for _, filePath := range daemon.BlacklistFilePaths {
+		if _, err := os.Stat(filePath); err != nil {
+			return fmt.Errorf("dnsd.Initialise: failed to read blacklist file - %v", err)
+		}
+	}
+
+	var err error
+	if daemon.localZones, err = compileLocalZones(daemon.LocalZones); err != nil {
+		return fmt.Errorf("dnsd.Initialise: %v", err)
+	}
+	if daemon.ForwarderMode == "" {
+		daemon.ForwarderMode = ForwarderModeRandom
+	}
+	if daemon.forwarders, err = newForwarderPool(daemon.ForwarderMode, daemon.Forwarders, daemon.ConditionalForwarders); err != nil {
+		return fmt.Errorf("dnsd.Initialise: %v", err)
+	}
+
 	daemon.allowQueryMutex = new(sync.Mutex)
+	daemon.dotMutex = new(sync.Mutex)
 	daemon.blackListMutex = new(sync.RWMutex)
 	daemon.blackList = make(map[string]struct{})
+	daemon.blackListSources = make([]BlacklistSourceReport, 0, len(daemon.BlacklistURLs)+len(daemon.BlacklistFilePaths))
+	for _, source := range append(append([]string{}, daemon.BlacklistURLs...), daemon.BlacklistFilePaths...) {
+		daemon.blackListSources = append(daemon.blackListSources, BlacklistSourceReport{Source: source})
+	}
 
 	daemon.rateLimit = &misc.RateLimit{
 		MaxCount: daemon.PerIPLimit,
@@ -172,6 +256,18 @@ func (daemon *Daemon) Initialise() error {
 	daemon.rateLimit.Initialise()
 
 	daemon.latestCommands = NewLatestCommands()
+	daemon.commandOutputs = nil
+	if daemon.CommandOutputRetentionSec > 0 {
+		daemon.commandOutputs = NewCommandOutputPages(daemon.CommandOutputRetentionSec)
+	}
+	daemon.responseCache = nil
+	if daemon.ResponseCacheSize > 0 {
+		daemon.responseCache = NewResponseCache(daemon.ResponseCacheSize)
+	}
+	daemon.queryLog = nil
+	if daemon.QueryLogSize > 0 {
+		daemon.queryLog = NewQueryLog(daemon.QueryLogSize)
+	}
 	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "dnsd", daemon, daemon.PerIPLimit)
 	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "dnsd", daemon, daemon.PerIPLimit)
 
@@ -224,8 +320,8 @@ func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
 }
 
 /*
-UpdateBlackList downloads the latest blacklist files from PGL and MVPS, resolves the IP addresses of each domain,
-and stores the latest blacklist names and IP addresses into blacklist map.
+UpdateBlackList downloads the latest blacklists and reads the local blacklist files, resolves the IP addresses of each
+domain, and stores the latest blacklist names and IP addresses into blacklist map.
 */
 func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 	beginUnixSec := time.Now().Unix()
@@ -238,7 +334,8 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 	}()
 
 	// Download black list data from all sources
-	allNames := DownloadAllBlacklists(daemon.logger)
+	allNames, reports := LoadBlacklists(daemon.logger, daemon.BlacklistURLs, daemon.BlacklistFilePaths, daemon.WhitelistNames)
+	daemon.updateBlacklistSources(reports)
 	if len(allNames) > maxEntries {
 		allNames = allNames[:maxEntries]
 	}
@@ -267,7 +364,7 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 	for i := 0; i < numRoutines; i++ {
 		go func(i int) {
 			defer parallelResolve.Done()
-			for j := i * (len(allNames) / numRoutines); j < (i+1)*(len(allNames)/numRoutines); j++ {
+			for j := i; j < len(allNames); j += numRoutines {
 				// Count number of resolution attempts only for logging the progress
 				atomic.AddInt64(&countResolutionAttempts, 1)
 				if atomic.LoadInt64(&countResolutionAttempts)%500 == 1 {
@@ -279,6 +376,13 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 				if strings.ContainsRune(name, 0) {
 					continue
 				}
+				if strings.HasPrefix(name, "*.") {
+					// A wildcard does not resolve into IP addresses
+					newBlackListMutex.Lock()
+					newBlackList[name] = struct{}{}
+					newBlackListMutex.Unlock()
+					continue
+				}
 				ips, err := net.LookupIP(name)
 				newBlackListMutex.Lock()
 				newBlackList[name] = struct{}{}
@@ -305,14 +409,42 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 		countResolvedIPs, len(allNames), (time.Now().Unix()-beginUnixSec)/60, numRoutines, len(newBlackList))
 }
 
+/*
+updateBlacklistSources memorises the latest reports of blacklist sources. If a source failed to refresh, its report
+retains the time of its previous successful refresh.
+*/
+func (daemon *Daemon) updateBlacklistSources(reports []BlacklistSourceReport) {
+	daemon.blackListMutex.Lock()
+	defer daemon.blackListMutex.Unlock()
+	for i, report := range reports {
+		if report.LastError != "" {
+			for _, previous := range daemon.blackListSources {
+				if previous.Source == report.Source {
+					reports[i].LastRefresh = previous.LastRefresh
+				}
+			}
+		}
+	}
+	daemon.blackListSources = reports
+}
+
+// GetBlacklistSourceReport returns the latest refresh report of each blacklist URL and file.
+func (daemon *Daemon) GetBlacklistSourceReport() []BlacklistSourceReport {
+	daemon.blackListMutex.RLock()
+	defer daemon.blackListMutex.RUnlock()
+	ret := make([]BlacklistSourceReport, len(daemon.blackListSources))
+	copy(ret, daemon.blackListSources)
+	return ret
+}
+
 /*
 You may call this function only after having called Initialise()!
-Start DNS daemon on configured TCP and UDP ports. Block caller until both listeners are told to stop.
-If either TCP or UDP port fails to listen, all listeners are closed and an error is returned.
+Start DNS daemon on configured TCP, UDP, and DNS-over-TLS ports. Block caller until all listeners are told to stop.
+If any of the ports fails to listen, all listeners are closed and an error is returned.
 */
 func (daemon *Daemon) StartAndBlock() error {
 	// Update ad-block black list in background
-	stopAdBlockUpdater := make(chan bool, 2)
+	stopAdBlockUpdater := make(chan bool, 3)
 	go func() {
 		firstTime := true
 		nextRunAt := time.Now().Add(BlacklistInitialDelaySec * time.Second)
@@ -341,7 +473,7 @@ func (daemon *Daemon) StartAndBlock() error {
 
 	// Start server listeners
 	numListeners := 0
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 	if daemon.UDPPort != 0 {
 		numListeners++
 		go func() {
@@ -358,6 +490,14 @@ func (daemon *Daemon) StartAndBlock() error {
 			stopAdBlockUpdater <- true
 		}()
 	}
+	if daemon.DoTPort != 0 {
+		numListeners++
+		go func() {
+			err := daemon.startAndBlockDoT()
+			errChan <- err
+			stopAdBlockUpdater <- true
+		}()
+	}
 	for i := 0; i < numListeners; i++ {
 		if err := <-errChan; err != nil {
 			daemon.Stop()
@@ -367,15 +507,23 @@ func (daemon *Daemon) StartAndBlock() error {
 	return nil
 }
 
-// Close all of open TCP and UDP listeners so that they will cease processing incoming connections.
+// Close all of open TCP, UDP, and DNS-over-TLS listeners so that they will cease processing incoming connections.
 func (daemon *Daemon) Stop() {
 	daemon.tcpServer.Stop()
 	daemon.udpServer.Stop()
+	daemon.stopDoT()
+}
+
+// Shutdown stops accepting new DNS queries and waits for the ongoing queries over TCP and UDP to complete.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	daemon.stopDoT()
+	return common.ShutdownConcurrently(ctx, daemon.tcpServer.Shutdown, daemon.udpServer.Shutdown)
 }
 
 /*
 IsInBlacklist returns true only if the input domain name or IP address is black listed. If the domain name represents
-a sub-domain name, then the function strips the sub-domain portion in order to check it against black list.
+a sub-domain name, then the function strips the sub-domain portion in order to check it against black list and its
+wildcards.
 */
 func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 	// If the name is exceedingly long, then return true as if the name is black-listed.
@@ -406,10 +554,16 @@ func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 	// Check each broken-down variation of domain name against black list
 	daemon.blackListMutex.RLock()
 	defer daemon.blackListMutex.RUnlock()
-	for _, candidate := range blackListCandidates {
+	for i, candidate := range blackListCandidates {
 		if _, blacklisted := daemon.blackList[candidate]; blacklisted {
 			return true
 		}
+		// A wildcard matches the sub-domains of its name
+		if i > 0 {
+			if _, blacklisted := daemon.blackList["*."+candidate]; blacklisted {
+				return true
+			}
+		}
 	}
 	return false
 }
@@ -477,6 +631,17 @@ func TestServer(dnsd *Daemon, t testingstub.T) {
 		},
 	}
 	testResolveNameAndBlackList(t, dnsd, udpResolver)
+	if dnsd.DoTPort != 0 {
+		// DNS-over-TLS uses the same framing as TCP
+		dotResolver := &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: true,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, e error) {
+				return tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", dnsd.DoTPort), &tls.Config{InsecureSkipVerify: true})
+			},
+		}
+		testResolveNameAndBlackList(t, dnsd, dotResolver)
+	}
 
 	// Daemon must stop in a second
 	dnsd.Stop()
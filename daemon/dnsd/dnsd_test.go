@@ -1,6 +1,9 @@
 package dnsd
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -25,6 +28,52 @@ func TestUpdateBlackList(t *testing.T) {
 	}
 }
 
+func TestUpdateBlackList_ConfiguredSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-dnsd-blacklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listFile := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(listFile, []byte("||ads.invalid^\n*.wild.invalid\nallowed.invalid\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daemon := Daemon{BlacklistFilePaths: []string{filepath.Join(dir, "does-not-exist")}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "blacklist file") {
+		t.Fatal(err)
+	}
+	daemon = Daemon{BlacklistURLs: []string{}, BlacklistFilePaths: []string{listFile}, WhitelistNames: []string{"allowed.invalid"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if report := daemon.GetBlacklistSourceReport(); len(report) != 1 || report[0].Source != listFile || !report[0].LastRefresh.IsZero() {
+		t.Fatalf("%+v", report)
+	}
+	daemon.UpdateBlackList(BlacklistMaxEntries)
+	for name, blocked := range map[string]bool{
+		"ads.invalid": true, "a.ads.invalid": true, "wild.invalid": false, "a.wild.invalid": true, "a.b.wild.invalid": true,
+		"allowed.invalid": false, "example.com": false,
+	} {
+		if daemon.IsInBlacklist(name) != blocked {
+			t.Fatal(name, blocked)
+		}
+	}
+	report := daemon.GetBlacklistSourceReport()
+	if len(report) != 1 || report[0].NumNames != 3 || report[0].LastRefresh.IsZero() || report[0].LastError != "" {
+		t.Fatalf("%+v", report)
+	}
+	// A failed refresh retains the time of previous successful refresh
+	lastRefresh := report[0].LastRefresh
+	if err := os.Remove(listFile); err != nil {
+		t.Fatal(err)
+	}
+	daemon.UpdateBlackList(BlacklistMaxEntries)
+	report = daemon.GetBlacklistSourceReport()
+	if len(report) != 1 || report[0].NumNames != 0 || !report[0].LastRefresh.Equal(lastRefresh) || report[0].LastError == "" {
+		t.Fatalf("%+v", report)
+	}
+}
+
 func TestCheckAllowClientIP(t *testing.T) {
 	daemon := Daemon{AllowQueryIPPrefixes: []string{"192.", "100."}}
 	if err := daemon.Initialise(); err != nil {
@@ -82,6 +131,16 @@ func TestDNSD(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
+	// DNS-over-TLS requires certificate and key
+	daemon.DoTPort = 34853
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLS certificate or key path is missing") {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = "../../sample-config.crt.txt"
+	daemon.TLSKeyPath = "../../sample-config.crt.key.txt"
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
 
 	TestServer(&daemon, t)
 }
@@ -0,0 +1,23 @@
+package dnsd
+
+/*
+ProcessDoHQuery formulates a response to a DNS-over-HTTPS (RFC 8484) query. The query body is a complete DNS message
+without the length prefix used by TCP. The response is processed the same way as a TCP query, which means it is subject
+to query IP restriction, black list, and toolbox command execution. If there is no appropriate response, the function
+returns an empty byte slice.
+*/
+func (daemon *Daemon) ProcessDoHQuery(clientIP string, queryBody []byte) []byte {
+	if len(queryBody) < MinNameQuerySize || len(queryBody) > MaxPacketSize {
+		return []byte{}
+	}
+	// Rate limit is enforced by the HTTP daemon, the processing routine only needs to know the query length.
+	queryLen := []byte{byte(len(queryBody) / 256), byte(len(queryBody) % 256)}
+	_, respBody := daemon.processTCPQuery(clientIP, queryLen, queryBody)
+	if len(respBody) < 2 {
+		return []byte{}
+	}
+	// Match transaction ID of original query
+	respBody[0] = queryBody[0]
+	respBody[1] = queryBody[1]
+	return respBody
+}
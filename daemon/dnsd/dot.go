@@ -0,0 +1,121 @@
+package dnsd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+/*
+startAndBlockDoT starts a DNS-over-TLS (RFC 7858) listener and blocks until the listener is told to stop.
+DoT queries are processed exactly the same way as TCP queries, they are only transported differently.
+*/
+func (daemon *Daemon) startAndBlockDoT() error {
+	daemon.dotMutex.Lock()
+	if daemon.dotListener != nil {
+		daemon.dotMutex.Unlock()
+		return fmt.Errorf("dnsd.startAndBlockDoT: listener on port %d must not be started a second time", daemon.DoTPort)
+	}
+	daemon.logger.Info("startAndBlockDoT", "", nil, "starting DNS-over-TLS listener")
+	listener, err := tls.Listen("tcp", net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.DoTPort)), &tls.Config{
+		Certificates: []tls.Certificate{daemon.tlsCert},
+	})
+	if err != nil {
+		daemon.dotMutex.Unlock()
+		return fmt.Errorf("dnsd.startAndBlockDoT: failed to listen on port %d - %v", daemon.DoTPort, err)
+	}
+	daemon.dotListener = listener
+	daemon.dotMutex.Unlock()
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("startAndBlockDoT", "", misc.ErrEmergencyLockDown, "")
+			return misc.ErrEmergencyLockDown
+		}
+		client, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("dnsd.startAndBlockDoT: failed to accept new connection - %v", err)
+		}
+		// Check client IP against rate limit
+		clientIP := client.RemoteAddr().(*net.TCPAddr).IP.String()
+		if !daemon.rateLimit.Add(clientIP, true) {
+			daemon.logger.MaybeMinorError(client.Close())
+			continue
+		}
+		go daemon.handleDoTConnection(clientIP, client)
+	}
+}
+
+/*
+handleDoTConnection converses with a DNS-over-TLS client. Unlike an ordinary TCP client, a DoT client often keeps the
+connection open for more queries, hence the conversation carries on until the client disconnects or goes idle.
+*/
+func (daemon *Daemon) handleDoTConnection(clientIP string, conn net.Conn) {
+	// Put processing duration into statistics, DoT is counted along with the ordinary TCP queries.
+	beginTimeNano := time.Now().UnixNano()
+	defer func() {
+		daemon.logger.MaybeMinorError(conn.Close())
+		misc.DNSDStatsTCP.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+	}()
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("handleDoTConnection", clientIP, misc.ErrEmergencyLockDown, "")
+			return
+		}
+		// The IO deadline applies to TLS handshake as well as reading the next query
+		daemon.logger.MaybeMinorError(conn.SetDeadline(time.Now().Add(ClientTimeoutSec * time.Second)))
+		queryLen := make([]byte, 2)
+		if _, err := io.ReadFull(conn, queryLen); err != nil {
+			if err != io.EOF {
+				daemon.logger.Info("handleDoTConnection", clientIP, err, "failed to read query length from client")
+			}
+			return
+		}
+		queryLenInteger := int(queryLen[0])*256 + int(queryLen[1])
+		if queryLenInteger > MaxPacketSize || queryLenInteger < MinNameQuerySize {
+			daemon.logger.Warning("handleDoTConnection", clientIP, nil, "invalid query length from client")
+			return
+		}
+		queryBody := make([]byte, queryLenInteger)
+		if _, err := io.ReadFull(conn, queryBody); err != nil {
+			daemon.logger.Warning("handleDoTConnection", clientIP, err, "failed to read query from client")
+			return
+		}
+		// Subsequent queries of the same connection are subject to rate limit too
+		if !daemon.rateLimit.Add(clientIP, true) {
+			return
+		}
+		respLen, respBody := daemon.processTCPQuery(clientIP, queryLen, queryBody)
+		// Close client connection in case there is no appropriate response
+		if len(respBody) < 2 {
+			return
+		}
+		// Match transaction ID of original query
+		respBody[0] = queryBody[0]
+		respBody[1] = queryBody[1]
+		if _, err := conn.Write(append(respLen, respBody...)); err != nil {
+			daemon.logger.Warning("handleDoTConnection", clientIP, err, "failed to answer to client")
+			return
+		}
+	}
+}
+
+// stopDoT closes DNS-over-TLS listener so that it ceases to accept new connections.
+func (daemon *Daemon) stopDoT() {
+	daemon.dotMutex.Lock()
+	defer daemon.dotMutex.Unlock()
+	if daemon.dotListener != nil {
+		if err := daemon.dotListener.Close(); err != nil {
+			daemon.logger.Warning("stopDoT", "", err, "failed to stop DNS-over-TLS listener")
+		}
+		daemon.dotListener = nil
+	}
+}
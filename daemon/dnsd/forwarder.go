@@ -0,0 +1,253 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The modes of choosing forwarders for a query.
+const (
+	ForwarderModeRandom  = "random"  // ForwarderModeRandom sends each query to a randomly chosen healthy forwarder.
+	ForwarderModeFastest = "fastest" // ForwarderModeFastest sends each query to the healthy forwarder of best score, then to the next one if it fails.
+	ForwarderModeRace    = "race"    // ForwarderModeRace sends each query to several healthy forwarders in parallel and uses the first response.
+)
+
+const (
+	ForwarderEjectAfterFailures = 3  // ForwarderEjectAfterFailures is the number of consecutive failures that will eject a forwarder.
+	ForwarderEjectionSec        = 60 // ForwarderEjectionSec is the number of seconds an ejected forwarder stays out of use.
+	ForwarderFastestAttempts    = 2  // ForwarderFastestAttempts is the maximum number of forwarders to try in fastest-first mode.
+	ForwarderRaceSize           = 3  // ForwarderRaceSize is the maximum number of forwarders to query in parallel in race mode.
+
+	// forwarderHealthWeight is the weight of the latest round trip in the moving average of latency and failure rate.
+	forwarderHealthWeight = 0.2
+)
+
+// ForwarderHealth keeps track of the responsiveness of a forwarder.
+type ForwarderHealth struct {
+	Address             string
+	AvgLatency          time.Duration // AvgLatency is the moving average of successful round trip duration.
+	FailureRate         float64       // FailureRate is the moving average of failed round trips, between 0 and 1.
+	NumQueries          int64
+	NumFailures         int64
+	ConsecutiveFailures int
+	EjectedUntil        time.Time // EjectedUntil is the time until which the forwarder will not be used.
+}
+
+// IsEjected returns true only if the forwarder is temporarily out of use due to consecutive failures.
+func (health *ForwarderHealth) IsEjected() bool {
+	return time.Now().Before(health.EjectedUntil)
+}
+
+/*
+GetScore returns the score of forwarder, the lower the better. The score is the average latency penalised by failure
+rate. A forwarder that has not yet been used gets the best score so that it will be tried soon.
+*/
+func (health *ForwarderHealth) GetScore() float64 {
+	latency := health.AvgLatency
+	if latency == 0 && health.NumFailures > 0 {
+		// The forwarder has never succeeded
+		latency = ForwarderTimeoutSec * time.Second
+	}
+	return float64(latency) * (1 + 10*health.FailureRate)
+}
+
+// conditionalForwarders are the forwarders dedicated to a domain name and its sub-domains.
+type conditionalForwarders struct {
+	suffix     string
+	forwarders []string
+}
+
+// forwarderPool chooses forwarders for queries and keeps track of their health.
+type forwarderPool struct {
+	mode        string
+	defaults    []string
+	conditional []conditionalForwarders // conditional forwarders are sorted from the longest domain suffix to the shortest
+	mutex       *sync.Mutex
+	health      map[string]*ForwarderHealth
+}
+
+// newForwarderPool constructs a forwarder pool and validates the conditional forwarder configuration.
+func newForwarderPool(mode string, defaults []string, conditional map[string][]string) (*forwarderPool, error) {
+	pool := &forwarderPool{
+		mode:        mode,
+		defaults:    defaults,
+		conditional: make([]conditionalForwarders, 0, len(conditional)),
+		mutex:       new(sync.Mutex),
+		health:      make(map[string]*ForwarderHealth),
+	}
+	switch mode {
+	case ForwarderModeRandom, ForwarderModeFastest, ForwarderModeRace:
+	default:
+		return nil, fmt.Errorf("unknown forwarder mode \"%s\"", mode)
+	}
+	for suffix, forwarders := range conditional {
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		if suffix == "" {
+			return nil, errors.New("conditional forwarder domain name must not be empty")
+		}
+		if len(forwarders) == 0 {
+			return nil, fmt.Errorf("conditional forwarders of \"%s\" must not be empty", suffix)
+		}
+		pool.conditional = append(pool.conditional, conditionalForwarders{suffix: suffix, forwarders: forwarders})
+	}
+	sort.Slice(pool.conditional, func(i, j int) bool {
+		return len(pool.conditional[i].suffix) > len(pool.conditional[j].suffix)
+	})
+	for _, addr := range defaults {
+		pool.health[addr] = &ForwarderHealth{Address: addr}
+	}
+	for _, cond := range pool.conditional {
+		for _, addr := range cond.forwarders {
+			pool.health[addr] = &ForwarderHealth{Address: addr}
+		}
+	}
+	return pool, nil
+}
+
+// getForwarders returns the conditional forwarders of the most specific domain suffix of the name, or the default forwarders.
+func (pool *forwarderPool) getForwarders(name string) []string {
+	for _, cond := range pool.conditional {
+		if name == cond.suffix || strings.HasSuffix(name, "."+cond.suffix) {
+			return cond.forwarders
+		}
+	}
+	return pool.defaults
+}
+
+/*
+getCandidates returns the forwarders to try for the query, in the order they should be tried. Ejected forwarders are
+left out, unless all of the forwarders have been ejected.
+*/
+func (pool *forwarderPool) getCandidates(queryBody []byte) []string {
+	var name string
+	if msg, err := parseMessage(queryBody); err == nil && len(msg.Question) > 0 {
+		name = msg.Question[0].Name
+	}
+	forwarders := pool.getForwarders(name)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	candidates := make([]string, 0, len(forwarders))
+	for _, addr := range forwarders {
+		if !pool.health[addr].IsEjected() {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		// Give all of them another chance rather than failing the query
+		candidates = append(candidates, forwarders...)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if pool.mode != ForwarderModeRandom {
+		// Forwarders of equal score remain in random order
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return pool.health[candidates[i]].GetScore() < pool.health[candidates[j]].GetScore()
+		})
+	}
+	return candidates
+}
+
+// record updates the health of a forwarder according to the outcome of a round trip.
+func (pool *forwarderPool) record(addr string, latency time.Duration, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	health := pool.health[addr]
+	health.NumQueries++
+	if err == nil {
+		health.ConsecutiveFailures = 0
+		health.FailureRate *= 1 - forwarderHealthWeight
+		if health.AvgLatency == 0 {
+			health.AvgLatency = latency
+		} else {
+			health.AvgLatency = time.Duration(float64(health.AvgLatency)*(1-forwarderHealthWeight) + float64(latency)*forwarderHealthWeight)
+		}
+		return
+	}
+	health.NumFailures++
+	health.ConsecutiveFailures++
+	health.FailureRate = health.FailureRate*(1-forwarderHealthWeight) + forwarderHealthWeight
+	// A forwarder that fails again after its ejection is over will be ejected again right away
+	if health.ConsecutiveFailures >= ForwarderEjectAfterFailures {
+		health.EjectedUntil = time.Now().Add(ForwarderEjectionSec * time.Second)
+	}
+}
+
+// getHealth returns a copy of the health of all forwarders, sorted by address.
+func (pool *forwarderPool) getHealth() []ForwarderHealth {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	ret := make([]ForwarderHealth, 0, len(pool.health))
+	for _, health := range pool.health {
+		ret = append(ret, *health)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Address < ret[j].Address
+	})
+	return ret
+}
+
+/*
+forward sends the query to forwarders chosen by the forwarder mode, and returns the first successful response. The
+exchange function conducts a round trip with the forwarder over a transport of caller's choice.
+*/
+func (pool *forwarderPool) forward(queryBody []byte, exchange func(forwarder string) ([]byte, error)) (respBody []byte, err error) {
+	candidates := pool.getCandidates(queryBody)
+	if len(candidates) == 0 {
+		return nil, errors.New("there is no forwarder")
+	}
+	exchangeAndRecord := func(forwarder string) ([]byte, error) {
+		begin := time.Now()
+		respBody, err := exchange(forwarder)
+		pool.record(forwarder, time.Since(begin), err)
+		return respBody, err
+	}
+	switch pool.mode {
+	case ForwarderModeFastest:
+		for i := 0; i < len(candidates) && i < ForwarderFastestAttempts; i++ {
+			if respBody, err = exchangeAndRecord(candidates[i]); err == nil {
+				return
+			}
+		}
+		return
+	case ForwarderModeRace:
+		if len(candidates) > ForwarderRaceSize {
+			candidates = candidates[:ForwarderRaceSize]
+		}
+		type outcome struct {
+			respBody []byte
+			err      error
+		}
+		// The buffer lets the slower forwarders finish their round trips after the winner is found
+		outcomes := make(chan outcome, len(candidates))
+		for _, forwarder := range candidates {
+			go func(forwarder string) {
+				respBody, err := exchangeAndRecord(forwarder)
+				outcomes <- outcome{respBody, err}
+			}(forwarder)
+		}
+		for range candidates {
+			result := <-outcomes
+			if result.err == nil {
+				return result.respBody, nil
+			}
+			err = result.err
+		}
+		return
+	default:
+		return exchangeAndRecord(candidates[0])
+	}
+}
+
+// GetForwarderHealth returns the health of default and conditional forwarders, sorted by address.
+func (daemon *Daemon) GetForwarderHealth() []ForwarderHealth {
+	if daemon.forwarders == nil {
+		return []ForwarderHealth{}
+	}
+	return daemon.forwarders.getHealth()
+}
@@ -0,0 +1,257 @@
+package dnsd
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+startStubResolver starts a UDP resolver on localhost that answers every query with an A record of the specified TTL,
+so that a test can tell which resolver has answered. The resolver waits for the delay before answering.
+*/
+func startStubResolver(t *testing.T, answerTTL uint32, delay time.Duration, numQueries *int32) (addr string, stop func()) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			buf := make([]byte, MaxPacketSize)
+			n, client, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(numQueries, 1)
+			go func(query []byte, client *net.UDPAddr) {
+				time.Sleep(delay)
+				_, _ = server.WriteToUDP(makeTestResponse(query, rcodeNoError, answerTTL, 0, 0), client)
+			}(buf[:n], client)
+		}
+	}()
+	return server.LocalAddr().String(), func() {
+		_ = server.Close()
+	}
+}
+
+// getDeadResolverAddr returns a localhost UDP address that nobody listens on, queries made to it fail quickly.
+func getDeadResolverAddr(t *testing.T) string {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.LocalAddr().String()
+	_ = server.Close()
+	return addr
+}
+
+// getAnswerTTL returns the TTL of the first answer record in the response, or 0 if there is none.
+func getAnswerTTL(t *testing.T, respBody []byte) uint32 {
+	msg, err := parseMessage(respBody)
+	if err != nil {
+		t.Fatal(err, respBody)
+	}
+	if len(msg.Answer) == 0 {
+		return 0
+	}
+	return msg.Answer[0].TTL
+}
+
+func TestDaemon_ConditionalForwarders(t *testing.T) {
+	var numDefaultQueries, numCorpQueries, numLabQueries int32
+	defaultAddr, stopDefault := startStubResolver(t, 100, 0, &numDefaultQueries)
+	defer stopDefault()
+	corpAddr, stopCorp := startStubResolver(t, 200, 0, &numCorpQueries)
+	defer stopCorp()
+	labAddr, stopLab := startStubResolver(t, 300, 0, &numLabQueries)
+	defer stopLab()
+
+	daemon := Daemon{
+		Address:           "127.0.0.1",
+		UDPPort:           1,
+		Forwarders:        []string{defaultAddr},
+		ResponseCacheSize: -1,
+		ConditionalForwarders: map[string][]string{
+			"Corp.Example.":    {corpAddr},
+			"lab.corp.example": {labAddr},
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []struct {
+		name string
+		ttl  uint32
+	}{
+		{"example.com", 100},
+		{"corp.example", 200},
+		{"intranet.corp.example", 200},
+		{"notcorp.example", 100},
+		{"lab.corp.example", 300},
+		{"server.lab.corp.example", 300},
+	} {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, query.name, typeA)); getAnswerTTL(t, resp) != query.ttl {
+			t.Fatal(query.name, resp)
+		}
+	}
+	if atomic.LoadInt32(&numDefaultQueries) != 2 || atomic.LoadInt32(&numCorpQueries) != 2 || atomic.LoadInt32(&numLabQueries) != 2 {
+		t.Fatal(numDefaultQueries, numCorpQueries, numLabQueries)
+	}
+
+	// Conditional forwarders must be sensible
+	for _, conditional := range []map[string][]string{{"": {corpAddr}}, {".": {corpAddr}}, {"corp.example": {}}} {
+		daemon.ConditionalForwarders = conditional
+		if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "conditional forwarder") {
+			t.Fatal(conditional, err)
+		}
+	}
+	daemon.ConditionalForwarders = nil
+	daemon.ForwarderMode = "slowest"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "unknown forwarder mode") {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemon_ForwarderEjection(t *testing.T) {
+	var numQueries int32
+	healthyAddr, stopHealthy := startStubResolver(t, 100, 0, &numQueries)
+	defer stopHealthy()
+	deadAddr := getDeadResolverAddr(t)
+
+	daemon := Daemon{
+		Address:           "127.0.0.1",
+		UDPPort:           1,
+		Forwarders:        []string{healthyAddr, deadAddr},
+		ResponseCacheSize: -1,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Randomly chosen forwarders will eventually include the dead one enough times to eject it
+	var numFailures int
+	for i := 0; i < 200 && numFailures < ForwarderEjectAfterFailures; i++ {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); len(resp) == 0 {
+			numFailures++
+		}
+	}
+	if numFailures != ForwarderEjectAfterFailures {
+		t.Fatal(numFailures)
+	}
+	// Ejected forwarder is no longer used
+	for i := 0; i < 20; i++ {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); getAnswerTTL(t, resp) != 100 {
+			t.Fatal(resp)
+		}
+	}
+	health := daemon.GetForwarderHealth()
+	if len(health) != 2 {
+		t.Fatalf("%+v", health)
+	}
+	for _, forwarder := range health {
+		if forwarder.Address == deadAddr {
+			if !forwarder.IsEjected() || forwarder.NumFailures != ForwarderEjectAfterFailures || forwarder.FailureRate == 0 || forwarder.AvgLatency != 0 {
+				t.Fatalf("%+v", forwarder)
+			}
+		} else if forwarder.IsEjected() || forwarder.NumFailures != 0 || forwarder.AvgLatency == 0 || forwarder.NumQueries != int64(atomic.LoadInt32(&numQueries)) {
+			t.Fatalf("%+v", forwarder)
+		}
+	}
+	if report := daemon.GetQueryStatsReport(); !strings.Contains(report, deadAddr+"\tavg latency 0s, failure rate") || !strings.Contains(report, ", ejected until ") {
+		t.Fatal(report)
+	}
+
+	// When all forwarders are ejected, they are all given another chance
+	daemon.Forwarders = []string{deadAddr}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < ForwarderEjectAfterFailures+2; i++ {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); len(resp) != 0 {
+			t.Fatal(resp)
+		}
+	}
+	if health := daemon.GetForwarderHealth(); len(health) != 1 || health[0].NumQueries != ForwarderEjectAfterFailures+2 || !health[0].IsEjected() {
+		t.Fatalf("%+v", health)
+	}
+}
+
+func TestDaemon_ForwarderModeFastest(t *testing.T) {
+	var numFastQueries, numSlowQueries int32
+	fastAddr, stopFast := startStubResolver(t, 100, 0, &numFastQueries)
+	defer stopFast()
+	slowAddr, stopSlow := startStubResolver(t, 200, 100*time.Millisecond, &numSlowQueries)
+	defer stopSlow()
+	deadAddr := getDeadResolverAddr(t)
+
+	daemon := Daemon{
+		Address:           "127.0.0.1",
+		UDPPort:           1,
+		Forwarders:        []string{fastAddr, slowAddr, deadAddr},
+		ForwarderMode:     ForwarderModeFastest,
+		ResponseCacheSize: -1,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Fastest-first mode retries a failed query with the next forwarder
+	for i := 0; i < 10; i++ {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); len(resp) == 0 {
+			t.Fatal(i)
+		}
+	}
+	// After each forwarder has been tried, the fastest one answers all subsequent queries
+	fastBefore, slowBefore := atomic.LoadInt32(&numFastQueries), atomic.LoadInt32(&numSlowQueries)
+	if fastBefore == 0 {
+		t.Fatal(fastBefore)
+	}
+	for i := 0; i < 10; i++ {
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); getAnswerTTL(t, resp) != 100 {
+			t.Fatal(resp)
+		}
+	}
+	if atomic.LoadInt32(&numFastQueries) != fastBefore+10 || atomic.LoadInt32(&numSlowQueries) != slowBefore {
+		t.Fatal(numFastQueries, numSlowQueries)
+	}
+}
+
+func TestDaemon_ForwarderModeRace(t *testing.T) {
+	var numFastQueries, numSlowQueries int32
+	fastAddr, stopFast := startStubResolver(t, 100, 0, &numFastQueries)
+	defer stopFast()
+	slowAddr, stopSlow := startStubResolver(t, 200, 300*time.Millisecond, &numSlowQueries)
+	defer stopSlow()
+	deadAddr := getDeadResolverAddr(t)
+
+	daemon := Daemon{
+		Address:           "127.0.0.1",
+		UDPPort:           1,
+		Forwarders:        []string{slowAddr, deadAddr, fastAddr},
+		ForwarderMode:     ForwarderModeRace,
+		ResponseCacheSize: -1,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// All three forwarders are queried in parallel, the fast one wins each race.
+	for i := 0; i < 5; i++ {
+		begin := time.Now()
+		if _, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", makeTestQuery(1, "example.com", typeA)); getAnswerTTL(t, resp) != 100 {
+			t.Fatal(resp)
+		}
+		if elapsed := time.Since(begin); elapsed > 200*time.Millisecond {
+			t.Fatal(elapsed)
+		}
+	}
+	if atomic.LoadInt32(&numFastQueries) != 5 {
+		t.Fatal(numFastQueries)
+	}
+	// The slow forwarder still finishes its round trips and gets a fair health record
+	time.Sleep(500 * time.Millisecond)
+	for _, health := range daemon.GetForwarderHealth() {
+		if health.Address == slowAddr && (health.NumQueries != 5 || health.AvgLatency < 300*time.Millisecond) {
+			t.Fatalf("%+v", health)
+		}
+	}
+}
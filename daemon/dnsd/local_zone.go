@@ -0,0 +1,394 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLocalZoneTTL  = 300 // DefaultLocalZoneTTL is the TTL of local zone records that do not specify their own TTL
+	maxLocalCNAMEChain   = 8   // maxLocalCNAMEChain is the maximum number of local CNAME records to follow for an answer
+	maxTextStringLength  = 255 // maxTextStringLength is the maximum length of a single character-string in TXT record
+	localZoneSOARefresh  = 3600
+	localZoneSOARetry    = 600
+	localZoneSOAExpire   = 86400
+	localZoneDefaultMail = "hostmaster"
+)
+
+// LocalRecord is a resource record of a local zone, written in the same notation as a BIND zone file.
+type LocalRecord struct {
+	Name  string `json:"Name"`  // Name is relative to zone name unless it ends with a full-stop, "@" is the zone name itself.
+	Type  string `json:"Type"`  // Type is one of A, AAAA, CNAME, TXT, MX, SRV, PTR.
+	Value string `json:"Value"` // Value is the record data, e.g. "192.168.1.2", "10 mail", or "10 5 5060 sip" (SRV).
+	TTL   int    `json:"TTL"`   // TTL is the record's time-to-live in seconds, it defaults to zone's TTL.
+}
+
+/*
+LocalZone is a DNS zone answered authoritatively by the DNS daemon, such as the host names of a home network. The zone
+records may come from the configuration, a hosts file, and a BIND-style zone file.
+*/
+type LocalZone struct {
+	Name          string        `json:"Name"`          // Name is the domain name of the zone, e.g. "home.lan" or "1.168.192.in-addr.arpa".
+	TTL           int           `json:"TTL"`           // TTL is the default time-to-live of the zone records.
+	Records       []LocalRecord `json:"Records"`       // Records are the zone records specified in configuration.
+	HostsFilePath string        `json:"HostsFilePath"` // HostsFilePath is an optional hosts file that supplies A and AAAA records.
+	ZoneFilePath  string        `json:"ZoneFilePath"`  // ZoneFilePath is an optional BIND-style zone file that supplies records.
+}
+
+// localRR is a resource record of a local zone that is ready to go into a response.
+type localRR struct {
+	Type   uint16
+	TTL    uint32
+	RData  []byte
+	Target string // Target is the canonical name of CNAME record, it is empty for other types.
+}
+
+// localZoneData is the compiled form of a local zone.
+type localZoneData struct {
+	apex    string
+	soa     localRR
+	records map[string][]localRR
+}
+
+// getAbsoluteName turns a name written in zone file notation into a fully qualified name in lower case, without the trailing full-stop.
+func getAbsoluteName(name, origin string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	default:
+		return name + "." + origin
+	}
+}
+
+// isInZone returns true only if the name is the zone apex or a name underneath it.
+func isInZone(name, apex string) bool {
+	return name == apex || strings.HasSuffix(name, "."+apex)
+}
+
+// parseUint16 parses a 16-bit unsigned integer from record data.
+func parseUint16(rrType, field string) (uint16, error) {
+	i, err := strconv.ParseUint(field, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%s record has a malformed number \"%s\"", rrType, field)
+	}
+	return uint16(i), nil
+}
+
+/*
+makeLocalRR converts record type and data fields written in zone file notation into a resource record. For TXT record,
+each field becomes a character-string of its own.
+*/
+func makeLocalRR(rrType string, fields []string, origin string, ttl uint32) (rr localRR, err error) {
+	rr.TTL = ttl
+	rrType = strings.ToUpper(rrType)
+	wantFields := map[string]int{"A": 1, "AAAA": 1, "CNAME": 1, "PTR": 1, "NS": 1, "MX": 2, "SRV": 4, "SOA": 7}
+	if want, exists := wantFields[rrType]; exists && len(fields) != want {
+		return rr, fmt.Errorf("%s record must have %d value fields, got %d", rrType, want, len(fields))
+	}
+	switch rrType {
+	case "A":
+		ip := net.ParseIP(fields[0]).To4()
+		if ip == nil {
+			return rr, fmt.Errorf("A record has a malformed IPv4 address \"%s\"", fields[0])
+		}
+		rr.Type, rr.RData = typeA, ip
+	case "AAAA":
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return rr, fmt.Errorf("AAAA record has a malformed IPv6 address \"%s\"", fields[0])
+		}
+		rr.Type, rr.RData = typeAAAA, ip.To16()
+	case "CNAME":
+		rr.Type, rr.Target = typeCNAME, getAbsoluteName(fields[0], origin)
+		rr.RData = encodeName(rr.Target)
+	case "PTR":
+		rr.Type, rr.RData = typePTR, encodeName(getAbsoluteName(fields[0], origin))
+	case "NS":
+		rr.Type, rr.RData = typeNS, encodeName(getAbsoluteName(fields[0], origin))
+	case "MX":
+		preference, err := parseUint16(rrType, fields[0])
+		if err != nil {
+			return rr, err
+		}
+		rr.Type = typeMX
+		rr.RData = append([]byte{byte(preference >> 8), byte(preference)}, encodeName(getAbsoluteName(fields[1], origin))...)
+	case "SRV":
+		rr.Type = typeSRV
+		rr.RData = make([]byte, 0, 32)
+		// Priority, weight, and port
+		for _, field := range fields[:3] {
+			num, err := parseUint16(rrType, field)
+			if err != nil {
+				return rr, err
+			}
+			rr.RData = append(rr.RData, byte(num>>8), byte(num))
+		}
+		rr.RData = append(rr.RData, encodeName(getAbsoluteName(fields[3], origin))...)
+	case "TXT":
+		if len(fields) == 0 {
+			return rr, fmt.Errorf("TXT record must have at least one value field")
+		}
+		rr.Type = typeTXT
+		for _, text := range fields {
+			// Long text is split into several character-strings
+			for {
+				chunk := text
+				if len(chunk) > maxTextStringLength {
+					chunk = chunk[:maxTextStringLength]
+				}
+				rr.RData = append(rr.RData, byte(len(chunk)))
+				rr.RData = append(rr.RData, chunk...)
+				if text = text[len(chunk):]; text == "" {
+					break
+				}
+			}
+		}
+	case "SOA":
+		rr.Type = typeSOA
+		rr.RData = append(encodeName(getAbsoluteName(fields[0], origin)), encodeName(getAbsoluteName(fields[1], origin))...)
+		// Serial, refresh, retry, expire, and minimum
+		for _, field := range fields[2:] {
+			num, err := parseTTL(field)
+			if err != nil {
+				return rr, fmt.Errorf("SOA record has a malformed number \"%s\"", field)
+			}
+			rr.RData = append(rr.RData, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(rr.RData[len(rr.RData)-4:], num)
+		}
+	default:
+		return rr, fmt.Errorf("record type \"%s\" is not supported", rrType)
+	}
+	if len(rr.RData) > 65535 {
+		return rr, fmt.Errorf("%s record data is too long", rrType)
+	}
+	return rr, nil
+}
+
+// parseHostsFile reads A and AAAA records from hosts file content. Host names that are not underneath the zone name are placed underneath it.
+func parseHostsFile(content, apex string, ttl uint32) (records map[string][]localRR) {
+	records = make(map[string][]localRR)
+	for _, line := range strings.Split(content, "\n") {
+		if commentIndex := strings.IndexByte(line, '#'); commentIndex >= 0 {
+			line = line[:commentIndex]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		rrType := "A"
+		if strings.ContainsRune(fields[0], ':') {
+			rrType = "AAAA"
+		}
+		rr, err := makeLocalRR(rrType, fields[:1], apex, ttl)
+		if err != nil {
+			continue
+		}
+		for _, hostName := range fields[1:] {
+			name := strings.ToLower(strings.TrimSuffix(hostName, "."))
+			if !isInZone(name, apex) {
+				name = name + "." + apex
+			}
+			records[name] = append(records[name], rr)
+		}
+	}
+	return
+}
+
+// compileLocalZone reads the local zone records from configuration and files, and returns their compiled form.
+func compileLocalZone(zone LocalZone) (*localZoneData, error) {
+	apex := getAbsoluteName(zone.Name, "")
+	if apex == "" {
+		return nil, fmt.Errorf("local zone name must not be empty")
+	}
+	ttl := uint32(DefaultLocalZoneTTL)
+	if zone.TTL > 0 {
+		ttl = uint32(zone.TTL)
+	}
+	data := &localZoneData{apex: apex, records: make(map[string][]localRR)}
+	if zone.HostsFilePath != "" {
+		content, err := ioutil.ReadFile(zone.HostsFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("local zone %s: failed to read hosts file - %v", apex, err)
+		}
+		for name, rrs := range parseHostsFile(string(content), apex, ttl) {
+			data.records[name] = append(data.records[name], rrs...)
+		}
+	}
+	if zone.ZoneFilePath != "" {
+		content, err := ioutil.ReadFile(zone.ZoneFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("local zone %s: failed to read zone file - %v", apex, err)
+		}
+		records, err := parseZoneFile(string(content), apex, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("local zone %s: %v", apex, err)
+		}
+		for name, rrs := range records {
+			data.records[name] = append(data.records[name], rrs...)
+		}
+	}
+	for _, record := range zone.Records {
+		recordTTL := ttl
+		if record.TTL > 0 {
+			recordTTL = uint32(record.TTL)
+		}
+		fields := []string{record.Value}
+		if !strings.EqualFold(record.Type, "TXT") {
+			fields = strings.Fields(record.Value)
+		}
+		rr, err := makeLocalRR(record.Type, fields, apex, recordTTL)
+		if err != nil {
+			return nil, fmt.Errorf("local zone %s: record %s - %v", apex, record.Name, err)
+		}
+		name := getAbsoluteName(record.Name, apex)
+		data.records[name] = append(data.records[name], rr)
+	}
+	for name, rrs := range data.records {
+		if !isInZone(name, apex) {
+			return nil, fmt.Errorf("local zone %s: record %s does not belong to the zone", apex, name)
+		}
+		for _, rr := range rrs {
+			if rr.Type == typeCNAME && len(rrs) > 1 {
+				return nil, fmt.Errorf("local zone %s: CNAME record %s must not coexist with other records", apex, name)
+			}
+		}
+	}
+	// The SOA record is necessary for negative answers, make one up if the zone does not come with it.
+	for _, rr := range data.records[apex] {
+		if rr.Type == typeSOA {
+			data.soa = rr
+		}
+	}
+	if data.soa.Type == 0 {
+		soa, err := makeLocalRR("SOA", []string{"@", localZoneDefaultMail, strconv.FormatInt(time.Now().Unix(), 10),
+			strconv.Itoa(localZoneSOARefresh), strconv.Itoa(localZoneSOARetry), strconv.Itoa(localZoneSOAExpire), strconv.Itoa(int(ttl))}, apex, ttl)
+		if err != nil {
+			return nil, err
+		}
+		data.soa = soa
+		data.records[apex] = append(data.records[apex], soa)
+	}
+	return data, nil
+}
+
+// compileLocalZones compiles all local zones and sorts them from the longest zone name to the shortest.
+func compileLocalZones(zones []LocalZone) ([]*localZoneData, error) {
+	compiled := make([]*localZoneData, 0, len(zones))
+	for _, zone := range zones {
+		data, err := compileLocalZone(zone)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, data)
+	}
+	// The most specific zone answers a name that belongs to nested zones
+	sort.Slice(compiled, func(i, j int) bool {
+		return len(compiled[i].apex) > len(compiled[j].apex)
+	})
+	return compiled, nil
+}
+
+// findLocalZone returns the most specific local zone that the name belongs to, or nil if there is none.
+func (daemon *Daemon) findLocalZone(name string) *localZoneData {
+	for _, zone := range daemon.localZones {
+		if isInZone(name, zone.apex) {
+			return zone
+		}
+	}
+	return nil
+}
+
+/*
+answerLocalZones returns an authoritative response (without length prefix) to the query if the queried name belongs to a
+local zone, or nil if the query should be handled by other means.
+*/
+func (daemon *Daemon) answerLocalZones(query []byte) []byte {
+	if len(daemon.localZones) == 0 {
+		return nil
+	}
+	msg, err := parseMessage(query)
+	if err != nil || msg.IsResponse() || len(msg.Question) != 1 || msg.Question[0].Class != classIN {
+		return nil
+	}
+	q := msg.Question[0]
+	zone := daemon.findLocalZone(q.Name)
+	if zone == nil {
+		return nil
+	}
+	questionSection := getQuestionSection(query)
+	if questionSection == nil {
+		return nil
+	}
+	resp := make([]byte, len(questionSection), len(questionSection)+256)
+	copy(resp, questionSection)
+	// Response, authoritative, copy opcode and recursion desired, recursion available.
+	resp[2] = 0x80 | 0x04 | (query[2] & 0x79)
+	resp[3] = 0x80
+	for i := 6; i < dnsHeaderSize; i++ {
+		resp[i] = 0
+	}
+	var numAnswers, numAuthority uint16
+	// Follow CNAME records that lead to other names of local zones
+	name, owner := q.Name, []byte{0xc0, dnsHeaderSize}
+	for chain := 0; chain < maxLocalCNAMEChain; chain++ {
+		rrs, exists := zone.records[name]
+		if !exists {
+			if numAnswers == 0 && !zone.hasNamesUnder(name) {
+				resp[3] |= rcodeNXDomain
+			}
+			break
+		}
+		var target string
+		for _, rr := range rrs {
+			if rr.Type == q.Type || q.Type == typeANY || rr.Type == typeCNAME {
+				resp = appendResourceRecord(resp, owner, rr.Type, classIN, rr.TTL, rr.RData)
+				numAnswers++
+				target = rr.Target
+			}
+		}
+		if target == "" || q.Type == typeCNAME || q.Type == typeANY {
+			break
+		}
+		if zone = daemon.findLocalZone(target); zone == nil {
+			// The client shall resolve the canonical name by itself
+			break
+		}
+		name, owner = target, encodeName(target)
+	}
+	if numAnswers == 0 {
+		// Negative answer carries the zone's SOA record
+		resp = appendResourceRecord(resp, encodeName(zone.apex), typeSOA, classIN, zone.soa.TTL, zone.soa.RData)
+		numAuthority++
+	}
+	binary.BigEndian.PutUint16(resp[6:], numAnswers)
+	binary.BigEndian.PutUint16(resp[8:], numAuthority)
+	// Respond with an OPT record if the client uses EDNS
+	for _, rr := range msg.Additional {
+		if rr.Type == typeOPT {
+			resp = withOPT(resp, &ednsOPT{UDPPayloadSize: ednsPayloadSize, ExtendedFlags: rr.TTL & ednsFlagDO})
+			break
+		}
+	}
+	return resp
+}
+
+// hasNamesUnder returns true only if the zone has records underneath the name, which makes the name an empty non-terminal.
+func (zone *localZoneData) hasNamesUnder(name string) bool {
+	for recordName := range zone.records {
+		if strings.HasSuffix(recordName, "."+name) {
+			return true
+		}
+	}
+	return false
+}
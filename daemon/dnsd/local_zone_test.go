@@ -0,0 +1,257 @@
+package dnsd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleZoneFile = `$ORIGIN home.lan.
+$TTL 1h
+@	IN	SOA	ns1 admin.home.lan. (
+		2020010101 ; serial
+		7200       ; refresh
+		3600       ; retry
+		1209600    ; expire
+		60 )       ; minimum
+	IN	NS	ns1
+	IN	MX	10 mail
+ns1	IN	A	192.168.1.1
+mail	600	IN	A	192.168.1.2
+	IN	600	AAAA	fd00::2
+www	CNAME	nas
+notes	TXT	"hello world" "; not a comment"
+_sip._tcp	SRV	10 5 5060 sip.example.com.
+$ORIGIN sub.home.lan.
+printer	A	192.168.1.9
+`
+
+func TestParseTTL(t *testing.T) {
+	for value, expected := range map[string]uint32{"0": 0, "3600": 3600, "1h": 3600, "1h30m": 5400, "1W2D": 777600, "10s": 10} {
+		if ttl, err := parseTTL(value); err != nil || ttl != expected {
+			t.Fatal(value, ttl, err)
+		}
+	}
+	for _, value := range []string{"", "h", "1x", "1h30", "-1", "99999999999"} {
+		if _, err := parseTTL(value); err == nil {
+			t.Fatal("did not error", value)
+		}
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	records, err := parseZoneFile(sampleZoneFile, "home.lan", DefaultLocalZoneTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	expectedNames := map[string]int{"home.lan": 2, "ns1.home.lan": 1, "mail.home.lan": 2, "www.home.lan": 1, "notes.home.lan": 1, "_sip._tcp.home.lan": 1, "printer.sub.home.lan": 1}
+	if len(records) != len(expectedNames) {
+		t.Fatal(names)
+	}
+	for name, count := range expectedNames {
+		if len(records[name]) != count {
+			t.Fatal(name, records[name])
+		}
+	}
+	// SOA
+	if soa := records["home.lan"][0]; soa.Type != typeSOA || soa.TTL != 3600 || !reflect.DeepEqual(soa.RData[len(soa.RData)-4:], []byte{0, 0, 0, 60}) {
+		t.Fatalf("%+v", soa)
+	}
+	// MX belongs to the previous owner
+	if mx := records["home.lan"][1]; mx.Type != typeMX || !reflect.DeepEqual(mx.RData, append([]byte{0, 10}, encodeName("mail.home.lan")...)) {
+		t.Fatalf("%+v", mx)
+	}
+	// TTL and class in either order
+	if mail := records["mail.home.lan"]; mail[0].TTL != 600 || mail[1].TTL != 600 || mail[1].Type != typeAAAA || len(mail[1].RData) != 16 {
+		t.Fatalf("%+v", mail)
+	}
+	if cname := records["www.home.lan"][0]; cname.Type != typeCNAME || cname.Target != "nas.home.lan" {
+		t.Fatalf("%+v", cname)
+	}
+	if txt := records["notes.home.lan"][0]; txt.Type != typeTXT || string(txt.RData) != "\x0bhello world\x0f; not a comment" {
+		t.Fatalf("%+v", txt)
+	}
+	if srv := records["_sip._tcp.home.lan"][0]; srv.Type != typeSRV || !reflect.DeepEqual(srv.RData, append([]byte{0, 10, 0, 5, 0x13, 0xc4}, encodeName("sip.example.com")...)) {
+		t.Fatalf("%+v", srv)
+	}
+	// Malformed zone files
+	for _, content := range []string{
+		"@ IN SOA ns1 admin ( 1 2 3 4 5",
+		"@ IN SOA ns1 admin 1 2 3 4 5 )",
+		`@ TXT "unterminated`,
+		"$INCLUDE other.zone",
+		"  IN A 192.168.1.1",
+		"@ IN",
+		"@ IN A 1.2.3",
+		"@ IN AAAA 1.2.3.4",
+		"@ IN MX mail",
+		"@ IN MX 99999 mail",
+		"@ IN SRV 1 2 mail",
+		"@ IN HINFO a b",
+	} {
+		if _, err := parseZoneFile(content, "home.lan", DefaultLocalZoneTTL); err == nil {
+			t.Fatal("did not error", content)
+		}
+	}
+}
+
+func TestParseHostsFile(t *testing.T) {
+	records := parseHostsFile(`
+# comment
+192.168.1.10 nas nas.home.lan. # media server
+fd00::10 nas
+not-an-ip bad
+192.168.1.11	laptop.home.lan
+`, "home.lan", 60)
+	if len(records) != 2 || len(records["nas.home.lan"]) != 3 || len(records["laptop.home.lan"]) != 1 {
+		t.Fatalf("%+v", records)
+	}
+	if rr := records["nas.home.lan"][2]; rr.Type != typeAAAA || rr.TTL != 60 {
+		t.Fatalf("%+v", rr)
+	}
+}
+
+func TestLocalZones(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-dnsd-local-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostsFile := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(hostsFile, []byte("192.168.1.10 nas\nfd00::10 nas\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	zoneFile := filepath.Join(dir, "home.lan.zone")
+	if err := ioutil.WriteFile(zoneFile, []byte(sampleZoneFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	daemon := Daemon{
+		Address:    "127.0.0.1",
+		UDPPort:    36712,
+		TCPPort:    36713,
+		PerIPLimit: 100,
+		// Unreachable forwarder ensures that local zones do not rely on forwarders
+		Forwarders: []string{"127.0.0.1:9"},
+		LocalZones: []LocalZone{
+			{
+				Name:          "home.lan",
+				HostsFilePath: hostsFile,
+				ZoneFilePath:  zoneFile,
+				Records: []LocalRecord{
+					{Name: "alias", Type: "CNAME", Value: "www"},
+					{Name: "external", Type: "CNAME", Value: "example.com."},
+					{Name: "long", Type: "TXT", Value: strings.Repeat("a", 600)},
+				},
+			},
+			{
+				Name:    "1.168.192.in-addr.arpa",
+				Records: []LocalRecord{{Name: "10", Type: "PTR", Value: "nas.home.lan.", TTL: 30}},
+			},
+		},
+	}
+	// Bad zones do not initialise
+	for _, zone := range []LocalZone{
+		{Name: ""},
+		{Name: "home.lan", HostsFilePath: filepath.Join(dir, "does-not-exist")},
+		{Name: "home.lan", ZoneFilePath: filepath.Join(dir, "does-not-exist")},
+		{Name: "home.lan", Records: []LocalRecord{{Name: "a", Type: "A", Value: "1.2.3"}}},
+		{Name: "home.lan", Records: []LocalRecord{{Name: "a.example.com.", Type: "A", Value: "1.2.3.4"}}},
+		{Name: "home.lan", Records: []LocalRecord{{Name: "a", Type: "A", Value: "1.2.3.4"}, {Name: "a", Type: "CNAME", Value: "b"}}},
+	} {
+		badDaemon := Daemon{LocalZones: []LocalZone{zone}}
+		if err := badDaemon.Initialise(); err == nil {
+			t.Fatalf("did not error %+v", zone)
+		}
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Local zone is answered before black list
+	daemon.blackList["nas.home.lan"] = struct{}{}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(1 * time.Second)
+
+	for _, network := range []string{"udp", "tcp"} {
+		port := daemon.UDPPort
+		if network == "tcp" {
+			port = daemon.TCPPort
+		}
+		resolver := &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(network, fmt.Sprintf("127.0.0.1:%d", port))
+			},
+		}
+		ctx := context.Background()
+		if addrs, err := resolver.LookupHost(ctx, "NAS.home.lan."); err != nil || len(addrs) != 2 {
+			t.Fatal(network, addrs, err)
+		}
+		// CNAME records are followed within local zones
+		if addrs, err := resolver.LookupHost(ctx, "alias.home.lan."); err != nil || len(addrs) != 2 {
+			t.Fatal(network, addrs, err)
+		}
+		if cname, err := resolver.LookupCNAME(ctx, "alias.home.lan."); err != nil || cname != "nas.home.lan." {
+			t.Fatal(network, cname, err)
+		}
+		if txt, err := resolver.LookupTXT(ctx, "notes.home.lan."); err != nil || !reflect.DeepEqual(txt, []string{"hello world; not a comment"}) {
+			t.Fatal(network, txt, err)
+		}
+		if mx, err := resolver.LookupMX(ctx, "home.lan."); err != nil || len(mx) != 1 || mx[0].Host != "mail.home.lan." || mx[0].Pref != 10 {
+			t.Fatal(network, mx, err)
+		}
+		if _, srv, err := resolver.LookupSRV(ctx, "sip", "tcp", "home.lan."); err != nil || len(srv) != 1 || srv[0].Target != "sip.example.com." || srv[0].Port != 5060 {
+			t.Fatal(network, srv, err)
+		}
+		if names, err := resolver.LookupAddr(ctx, "192.168.1.10"); err != nil || !reflect.DeepEqual(names, []string{"nas.home.lan."}) {
+			t.Fatal(network, names, err)
+		}
+		// Nested names and non-existent names
+		if addrs, err := resolver.LookupHost(ctx, "printer.sub.home.lan."); err != nil || !reflect.DeepEqual(addrs, []string{"192.168.1.9"}) {
+			t.Fatal(network, addrs, err)
+		}
+		if _, err := resolver.LookupHost(ctx, "does-not-exist.home.lan."); err == nil || !err.(*net.DNSError).IsNotFound {
+			t.Fatal(network, err)
+		}
+		if _, err := resolver.LookupTXT(ctx, "nas.home.lan."); err == nil || !err.(*net.DNSError).IsNotFound {
+			t.Fatal(network, err)
+		}
+	}
+	// A large answer does not fit into a UDP response, the client will have to retry over TCP.
+	query := makeTestQuery(1, "long.home.lan", typeTXT)
+	if resp := daemon.handleUDPLocalZoneQuery("127.0.0.1", query); len(resp) != len(query) || resp[2]&0x02 == 0 {
+		t.Fatal(resp)
+	}
+	queryLen := []byte{0, byte(len(query))}
+	if _, resp := daemon.processTCPQuery("127.0.0.1", queryLen, query); len(resp) < 600 || resp[2]&0x02 != 0 {
+		t.Fatal(resp)
+	}
+	// A canonical name outside of local zones is left for the client to resolve
+	msg, err := parseMessage(daemon.answerLocalZones(makeTestQuery(2, "external.home.lan", typeA)))
+	if err != nil || len(msg.Answer) != 1 || msg.Answer[0].Type != typeCNAME || msg.RCode() != rcodeNoError {
+		t.Fatalf("%+v %v", msg, err)
+	}
+	// Names outside of local zones and disallowed clients are not answered
+	if resp := daemon.answerLocalZones(makeTestQuery(3, "example.com", typeA)); resp != nil {
+		t.Fatal(resp)
+	}
+	if resp := daemon.handleUDPLocalZoneQuery("1.2.3.4", query); len(resp) != 0 {
+		t.Fatal(resp)
+	}
+}
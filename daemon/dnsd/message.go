@@ -0,0 +1,403 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	dnsHeaderSize   = 12  // dnsHeaderSize is the size of DNS message header
+	maxNamePointers = 32  // maxNamePointers limits the number of compression pointers followed while reading a name
+	minUDPPayload   = 512 // minUDPPayload is the maximum response size for UDP clients that do not support EDNS
+	rcodeNoError    = 0   // rcodeNoError is the response code of a successful query
+	rcodeNXDomain   = 3   // rcodeNXDomain is the response code of a query made against non-existent domain name
+	typeA           = 1   // typeA is the type number of IPv4 address record
+	typeNS          = 2   // typeNS is the type number of name server record
+	typeCNAME       = 5   // typeCNAME is the type number of canonical name record
+	typeSOA         = 6   // typeSOA is the type number of start-of-authority resource record
+	typePTR         = 12  // typePTR is the type number of pointer record
+	typeMX          = 15  // typeMX is the type number of mail exchange record
+	typeTXT         = 16  // typeTXT is the type number of text record
+	typeAAAA        = 28  // typeAAAA is the type number of IPv6 address record
+	typeSRV         = 33  // typeSRV is the type number of service locator record
+	typeOPT         = 41  // typeOPT is the type number of EDNS0 OPT pseudo resource record
+	typeANY         = 255 // typeANY is the query type that asks for all records of a name
+	classIN         = 1   // classIN is the Internet class
+)
+
+const (
+	ednsPayloadSize = 1232   // ednsPayloadSize is the UDP payload size advertised to forwarders and EDNS clients, as recommended by DNS flag day 2020.
+	ednsFlagDO      = 0x8000 // ednsFlagDO is the DNSSEC OK bit among the extended flags in the TTL field of OPT record
+	ednsOptionECS   = 8      // ednsOptionECS is the option code of EDNS client subnet
+)
+
+var errMalformedMessage = errors.New("malformed DNS message")
+
+// dnsQuestion is the question section entry of a DNS message.
+type dnsQuestion struct {
+	Name  string // Name is the queried name in lower case without the trailing full-stop
+	Type  uint16
+	Class uint16
+}
+
+// dnsResourceRecord describes the location and properties of a resource record in a DNS message.
+type dnsResourceRecord struct {
+	Offset    int // Offset is the position of the record's owner name in the message
+	Type      uint16
+	Class     uint16
+	TTL       uint32
+	TTLOffset int // TTLOffset is the position of the 4-byte TTL field in the message
+	RDataOff  int // RDataOff is the position of record data in the message
+	RDataLen  int
+}
+
+// dnsMessage is a shallowly parsed DNS message, it refers to the original packet for record data.
+type dnsMessage struct {
+	ID         uint16
+	Flags      uint16
+	Question   []dnsQuestion
+	Answer     []dnsResourceRecord
+	Authority  []dnsResourceRecord
+	Additional []dnsResourceRecord
+}
+
+// IsResponse returns true only if the message is a response.
+func (msg *dnsMessage) IsResponse() bool {
+	return msg.Flags&0x8000 != 0
+}
+
+// IsTruncated returns true only if the message has the TC (truncated) bit set.
+func (msg *dnsMessage) IsTruncated() bool {
+	return msg.Flags&0x0200 != 0
+}
+
+// IsDNSSECOK returns true only if the message carries an EDNS0 OPT record with the DO (DNSSEC OK) bit set.
+func (msg *dnsMessage) IsDNSSECOK() bool {
+	for _, rr := range msg.Additional {
+		if rr.Type == typeOPT {
+			return rr.TTL&ednsFlagDO != 0
+		}
+	}
+	return false
+}
+
+// RCode returns the 4-bit response code from message header.
+func (msg *dnsMessage) RCode() int {
+	return int(msg.Flags & 0x000f)
+}
+
+/*
+readName reads a domain name starting at the offset, following compression pointers if necessary. It returns the name in
+lower case without the trailing full-stop, and the offset of the byte that follows the name in its original position.
+*/
+func readName(packet []byte, offset int) (name string, next int, err error) {
+	var labels []string
+	next = -1
+	for pointers := 0; ; {
+		if offset >= len(packet) {
+			return "", 0, errMalformedMessage
+		}
+		labelLen := int(packet[offset])
+		switch {
+		case labelLen == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case labelLen&0xc0 == 0xc0:
+			if offset+1 >= len(packet) {
+				return "", 0, errMalformedMessage
+			}
+			if pointers++; pointers > maxNamePointers {
+				return "", 0, errMalformedMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(packet[offset:]) & 0x3fff)
+		case labelLen&0xc0 != 0:
+			// Extended label types are obsolete
+			return "", 0, errMalformedMessage
+		default:
+			if offset+1+labelLen > len(packet) {
+				return "", 0, errMalformedMessage
+			}
+			labels = append(labels, string(packet[offset+1:offset+1+labelLen]))
+			offset += 1 + labelLen
+		}
+	}
+}
+
+// readResourceRecords reads a number of resource records starting at the offset.
+func readResourceRecords(packet []byte, offset, count int) (records []dnsResourceRecord, next int, err error) {
+	records = make([]dnsResourceRecord, 0, count)
+	for i := 0; i < count; i++ {
+		recordOffset := offset
+		if _, offset, err = readName(packet, offset); err != nil {
+			return
+		}
+		if offset+10 > len(packet) {
+			return nil, 0, errMalformedMessage
+		}
+		rr := dnsResourceRecord{
+			Offset:    recordOffset,
+			Type:      binary.BigEndian.Uint16(packet[offset:]),
+			Class:     binary.BigEndian.Uint16(packet[offset+2:]),
+			TTL:       binary.BigEndian.Uint32(packet[offset+4:]),
+			TTLOffset: offset + 4,
+			RDataLen:  int(binary.BigEndian.Uint16(packet[offset+8:])),
+			RDataOff:  offset + 10,
+		}
+		if rr.RDataOff+rr.RDataLen > len(packet) {
+			return nil, 0, errMalformedMessage
+		}
+		records = append(records, rr)
+		offset = rr.RDataOff + rr.RDataLen
+	}
+	return records, offset, nil
+}
+
+// parseMessage parses the header, question section, and resource record locations of a DNS message.
+func parseMessage(packet []byte) (msg dnsMessage, err error) {
+	if len(packet) < dnsHeaderSize {
+		return msg, errMalformedMessage
+	}
+	msg.ID = binary.BigEndian.Uint16(packet[0:])
+	msg.Flags = binary.BigEndian.Uint16(packet[2:])
+	qdCount := int(binary.BigEndian.Uint16(packet[4:]))
+	anCount := int(binary.BigEndian.Uint16(packet[6:]))
+	nsCount := int(binary.BigEndian.Uint16(packet[8:]))
+	arCount := int(binary.BigEndian.Uint16(packet[10:]))
+	offset := dnsHeaderSize
+	msg.Question = make([]dnsQuestion, 0, qdCount)
+	for i := 0; i < qdCount; i++ {
+		var q dnsQuestion
+		if q.Name, offset, err = readName(packet, offset); err != nil {
+			return
+		}
+		if offset+4 > len(packet) {
+			return msg, errMalformedMessage
+		}
+		q.Type = binary.BigEndian.Uint16(packet[offset:])
+		q.Class = binary.BigEndian.Uint16(packet[offset+2:])
+		offset += 4
+		msg.Question = append(msg.Question, q)
+	}
+	if msg.Answer, offset, err = readResourceRecords(packet, offset, anCount); err != nil {
+		return
+	}
+	if msg.Authority, offset, err = readResourceRecords(packet, offset, nsCount); err != nil {
+		return
+	}
+	msg.Additional, _, err = readResourceRecords(packet, offset, arCount)
+	return
+}
+
+/*
+getUDPPayloadSize returns the maximum size of response a UDP client is able to receive, as advertised by the EDNS0 OPT
+record of its query. If the client does not use EDNS0, the size will be the classic 512 bytes.
+*/
+func getUDPPayloadSize(query []byte) int {
+	msg, err := parseMessage(query)
+	if err != nil {
+		return minUDPPayload
+	}
+	for _, rr := range msg.Additional {
+		if rr.Type == typeOPT {
+			// The class field of OPT record carries the payload size
+			if size := int(rr.Class); size > MaxPacketSize {
+				return MaxPacketSize
+			} else if size > minUDPPayload {
+				return size
+			}
+			break
+		}
+	}
+	return minUDPPayload
+}
+
+// encodeName encodes a domain name (with or without the trailing full-stop) into uncompressed wire format.
+func encodeName(name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	encoded := make([]byte, 0, len(name)+2)
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			encoded = append(encoded, byte(len(label)))
+			encoded = append(encoded, label...)
+		}
+	}
+	return append(encoded, 0)
+}
+
+// appendResourceRecord appends a resource record to the DNS message. The owner name must already be in wire format.
+func appendResourceRecord(packet, owner []byte, rrType, class uint16, ttl uint32, rData []byte) []byte {
+	packet = append(packet, owner...)
+	packet = append(packet, byte(rrType>>8), byte(rrType), byte(class>>8), byte(class))
+	packet = append(packet, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+	packet = append(packet, byte(len(rData)>>8), byte(len(rData)))
+	return append(packet, rData...)
+}
+
+/*
+getQuestionSection returns the header and question section of a DNS message that carries exactly one question, or nil
+if the message is malformed.
+*/
+func getQuestionSection(packet []byte) []byte {
+	if len(packet) < dnsHeaderSize || binary.BigEndian.Uint16(packet[4:]) != 1 {
+		return nil
+	}
+	_, end, err := readName(packet, dnsHeaderSize)
+	if err != nil || end+4 > len(packet) {
+		return nil
+	}
+	return packet[:end+4]
+}
+
+/*
+makeTruncatedResponse turns a response that is too large for its UDP client into an empty response with the TC
+(truncated) bit set, which tells the client to repeat the query over TCP.
+*/
+func makeTruncatedResponse(response []byte) []byte {
+	question := getQuestionSection(response)
+	if question == nil {
+		return []byte{}
+	}
+	truncated := make([]byte, len(question))
+	copy(truncated, question)
+	truncated[2] |= 0x02
+	// Keep only the question
+	for i := 6; i < dnsHeaderSize; i++ {
+		truncated[i] = 0
+	}
+	// Tell an EDNS client about the payload size even though the response is truncated
+	if opt, err := getOPT(response); err == nil && opt != nil {
+		opt.Options = nil
+		truncated = withOPT(truncated, opt)
+	}
+	return truncated
+}
+
+// ednsOption is an option carried in the record data of EDNS0 OPT record.
+type ednsOption struct {
+	Code uint16
+	Data []byte
+}
+
+// ednsOPT is the content of EDNS0 OPT pseudo resource record, as described in RFC 6891.
+type ednsOPT struct {
+	UDPPayloadSize uint16
+	ExtendedFlags  uint32 // ExtendedFlags are the extended RCODE, version, DO bit, and reserved bits in the TTL field
+	Options        []ednsOption
+}
+
+// IsDNSSECOK returns true only if the DO (DNSSEC OK) bit is set.
+func (opt *ednsOPT) IsDNSSECOK() bool {
+	return opt.ExtendedFlags&ednsFlagDO != 0
+}
+
+// encode returns the OPT record in wire format.
+func (opt *ednsOPT) encode() []byte {
+	rData := make([]byte, 0, 64)
+	for _, option := range opt.Options {
+		rData = append(rData, byte(option.Code>>8), byte(option.Code), byte(len(option.Data)>>8), byte(len(option.Data)))
+		rData = append(rData, option.Data...)
+	}
+	return appendResourceRecord(nil, []byte{0}, typeOPT, opt.UDPPayloadSize, opt.ExtendedFlags, rData)
+}
+
+// getOPT returns the EDNS0 OPT record of the DNS message, or nil if the message does not carry one.
+func getOPT(packet []byte) (*ednsOPT, error) {
+	msg, err := parseMessage(packet)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range msg.Additional {
+		if rr.Type != typeOPT {
+			continue
+		}
+		opt := &ednsOPT{UDPPayloadSize: rr.Class, ExtendedFlags: rr.TTL, Options: make([]ednsOption, 0, 2)}
+		rData := packet[rr.RDataOff : rr.RDataOff+rr.RDataLen]
+		for len(rData) > 0 {
+			if len(rData) < 4 {
+				return nil, errMalformedMessage
+			}
+			optionLen := int(binary.BigEndian.Uint16(rData[2:]))
+			if 4+optionLen > len(rData) {
+				return nil, errMalformedMessage
+			}
+			opt.Options = append(opt.Options, ednsOption{Code: binary.BigEndian.Uint16(rData), Data: rData[4 : 4+optionLen]})
+			rData = rData[4+optionLen:]
+		}
+		return opt, nil
+	}
+	return nil, nil
+}
+
+/*
+withOPT returns a copy of the DNS message with its OPT record replaced by the input record, or removed if the input is
+nil. If the message does not yet carry an OPT record, the input record is appended to the additional section.
+*/
+func withOPT(packet []byte, opt *ednsOPT) []byte {
+	msg, err := parseMessage(packet)
+	if err != nil {
+		return packet
+	}
+	var encoded []byte
+	if opt != nil {
+		encoded = opt.encode()
+	}
+	arCount := binary.BigEndian.Uint16(packet[10:])
+	ret := make([]byte, 0, len(packet)+len(encoded))
+	for _, rr := range msg.Additional {
+		if rr.Type == typeOPT {
+			// Replace the OPT record in-place, the other records remain where they were.
+			ret = append(ret, packet[:rr.Offset]...)
+			ret = append(ret, encoded...)
+			ret = append(ret, packet[rr.RDataOff+rr.RDataLen:]...)
+			if opt == nil {
+				binary.BigEndian.PutUint16(ret[10:], arCount-1)
+			}
+			return ret
+		}
+	}
+	if opt == nil {
+		return append(ret, packet...)
+	}
+	ret = append(ret, packet...)
+	ret = append(ret, encoded...)
+	binary.BigEndian.PutUint16(ret[10:], arCount+1)
+	return ret
+}
+
+/*
+makeForwarderQuery returns the query to be sent to forwarders on behalf of a client. If the client uses EDNS, the
+client subnet option is stripped to protect the client's privacy, and the advertised payload size becomes that of
+laitos, while the DO bit passes through as-is. A query without EDNS is returned as-is.
+*/
+func makeForwarderQuery(query []byte) []byte {
+	opt, err := getOPT(query)
+	if err != nil || opt == nil {
+		return query
+	}
+	options := make([]ednsOption, 0, len(opt.Options))
+	for _, option := range opt.Options {
+		if option.Code != ednsOptionECS {
+			options = append(options, option)
+		}
+	}
+	opt.Options = options
+	opt.UDPPayloadSize = ednsPayloadSize
+	return withOPT(query, opt)
+}
+
+/*
+fitUDPResponse returns the response as-is if it fits in the UDP client's buffer, or a truncated response that tells
+the client to repeat the query over TCP.
+*/
+func fitUDPResponse(query, response []byte) []byte {
+	if len(response) > getUDPPayloadSize(query) {
+		return makeTruncatedResponse(response)
+	}
+	return response
+}
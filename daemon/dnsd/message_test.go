@@ -0,0 +1,249 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// makeTestEDNSQuery returns a query packet that carries an OPT record with the payload size, DO bit, and options.
+func makeTestEDNSQuery(id uint16, name string, qType uint16, payloadSize uint16, dnssecOK bool, options ...ednsOption) []byte {
+	opt := &ednsOPT{UDPPayloadSize: payloadSize, Options: options}
+	if dnssecOK {
+		opt.ExtendedFlags = ednsFlagDO
+	}
+	return withOPT(makeTestQuery(id, name, qType), opt)
+}
+
+var (
+	testECSOption    = ednsOption{Code: ednsOptionECS, Data: []byte{0, 1, 24, 0, 192, 168, 1}}
+	testCookieOption = ednsOption{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+)
+
+func TestEDNS0OPT(t *testing.T) {
+	// Query without EDNS
+	query := makeTestQuery(1, "example.com", typeA)
+	if opt, err := getOPT(query); err != nil || opt != nil {
+		t.Fatal(opt, err)
+	}
+	if forwarderQuery := makeForwarderQuery(query); !bytes.Equal(forwarderQuery, query) {
+		t.Fatal(forwarderQuery)
+	}
+	if withoutOPT := withOPT(query, nil); !bytes.Equal(withoutOPT, query) {
+		t.Fatal(withoutOPT)
+	}
+
+	// Query with EDNS, DO bit, client subnet, and cookie
+	query = makeTestEDNSQuery(1, "example.com", typeA, 4096, true, testECSOption, testCookieOption)
+	msg, err := parseMessage(query)
+	if err != nil || len(msg.Additional) != 1 || !msg.IsDNSSECOK() || getUDPPayloadSize(query) != 4096 {
+		t.Fatal(msg, err)
+	}
+	opt, err := getOPT(query)
+	if err != nil || opt.UDPPayloadSize != 4096 || !opt.IsDNSSECOK() || len(opt.Options) != 2 ||
+		opt.Options[0].Code != ednsOptionECS || !bytes.Equal(opt.Options[1].Data, testCookieOption.Data) {
+		t.Fatalf("%+v %v", opt, err)
+	}
+	// Payload size is capped by the maximum packet size
+	if size := getUDPPayloadSize(makeTestEDNSQuery(1, "example.com", typeA, 65000, false)); size != MaxPacketSize {
+		t.Fatal(size)
+	}
+
+	// Forwarder query does not reveal client subnet, and advertises laitos' own payload size
+	forwarderQuery := makeForwarderQuery(query)
+	if opt, err := getOPT(forwarderQuery); err != nil || opt.UDPPayloadSize != ednsPayloadSize || !opt.IsDNSSECOK() ||
+		len(opt.Options) != 1 || opt.Options[0].Code != testCookieOption.Code {
+		t.Fatalf("%+v %v", opt, err)
+	}
+	if msg, err := parseMessage(forwarderQuery); err != nil || len(msg.Additional) != 1 || msg.Question[0].Name != "example.com" {
+		t.Fatal(msg, err)
+	}
+	// The original query is not modified
+	if opt, _ := getOPT(query); len(opt.Options) != 2 {
+		t.Fatalf("%+v", opt)
+	}
+
+	// Removing the OPT record
+	if withoutOPT := withOPT(query, nil); !bytes.Equal(withoutOPT, makeTestQuery(1, "example.com", typeA)) {
+		t.Fatal(withoutOPT)
+	}
+
+	// Malformed option
+	malformed := makeTestEDNSQuery(1, "example.com", typeA, 4096, false, testCookieOption)
+	binary.BigEndian.PutUint16(malformed[len(malformed)-len(testCookieOption.Data)-2:], 100)
+	if opt, err := getOPT(malformed); err == nil {
+		t.Fatalf("%+v", opt)
+	}
+}
+
+func TestMakeTextResponse_EDNS0(t *testing.T) {
+	getText := func(resp []byte) (string, dnsMessage) {
+		msg, err := parseMessage(resp)
+		if err != nil || len(msg.Answer) != 1 || msg.Answer[0].Type != typeTXT {
+			t.Fatal(msg, err)
+		}
+		return string(resp[msg.Answer[0].RDataOff+1 : msg.Answer[0].RDataOff+msg.Answer[0].RDataLen]), msg
+	}
+	// Without EDNS the response does not carry OPT
+	query := makeTestQuery(1, "_.abcdefgh.0.example.com", typeTXT)
+	text, msg := getText(MakeTextResponse(query, "hello"))
+	if text != "hello" || len(msg.Additional) != 0 || len(msg.Question) != 1 || msg.IsTruncated() {
+		t.Fatal(text, msg)
+	}
+	// With EDNS the response advertises payload size and passes the DO bit through, but not the options.
+	query = makeTestEDNSQuery(1, "_.abcdefgh.0.example.com", typeTXT, 4096, true, testECSOption)
+	resp := MakeTextResponse(query, "hello")
+	text, msg = getText(resp)
+	if opt, err := getOPT(resp); text != "hello" || err != nil || opt.UDPPayloadSize != ednsPayloadSize || !opt.IsDNSSECOK() || len(opt.Options) != 0 {
+		t.Fatalf("%s %+v %v", text, opt, err)
+	}
+	// Non-TXT query does not get a text response
+	if resp := MakeTextResponse(makeTestQuery(1, "example.com", typeA), "hello"); len(resp) != 0 {
+		t.Fatal(resp)
+	}
+
+	// A long name and long text exceed the classic 512 bytes
+	longName := strings.Repeat(strings.Repeat("a", 58)+".", 4) + "example.com"
+	longText := strings.Repeat("b", MaxTextResponseLen)
+	query = makeTestQuery(1, longName, typeTXT)
+	if resp := fitUDPResponse(query, MakeTextResponse(query, longText)); len(resp) > minUDPPayload {
+		t.Fatal(len(resp))
+	} else if msg, err := parseMessage(resp); err != nil || !msg.IsTruncated() || len(msg.Answer) != 0 || msg.Question[0].Name != longName {
+		t.Fatal(msg, err)
+	}
+	// EDNS client receives the response in full
+	query = makeTestEDNSQuery(1, longName, typeTXT, 1232, false)
+	if resp := fitUDPResponse(query, MakeTextResponse(query, longText)); len(resp) <= minUDPPayload {
+		t.Fatal(len(resp))
+	} else if text, msg := getText(resp); text != longText || msg.IsTruncated() {
+		t.Fatal(text)
+	}
+	// EDNS client with a small buffer is told about the payload size in the truncated response
+	query = makeTestEDNSQuery(1, longName, typeTXT, 512, false)
+	if resp := fitUDPResponse(query, MakeTextResponse(query, longText)); len(resp) > minUDPPayload {
+		t.Fatal(len(resp))
+	} else if opt, err := getOPT(resp); err != nil || opt == nil || opt.UDPPayloadSize != ednsPayloadSize {
+		t.Fatalf("%+v %v", opt, err)
+	}
+}
+
+/*
+startLargeResponseForwarder starts a forwarder on localhost that always answers UDP queries with a truncated response,
+and answers TCP queries with a complete response of 40 A records. The latest query received is sent to the channel.
+*/
+func startLargeResponseForwarder(t *testing.T, queries chan<- []byte) (addr string, stop func()) {
+	udpServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpServer, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udpServer.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	makeLargeResponse := func(query []byte) []byte {
+		resp := append([]byte{}, getQuestionSection(query)...)
+		resp[2], resp[3] = 0x81, 0x80
+		binary.BigEndian.PutUint16(resp[6:], 40)
+		resp[10], resp[11] = 0, 0
+		for i := 0; i < 40; i++ {
+			resp = appendResourceRecord(resp, []byte{0xc0, 0x0c}, typeA, classIN, 300, []byte{10, 0, 0, byte(i)})
+		}
+		return resp
+	}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, client, err := udpServer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			queries <- append([]byte{}, buf[:n]...)
+			_, _ = udpServer.WriteToUDP(makeTruncatedResponse(makeLargeResponse(buf[:n])), client)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcpServer.Accept()
+			if err != nil {
+				return
+			}
+			queryLen := make([]byte, 2)
+			if _, err := io.ReadFull(conn, queryLen); err == nil {
+				query := make([]byte, int(queryLen[0])*256+int(queryLen[1]))
+				if _, err := io.ReadFull(conn, query); err == nil {
+					queries <- query
+					resp := makeLargeResponse(query)
+					_, _ = conn.Write(append([]byte{byte(len(resp) / 256), byte(len(resp) % 256)}, resp...))
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	return udpServer.LocalAddr().String(), func() {
+		_ = udpServer.Close()
+		_ = tcpServer.Close()
+	}
+}
+
+func TestDaemon_EDNS0Forwarding(t *testing.T) {
+	queries := make(chan []byte, 100)
+	forwarderAddr, stopForwarder := startLargeResponseForwarder(t, queries)
+	defer stopForwarder()
+	daemon := Daemon{Address: "127.0.0.1", UDPPort: 1, Forwarders: []string{forwarderAddr}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	getForwardedQueries := func() (ret [][]byte) {
+		for {
+			select {
+			case query := <-queries:
+				ret = append(ret, query)
+			default:
+				return
+			}
+		}
+	}
+
+	// The forwarder's truncated UDP response makes laitos repeat the query over TCP, the EDNS client gets the full response.
+	query := makeTestEDNSQuery(1234, "example.com", typeA, 4096, true, testECSOption, testCookieOption)
+	respLen, resp := daemon.handleUDPRecursiveQuery("127.0.0.1", query)
+	msg, err := parseMessage(resp[:respLen])
+	if err != nil || msg.IsTruncated() || len(msg.Answer) != 40 || respLen <= minUDPPayload {
+		t.Fatal(msg, err)
+	}
+	forwarded := getForwardedQueries()
+	if len(forwarded) != 2 {
+		t.Fatal(forwarded)
+	}
+	for _, forwardedQuery := range forwarded {
+		// Client subnet is stripped, DO bit passes through, payload size is that of laitos.
+		if opt, err := getOPT(forwardedQuery); err != nil || !opt.IsDNSSECOK() || opt.UDPPayloadSize != ednsPayloadSize ||
+			len(opt.Options) != 1 || opt.Options[0].Code != testCookieOption.Code {
+			t.Fatalf("%+v %v", opt, err)
+		}
+	}
+
+	// The same response from cache is truncated for a client that does not use EDNS
+	query = makeTestQuery(1235, "example.com", typeA)
+	respLen, resp = daemon.handleUDPRecursiveQuery("127.0.0.1", query)
+	if msg, err := parseMessage(resp[:respLen]); err != nil || !msg.IsTruncated() || len(msg.Answer) != 0 || respLen > minUDPPayload {
+		t.Fatal(msg, err)
+	}
+	// The DO bit is part of cache key, hence this query went to the forwarder rather than the cache.
+	if forwarded := getForwardedQueries(); len(forwarded) != 2 {
+		t.Fatal(forwarded)
+	} else if opt, err := getOPT(forwarded[0]); err != nil || opt != nil {
+		t.Fatal(opt, err)
+	}
+	// The client repeats the query over TCP and receives the response from cache in full
+	respLenBytes, resp := daemon.handleTCPRecursiveQuery("127.0.0.1", []byte{0, byte(len(query))}, query)
+	if msg, err := parseMessage(resp); err != nil || msg.IsTruncated() || len(msg.Answer) != 40 || int(respLenBytes[0])*256+int(respLenBytes[1]) != len(resp) {
+		t.Fatal(msg, err)
+	}
+	if forwarded := getForwardedQueries(); len(forwarded) != 0 {
+		t.Fatal(forwarded)
+	}
+}
@@ -52,30 +52,37 @@ func GetBlackHoleResponse(queryNoLength []byte) []byte {
 	return answerPacket
 }
 
+/*
+MakeTextResponse returns a DNS response packet (without prefix length bytes) that answers the TXT query with the text.
+If the query uses EDNS, the response carries an OPT record that advertises the payload size of laitos and passes the DO
+bit through. The caller is responsible for fitting the response into a UDP client's buffer.
+*/
 func MakeTextResponse(queryNoLength []byte, text string) []byte {
 	if queryNoLength == nil || len(queryNoLength) < MinNameQuerySize {
 		return []byte{}
 	}
-	// Limit response to 254 characters maximum, I am feeling lazy to implement multi-entry reply.
-	if len(text) > 254 {
-		text = text[:254]
+	// Limit response to 254 characters maximum, longer output is paged by the caller.
+	if len(text) > MaxTextResponseLen {
+		text = text[:MaxTextResponseLen]
 	}
-
-	queryMagicIndex := bytes.Index(queryNoLength[MinNameQuerySize:], textQueryMagic)
-	if queryMagicIndex < 0 {
+	question := getQuestionSection(queryNoLength)
+	if question == nil || !bytes.Equal(question[len(question)-len(textQueryMagic):], textQueryMagic) {
 		return []byte{}
 	}
-	// Copy input packet into output packet
-	answerPacket := make([]byte, 0, len(queryNoLength))
-	answerPacket = append(answerPacket, queryNoLength[:MinNameQuerySize+queryMagicIndex+len(textQueryMagic)]...)
+	// Copy input header and question into output packet
+	answerPacket := make([]byte, 0, len(question)+len(text)+32)
+	answerPacket = append(answerPacket, question...)
 
 	// Manipulate response based on the copied input query
 	// Byte 0, 1 - transaction ID already matches that of input query
 	// Byte 2, 3 - standard response, no error.
 	copy(answerPacket[2:4], StandardResponseNoError)
-	// Byte 6, 7 - there is exactly one answer RR
+	// Byte 6, 7 - there is exactly one answer RR, followed by no authority or additional RR.
 	answerPacket[6] = 0
 	answerPacket[7] = 1
+	for i := 8; i < dnsHeaderSize; i++ {
+		answerPacket[i] = 0
+	}
 
 	// Answer entry magic c0 0c
 	answerPacket = append(answerPacket, 0xc0, 0x0c)
@@ -89,10 +96,10 @@ func MakeTextResponse(queryNoLength []byte, text string) []byte {
 	answerPacket = append(answerPacket, byte(len(text)))
 	// Text entry content
 	answerPacket = append(answerPacket, []byte(text)...)
-	// Additional Record from the original packet
-	queryAdditionalRecord := queryNoLength[queryMagicIndex+MinNameQuerySize:]
-	answerPacket = append(answerPacket, queryAdditionalRecord...)
-
+	// Respond to EDNS query with OPT record
+	if queryOPT, err := getOPT(queryNoLength); err == nil && queryOPT != nil {
+		answerPacket = withOPT(answerPacket, &ednsOPT{UDPPayloadSize: ednsPayloadSize, ExtendedFlags: queryOPT.ExtendedFlags & ednsFlagDO})
+	}
 	return answerPacket
 }
 
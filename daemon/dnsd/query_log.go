@@ -0,0 +1,253 @@
+package dnsd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueryLogSize = 1000 // DefaultQueryLogSize is the number of latest queries to remember when QueryLogSize is left unspecified.
+	QueryStatsTopN      = 10   // QueryStatsTopN is the number of top blocked names, clients, and queried names shown in the stats report.
+	QueryStatsLatestN   = 30   // QueryStatsLatestN is the number of latest queries shown in the stats report.
+)
+
+// The verdicts of DNS queries as recorded in query log.
+const (
+	QueryVerdictBlocked   = "blocked"   // QueryVerdictBlocked is the verdict of a black-listed name answered with black hole.
+	QueryVerdictForwarded = "forwarded" // QueryVerdictForwarded is the verdict of a query answered by a forwarder or the response cache.
+	QueryVerdictLocal     = "local"     // QueryVerdictLocal is the verdict of a query answered from a local zone.
+	QueryVerdictCommand   = "command"   // QueryVerdictCommand is the verdict of a TXT query that executed a toolbox command.
+	QueryVerdictRefused   = "refused"   // QueryVerdictRefused is the verdict of a query made by a client IP that is not allowed to query.
+)
+
+// QueryLogEntry describes a query processed by the DNS daemon.
+type QueryLogEntry struct {
+	Time     time.Time
+	ClientIP string
+	Name     string // Name is the queried name, it is left empty for toolbox commands to avoid revealing the password PIN.
+	Type     uint16
+	Verdict  string
+	Latency  time.Duration
+}
+
+// QueryCount is the number of queries made by a client or made against a name.
+type QueryCount struct {
+	Key   string
+	Count int
+}
+
+// QueryStats summarises the queries in a query log.
+type QueryStats struct {
+	NumQueries      int
+	Since           time.Time      // Since is the time of the oldest query in the log.
+	VerdictCounts   map[string]int // VerdictCounts is the number of queries of each verdict.
+	TopBlockedNames []QueryCount
+	TopClients      []QueryCount
+	TopNames        []QueryCount
+}
+
+// QueryLog remembers a fixed number of latest DNS queries. Methods of a nil QueryLog do nothing.
+type QueryLog struct {
+	mutex   *sync.Mutex
+	entries []QueryLogEntry
+	next    int  // next is the position where the next entry will be placed
+	full    bool // full is true if the entries have wrapped around
+}
+
+// NewQueryLog constructs a new query log that remembers up to the specified number of latest queries.
+func NewQueryLog(size int) *QueryLog {
+	return &QueryLog{
+		mutex:   new(sync.Mutex),
+		entries: make([]QueryLogEntry, size),
+	}
+}
+
+// Add places a new entry into the log, evicting the oldest entry if the log is full.
+func (queryLog *QueryLog) Add(entry QueryLogEntry) {
+	if queryLog == nil {
+		return
+	}
+	queryLog.mutex.Lock()
+	defer queryLog.mutex.Unlock()
+	queryLog.entries[queryLog.next] = entry
+	if queryLog.next++; queryLog.next == len(queryLog.entries) {
+		queryLog.next = 0
+		queryLog.full = true
+	}
+}
+
+// GetEntries returns a copy of all entries in the log, the oldest entry comes first.
+func (queryLog *QueryLog) GetEntries() []QueryLogEntry {
+	if queryLog == nil {
+		return []QueryLogEntry{}
+	}
+	queryLog.mutex.Lock()
+	defer queryLog.mutex.Unlock()
+	if !queryLog.full {
+		ret := make([]QueryLogEntry, queryLog.next)
+		copy(ret, queryLog.entries[:queryLog.next])
+		return ret
+	}
+	ret := make([]QueryLogEntry, 0, len(queryLog.entries))
+	ret = append(ret, queryLog.entries[queryLog.next:]...)
+	return append(ret, queryLog.entries[:queryLog.next]...)
+}
+
+// GetStats summarises the queries in the log, with up to topN entries in each of the top lists.
+func (queryLog *QueryLog) GetStats(topN int) QueryStats {
+	entries := queryLog.GetEntries()
+	stats := QueryStats{NumQueries: len(entries), VerdictCounts: make(map[string]int)}
+	if len(entries) > 0 {
+		stats.Since = entries[0].Time
+	}
+	blockedNames := make(map[string]int)
+	clients := make(map[string]int)
+	names := make(map[string]int)
+	for _, entry := range entries {
+		stats.VerdictCounts[entry.Verdict]++
+		clients[entry.ClientIP]++
+		if entry.Name != "" {
+			names[entry.Name]++
+			if entry.Verdict == QueryVerdictBlocked {
+				blockedNames[entry.Name]++
+			}
+		}
+	}
+	stats.TopBlockedNames = getTopQueryCounts(blockedNames, topN)
+	stats.TopClients = getTopQueryCounts(clients, topN)
+	stats.TopNames = getTopQueryCounts(names, topN)
+	return stats
+}
+
+// getTopQueryCounts returns up to topN keys with the highest counts, ties are broken by key in alphabetical order.
+func getTopQueryCounts(counts map[string]int, topN int) []QueryCount {
+	ret := make([]QueryCount, 0, len(counts))
+	for key, count := range counts {
+		ret = append(ret, QueryCount{Key: key, Count: count})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].Key < ret[j].Key
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	if len(ret) > topN {
+		ret = ret[:topN]
+	}
+	return ret
+}
+
+// getTypeName returns the mnemonic of a query type, such as "AAAA".
+func getTypeName(qType uint16) string {
+	switch qType {
+	case typeA:
+		return "A"
+	case typeNS:
+		return "NS"
+	case typeCNAME:
+		return "CNAME"
+	case typeSOA:
+		return "SOA"
+	case typePTR:
+		return "PTR"
+	case typeMX:
+		return "MX"
+	case typeTXT:
+		return "TXT"
+	case typeAAAA:
+		return "AAAA"
+	case typeSRV:
+		return "SRV"
+	case typeANY:
+		return "ANY"
+	}
+	return "TYPE" + strconv.Itoa(int(qType))
+}
+
+/*
+logQuery records a processed query in the query log. If the query carries a toolbox command, the queried name is not
+recorded because it contains the password PIN.
+*/
+func (daemon *Daemon) logQuery(clientIP string, queryBody []byte, verdict string, beginTime time.Time) {
+	if daemon.queryLog == nil {
+		return
+	}
+	entry := QueryLogEntry{Time: beginTime, ClientIP: clientIP, Verdict: verdict, Latency: time.Since(beginTime)}
+	if msg, err := parseMessage(queryBody); err == nil && len(msg.Question) > 0 {
+		entry.Name = msg.Question[0].Name
+		entry.Type = msg.Question[0].Type
+	}
+	if entry.Type == typeTXT && len(DecodeDTMFCommandInput(ExtractTextQueryInput(queryBody))) > 1 {
+		entry.Name = ""
+	}
+	daemon.queryLog.Add(entry)
+}
+
+/*
+GetQueryStatsReport returns a human-readable report of recent queries - the number of queries of each verdict, top
+blocked names, top clients, top queried names, the refresh status of blacklist sources, the health of forwarders, and
+the latest queries.
+*/
+func (daemon *Daemon) GetQueryStatsReport() string {
+	var buf bytes.Buffer
+	if daemon.queryLog == nil {
+		buf.WriteString("Query log is disabled.\n")
+	} else {
+		stats := daemon.queryLog.GetStats(QueryStatsTopN)
+		buf.WriteString(fmt.Sprintf("Queries: %d since %s\n", stats.NumQueries, stats.Since.Format(time.RFC3339)))
+		buf.WriteString("Verdicts:")
+		for _, verdict := range []string{QueryVerdictForwarded, QueryVerdictBlocked, QueryVerdictLocal, QueryVerdictCommand, QueryVerdictRefused} {
+			buf.WriteString(fmt.Sprintf(" %s %d", verdict, stats.VerdictCounts[verdict]))
+		}
+		buf.WriteRune('\n')
+		for _, top := range []struct {
+			title  string
+			counts []QueryCount
+		}{
+			{"Top blocked names", stats.TopBlockedNames},
+			{"Top clients", stats.TopClients},
+			{"Top queried names", stats.TopNames},
+		} {
+			buf.WriteString("\n" + top.title + ":\n")
+			for _, count := range top.counts {
+				buf.WriteString(fmt.Sprintf("%d\t%s\n", count.Count, count.Key))
+			}
+		}
+	}
+	buf.WriteString("\nBlacklist sources:\n")
+	for _, report := range daemon.GetBlacklistSourceReport() {
+		lastRefresh := "never"
+		if !report.LastRefresh.IsZero() {
+			lastRefresh = report.LastRefresh.Format(time.RFC3339)
+		}
+		buf.WriteString(fmt.Sprintf("%s\t%d names, last refreshed %s", report.Source, report.NumNames, lastRefresh))
+		if report.LastError != "" {
+			buf.WriteString(", latest refresh failed - " + report.LastError)
+		}
+		buf.WriteRune('\n')
+	}
+	buf.WriteString("\nForwarders:\n")
+	for _, health := range daemon.GetForwarderHealth() {
+		buf.WriteString(fmt.Sprintf("%s\tavg latency %s, failure rate %.2f, %d queries, %d failures", health.Address,
+			health.AvgLatency.Round(time.Millisecond), health.FailureRate, health.NumQueries, health.NumFailures))
+		if health.IsEjected() {
+			buf.WriteString(", ejected until " + health.EjectedUntil.Format(time.RFC3339))
+		}
+		buf.WriteRune('\n')
+	}
+	if daemon.queryLog != nil {
+		buf.WriteString("\nLatest queries:\n")
+		entries := daemon.queryLog.GetEntries()
+		// Latest query comes first
+		for i := len(entries) - 1; i >= 0 && i >= len(entries)-QueryStatsLatestN; i-- {
+			entry := entries[i]
+			buf.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.ClientIP,
+				getTypeName(entry.Type), entry.Name, entry.Verdict, entry.Latency.Round(time.Millisecond)))
+		}
+	}
+	return buf.String()
+}
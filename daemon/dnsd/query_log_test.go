@@ -0,0 +1,130 @@
+package dnsd
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	var nilLog *QueryLog
+	nilLog.Add(QueryLogEntry{})
+	if entries := nilLog.GetEntries(); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+
+	queryLog := NewQueryLog(4)
+	if stats := queryLog.GetStats(2); stats.NumQueries != 0 || len(stats.TopClients) != 0 || !stats.Since.IsZero() {
+		t.Fatalf("%+v", stats)
+	}
+	begin := time.Now()
+	for i, entry := range []QueryLogEntry{
+		// The first entry is evicted
+		{ClientIP: "192.168.0.9", Name: "evicted.example.com", Verdict: QueryVerdictBlocked},
+		{ClientIP: "192.168.0.1", Name: "ads.example.com", Verdict: QueryVerdictBlocked},
+		{ClientIP: "192.168.0.2", Name: "ads.example.com", Verdict: QueryVerdictBlocked},
+		{ClientIP: "192.168.0.2", Name: "example.com", Verdict: QueryVerdictForwarded},
+		{ClientIP: "192.168.0.2", Name: "", Verdict: QueryVerdictCommand},
+	} {
+		entry.Time = begin.Add(time.Duration(i) * time.Second)
+		queryLog.Add(entry)
+	}
+	entries := queryLog.GetEntries()
+	if len(entries) != 4 || entries[0].Name != "ads.example.com" || entries[3].Verdict != QueryVerdictCommand {
+		t.Fatalf("%+v", entries)
+	}
+	stats := queryLog.GetStats(2)
+	if stats.NumQueries != 4 || !stats.Since.Equal(begin.Add(1*time.Second)) {
+		t.Fatalf("%+v", stats)
+	}
+	if !reflect.DeepEqual(stats.VerdictCounts, map[string]int{QueryVerdictBlocked: 2, QueryVerdictForwarded: 1, QueryVerdictCommand: 1}) {
+		t.Fatalf("%+v", stats.VerdictCounts)
+	}
+	if !reflect.DeepEqual(stats.TopBlockedNames, []QueryCount{{"ads.example.com", 2}}) {
+		t.Fatalf("%+v", stats.TopBlockedNames)
+	}
+	if !reflect.DeepEqual(stats.TopClients, []QueryCount{{"192.168.0.2", 3}, {"192.168.0.1", 1}}) {
+		t.Fatalf("%+v", stats.TopClients)
+	}
+	if !reflect.DeepEqual(stats.TopNames, []QueryCount{{"ads.example.com", 2}, {"example.com", 1}}) {
+		t.Fatalf("%+v", stats.TopNames)
+	}
+}
+
+func TestDaemon_QueryStats(t *testing.T) {
+	daemon := Daemon{
+		Address:    "127.0.0.1",
+		TCPPort:    36714,
+		Forwarders: []string{"127.0.0.1:9"},
+		LocalZones: []LocalZone{{Name: "home.lan", Records: []LocalRecord{{Name: "nas", Type: "A", Value: "192.168.1.10"}}}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.blackList["ads.example.com"] = struct{}{}
+	for _, query := range []struct {
+		clientIP string
+		name     string
+	}{
+		{"127.0.0.1", "ads.example.com"},
+		{"127.0.0.1", "sub.ads.example.com"},
+		{"127.0.0.1", "nas.home.lan"},
+		{"1.2.3.4", "nas.home.lan"},
+		{"1.2.3.4", "example.com"},
+	} {
+		queryBody := makeTestQuery(1, query.name, typeA)
+		daemon.processTCPQuery(query.clientIP, []byte{0, byte(len(queryBody))}, queryBody)
+	}
+	// The queried name of a toolbox command must not be recorded
+	cmdQuery, err := hex.DecodeString("d21e01200001000000000001335f383838333337373739393937373737333332323237373733333830313432303737373730303333323232343436363630303202687a02676c00001000010000291000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.logQuery("127.0.0.1", cmdQuery, QueryVerdictCommand, time.Now())
+
+	entries := daemon.queryLog.GetEntries()
+	if len(entries) != 6 {
+		t.Fatalf("%+v", entries)
+	}
+	for i, verdict := range []string{QueryVerdictBlocked, QueryVerdictBlocked, QueryVerdictLocal, QueryVerdictRefused, QueryVerdictRefused, QueryVerdictCommand} {
+		if entries[i].Verdict != verdict {
+			t.Fatalf("%d %+v", i, entries[i])
+		}
+	}
+	if entries[1].Name != "sub.ads.example.com" || entries[1].Type != typeA || entries[1].ClientIP != "127.0.0.1" {
+		t.Fatalf("%+v", entries[1])
+	}
+	if entries[5].Name != "" || entries[5].Type != typeTXT {
+		t.Fatalf("%+v", entries[5])
+	}
+
+	report := daemon.GetQueryStatsReport()
+	for _, expected := range []string{
+		"Queries: 6 since",
+		"forwarded 0 blocked 2 local 1 command 1 refused 2",
+		"Top blocked names:\n1\tads.example.com\n1\tsub.ads.example.com\n",
+		"Top clients:\n4\t127.0.0.1\n2\t1.2.3.4\n",
+		"Top queried names:\n2\tnas.home.lan\n",
+		"Blacklist sources:\n" + HostsFileURLs[0] + "\t0 names, last refreshed never\n",
+		"Forwarders:\n127.0.0.1:9\tavg latency 0s, failure rate 0.00, 0 queries, 0 failures\n",
+		"\t127.0.0.1\tA\tads.example.com\tblocked\t",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatal(expected, report)
+		}
+	}
+	if strings.Contains(report, "hz.gl") {
+		t.Fatal(report)
+	}
+
+	// The report tells that the query log is disabled
+	daemon.QueryLogSize = -1
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if report := daemon.GetQueryStatsReport(); !strings.HasPrefix(report, "Query log is disabled") {
+		t.Fatal(report)
+	}
+}
@@ -1,7 +1,8 @@
 package dnsd
 
 import (
-	"math/rand"
+	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -39,14 +40,7 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 		return
 	}
 	// Formulate a response
-	var respBody, respLen []byte
-	if isTextQuery(queryBody) {
-		// Handle toolbox command that arrives as a text query
-		respLen, respBody = daemon.handleTCPTextQuery(ip, queryLen, queryBody)
-	} else {
-		// Handle other query types such as name query
-		respLen, respBody = daemon.handleTCPNameOrOtherQuery(ip, queryLen, queryBody)
-	}
+	respLen, respBody := daemon.processTCPQuery(ip, queryLen, queryBody)
 	// Close client connection in case there is no appropriate response
 	if respBody == nil || len(respBody) < 2 {
 		return
@@ -63,11 +57,55 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 	}
 }
 
-func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+/*
+processTCPQuery formulates a response to a query that arrived over a reliable stream transport, such as TCP, TLS (DoT),
+and HTTPS (DoH). The response is forwarded from a recursive resolver via TCP if the query is neither made against a local
+zone, black-listed, nor a toolbox command.
+*/
+func (daemon *Daemon) processTCPQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+	beginTime := time.Now()
+	var verdict string
+	defer func() {
+		daemon.logQuery(clientIP, queryBody, verdict, beginTime)
+	}()
+	if localResp := daemon.answerLocalZones(queryBody); localResp != nil {
+		// Local zones are answered before black list and forwarders
+		if !daemon.checkAllowClientIP(clientIP) {
+			daemon.logger.Warning("processTCPQuery", clientIP, nil, "client IP is not allowed to query")
+			verdict = QueryVerdictRefused
+			return []byte{}, []byte{}
+		}
+		daemon.logger.Info("processTCPQuery", clientIP, nil, "answered from local zone")
+		verdict = QueryVerdictLocal
+		return []byte{byte(len(localResp) / 256), byte(len(localResp) % 256)}, localResp
+	}
+	if isTextQuery(queryBody) {
+		// Handle toolbox command that arrives as a text query
+		respLen, respBody, verdict = daemon.handleTCPTextQuery(clientIP, queryLen, queryBody)
+		return
+	}
+	// Handle other query types such as name query
+	respLen, respBody, verdict = daemon.handleTCPNameOrOtherQuery(clientIP, queryLen, queryBody)
+	return
+}
+
+func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte, verdict string) {
 	queriedName := ExtractTextQueryInput(queryBody)
 	if daemon.processQueryTestCaseFunc != nil {
 		daemon.processQueryTestCaseFunc(queriedName)
 	}
+	if id, n, isChunkQuery := ParseCommandOutputChunkQuery(queriedName); isChunkQuery {
+		if !daemon.checkAllowClientIP(clientIP) {
+			daemon.logger.Warning("handleTCPTextQuery", clientIP, nil, "client IP is not allowed to query")
+			return []byte{}, []byte{}, QueryVerdictRefused
+		}
+		daemon.logger.Info("handleTCPTextQuery", clientIP, nil, "retrieve chunk %d of command output", n)
+		respBody = MakeTextResponse(queryBody, daemon.commandOutputs.GetChunk(clientIP, id, n))
+		respLenInt := len(respBody)
+		respLen = []byte{byte(respLenInt / 256), byte(respLenInt % 256)}
+		verdict = QueryVerdictCommand
+		return
+	}
 	if dtmfDecoded := DecodeDTMFCommandInput(queriedName); len(dtmfDecoded) > 1 {
 		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, dtmfDecoded)
 		if cmdResult.Error == toolbox.ErrPINAndShortcutNotFound {
@@ -80,9 +118,10 @@ func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []
 		} else {
 			daemon.logger.Info("handleTCPTextQuery", clientIP, nil, "processed a toolbox command")
 
-			respBody = MakeTextResponse(queryBody, cmdResult.CombinedOutput)
+			respBody = MakeTextResponse(queryBody, daemon.commandOutputs.Paginate(clientIP, cmdResult.CombinedOutput))
 			respLenInt := len(respBody)
 			respLen = []byte{byte(respLenInt / 256), byte(respLenInt % 256)}
+			verdict = QueryVerdictCommand
 			return
 		}
 	} else {
@@ -90,14 +129,20 @@ func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []
 	}
 forwardToRecursiveResolver:
 	// There's a chance of being a typo in the PIN entry, make sure this function does not log the request input.
-	return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+	verdict = QueryVerdictForwarded
+	if !daemon.checkAllowClientIP(clientIP) {
+		verdict = QueryVerdictRefused
+	}
+	respLen, respBody = daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+	return
 }
 
-func (daemon *Daemon) handleTCPNameOrOtherQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+func (daemon *Daemon) handleTCPNameOrOtherQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte, verdict string) {
 	respLen = make([]byte, 0)
 	respBody = make([]byte, 0)
 	if !daemon.checkAllowClientIP(clientIP) {
 		daemon.logger.Warning("handleTCPNameOrOtherQuery", clientIP, nil, "client IP is not allowed to query")
+		verdict = QueryVerdictRefused
 		return
 	}
 	domainName := ExtractDomainName(queryBody)
@@ -115,14 +160,16 @@ func (daemon *Daemon) handleTCPNameOrOtherQuery(clientIP string, queryLen, query
 		respBody = GetBlackHoleResponse(queryBody)
 		respLenInt := len(respBody)
 		respLen = []byte{byte(respLenInt / 256), byte(respLenInt % 256)}
+		verdict = QueryVerdictBlocked
 	} else {
 		respLen, respBody = daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		verdict = QueryVerdictForwarded
 	}
 	return
 }
 
 /*
-handleTCPRecursiveQuery forward the input query to a randomly chosen recursive resolver and retrieves the response.
+handleTCPRecursiveQuery forwards the input query to recursive resolvers and retrieves the response.
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
@@ -133,40 +180,49 @@ func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, queryLen, queryBo
 		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
 		return
 	}
-	randForwarder := daemon.Forwarders[rand.Intn(len(daemon.Forwarders))]
-	// Forward the query to a randomly chosen recursive resolver
-	myForwarder, err := net.DialTimeout("tcp", randForwarder, ForwarderTimeoutSec*time.Second)
+	// Answer the query from cache if possible
+	if cachedResp := daemon.responseCache.Get(queryBody, MaxPacketSize); cachedResp != nil {
+		return []byte{byte(len(cachedResp) / 256), byte(len(cachedResp) % 256)}, cachedResp
+	}
+	forwarderQuery := makeForwarderQuery(queryBody)
+	forwarderResp, err := daemon.forwarders.forward(queryBody, func(forwarder string) ([]byte, error) {
+		return exchangeTCP(forwarder, forwarderQuery)
+	})
 	if err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to connect to forwarder")
+		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to get response from forwarder")
 		return
 	}
+	daemon.responseCache.Put(queryBody, forwarderResp)
+	return []byte{byte(len(forwarderResp) / 256), byte(len(forwarderResp) % 256)}, forwarderResp
+}
+
+// exchangeTCP sends the query (without the length prefix) to a forwarder over TCP, and returns the forwarder's response.
+func exchangeTCP(forwarder string, queryBody []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", forwarder, ForwarderTimeoutSec*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to forwarder %s - %v", forwarder, err)
+	}
 	defer func() {
-		daemon.logger.MaybeMinorError(myForwarder.Close())
+		_ = conn.Close()
 	}()
-	// Send original query to the resolver without modification
-	daemon.logger.MaybeMinorError(myForwarder.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
-	if _, err = myForwarder.Write(queryLen); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to write length to forwarder")
-		return
-	} else if _, err = myForwarder.Write(queryBody); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to write query to forwarder")
-		return
+	if err := conn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte{byte(len(queryBody) / 256), byte(len(queryBody) % 256)}, queryBody...)); err != nil {
+		return nil, fmt.Errorf("failed to write query to forwarder %s - %v", forwarder, err)
 	}
 	// Read resolver's response
-	respLen = make([]byte, 2)
-	if _, err = myForwarder.Read(respLen); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to read length from forwarder")
-		return
+	respLen := make([]byte, 2)
+	if _, err := io.ReadFull(conn, respLen); err != nil {
+		return nil, fmt.Errorf("failed to read length from forwarder %s - %v", forwarder, err)
 	}
 	respLenInt := int(respLen[0])*256 + int(respLen[1])
 	if respLenInt > MaxPacketSize || respLenInt < 1 {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, nil, "bad response length from forwarder")
-		return
+		return nil, fmt.Errorf("bad response length from forwarder %s", forwarder)
 	}
-	respBody = make([]byte, respLenInt)
-	if _, err = myForwarder.Read(respBody); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to read response from forwarder")
-		return
+	respBody := make([]byte, respLenInt)
+	if _, err := io.ReadFull(conn, respBody); err != nil {
+		return nil, fmt.Errorf("failed to read response from forwarder %s - %v", forwarder, err)
 	}
-	return
+	return respBody, nil
 }
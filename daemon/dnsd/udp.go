@@ -1,7 +1,7 @@
 package dnsd
 
 import (
-	"math/rand"
+	"fmt"
 	"net"
 	"time"
 
@@ -22,15 +22,25 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 		logger.Warning("HandleUDPClient", ip, nil, "packet length is too small")
 		return
 	}
+	beginTime := time.Now()
 	var respLenInt int
 	var respBody []byte
-	if isTextQuery(packet) {
+	var verdict string
+	if localResp := daemon.handleUDPLocalZoneQuery(ip, packet); localResp != nil {
+		// Local zones are answered before black list and forwarders
+		respLenInt, respBody = len(localResp), localResp
+		verdict = QueryVerdictLocal
+		if len(localResp) == 0 {
+			verdict = QueryVerdictRefused
+		}
+	} else if isTextQuery(packet) {
 		// Handle toolbox command that arrives as a text query
-		respLenInt, respBody = daemon.handleUDPTextQuery(ip, packet)
+		respLenInt, respBody, verdict = daemon.handleUDPTextQuery(ip, packet)
 	} else {
 		// Handle other query types such as name query
-		respLenInt, respBody = daemon.handleUDPNameOrOtherQuery(ip, packet)
+		respLenInt, respBody, verdict = daemon.handleUDPNameOrOtherQuery(ip, packet)
 	}
+	daemon.logQuery(ip, packet, verdict, beginTime)
 	// Ignore the request if there is no appropriate response
 	if respBody == nil || len(respBody) < 3 {
 		return
@@ -46,11 +56,37 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 	}
 }
 
-func (daemon *Daemon) handleUDPTextQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+/*
+handleUDPLocalZoneQuery returns an authoritative response to a query made against a local zone, or nil if the query is
+not for a local zone. If the response does not fit in client's buffer, the client is told to repeat the query over TCP.
+*/
+func (daemon *Daemon) handleUDPLocalZoneQuery(clientIP string, queryBody []byte) []byte {
+	respBody := daemon.answerLocalZones(queryBody)
+	if respBody == nil {
+		return nil
+	}
+	if !daemon.checkAllowClientIP(clientIP) {
+		daemon.logger.Warning("handleUDPLocalZoneQuery", clientIP, nil, "client IP is not allowed to query")
+		return []byte{}
+	}
+	daemon.logger.Info("handleUDPLocalZoneQuery", clientIP, nil, "answered from local zone")
+	return fitUDPResponse(queryBody, respBody)
+}
+
+func (daemon *Daemon) handleUDPTextQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte, verdict string) {
 	queriedName := ExtractTextQueryInput(queryBody)
 	if daemon.processQueryTestCaseFunc != nil {
 		daemon.processQueryTestCaseFunc(queriedName)
 	}
+	if id, n, isChunkQuery := ParseCommandOutputChunkQuery(queriedName); isChunkQuery {
+		if !daemon.checkAllowClientIP(clientIP) {
+			daemon.logger.Warning("handleUDPTextQuery", clientIP, nil, "client IP is not allowed to query")
+			return 0, []byte{}, QueryVerdictRefused
+		}
+		daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "retrieve chunk %d of command output", n)
+		respBody = fitUDPResponse(queryBody, MakeTextResponse(queryBody, daemon.commandOutputs.GetChunk(clientIP, id, n)))
+		return len(respBody), respBody, QueryVerdictCommand
+	}
 	if dtmfDecoded := DecodeDTMFCommandInput(queriedName); len(dtmfDecoded) > 1 {
 		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, dtmfDecoded)
 		if cmdResult.Error == toolbox.ErrPINAndShortcutNotFound {
@@ -62,18 +98,23 @@ func (daemon *Daemon) handleUDPTextQuery(clientIP string, queryBody []byte) (res
 			goto forwardToRecursiveResolver
 		} else {
 			daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "processed a toolbox command")
-			respBody = MakeTextResponse(queryBody, cmdResult.CombinedOutput)
-			return len(respBody), respBody
+			respBody = fitUDPResponse(queryBody, MakeTextResponse(queryBody, daemon.commandOutputs.Paginate(clientIP, cmdResult.CombinedOutput)))
+			return len(respBody), respBody, QueryVerdictCommand
 		}
 	} else {
 		daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "handle query \"%s\"", string(queriedName))
 	}
 forwardToRecursiveResolver:
 	// There's a chance of being a typo in the PIN entry, make sure this function does not log the request input.
-	return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	verdict = QueryVerdictForwarded
+	if !daemon.checkAllowClientIP(clientIP) {
+		verdict = QueryVerdictRefused
+	}
+	respLenInt, respBody = daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	return
 }
 
-func (daemon *Daemon) handleUDPNameOrOtherQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+func (daemon *Daemon) handleUDPNameOrOtherQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte, verdict string) {
 	// Handle other query types such as name query
 	domainName := ExtractDomainName(queryBody)
 	if domainName == "" {
@@ -89,13 +130,19 @@ func (daemon *Daemon) handleUDPNameOrOtherQuery(clientIP string, queryBody []byt
 		daemon.logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle black-listed \"%s\"", domainName)
 		respBody = GetBlackHoleResponse(queryBody)
 		respLenInt = len(respBody)
+		verdict = QueryVerdictBlocked
 		return
 	}
-	return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	verdict = QueryVerdictForwarded
+	if !daemon.checkAllowClientIP(clientIP) {
+		verdict = QueryVerdictRefused
+	}
+	respLenInt, respBody = daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	return
 }
 
 /*
-handleUDPRecursiveQuery forward the input query to a randomly chosen recursive resolver and retrieves the response.
+handleUDPRecursiveQuery forwards the input query to recursive resolvers and retrieves the response.
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
@@ -105,27 +152,53 @@ func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte)
 		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
 		return
 	}
-	// Forward the query to a randomly chosen recursive resolver and return its response
-	randForwarder := daemon.Forwarders[rand.Intn(len(daemon.Forwarders))]
-	forwarderConn, err := net.DialTimeout("udp", randForwarder, ForwarderTimeoutSec*time.Second)
+	// Answer the query from cache if possible
+	if cachedResp := daemon.responseCache.Get(queryBody, MaxPacketSize); cachedResp != nil {
+		cachedResp = fitUDPResponse(queryBody, cachedResp)
+		return len(cachedResp), cachedResp
+	}
+	forwarderQuery := makeForwarderQuery(queryBody)
+	forwarderResp, err := daemon.forwarders.forward(queryBody, func(forwarder string) ([]byte, error) {
+		resp, err := exchangeUDP(forwarder, forwarderQuery)
+		if err == nil {
+			if msg, parseErr := parseMessage(resp); parseErr == nil && msg.IsTruncated() {
+				// The complete response (e.g. with DNSSEC records) is too large for UDP, ask the forwarder again over TCP.
+				return exchangeTCP(forwarder, forwarderQuery)
+			}
+		}
+		return resp, err
+	})
 	if err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to dial forwarder's address")
+		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to get response from forwarder")
 		return
 	}
-	daemon.logger.MaybeMinorError(forwarderConn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
-	if _, err := forwarderConn.Write(queryBody); err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to write to forwarder")
-		return
+	daemon.responseCache.Put(queryBody, forwarderResp)
+	forwarderResp = fitUDPResponse(queryBody, forwarderResp)
+	return len(forwarderResp), forwarderResp
+}
+
+// exchangeUDP sends the query to a forwarder over UDP, and returns the forwarder's response.
+func exchangeUDP(forwarder string, queryBody []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", forwarder, ForwarderTimeoutSec*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial forwarder %s - %v", forwarder, err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if err := conn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(queryBody); err != nil {
+		return nil, fmt.Errorf("failed to write to forwarder %s - %v", forwarder, err)
 	}
-	respBody = make([]byte, MaxPacketSize)
-	respLenInt, err = forwarderConn.Read(respBody)
+	respBody := make([]byte, MaxPacketSize)
+	respLenInt, err := conn.Read(respBody)
 	if err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to read from forwarder")
-		return
+		return nil, fmt.Errorf("failed to read from forwarder %s - %v", forwarder, err)
 	}
 	if respLenInt < 3 {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "forwarder response is abnormally small")
-		return
+		return nil, fmt.Errorf("response from forwarder %s is abnormally small", forwarder)
 	}
-	return
+	return respBody[:respLenInt], nil
 }
@@ -0,0 +1,176 @@
+package dnsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// parseTTL parses a TTL value written in seconds or in BIND notation with units, such as "3600", "1h", and "1h30m".
+func parseTTL(value string) (uint32, error) {
+	if value == "" {
+		return 0, fmt.Errorf("TTL must not be empty")
+	}
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(secs), nil
+	}
+	unitSecs := map[rune]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	var total, num uint64
+	var hasDigit bool
+	for _, c := range strings.ToLower(value) {
+		if c >= '0' && c <= '9' {
+			num = num*10 + uint64(c-'0')
+			hasDigit = true
+		} else if secs, exists := unitSecs[c]; exists && hasDigit {
+			total += num * secs
+			num, hasDigit = 0, false
+		} else {
+			return 0, fmt.Errorf("malformed TTL \"%s\"", value)
+		}
+		if total+num > 0xffffffff {
+			return 0, fmt.Errorf("TTL \"%s\" is too large", value)
+		}
+	}
+	if hasDigit {
+		return 0, fmt.Errorf("malformed TTL \"%s\"", value)
+	}
+	return uint32(total), nil
+}
+
+// zoneFileEntry is a logical line of zone file, which may span multiple physical lines enclosed by parentheses.
+type zoneFileEntry struct {
+	lineNum    int
+	hasOwner   bool // hasOwner is false if the entry begins with white space, in which case the previous owner is used.
+	fields     []string
+	quotedMask []bool // quotedMask tells whether each field was a quoted string
+}
+
+// tokeniseZoneFile breaks zone file content into logical lines of fields, with comments and parentheses removed.
+func tokeniseZoneFile(content string) ([]zoneFileEntry, error) {
+	entries := make([]zoneFileEntry, 0, 32)
+	var current zoneFileEntry
+	var parenDepth int
+	runes := []rune(content)
+	lineNum := 1
+	atLineStart := true
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		if atLineStart && parenDepth == 0 {
+			current = zoneFileEntry{lineNum: lineNum, hasOwner: !unicode.IsSpace(c) || c == '\n'}
+		}
+		atLineStart = false
+		switch {
+		case c == '\n':
+			if parenDepth == 0 && len(current.fields) > 0 {
+				entries = append(entries, current)
+			}
+			lineNum++
+			atLineStart = true
+		case unicode.IsSpace(c):
+		case c == ';':
+			// Comment runs till the end of line
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			parenDepth++
+		case c == ')':
+			if parenDepth--; parenDepth < 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", lineNum)
+			}
+		case c == '"':
+			var field strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) || runes[i] == '\n' {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", lineNum)
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				} else if runes[i] == '"' {
+					break
+				}
+				field.WriteRune(runes[i])
+			}
+			current.fields = append(current.fields, field.String())
+			current.quotedMask = append(current.quotedMask, true)
+		default:
+			start := i
+			for i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && !strings.ContainsRune(`;()"`, runes[i+1]) {
+				i++
+			}
+			current.fields = append(current.fields, string(runes[start:i+1]))
+			current.quotedMask = append(current.quotedMask, false)
+		}
+	}
+	if parenDepth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", lineNum)
+	}
+	if len(current.fields) > 0 && !atLineStart {
+		entries = append(entries, current)
+	}
+	return entries, nil
+}
+
+/*
+parseZoneFile reads the resource records from BIND-style zone file content. It understands $ORIGIN and $TTL directives,
+relative names, "@" as the origin, omitted owner names, optional TTL and class in any order, and multi-line records
+enclosed by parentheses. NS records are accepted but not served.
+*/
+func parseZoneFile(content, origin string, defaultTTL uint32) (map[string][]localRR, error) {
+	entries, err := tokeniseZoneFile(content)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string][]localRR)
+	var owner string
+	for _, entry := range entries {
+		fields := entry.fields
+		if !entry.quotedMask[0] && strings.HasPrefix(fields[0], "$") {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: directive %s requires a value", entry.lineNum, fields[0])
+			}
+			switch strings.ToUpper(fields[0]) {
+			case "$ORIGIN":
+				origin = getAbsoluteName(fields[1], origin)
+			case "$TTL":
+				if defaultTTL, err = parseTTL(fields[1]); err != nil {
+					return nil, fmt.Errorf("line %d: %v", entry.lineNum, err)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: directive %s is not supported", entry.lineNum, fields[0])
+			}
+			continue
+		}
+		if entry.hasOwner {
+			owner = getAbsoluteName(fields[0], origin)
+			fields = fields[1:]
+		} else if owner == "" {
+			return nil, fmt.Errorf("line %d: the first record must have an owner name", entry.lineNum)
+		}
+		// TTL and class may appear in any order before record type
+		ttl := defaultTTL
+		var rrType string
+		for len(fields) > 0 && rrType == "" {
+			field := fields[0]
+			fields = fields[1:]
+			if recordTTL, err := parseTTL(field); err == nil {
+				ttl = recordTTL
+			} else if !strings.EqualFold(field, "IN") {
+				rrType = strings.ToUpper(field)
+			}
+		}
+		if rrType == "" {
+			return nil, fmt.Errorf("line %d: record type is missing", entry.lineNum)
+		}
+		rr, err := makeLocalRR(rrType, fields, origin, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", entry.lineNum, err)
+		}
+		if rr.Type == typeNS {
+			continue
+		}
+		records[owner] = append(records[owner], rr)
+	}
+	return records, nil
+}
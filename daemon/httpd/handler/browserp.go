@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -244,6 +245,12 @@ func (_ *HandleBrowserPhantomJS) SelfTest() error {
 	return nil
 }
 
+// Shutdown kills all browser instances.
+func (remoteBrowser *HandleBrowserPhantomJS) Shutdown(context.Context) error {
+	remoteBrowser.Browsers.KillAll()
+	return nil
+}
+
 type HandleBrowserPhantomJSImage struct {
 	Browsers *phantomjs.Instances `json:"-"` // Reference to browser instances constructed in HandleBrowser handler
 }
@@ -289,3 +296,7 @@ func (_ *HandleBrowserPhantomJSImage) GetRateLimitFactor() int {
 func (_ *HandleBrowserPhantomJSImage) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleBrowserPhantomJSImage) Shutdown(context.Context) error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -143,6 +144,12 @@ func (_ *HandleBrowserSlimerJS) SelfTest() error {
 	return nil
 }
 
+// Shutdown kills all browser instances.
+func (remoteBrowser *HandleBrowserSlimerJS) Shutdown(context.Context) error {
+	remoteBrowser.Browsers.KillAll()
+	return nil
+}
+
 type HandleBrowserSlimerJSImage struct {
 	Browsers *slimerjs.Instances `json:"-"` // Reference to browser instances constructed in HandleBrowser handler
 }
@@ -188,3 +195,7 @@ func (_ *HandleBrowserSlimerJSImage) GetRateLimitFactor() int {
 func (_ *HandleBrowserSlimerJSImage) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleBrowserSlimerJSImage) Shutdown(context.Context) error {
+	return nil
+}
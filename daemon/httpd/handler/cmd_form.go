@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html"
@@ -69,3 +70,7 @@ func (_ *HandleCommandForm) GetRateLimitFactor() int {
 func (_ *HandleCommandForm) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleCommandForm) Shutdown(context.Context) error {
+	return nil
+}
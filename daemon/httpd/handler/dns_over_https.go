@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// DNSMessageContentType is the content type of DNS-over-HTTPS request and response bodies, as defined in RFC 8484.
+const DNSMessageContentType = "application/dns-message"
+
+/*
+HandleDNSOverHTTPS serves DNS-over-HTTPS (RFC 8484) queries using the DNS daemon. The queries are subject to the same
+restriction as ordinary DNS queries, hence the client IP must be allowed to query the DNS daemon, black listed names are
+answered with black hole, and toolbox commands may be executed via TXT queries.
+*/
+type HandleDNSOverHTTPS struct {
+	DNSDaemon *dnsd.Daemon `json:"-"` // DNSDaemon processes the DNS queries
+	logger    lalog.Logger
+}
+
+func (doh *HandleDNSOverHTTPS) Initialise(logger lalog.Logger, _ *toolbox.CommandProcessor) error {
+	doh.logger = logger
+	if doh.DNSDaemon == nil {
+		return errors.New("HandleDNSOverHTTPS.Initialise: DNS daemon must not be nil")
+	}
+	return nil
+}
+
+func (doh *HandleDNSOverHTTPS) Handle(w http.ResponseWriter, r *http.Request) {
+	clientIP := GetRealClientIP(r)
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		// The query is a base64url encoded DNS message without padding
+		var err error
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.FormValue("dns"), "="))
+		if err != nil {
+			http.Error(w, "failed to decode parameter dns", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DNSMessageContentType {
+			http.Error(w, "content type must be "+DNSMessageContentType, http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		query, err = io.ReadAll(io.LimitReader(r.Body, dnsd.MaxPacketSize+1))
+		if err != nil {
+			doh.logger.Warning("Handle", clientIP, err, "failed to read request body")
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method must be GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(query) < dnsd.MinNameQuerySize || len(query) > dnsd.MaxPacketSize {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+	resp := doh.DNSDaemon.ProcessDoHQuery(clientIP, query)
+	if len(resp) == 0 {
+		http.Error(w, "no response to DNS query", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", DNSMessageContentType)
+	NoCache(w)
+	_, _ = w.Write(resp)
+}
+
+func (_ *HandleDNSOverHTTPS) GetRateLimitFactor() int {
+	return 8
+}
+
+func (_ *HandleDNSOverHTTPS) SelfTest() error {
+	return nil
+}
+
+func (_ *HandleDNSOverHTTPS) Shutdown(context.Context) error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+/*
+HandleDNSQueryStats returns a text report of the recent queries processed by DNS daemon, including the top blocked
+names, top clients, top queried names, and the refresh status of blacklist sources.
+*/
+type HandleDNSQueryStats struct {
+	DNSDaemon *dnsd.Daemon `json:"-"` // DNSDaemon is the subject of the report
+	logger    lalog.Logger
+}
+
+func (stats *HandleDNSQueryStats) Initialise(logger lalog.Logger, _ *toolbox.CommandProcessor) error {
+	stats.logger = logger
+	if stats.DNSDaemon == nil {
+		return errors.New("HandleDNSQueryStats.Initialise: DNS daemon must not be nil")
+	}
+	return nil
+}
+
+func (stats *HandleDNSQueryStats) Handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	NoCache(w)
+	_, _ = w.Write([]byte(stats.DNSDaemon.GetQueryStatsReport()))
+}
+
+func (_ *HandleDNSQueryStats) GetRateLimitFactor() int {
+	return 2
+}
+
+func (_ *HandleDNSQueryStats) SelfTest() error {
+	return nil
+}
+
+func (_ *HandleDNSQueryStats) Shutdown(context.Context) error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -183,3 +184,7 @@ func (_ *HandleFileUpload) SelfTest() error {
 	}
 	return nil
 }
+
+func (_ *HandleFileUpload) Shutdown(context.Context) error {
+	return nil
+}
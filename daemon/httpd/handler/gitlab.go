@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -196,3 +197,7 @@ func (lab *HandleGitlabBrowser) SelfTest() error {
 	}
 	return fmt.Errorf("HandleGitlabBrowser encountered errors: %+v", errs)
 }
+
+func (_ *HandleGitlabBrowser) Shutdown(context.Context) error {
+	return nil
+}
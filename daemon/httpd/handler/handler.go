@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"net/http"
 	"strings"
@@ -23,6 +24,9 @@ type Handler interface {
 
 	// SelfTest validates configuration such as connectivity to external service. It may work only after Initialise() succeeds.
 	SelfTest() error
+
+	// Shutdown stops the background activities started by the handler, such as command timers and browser instances.
+	Shutdown(context.Context) error
 }
 
 // XMLEscape returns properly escaped XML equivalent of the plain text input.
@@ -1,7 +1,14 @@
 package handler
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 func TestXMLEscape(t *testing.T) {
@@ -10,4 +17,25 @@ func TestXMLEscape(t *testing.T) {
 	}
 }
 
+func TestHandleTwilioSMSHook_ChannelProfile(t *testing.T) {
+	proc := toolbox.GetTestCommandProcessor()
+	// The channel profile of other web services does not apply to SMS replies
+	proc.ResultFilters = append(proc.ResultFilters[:2], append([]toolbox.ResultFilter{&toolbox.ChannelProfile{ChatMarkup: toolbox.ChatMarkupHTML}}, proc.ResultFilters[2:]...)...)
+	hand := &HandleTwilioSMSHook{ChannelProfile: toolbox.ChannelProfile{GSM7: true}}
+	if err := hand.Initialise(lalog.Logger{}, proc); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/sms", strings.NewReader(url.Values{"Body": {toolbox.TestCommandProcessorPIN + ".s echo “hi”"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	hand.Handle(rec, req)
+	if body := rec.Body.String(); !strings.Contains(body, "<Message>&#34;hi&#34;</Message>") {
+		t.Fatal(body)
+	}
+	// The command processor shared with other web services is left alone
+	if profile := proc.ResultFilters[2].(*toolbox.ChannelProfile); profile.ChatMarkup != toolbox.ChatMarkupHTML {
+		t.Fatal(profile)
+	}
+}
+
 // API handler tests are written in httpd.go and run in httpd_test.go
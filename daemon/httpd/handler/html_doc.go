@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -58,3 +59,7 @@ func (_ *HandleHTMLDocument) GetRateLimitFactor() int {
 func (_ *HandleHTMLDocument) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleHTMLDocument) Shutdown(context.Context) error {
+	return nil
+}
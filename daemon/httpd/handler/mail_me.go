@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -87,3 +88,7 @@ func (mm *HandleMailMe) SelfTest() error {
 	}
 	return nil
 }
+
+func (_ *HandleMailMe) Shutdown(context.Context) error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -91,6 +92,10 @@ func (_ *HandleReportsRetrieval) SelfTest() error {
 	return nil
 }
 
+func (_ *HandleReportsRetrieval) Shutdown(context.Context) error {
+	return nil
+}
+
 // HandleAppCommand executes app command from the incoming request.
 type HandleAppCommand struct {
 	cmdProc *toolbox.CommandProcessor
@@ -108,7 +113,13 @@ func (hand *HandleAppCommand) Initialise(_ lalog.Logger, cmdProc *toolbox.Comman
 }
 
 func (hand *HandleAppCommand) Handle(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
+	// The client may ask for the result in JSON instead of plain text
+	structured := r.FormValue("format") == "json"
+	if structured {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
 	NoCache(w)
 	cmd := r.FormValue("cmd")
 	if cmd == "" {
@@ -122,7 +133,16 @@ func (hand *HandleAppCommand) Handle(w http.ResponseWriter, r *http.Request) {
 		Content:    cmd,
 		TimeoutSec: HTTPClienAppCommandTimeout,
 	}, true)
-	_, _ = w.Write([]byte(result.CombinedOutput))
+	if structured {
+		serialised, err := result.ToJSON()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(serialised)
+	} else {
+		_, _ = w.Write([]byte(result.CombinedOutput))
+	}
 }
 
 func (hand *HandleAppCommand) GetRateLimitFactor() int {
@@ -132,3 +152,7 @@ func (hand *HandleAppCommand) GetRateLimitFactor() int {
 func (_ *HandleAppCommand) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleAppCommand) Shutdown(context.Context) error {
+	return nil
+}
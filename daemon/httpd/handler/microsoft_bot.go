@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -242,3 +243,7 @@ func (hand *HandleMicrosoftBot) SelfTest() error {
 	}
 	return nil
 }
+
+func (_ *HandleMicrosoftBot) Shutdown(context.Context) error {
+	return nil
+}
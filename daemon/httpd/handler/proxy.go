@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -261,3 +262,7 @@ func (xy *HandleWebProxy) GetRateLimitFactor() int {
 func (_ *HandleWebProxy) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleWebProxy) Shutdown(context.Context) error {
+	return nil
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -53,7 +54,6 @@ func (notif *HandleRecurringCommands) Initialise(logger lalog.Logger, cmdProc *t
 			return err
 		}
 		go timer.Start()
-		// Because handlers do not have tear-down function, there is no way to stop them. Consider fixing this in the future?
 	}
 	return nil
 }
@@ -66,6 +66,23 @@ func (_ *HandleRecurringCommands) SelfTest() error {
 	return nil
 }
 
+// Shutdown stops all command timers. If the context is done before then, the function gives up waiting and returns an error.
+func (notif *HandleRecurringCommands) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		for _, timer := range notif.RecurringCommands {
+			timer.Stop()
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("HandleRecurringCommands.Shutdown: %v", ctx.Err())
+	}
+}
+
 func (notif *HandleRecurringCommands) Handle(w http.ResponseWriter, r *http.Request) {
 	NoCache(w)
 	if retrieveFromChannel := r.FormValue("retrieve"); retrieveFromChannel == "" {
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -256,6 +257,12 @@ func (_ *HandleVirtualMachine) SelfTest() error {
 	return nil
 }
 
+// Shutdown kills the virtual machine.
+func (handler *HandleVirtualMachine) Shutdown(context.Context) error {
+	handler.VM.Kill()
+	return nil
+}
+
 // HandleVirtualMachineScreenshot is an HTTP handler that takes a screenshot of remote virtual machine and serves it in JPEG.
 type HandleVirtualMachineScreenshot struct {
 	VM *remotevm.VM `json:"-"`
@@ -301,3 +308,7 @@ func (_ *HandleVirtualMachineScreenshot) GetRateLimitFactor() int {
 func (_ *HandleVirtualMachineScreenshot) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleVirtualMachineScreenshot) Shutdown(context.Context) error {
+	return nil
+}
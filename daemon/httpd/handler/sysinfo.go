@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"net/http"
 
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
@@ -49,3 +50,7 @@ func (_ *HandleSystemInfo) GetRateLimitFactor() int {
 func (_ *HandleSystemInfo) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleSystemInfo) Shutdown(context.Context) error {
+	return nil
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -212,3 +213,7 @@ func (_ *HandleTheThingsNetworkHTTPIntegration) GetRateLimitFactor() int {
 func (_ *HandleTheThingsNetworkHTTPIntegration) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleTheThingsNetworkHTTPIntegration) Shutdown(context.Context) error {
+	return nil
+}
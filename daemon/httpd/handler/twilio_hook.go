@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -41,6 +42,12 @@ const (
 
 // Handle Twilio phone number's SMS hook.
 type HandleTwilioSMSHook struct {
+	/*
+		ChannelProfile adapts command results to SMS replies, such as the GSM character set and segmentation. It
+		replaces the channel profile of HTTPFilters that is meant for the other web services.
+	*/
+	ChannelProfile toolbox.ChannelProfile `json:"ChannelProfile"`
+
 	senderRateLimit *misc.RateLimit // senderRateLimit prevents excessive SMS replies from being replied to spam numbers
 
 	logger  lalog.Logger
@@ -48,8 +55,29 @@ type HandleTwilioSMSHook struct {
 }
 
 func (hand *HandleTwilioSMSHook) Initialise(logger lalog.Logger, cmdProc *toolbox.CommandProcessor) error {
+	if cmdProc == nil {
+		return errors.New("HandleTwilioSMSHook.Initialise: command processor must not be nil")
+	}
 	hand.logger = logger
-	hand.cmdProc = cmdProc
+	// Process commands with the SMS channel profile in place of the one shared by other web services
+	resultFilters := make([]toolbox.ResultFilter, 0, len(cmdProc.ResultFilters)+1)
+	profilePlaced := false
+	for _, filter := range cmdProc.ResultFilters {
+		if _, isProfile := filter.(*toolbox.ChannelProfile); isProfile {
+			filter, profilePlaced = &hand.ChannelProfile, true
+		}
+		resultFilters = append(resultFilters, filter)
+		// Channel profile works on the combined output after it has been linted
+		if _, isSayEmpty := filter.(*toolbox.SayEmptyOutput); isSayEmpty && !profilePlaced {
+			resultFilters, profilePlaced = append(resultFilters, &hand.ChannelProfile), true
+		}
+	}
+	hand.cmdProc = &toolbox.CommandProcessor{
+		Features:       cmdProc.Features,
+		CommandFilters: cmdProc.CommandFilters,
+		ResultFilters:  resultFilters,
+		MaxCmdPerSec:   cmdProc.MaxCmdPerSec,
+	}
 	// Allow maximum of 1 SMS to be received every 5 seconds, per phone number.
 	hand.senderRateLimit = &misc.RateLimit{
 		UnitSecs: TwilioPhoneNumberRateLimitIntervalSec,
@@ -103,6 +131,10 @@ func (_ *HandleTwilioSMSHook) SelfTest() error {
 	return nil
 }
 
+func (_ *HandleTwilioSMSHook) Shutdown(context.Context) error {
+	return nil
+}
+
 // Say a greeting in Twilio phone number's telephone call hook.
 type HandleTwilioCallHook struct {
 	CallGreeting     string `json:"CallGreeting"` // a message to speak upon picking up a call
@@ -157,6 +189,10 @@ func (_ *HandleTwilioCallHook) SelfTest() error {
 	return nil
 }
 
+func (_ *HandleTwilioCallHook) Shutdown(context.Context) error {
+	return nil
+}
+
 // Carry on with command processing in Twilio telephone call conversation.
 type HandleTwilioCallCallback struct {
 	MyEndpoint string `json:"-"` // URL endpoint to the callback itself, including prefix /.
@@ -240,3 +276,7 @@ func (hand *HandleTwilioCallCallback) GetRateLimitFactor() int {
 func (_ *HandleTwilioCallCallback) SelfTest() error {
 	return nil
 }
+
+func (_ *HandleTwilioCallCallback) Shutdown(context.Context) error {
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -65,6 +67,15 @@ func (col HandlerCollection) SelfTest() error {
 	return errors.New(strings.Join(ret, " | "))
 }
 
+// Shutdown stops the background activities of all special handlers, and returns the first error encountered.
+func (col HandlerCollection) Shutdown(ctx context.Context) error {
+	shutdownFuns := make([]func(context.Context) error, 0, len(col))
+	for _, hand := range col {
+		shutdownFuns = append(shutdownFuns, hand.Shutdown)
+	}
+	return common.ShutdownConcurrently(ctx, shutdownFuns...)
+}
+
 // Generic HTTP daemon.
 type Daemon struct {
 	Address          string            `json:"Address"`          // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
@@ -317,6 +328,29 @@ func (daemon *Daemon) StopTLS() {
 	}
 }
 
+/*
+Shutdown gracefully shuts down both listeners with and without TLS, giving the ongoing requests until the context is
+done to complete, and then stops the background activities of handlers.
+*/
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	shutdownServer := func(server *http.Server) func(context.Context) error {
+		return func(ctx context.Context) error {
+			if server == nil {
+				return nil
+			}
+			if err := server.Shutdown(ctx); err != nil {
+				return fmt.Errorf("httpd.Shutdown: failed to shut down listener on %s - %v", server.Addr, err)
+			}
+			return nil
+		}
+	}
+	serverErr := common.ShutdownConcurrently(ctx, shutdownServer(daemon.serverNoTLS), shutdownServer(daemon.serverWithTLS))
+	if err := daemon.HandlerCollection.Shutdown(ctx); err != nil {
+		return err
+	}
+	return serverErr
+}
+
 // Run unit tests on API handlers of an already started HTTP daemon all API handlers. Essentially, it tests "handler" package.
 func TestAPIHandlers(httpd *Daemon, t testingstub.T) {
 	addr := fmt.Sprintf("http://%s:%d", httpd.Address, httpd.Port)
@@ -641,6 +675,15 @@ over.
 	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "hi" {
 		t.Fatal(err, string(resp.Body))
 	}
+	// The client may ask for the result in JSON
+	resp, err = inet.DoHTTP(inet.HTTPRequest{
+		Method: http.MethodPost,
+		Body:   strings.NewReader(url.Values{"cmd": {toolbox.TestCommandProcessorPIN + ".s echo hi"}, "format": {"json"}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleAppCommand{}))
+	var structuredResult toolbox.StructuredResult
+	if err != nil || resp.StatusCode != http.StatusOK || json.Unmarshal(resp.Body, &structuredResult) != nil ||
+		structuredResult.Output != "hi" || structuredResult.CombinedOutput != "hi" || structuredResult.Trigger != ".s" {
+		t.Fatal(err, string(resp.Body))
+	}
 
 	// Test reports endpoint
 	httpd.Processor.Features.MessageProcessor.StoreReport(toolbox.SubjectReportRequest{
@@ -685,6 +728,46 @@ over.
 	if cmd := httpd.Processor.Features.MessageProcessor.OutgoingAppCommands["subject-host-name"]; cmd != "test123" {
 		t.Fatal(cmd)
 	}
+
+	// DNS-over-HTTPS - TXT query of toolbox command "verysecret.s echo a" on domain hz.gl
+	dohEndpoint := httpd.GetHandlerByFactoryType(&handler.HandleDNSOverHTTPS{})
+	dohQuery, err := hex.DecodeString("d21e01200001000000000001335f383838333337373739393937373737333332323237373733333830313432303737373730303333323232343436363630303202687a02676c00001000010000291000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+dohEndpoint+"?dns="+base64.RawURLEncoding.EncodeToString(dohQuery))
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != handler.DNSMessageContentType ||
+		len(resp.Body) <= len(dohQuery) || !bytes.Equal(resp.Body[:2], dohQuery[:2]) {
+		t.Fatal(err, resp.StatusCode, resp.Body)
+	}
+	resp, err = inet.DoHTTP(inet.HTTPRequest{
+		Method:      http.MethodPost,
+		ContentType: handler.DNSMessageContentType,
+		Body:        bytes.NewReader(dohQuery),
+	}, addr+dohEndpoint)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != handler.DNSMessageContentType ||
+		len(resp.Body) <= len(dohQuery) || !bytes.Equal(resp.Body[:2], dohQuery[:2]) {
+		t.Fatal(err, resp.StatusCode, resp.Body)
+	}
+	// Malformed queries are rejected
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+dohEndpoint+"?dns=AAAA")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(err, resp.StatusCode, string(resp.Body))
+	}
+	resp, err = inet.DoHTTP(inet.HTTPRequest{
+		Method:      http.MethodPost,
+		ContentType: "text/plain",
+		Body:        bytes.NewReader(dohQuery),
+	}, addr+dohEndpoint)
+	if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatal(err, resp.StatusCode, string(resp.Body))
+	}
+	// DNS query stats - both of the toolbox commands above are recorded without revealing the command input
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+httpd.GetHandlerByFactoryType(&handler.HandleDNSQueryStats{}))
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "command 2") ||
+		strings.Contains(string(resp.Body), "hz.gl") {
+		t.Fatal(err, resp.StatusCode, string(resp.Body))
+	}
 }
 
 const (
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -129,6 +130,12 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	}
 	daemon.HandlerCollection["/cmd"] = &handler.HandleAppCommand{}
 	daemon.HandlerCollection["/reports"] = &handler.HandleReportsRetrieval{}
+	dnsDaemon := &dnsd.Daemon{Address: "127.0.0.1", TCPPort: 61211, Processor: toolbox.GetTestCommandProcessor()}
+	if err := dnsDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.HandlerCollection["/dns-query"] = &handler.HandleDNSOverHTTPS{DNSDaemon: dnsDaemon}
+	daemon.HandlerCollection["/dns-stats"] = &handler.HandleDNSQueryStats{DNSDaemon: dnsDaemon}
 
 	if err := daemon.Initialise(""); err != nil {
 		t.Fatal(err)
@@ -2,6 +2,7 @@ package maintenance
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -299,6 +300,12 @@ func (daemon *Daemon) Stop() {
 	}
 }
 
+// Shutdown stops the maintenance loop. Should a maintenance run be in progress, it will be the last run.
+func (daemon *Daemon) Shutdown(_ context.Context) error {
+	daemon.Stop()
+	return nil
+}
+
 // logPrintStage reports the start/finish of a maintenance stage to the output buffer and program log.
 func (daemon *Daemon) logPrintStage(out *bytes.Buffer, template string, a ...interface{}) {
 	if duration := time.Now().Unix() - daemon.lastStepTimestamp; duration > 5 {
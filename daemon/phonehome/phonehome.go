@@ -1,6 +1,7 @@
 package phonehome
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -236,6 +237,12 @@ func (daemon *Daemon) Stop() {
 	daemon.runLoop = false
 }
 
+// Shutdown stops the reporting loop, there is no other outstanding work to wait for.
+func (daemon *Daemon) Shutdown(_ context.Context) error {
+	daemon.Stop()
+	return nil
+}
+
 // TestServer implements test cases for the phone-home daemon.
 func TestServer(server *Daemon, t testingstub.T) {
 	// Start a web server that behaves like a message processor server
@@ -8,6 +8,8 @@ package plainsocket
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -100,16 +102,24 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 		if line == "" {
 			continue
 		}
-		// Process line of command and respond
+		// Process line of command and respond, the client may ask for the result in JSON.
+		line, structured := toolbox.TrimPrefixStructuredResult(line)
 		result := daemon.Processor.Process(toolbox.Command{
 			DaemonName: "plainsocket",
 			ClientID:   ip,
 			Content:    string(line),
 			TimeoutSec: CommandTimeoutSec,
 		}, true)
+		response := []byte(result.CombinedOutput)
+		if structured {
+			if response, err = result.ToJSON(); err != nil {
+				logger.Warning("HandleTCPConnection", ip, err, "failed to serialise result")
+				return
+			}
+		}
 		if err := conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
 			return
-		} else if _, err := conn.Write([]byte(result.CombinedOutput)); err != nil {
+		} else if _, err := conn.Write(response); err != nil {
 			return
 		} else if _, err := conn.Write([]byte("\r\n")); err != nil {
 			return
@@ -148,17 +158,27 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 		if line == "" {
 			continue
 		}
-		// Process line of command and respond
+		// Process line of command and respond, the client may ask for the result in JSON.
+		line, structured := toolbox.TrimPrefixStructuredResult(line)
 		result := daemon.Processor.Process(toolbox.Command{
 			DaemonName: "plainsocket",
 			ClientID:   ip,
 			Content:    string(line),
 			TimeoutSec: CommandTimeoutSec,
 		}, true)
+		response := result.CombinedOutput
+		if structured {
+			serialised, err := result.ToJSON()
+			if err != nil {
+				logger.Warning("HandleUDPClient", ip, err, "failed to serialise result")
+				return
+			}
+			response = string(serialised)
+		}
 		if err := srv.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
 			logger.Warning("HandleUDPClient", ip, err, "failed to write response")
 			return
-		} else if _, err := srv.WriteToUDP([]byte(result.CombinedOutput+"\r\n"), client); err != nil {
+		} else if _, err := srv.WriteToUDP([]byte(response+"\r\n"), client); err != nil {
 			logger.Warning("HandleUDPClient", ip, err, "failed to write response")
 			return
 		}
@@ -198,6 +218,11 @@ func (daemon *Daemon) Stop() {
 	daemon.udpServer.Stop()
 }
 
+// Shutdown stops accepting new clients, and waits for ongoing TCP and UDP conversations to complete.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	return common.ShutdownConcurrently(ctx, daemon.tcpServer.Shutdown, daemon.udpServer.Shutdown)
+}
+
 // TestServer contains the comprehensive test case for both TCP and UDP servers.
 func TestServer(server *Daemon, t testingstub.T) {
 	// Server should start within two seconds
@@ -243,6 +268,19 @@ func TestServer(server *Daemon, t testingstub.T) {
 	if string(goodPINResp) != "hi" {
 		t.Fatal(string(goodPINResp))
 	}
+	// Ask for the result in JSON
+	_, err = tcpClient.Write([]byte(toolbox.PrefixStructuredResult + " verysecret .s echo hi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	structuredResp, _, err := reader.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var structuredResult toolbox.StructuredResult
+	if err := json.Unmarshal(structuredResp, &structuredResult); err != nil || structuredResult.Output != "hi" || structuredResult.Trigger != ".s" {
+		t.Fatal(err, string(structuredResp))
+	}
 
 	// Prepare for UDP conversations
 	udpClient, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(server.UDPPort))
@@ -0,0 +1,182 @@
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSearchYears is the number of years ahead to search for the next time a cron expression matches.
+const CronSearchYears = 5
+
+// cronMacros are the shorthands of common cron expressions.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	// cronMonthNames are the names that may be used in place of month numbers.
+	cronMonthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	// cronWeekdayNames are the names that may be used in place of weekday numbers.
+	cronWeekdayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+/*
+CronExpression is a parsed cron expression of five fields - minute, hour, day of month, month, and day of week. Each
+field is a comma-separated list of "*", numbers, and ranges, optionally followed by a step such as "0-30/10". Months and
+weekdays may also be written as names such as "jan" and "mon". As is the tradition of cron, if both day of month and day
+of week are restricted, then the expression matches either of them.
+*/
+type CronExpression struct {
+	minutes, hours, days, months, weekdays uint64 // minutes, hours, days, months, and weekdays are bit sets of the matching values.
+	daysRestricted, weekdaysRestricted     bool   // daysRestricted and weekdaysRestricted are true if the fields are not "*".
+
+	text string
+}
+
+// ParseCron parses the cron expression of five fields, or one of the macros such as "@daily".
+func ParseCron(text string) (*CronExpression, error) {
+	text = strings.TrimSpace(text)
+	fieldsText := text
+	if macro, exists := cronMacros[strings.ToLower(text)]; exists {
+		fieldsText = macro
+	}
+	fields := strings.Fields(fieldsText)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("ParseCron: \"%s\" must have five fields - minute, hour, day of month, month, and day of week", text)
+	}
+	expr := &CronExpression{text: text}
+	var err error
+	if expr.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("ParseCron: minute - %v", err)
+	}
+	if expr.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("ParseCron: hour - %v", err)
+	}
+	if expr.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("ParseCron: day of month - %v", err)
+	}
+	if expr.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("ParseCron: month - %v", err)
+	}
+	// Both 0 and 7 stand for Sunday
+	if expr.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdayNames); err != nil {
+		return nil, fmt.Errorf("ParseCron: day of week - %v", err)
+	}
+	if expr.weekdays&(1<<7) != 0 {
+		expr.weekdays |= 1
+	}
+	expr.daysRestricted = !strings.HasPrefix(fields[2], "*")
+	expr.weekdaysRestricted = !strings.HasPrefix(fields[4], "*")
+	return expr, nil
+}
+
+// parseCronValue parses a number or a name within the range of a cron field.
+func parseCronValue(text string, min, max int, names map[string]int) (int, error) {
+	if value, exists := names[strings.ToLower(text)]; exists {
+		return value, nil
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("\"%s\" is not a number within [%d, %d]", text, min, max)
+	}
+	return value, nil
+}
+
+// parseCronField returns the bit set of values matched by the comma-separated list of values, ranges, and steps.
+func parseCronField(field string, min, max int, names map[string]int) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rangeText, step := part, 1
+		if slash := strings.IndexRune(part, '/'); slash != -1 {
+			rangeText = part[:slash]
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("\"%s\" has a malformed step", part)
+			}
+		}
+		begin, end := min, max
+		if rangeText != "*" {
+			if dash := strings.IndexRune(rangeText, '-'); dash != -1 {
+				if begin, err = parseCronValue(rangeText[:dash], min, max, names); err != nil {
+					return
+				}
+				if end, err = parseCronValue(rangeText[dash+1:], min, max, names); err != nil {
+					return
+				}
+				if end < begin {
+					return 0, fmt.Errorf("\"%s\" has a backward range", part)
+				}
+			} else {
+				if begin, err = parseCronValue(rangeText, min, max, names); err != nil {
+					return
+				}
+				// A single value with a step, such as "5/15", runs from the value to the end of the range.
+				if step == 1 {
+					end = begin
+				}
+			}
+		}
+		for value := begin; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return
+}
+
+// String returns the cron expression text that the expression was parsed from.
+func (expr *CronExpression) String() string {
+	return expr.text
+}
+
+// matchesDay returns true if the day of month and day of week of the time match the expression.
+func (expr *CronExpression) matchesDay(t time.Time) bool {
+	dayMatched := expr.days&(1<<uint(t.Day())) != 0
+	weekdayMatched := expr.weekdays&(1<<uint(t.Weekday())) != 0
+	if expr.daysRestricted && expr.weekdaysRestricted {
+		return dayMatched || weekdayMatched
+	}
+	return dayMatched && weekdayMatched
+}
+
+// Matches returns true if the minute of the time matches the expression, the time should be in the intended time zone.
+func (expr *CronExpression) Matches(t time.Time) bool {
+	return expr.minutes&(1<<uint(t.Minute())) != 0 && expr.hours&(1<<uint(t.Hour())) != 0 &&
+		expr.months&(1<<uint(t.Month())) != 0 && expr.matchesDay(t)
+}
+
+/*
+Next returns the earliest minute after the time that matches the expression in the time zone. It returns a zero time if
+the expression does not match any time in the next few years, e.g. the 30th of February.
+*/
+func (expr *CronExpression) Next(after time.Time, location *time.Location) time.Time {
+	t := after.In(location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(CronSearchYears, 0, 0)
+	// advance makes sure that time moves forward, even if a local time is repeated when daylight saving time ends.
+	advance := func(next time.Time) {
+		if next.After(t) {
+			t = next
+		} else {
+			t = t.Add(time.Minute)
+		}
+	}
+	for t.Before(limit) {
+		if expr.months&(1<<uint(t.Month())) == 0 {
+			advance(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location))
+		} else if !expr.matchesDay(t) {
+			advance(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location))
+		} else if expr.hours&(1<<uint(t.Hour())) == 0 {
+			advance(time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location))
+		} else if expr.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
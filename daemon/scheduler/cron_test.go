@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, text := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "5-1 * * * *", "*/0 * * * *", "a * * * *", "* * * abc *", "@never"} {
+		if _, err := ParseCron(text); err == nil {
+			t.Fatal("did not error", text)
+		}
+	}
+	expr, err := ParseCron("0,30 9-17/4 * jan-MAR mon-fri")
+	if err != nil || expr.String() != "0,30 9-17/4 * jan-MAR mon-fri" {
+		t.Fatal(expr, err)
+	}
+	for timeText, matches := range map[string]bool{
+		"2020-01-06T09:00:00Z": true,  // Monday
+		"2020-01-06T13:30:00Z": true,  // Monday
+		"2020-03-31T17:00:00Z": true,  // Tuesday
+		"2020-01-06T10:00:00Z": false, // hour does not match the step
+		"2020-01-06T09:15:00Z": false, // minute does not match
+		"2020-01-05T09:00:00Z": false, // Sunday
+		"2020-04-06T09:00:00Z": false, // April
+	} {
+		at, _ := time.Parse(time.RFC3339, timeText)
+		if expr.Matches(at) != matches {
+			t.Fatal(timeText)
+		}
+	}
+	// A single value with a step runs till the end of the range, and 7 is also Sunday.
+	expr, err = ParseCron("5/20 0 * * 7")
+	if err != nil || expr.minutes != 1<<5|1<<25|1<<45 || expr.weekdays&1 == 0 {
+		t.Fatal(expr, err)
+	}
+	expr, err = ParseCron("@Hourly")
+	if err != nil || expr.minutes != 1 || expr.hours != 1<<24-1 {
+		t.Fatal(expr, err)
+	}
+}
+
+func TestCronExpression_Next(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("time zone database is not available", err)
+	}
+	after, _ := time.Parse(time.RFC3339, "2020-01-31T23:59:30Z")
+	for text, next := range map[string]string{
+		"* * * * *":    "2020-02-01T00:00:00Z",
+		"@hourly":      "2020-02-01T00:00:00Z",
+		"30 7 * * *":   "2020-02-01T07:30:00Z",
+		"0 0 29 2 *":   "2020-02-29T00:00:00Z",
+		"0 12 * * mon": "2020-02-03T12:00:00Z",
+		// Either day of month or day of week matches when both are restricted
+		"0 12 15 * mon": "2020-02-03T12:00:00Z",
+		"0 12 1 * mon":  "2020-02-01T12:00:00Z",
+		"0 0 1 jun *":   "2020-05-31T23:00:00Z", // British summer time is an hour ahead of UTC
+	} {
+		expr, err := ParseCron(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expr.Next(after, london); got.UTC().Format(time.RFC3339) != next {
+			t.Fatal(text, got)
+		}
+	}
+	// The same expression matches different instants in different time zones
+	expr, _ := ParseCron("0 9 * * *")
+	if got := expr.Next(after, time.UTC); got.Format(time.RFC3339) != "2020-02-01T09:00:00Z" {
+		t.Fatal(got)
+	}
+	if tokyo, err := time.LoadLocation("Asia/Tokyo"); err == nil {
+		if got := expr.Next(after, tokyo); got.UTC().Format(time.RFC3339) != "2020-02-01T00:00:00Z" {
+			t.Fatal(got)
+		}
+	}
+	// Skip the local time that does not exist when daylight saving time begins
+	expr, _ = ParseCron("30 1 * * *")
+	after, _ = time.Parse(time.RFC3339, "2020-03-28T12:00:00Z")
+	if got := expr.Next(after, london); got.UTC().Format(time.RFC3339) != "2020-03-30T00:30:00Z" {
+		t.Fatal(got)
+	}
+	// The 30th of February never comes
+	expr, _ = ParseCron("0 0 30 2 *")
+	if got := expr.Next(after, london); !got.IsZero() {
+		t.Fatal(got)
+	}
+}
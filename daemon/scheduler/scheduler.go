@@ -0,0 +1,417 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// DefaultCommandTimeoutSec is the default timeout of scheduled commands.
+	DefaultCommandTimeoutSec = 60
+	// MaxMissedRunsToCount is the maximum number of missed runs to count for a schedule after downtime.
+	MaxMissedRunsToCount = 10000
+	// NoSinks is the placeholder of an empty list of sinks in the command that defines a schedule.
+	NoSinks = "-"
+)
+
+// ErrBadScheduleCommand reminds user of the proper syntax to list, define, remove, or run schedules.
+var ErrBadScheduleCommand = errors.New(`list | set NAME SINK1,SINK2|- TIMEZONE CRON APP-COMMAND | del NAME | run NAME`)
+
+// Schedule runs an app command at the times matched by a cron expression, and delivers the result to sinks.
+type Schedule struct {
+	Cron     string   `json:"Cron"`     // Cron is the cron expression of five fields (e.g. "30 7 * * mon-fri"), or a macro such as "@daily".
+	TimeZone string   `json:"TimeZone"` // TimeZone is the IANA name of the cron expression's time zone, e.g. "Europe/London". It defaults to the server's time zone.
+	Command  string   `json:"Command"`  // Command is the app command to run, without the password PIN.
+	Sinks    []string `json:"Sinks"`    // Sinks are the names of sinks that receive the command result.
+
+	expr     *CronExpression
+	location *time.Location
+}
+
+// Initialise parses the cron expression and time zone, and makes sure that the sinks are defined.
+func (sched *Schedule) Initialise(sinks map[string]*Sink) (err error) {
+	if strings.TrimSpace(sched.Command) == "" {
+		return errors.New("Command must not be empty")
+	}
+	if sched.expr, err = ParseCron(sched.Cron); err != nil {
+		return
+	}
+	timeZone := sched.TimeZone
+	if timeZone == "" {
+		timeZone = "Local"
+	}
+	if sched.location, err = time.LoadLocation(timeZone); err != nil {
+		return fmt.Errorf("failed to load time zone \"%s\" - %v", sched.TimeZone, err)
+	}
+	if sched.expr.Next(time.Now(), sched.location).IsZero() {
+		return fmt.Errorf("cron expression \"%s\" never matches", sched.Cron)
+	}
+	for _, name := range sched.Sinks {
+		if _, exists := sinks[name]; !exists {
+			return fmt.Errorf("sink \"%s\" is not defined", name)
+		}
+	}
+	return nil
+}
+
+// schedulerState is persisted in the state file, it keeps the schedules defined at runtime and the time of latest runs.
+type schedulerState struct {
+	// LastRun is the minute of each schedule's latest run, keyed by schedule name.
+	LastRun map[string]time.Time `json:"LastRun"`
+	// Edits are the schedules defined at runtime, they take precedence over the configuration. A nil schedule is removed.
+	Edits map[string]*Schedule `json:"Edits"`
+}
+
+/*
+Daemon runs app commands on schedules of cron expressions, and delivers the results to sinks such as mail recipients,
+telegram chat, SMS, and webhook. If the daemon was not running when schedules were due, the sinks receive a report of the
+missed runs rather than the results of late runs. Schedules may be listed and edited at runtime using the environment
+control app.
+*/
+type Daemon struct {
+	Schedules map[string]*Schedule `json:"Schedules"` // Schedules are keyed by schedule name.
+	Sinks     map[string]*Sink     `json:"Sinks"`     // Sinks are keyed by sink name, which schedules refer to.
+	// StateFilePath is the JSON file that keeps the schedules defined at runtime and the time of latest runs, which tells the missed runs.
+	StateFilePath string `json:"StateFilePath"`
+	// CommandTimeoutSec is the timeout of each scheduled command.
+	CommandTimeoutSec int `json:"CommandTimeoutSec"`
+	// TelegramAuthorizationToken is the telegram bot API token used to deliver results to telegram chats, it defaults to the one of telegram bot daemon.
+	TelegramAuthorizationToken string `json:"TelegramAuthorizationToken"`
+
+	MailClient inet.MailClient           `json:"-"` // MailClient delivers results to mail recipients.
+	Processor  *toolbox.CommandProcessor `json:"-"` // Processor runs the scheduled commands.
+
+	schedules   map[string]*Schedule // schedules are the effective schedules made of configuration and runtime edits.
+	state       schedulerState       // state is persisted to the state file.
+	lastChecked map[string]time.Time // lastChecked is the latest minute that each schedule has been checked for runs.
+	pin         string               // pin is the password PIN that authenticates scheduled commands.
+	pending     int32                // pending is the number of scheduled commands and deliveries in progress.
+	mutex       *sync.Mutex
+
+	loopIsRunning int32     // loopIsRunning has value 1 only when the daemon loop is running.
+	stop          chan bool // stop signals daemon loop to stop
+	// getNow returns the current time, it is replaced by test cases to simulate passage of time.
+	getNow func() time.Time
+	logger lalog.Logger
+}
+
+// Initialise validates configuration, restores the state from the state file, and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	if daemon.CommandTimeoutSec < 1 {
+		daemon.CommandTimeoutSec = DefaultCommandTimeoutSec
+	}
+	daemon.logger = lalog.Logger{ComponentName: "scheduler", ComponentID: []lalog.LoggerIDField{{Key: "Schedules", Value: len(daemon.Schedules)}}}
+	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
+		return errors.New("scheduler.Initialise: command processor and its filters must be configured")
+	}
+	daemon.Processor.SetLogger(daemon.logger)
+	// Scheduled commands are authenticated by the password PIN
+	for _, filter := range daemon.Processor.CommandFilters {
+		if pinFilter, ok := filter.(*toolbox.PINAndShortcuts); ok {
+			daemon.pin = pinFilter.PIN
+		}
+	}
+	if daemon.pin == "" {
+		return errors.New("scheduler.Initialise: PINAndShortcuts must have a password PIN")
+	}
+	for name, sink := range daemon.Sinks {
+		if sink == nil {
+			return fmt.Errorf("scheduler.Initialise: sink \"%s\" must not be empty", name)
+		}
+		if err := sink.Initialise(daemon); err != nil {
+			return fmt.Errorf("scheduler.Initialise: sink \"%s\" - %v", name, err)
+		}
+	}
+	daemon.mutex = new(sync.Mutex)
+	daemon.state = schedulerState{LastRun: make(map[string]time.Time), Edits: make(map[string]*Schedule)}
+	if daemon.StateFilePath != "" {
+		content, err := ioutil.ReadFile(daemon.StateFilePath)
+		if err == nil {
+			if err := json.Unmarshal(content, &daemon.state); err != nil {
+				return fmt.Errorf("scheduler.Initialise: failed to deserialise state file - %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("scheduler.Initialise: failed to read state file - %v", err)
+		}
+	}
+	daemon.schedules = make(map[string]*Schedule)
+	for name, sched := range daemon.Schedules {
+		if sched == nil {
+			return fmt.Errorf("scheduler.Initialise: schedule \"%s\" must not be empty", name)
+		}
+		if err := sched.Initialise(daemon.Sinks); err != nil {
+			return fmt.Errorf("scheduler.Initialise: schedule \"%s\" - %v", name, err)
+		}
+		daemon.schedules[name] = sched
+	}
+	for name, sched := range daemon.state.Edits {
+		if sched == nil {
+			delete(daemon.schedules, name)
+			continue
+		}
+		// The configuration may have changed since the schedule was defined at runtime, e.g. its sink is gone.
+		if err := sched.Initialise(daemon.Sinks); err != nil {
+			daemon.logger.Warning("Initialise", name, err, "ignore the schedule defined at runtime")
+			continue
+		}
+		daemon.schedules[name] = sched
+	}
+	// Missed runs are counted from the latest run before the daemon was last stopped
+	daemon.lastChecked = make(map[string]time.Time)
+	for name, lastRun := range daemon.state.LastRun {
+		daemon.lastChecked[name] = lastRun
+	}
+	if daemon.getNow == nil {
+		daemon.getNow = time.Now
+	}
+	daemon.stop = make(chan bool)
+	return nil
+}
+
+// saveState writes the state into the state file, if the file is configured. The caller must hold the mutex.
+func (daemon *Daemon) saveState() {
+	if daemon.StateFilePath == "" {
+		return
+	}
+	content, err := json.MarshalIndent(daemon.state, "", "  ")
+	if err != nil {
+		daemon.logger.Warning("saveState", "", err, "failed to serialise state")
+		return
+	}
+	// Write into a temporary file first, so that a crash does not leave the state file half-written.
+	tmpPath := daemon.StateFilePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		daemon.logger.Warning("saveState", "", err, "failed to write state file")
+		return
+	}
+	if err := os.Rename(tmpPath, daemon.StateFilePath); err != nil {
+		daemon.logger.Warning("saveState", "", err, "failed to write state file")
+	}
+}
+
+// deliver sends the report to the sinks of the schedule in background.
+func (daemon *Daemon) deliver(sched *Schedule, report Report) {
+	for _, sinkName := range sched.Sinks {
+		sink := daemon.Sinks[sinkName]
+		atomic.AddInt32(&daemon.pending, 1)
+		go func(sinkName string, sink *Sink) {
+			defer atomic.AddInt32(&daemon.pending, -1)
+			for _, err := range sink.Deliver(daemon, report) {
+				daemon.logger.Warning("deliver", report.Schedule, err, "failed to deliver report to sink \"%s\"", sinkName)
+			}
+		}(sinkName, sink)
+	}
+}
+
+// run runs the scheduled command in background, and then delivers the result. The caller must hold the mutex.
+func (daemon *Daemon) run(name string, sched *Schedule, scheduledTime time.Time) {
+	daemon.state.LastRun[name] = scheduledTime
+	daemon.saveState()
+	atomic.AddInt32(&daemon.pending, 1)
+	go func() {
+		defer atomic.AddInt32(&daemon.pending, -1)
+		beginTimeNano := time.Now().UnixNano()
+		result := daemon.Processor.Process(toolbox.Command{
+			DaemonName: "scheduler",
+			ClientID:   name,
+			TimeoutSec: daemon.CommandTimeoutSec,
+			Content:    daemon.pin + sched.Command,
+		}, true)
+		misc.SchedulerStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+		daemon.logger.Info("run", name, result.Error, "completed scheduled command")
+		daemon.deliver(sched, Report{Schedule: name, ScheduledTime: scheduledTime.In(sched.location), Result: result})
+	}()
+}
+
+/*
+tick runs the schedules that are due in the minute of the current time, and reports the runs missed since a schedule
+was last checked, which happens when the daemon was not running.
+*/
+func (daemon *Daemon) tick(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	for name, sched := range daemon.schedules {
+		since, exists := daemon.lastChecked[name]
+		if !exists {
+			// A new schedule may run in the current minute
+			since = minute.Add(-time.Minute)
+		}
+		if !since.Before(minute) {
+			continue
+		}
+		daemon.lastChecked[name] = minute
+		missed := 0
+		var latestMissed time.Time
+		for next := sched.expr.Next(since, sched.location); !next.IsZero() && next.Before(minute) && missed < MaxMissedRunsToCount; next = sched.expr.Next(next, sched.location) {
+			missed++
+			latestMissed = next
+		}
+		if missed > 0 {
+			daemon.logger.Warning("tick", name, nil, "missed %d runs, the latest was due at %s", missed, latestMissed)
+			daemon.deliver(sched, Report{Schedule: name, ScheduledTime: latestMissed, MissedRuns: missed})
+		}
+		if sched.expr.Matches(minute.In(sched.location)) {
+			daemon.run(name, sched, minute)
+		}
+	}
+}
+
+// StartAndBlock checks the schedules at the beginning of each minute, until the daemon is stopped.
+func (daemon *Daemon) StartAndBlock() error {
+	daemon.logger.Info("StartAndBlock", "", nil, "going to run %d schedules", len(daemon.schedules))
+	atomic.StoreInt32(&daemon.loopIsRunning, 1)
+	defer atomic.StoreInt32(&daemon.loopIsRunning, 0)
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
+			return misc.ErrEmergencyLockDown
+		}
+		now := daemon.getNow()
+		daemon.tick(now)
+		select {
+		case <-daemon.stop:
+			return nil
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+	}
+}
+
+// Stop the daemon loop, the scheduled commands that are already running will continue nonetheless.
+func (daemon *Daemon) Stop() {
+	if atomic.CompareAndSwapInt32(&daemon.loopIsRunning, 1, 0) {
+		daemon.stop <- true
+	}
+}
+
+/*
+Shutdown stops the daemon loop, and then waits for the running commands and deliveries to complete. If the context is
+done before then, the function gives up waiting and returns an error.
+*/
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	daemon.Stop()
+	for atomic.LoadInt32(&daemon.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("scheduler.Shutdown: %d commands and deliveries are still in progress - %v", atomic.LoadInt32(&daemon.pending), ctx.Err())
+		case <-time.After(common.ShutdownPollIntervalMilli * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// popWord returns the first word of the text, and the text that follows the word without leading spaces.
+func popWord(text string) (word, rest string) {
+	text = strings.TrimSpace(text)
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end == -1 {
+		return text, ""
+	}
+	return text[:end], strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+}
+
+/*
+Manage lists, defines, removes, or runs schedules according to the parameters:
+  - "list" (or empty) lists the schedules and the time of their next run.
+  - "set NAME SINK1,SINK2 TIMEZONE CRON APP-COMMAND" defines a schedule, or replaces the one of the same name. The sinks
+    may be "-" for none, and the cron expression is made of five fields or a single macro such as "@daily".
+  - "del NAME" removes a schedule.
+  - "run NAME" runs a schedule right away.
+*/
+func (daemon *Daemon) Manage(params string) (string, error) {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	action, rest := popWord(params)
+	switch strings.ToLower(action) {
+	case "", "list":
+		return daemon.list(), nil
+	case "set":
+		name, rest := popWord(rest)
+		sinks, rest := popWord(rest)
+		timeZone, rest := popWord(rest)
+		cronFields := make([]string, 0, 5)
+		var field string
+		for len(cronFields) < 5 {
+			if field, rest = popWord(rest); field == "" {
+				return "", ErrBadScheduleCommand
+			}
+			cronFields = append(cronFields, field)
+			if strings.HasPrefix(field, "@") {
+				break
+			}
+		}
+		sched := &Schedule{Cron: strings.Join(cronFields, " "), TimeZone: timeZone, Command: rest}
+		if sinks != NoSinks {
+			sched.Sinks = strings.Split(sinks, ",")
+		}
+		if name == "" || timeZone == "" {
+			return "", ErrBadScheduleCommand
+		}
+		if err := sched.Initialise(daemon.Sinks); err != nil {
+			return "", err
+		}
+		daemon.schedules[name] = sched
+		daemon.state.Edits[name] = sched
+		// The new schedule may run in the current minute
+		delete(daemon.lastChecked, name)
+		daemon.saveState()
+		return fmt.Sprintf("schedule %s is saved, it will run next at %s", name, sched.expr.Next(daemon.getNow(), sched.location).Format("2006-01-02 15:04 MST")), nil
+	case "del":
+		name, _ := popWord(rest)
+		if _, exists := daemon.schedules[name]; !exists {
+			return "", fmt.Errorf("schedule \"%s\" does not exist", name)
+		}
+		delete(daemon.schedules, name)
+		delete(daemon.state.LastRun, name)
+		daemon.state.Edits[name] = nil
+		daemon.saveState()
+		return fmt.Sprintf("schedule %s is removed", name), nil
+	case "run":
+		name, _ := popWord(rest)
+		sched, exists := daemon.schedules[name]
+		if !exists {
+			return "", fmt.Errorf("schedule \"%s\" does not exist", name)
+		}
+		daemon.run(name, sched, daemon.getNow().Truncate(time.Minute))
+		return fmt.Sprintf("schedule %s is running", name), nil
+	}
+	return "", ErrBadScheduleCommand
+}
+
+// list returns one line of text for each schedule sorted by name. The caller must hold the mutex.
+func (daemon *Daemon) list() string {
+	names := make([]string, 0, len(daemon.schedules))
+	for name := range daemon.schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out bytes.Buffer
+	now := daemon.getNow()
+	for _, name := range names {
+		sched := daemon.schedules[name]
+		sinks := NoSinks
+		if len(sched.Sinks) > 0 {
+			sinks = strings.Join(sched.Sinks, ",")
+		}
+		out.WriteString(fmt.Sprintf("%s %s %s %s next=%s: %s\n", name, sinks, sched.location, sched.Cron,
+			sched.expr.Next(now, sched.location).Format("2006-01-02 15:04 MST"), sched.Command))
+	}
+	return out.String()
+}
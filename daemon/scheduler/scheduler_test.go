@@ -0,0 +1,228 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// startWebhook starts a web server that forwards the payloads it receives to the returned channel.
+func startWebhook(t *testing.T) (*httptest.Server, chan webhookPayload) {
+	payloads := make(chan webhookPayload, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		payloads <- payload
+	}))
+	return srv, payloads
+}
+
+// receivePayloads waits for and returns the number of payloads, keyed by schedule name and the number of missed runs.
+func receivePayloads(t *testing.T, payloads chan webhookPayload, count int) map[string]webhookPayload {
+	ret := make(map[string]webhookPayload)
+	for i := 0; i < count; i++ {
+		select {
+		case payload := <-payloads:
+			ret[fmt.Sprintf("%s-%d", payload.Schedule, payload.MissedRuns)] = payload
+		case <-time.After(10 * time.Second):
+			t.Fatal("did not receive payload")
+		}
+	}
+	select {
+	case payload := <-payloads:
+		t.Fatal("unexpected payload", payload)
+	case <-time.After(500 * time.Millisecond):
+	}
+	return ret
+}
+
+func TestDaemon_Initialise(t *testing.T) {
+	daemon := Daemon{}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.Processor = toolbox.GetTestCommandProcessor()
+	daemon.Sinks = map[string]*Sink{"nothing": {}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	// Mail client and telegram bot are not configured
+	daemon.Sinks = map[string]*Sink{"mail": {MailRecipients: []string{"me@example.com"}}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.Sinks = map[string]*Sink{"telegram": {TelegramChatID: 123}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.Sinks = map[string]*Sink{"hook": {WebhookURL: "http://localhost"}}
+	for _, sched := range []*Schedule{
+		{Cron: "* * * *", Command: ".s echo"},
+		{Cron: "0 0 30 2 *", Command: ".s echo"},
+		{Cron: "* * * * *", TimeZone: "Nowhere/Nowhere", Command: ".s echo"},
+		{Cron: "* * * * *", Command: ".s echo", Sinks: []string{"nothing"}},
+		{Cron: "* * * * *", Command: ""},
+	} {
+		daemon.Schedules = map[string]*Schedule{"sched": sched}
+		if err := daemon.Initialise(); err == nil {
+			t.Fatal("did not error", sched)
+		}
+	}
+	daemon.Schedules = map[string]*Schedule{"sched": {Cron: "@daily", Command: ".s echo", Sinks: []string{"hook"}}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemon_RunAndMissedRuns(t *testing.T) {
+	srv, payloads := startWebhook(t)
+	defer srv.Close()
+	stateFilePath := filepath.Join(os.TempDir(), "laitos-TestDaemon_RunAndMissedRuns.json")
+	defer os.Remove(stateFilePath)
+	os.Remove(stateFilePath)
+	now, _ := time.Parse(time.RFC3339, "2020-01-01T07:00:10Z")
+	newDaemon := func() *Daemon {
+		daemon := &Daemon{
+			Schedules: map[string]*Schedule{
+				"minutely": {Cron: "* * * * *", TimeZone: "UTC", Command: ".s echo hi", Sinks: []string{"hook"}},
+				"hourly":   {Cron: "@hourly", TimeZone: "UTC", Command: ".s echo", Sinks: []string{"hook"}},
+			},
+			Sinks:         map[string]*Sink{"hook": {WebhookURL: srv.URL}},
+			StateFilePath: stateFilePath,
+			Processor:     toolbox.GetTestCommandProcessor(),
+			getNow:        func() time.Time { return now },
+		}
+		if err := daemon.Initialise(); err != nil {
+			t.Fatal(err)
+		}
+		return daemon
+	}
+	daemon := newDaemon()
+	// Both schedules run at the beginning of an hour
+	daemon.tick(now)
+	received := receivePayloads(t, payloads, 2)
+	if payload := received["minutely-0"]; payload.ScheduledTime != "2020-01-01T07:00:00Z" || !strings.Contains(string(payload.Result), `hi`) {
+		t.Fatal(received)
+	}
+	// Each schedule runs at most once a minute
+	daemon.tick(now.Add(30 * time.Second))
+	receivePayloads(t, payloads, 0)
+	daemon.tick(now.Add(time.Minute))
+	receivePayloads(t, payloads, 1)
+	if err := daemon.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// After downtime, the missed runs are reported before the schedule runs again
+	now = now.Add(10 * time.Minute)
+	daemon = newDaemon()
+	daemon.tick(now)
+	received = receivePayloads(t, payloads, 2)
+	if payload := received["minutely-8"]; payload.ScheduledTime != "2020-01-01T07:09:00Z" || len(payload.Result) != 0 {
+		t.Fatal(received)
+	}
+	if payload := received["minutely-0"]; payload.ScheduledTime != "2020-01-01T07:10:00Z" {
+		t.Fatal(received)
+	}
+	if err := daemon.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDaemon_Manage(t *testing.T) {
+	srv, payloads := startWebhook(t)
+	defer srv.Close()
+	stateFilePath := filepath.Join(os.TempDir(), "laitos-TestDaemon_Manage.json")
+	defer os.Remove(stateFilePath)
+	os.Remove(stateFilePath)
+	now, _ := time.Parse(time.RFC3339, "2020-01-01T07:00:10Z")
+	newDaemon := func() *Daemon {
+		daemon := &Daemon{
+			Schedules:     map[string]*Schedule{"daily": {Cron: "@daily", TimeZone: "UTC", Command: ".s echo", Sinks: []string{"hook"}}},
+			Sinks:         map[string]*Sink{"hook": {WebhookURL: srv.URL}},
+			StateFilePath: stateFilePath,
+			Processor:     toolbox.GetTestCommandProcessor(),
+			getNow:        func() time.Time { return now },
+		}
+		if err := daemon.Initialise(); err != nil {
+			t.Fatal(err)
+		}
+		return daemon
+	}
+	daemon := newDaemon()
+	for _, params := range []string{"bad", "set", "set a hook", "set a hook UTC 1 2 3", "set a nothing UTC @daily .s echo",
+		"set a hook UTC 61 * * * * .s echo", "set a hook UTC @daily", "del nothing", "run nothing"} {
+		if _, err := daemon.Manage(params); err == nil {
+			t.Fatal("did not error", params)
+		}
+	}
+	if out, err := daemon.Manage("set weekly - UTC 30 8 * * MON .s echo  Weekly"); err != nil || out != "schedule weekly is saved, it will run next at 2020-01-06 08:30 UTC" {
+		t.Fatal(out, err)
+	}
+	if out, err := daemon.Manage("set daily hook UTC @daily .s echo hello"); err != nil {
+		t.Fatal(out, err)
+	}
+	if out, err := daemon.Manage(""); err != nil || out != "daily hook UTC @daily next=2020-01-02 00:00 UTC: .s echo hello\nweekly - UTC 30 8 * * MON next=2020-01-06 08:30 UTC: .s echo  Weekly\n" {
+		t.Fatal(out, err)
+	}
+	if out, err := daemon.Manage("run daily"); err != nil || out != "schedule daily is running" {
+		t.Fatal(out, err)
+	}
+	if payload := receivePayloads(t, payloads, 1)["daily-0"]; !strings.Contains(string(payload.Result), "hello") {
+		t.Fatal(payload)
+	}
+	// Runtime edits are restored from the state file, and they take precedence over the configuration.
+	daemon = newDaemon()
+	if out, err := daemon.Manage("del weekly"); err != nil || out != "schedule weekly is removed" {
+		t.Fatal(out, err)
+	}
+	daemon = newDaemon()
+	if out, err := daemon.Manage("list"); err != nil || out != "daily hook UTC @daily next=2020-01-02 00:00 UTC: .s echo hello\n" {
+		t.Fatal(out, err)
+	}
+	if _, err := daemon.Manage("del daily"); err != nil {
+		t.Fatal(err)
+	}
+	daemon = newDaemon()
+	if out, err := daemon.Manage("list"); err != nil || out != "" {
+		t.Fatal(out, err)
+	}
+}
+
+func TestDaemon_StartAndBlock(t *testing.T) {
+	daemon := Daemon{Processor: toolbox.GetTestCommandProcessor()}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- daemon.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+	if err := daemon.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
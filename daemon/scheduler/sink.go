@@ -0,0 +1,138 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/telegrambot"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// DeliveryTimeoutSec is the timeout of each attempt to deliver a report to a sink.
+const DeliveryTimeoutSec = 30
+
+/*
+Sink is a destination of the reports of scheduled commands. A sink may deliver each report to several destinations at
+once, such as mail recipients and a telegram chat.
+*/
+type Sink struct {
+	MailRecipients []string `json:"MailRecipients"` // MailRecipients receive the reports via mail client of the daemon.
+	TelegramChatID int64    `json:"TelegramChatID"` // TelegramChatID is the telegram chat that receives the reports via the telegram bot.
+	SMSPhoneNumber string   `json:"SMSPhoneNumber"` // SMSPhoneNumber is the phone number (e.g. +4412345678) that receives the reports via Twilio.
+	WebhookURL     string   `json:"WebhookURL"`     // WebhookURL receives the reports in JSON via HTTP POST.
+}
+
+// Report is the outcome of a scheduled run, or the runs that were missed while the daemon was not running.
+type Report struct {
+	Schedule      string          // Schedule is the name of the schedule.
+	ScheduledTime time.Time       // ScheduledTime is the minute when the command was supposed to run, or the latest missed run.
+	MissedRuns    int             // MissedRuns is the number of runs that were missed, it is 0 if the command has run.
+	Result        *toolbox.Result // Result is the command result, it is nil if the runs were missed.
+}
+
+// webhookPayload is the JSON content sent to a webhook.
+type webhookPayload struct {
+	Schedule      string          `json:"Schedule"`
+	ScheduledTime string          `json:"ScheduledTime"`
+	MissedRuns    int             `json:"MissedRuns"`
+	Result        json.RawMessage `json:"Result,omitempty"`
+}
+
+// GetSubject returns a short text that identifies the report, such as a mail subject.
+func (report Report) GetSubject() string {
+	if report.Result == nil {
+		return fmt.Sprintf("schedule %s missed %d runs", report.Schedule, report.MissedRuns)
+	}
+	return fmt.Sprintf("schedule %s ran at %s", report.Schedule, report.ScheduledTime.Format("2006-01-02 15:04 MST"))
+}
+
+// GetText returns the report in text, it is the command output if the command has run.
+func (report Report) GetText() string {
+	if report.Result == nil {
+		return fmt.Sprintf("schedule %s missed %d runs while laitos was not running, the latest was due at %s",
+			report.Schedule, report.MissedRuns, report.ScheduledTime.Format("2006-01-02 15:04 MST"))
+	}
+	return report.Result.CombinedOutput
+}
+
+// Initialise validates the sink configuration against the facilities available to the daemon.
+func (sink *Sink) Initialise(daemon *Daemon) error {
+	if len(sink.MailRecipients) == 0 && sink.TelegramChatID == 0 && sink.SMSPhoneNumber == "" && sink.WebhookURL == "" {
+		return errors.New("a sink must have at least one of MailRecipients, TelegramChatID, SMSPhoneNumber, and WebhookURL")
+	}
+	if len(sink.MailRecipients) > 0 && !daemon.MailClient.IsConfigured() {
+		return errors.New("MailClient must be configured to deliver to MailRecipients")
+	}
+	if sink.TelegramChatID != 0 && daemon.TelegramAuthorizationToken == "" {
+		return errors.New("TelegramAuthorizationToken must be configured to deliver to TelegramChatID")
+	}
+	if sink.SMSPhoneNumber != "" {
+		if !strings.HasPrefix(sink.SMSPhoneNumber, "+") {
+			return errors.New("SMSPhoneNumber must begin with + and country code")
+		}
+		if !daemon.Processor.Features.Twilio.IsConfigured() {
+			return errors.New("Twilio app must be configured to deliver to SMSPhoneNumber")
+		}
+	}
+	return nil
+}
+
+// Deliver sends the report to all destinations of the sink, and returns the delivery errors if any.
+func (sink *Sink) Deliver(daemon *Daemon, report Report) (errs []error) {
+	if len(sink.MailRecipients) > 0 {
+		if err := daemon.MailClient.Send(report.GetSubject(), report.GetText(), sink.MailRecipients...); err != nil {
+			errs = append(errs, fmt.Errorf("mail - %v", err))
+		}
+	}
+	if sink.TelegramChatID != 0 {
+		bot := telegrambot.Daemon{AuthorizationToken: daemon.TelegramAuthorizationToken}
+		if err := bot.ReplyTo(sink.TelegramChatID, report.Schedule+": "+report.GetText()); err != nil {
+			errs = append(errs, fmt.Errorf("telegram - %v", err))
+		}
+	}
+	if sink.SMSPhoneNumber != "" {
+		result := daemon.Processor.Features.Twilio.SendSMS(toolbox.Command{
+			TimeoutSec: DeliveryTimeoutSec,
+			Content:    sink.SMSPhoneNumber + " " + report.Schedule + ": " + report.GetText(),
+		})
+		if result.Error != nil {
+			errs = append(errs, fmt.Errorf("SMS - %v", result.Error))
+		}
+	}
+	if sink.WebhookURL != "" {
+		payload := webhookPayload{
+			Schedule:      report.Schedule,
+			ScheduledTime: report.ScheduledTime.Format(time.RFC3339),
+			MissedRuns:    report.MissedRuns,
+		}
+		if report.Result != nil {
+			serialised, err := report.Result.ToJSON()
+			if err != nil {
+				return append(errs, fmt.Errorf("webhook - %v", err))
+			}
+			payload.Result = serialised
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return append(errs, fmt.Errorf("webhook - %v", err))
+		}
+		resp, err := inet.DoHTTP(inet.HTTPRequest{
+			TimeoutSec:  DeliveryTimeoutSec,
+			Method:      http.MethodPost,
+			ContentType: "application/json",
+			Body:        strings.NewReader(string(body)),
+		}, strings.Replace(sink.WebhookURL, "%", "%%", -1))
+		if err == nil {
+			err = resp.Non2xxToError()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook - %v", err))
+		}
+	}
+	return
+}
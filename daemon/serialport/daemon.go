@@ -1,6 +1,7 @@
 package serialport
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -216,6 +217,12 @@ func (daemon *Daemon) Stop() {
 	}
 }
 
+// Shutdown stops serial device detection and terminates conversations with the connected devices.
+func (daemon *Daemon) Shutdown(_ context.Context) error {
+	daemon.Stop()
+	return nil
+}
+
 // TestDaemon provides unit test coverage for the serial port daemon.
 func TestDaemon(daemon *Daemon, t testingstub.T) {
 	// Instead of emulating a serial device driven by OS driver, the test subject simply uses a text file with a line of command.
@@ -9,6 +9,7 @@ package simpleipsvcd
 
 import (
 	"bufio"
+	"context"
 	"io/ioutil"
 	"net"
 	"strconv"
@@ -148,6 +149,22 @@ func (daemon *Daemon) Stop() {
 	}
 }
 
+// Shutdown stops all TCP and UDP servers from accepting new clients, and waits for ongoing conversations to complete.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	shutdownFuns := make([]func(context.Context) error, 0, len(daemon.tcpServers)+len(daemon.udpServers))
+	for _, server := range daemon.tcpServers {
+		if server != nil {
+			shutdownFuns = append(shutdownFuns, server.Shutdown)
+		}
+	}
+	for _, server := range daemon.udpServers {
+		if server != nil {
+			shutdownFuns = append(shutdownFuns, server.Shutdown)
+		}
+	}
+	return common.ShutdownConcurrently(ctx, shutdownFuns...)
+}
+
 // responseActiveUsers returns configured active system user names in response to a sysstat service client.
 func (daemon *Daemon) responseActiveUsers() string {
 	return daemon.ActiveUserNames + "\r\n"
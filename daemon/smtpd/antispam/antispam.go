@@ -0,0 +1,296 @@
+/*
+antispam package gives a spam score to the SMTP conversations and mails arriving at the SMTP server. A pipeline of checks
+examines the conversation when the client names each recipient, and once more after the mail message has arrived. The
+accumulated score decides whether the mail is accepted, tagged as spam, or rejected.
+*/
+package antispam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultTagScore    = 5  // DefaultTagScore is the default score at which a mail is tagged as spam.
+	DefaultRejectScore = 10 // DefaultRejectScore is the default score at which a mail is rejected.
+
+	// HeaderSpamStatus is the name of the header that carries the spam score and the indications that contributed to it.
+	HeaderSpamStatus = "X-Spam-Status"
+	// HeaderSpamFlag is the name of the header that is present only if the mail is tagged as spam.
+	HeaderSpamFlag = "X-Spam-Flag"
+)
+
+// Conversation is the information about an SMTP conversation available to the checks.
+type Conversation struct {
+	ClientIP  string // ClientIP is the IP address of the SMTP client.
+	HELO      string // HELO is the host name that the client introduced itself with.
+	MailFrom  string // MailFrom is the address of the MAIL FROM command.
+	Recipient string // Recipient is the address of the latest RCPT TO command, it is only available to CheckRecipient.
+	Message   []byte // Message is the mail message, it is only available to CheckMessage.
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Score float64  // Score is positive if the check finds the conversation suspicious.
+	Tests []string // Tests name the indications that contributed to the score, such as "HELO_BARE_IP".
+	Defer bool     // Defer asks the client to deliver the mail to the recipient later, it is how greylisting works.
+}
+
+// Check examines an SMTP conversation for indications of spam.
+type Check interface {
+	// CheckRecipient examines the conversation when the client names a recipient.
+	CheckRecipient(conv *Conversation) Result
+	// CheckMessage examines the conversation after the mail message has arrived.
+	CheckMessage(conv *Conversation) Result
+}
+
+// Persistent is implemented by the checks that keep their state on disk.
+type Persistent interface {
+	// Save writes the latest state of the check to disk.
+	Save() error
+}
+
+// Action is the decision made about a conversation according to its spam score.
+type Action int
+
+const (
+	ActionAccept Action = iota // ActionAccept accepts the mail as it is.
+	ActionTag                  // ActionTag accepts the mail, and tags it as spam.
+	ActionReject               // ActionReject rejects the mail.
+	ActionDefer                // ActionDefer asks the client to deliver the mail to the recipient later.
+)
+
+// Pipeline runs the checks over SMTP conversations and compares the accumulated score against the thresholds.
+type Pipeline struct {
+	Checks      []Check
+	TagScore    float64 // TagScore is the score at which a mail is tagged as spam.
+	RejectScore float64 // RejectScore is the score at which a mail is rejected.
+}
+
+// NewReport returns a new report that accumulates the results of the checks for a new SMTP conversation.
+func (pipeline *Pipeline) NewReport() *Report {
+	return &Report{pipeline: pipeline, scores: make([]float64, len(pipeline.Checks)), tests: make(map[string]struct{})}
+}
+
+// Save writes the latest state of the persistent checks to disk.
+func (pipeline *Pipeline) Save() error {
+	for _, check := range pipeline.Checks {
+		if persistent, ok := check.(Persistent); ok {
+			if err := persistent.Save(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Report accumulates the results of the checks applied to an SMTP conversation.
+type Report struct {
+	pipeline *Pipeline
+	// scores are the highest score given by each check, a check examines the conversation once for each recipient.
+	scores []float64
+	tests  map[string]struct{}
+}
+
+// add memorises the result of the check at the index, and returns true only if the result asks to defer the mail.
+func (report *Report) add(index int, result Result) bool {
+	if result.Score > report.scores[index] {
+		report.scores[index] = result.Score
+	}
+	for _, test := range result.Tests {
+		report.tests[test] = struct{}{}
+	}
+	return result.Defer
+}
+
+// action returns the action to take according to the accumulated score.
+func (report *Report) action() Action {
+	score := report.Score()
+	if score >= report.pipeline.RejectScore {
+		return ActionReject
+	} else if score >= report.pipeline.TagScore {
+		return ActionTag
+	}
+	return ActionAccept
+}
+
+/*
+Recipient runs the checks when the client names a recipient, and returns the action to take for the recipient. A
+recipient is deferred only if the conversation does not deserve a rejection.
+*/
+func (report *Report) Recipient(conv *Conversation) Action {
+	var deferred bool
+	for i, check := range report.pipeline.Checks {
+		if report.add(i, check.CheckRecipient(conv)) {
+			deferred = true
+		}
+	}
+	if action := report.action(); action == ActionReject || !deferred {
+		return action
+	}
+	return ActionDefer
+}
+
+// Message runs the checks after the mail message has arrived, and returns the action to take for the mail.
+func (report *Report) Message(conv *Conversation) Action {
+	for i, check := range report.pipeline.Checks {
+		report.add(i, check.CheckMessage(conv))
+	}
+	return report.action()
+}
+
+// Score returns the accumulated spam score of the conversation.
+func (report *Report) Score() (score float64) {
+	for _, checkScore := range report.scores {
+		score += checkScore
+	}
+	return
+}
+
+// Tests returns the sorted names of the indications that contributed to the spam score.
+func (report *Report) Tests() []string {
+	tests := make([]string, 0, len(report.tests))
+	for test := range report.tests {
+		tests = append(tests, test)
+	}
+	sort.Strings(tests)
+	return tests
+}
+
+// Header returns the value of X-Spam-Status header, e.g. "Yes, score=6.5 required=5.0 tests=HELO_BARE_IP,MISSING_DATE".
+func (report *Report) Header() string {
+	spam := "No"
+	if report.action() != ActionAccept {
+		spam = "Yes"
+	}
+	tests := "none"
+	if len(report.tests) > 0 {
+		tests = strings.Join(report.Tests(), ",")
+	}
+	return fmt.Sprintf("%s, score=%.1f required=%.1f tests=%s", spam, report.Score(), report.pipeline.TagScore, tests)
+}
+
+/*
+WithHeaders returns the mail message with X-Spam-Status header on top, as well as X-Spam-Flag header if the mail is
+tagged as spam. The spam headers that came with the mail are removed, as they must not be trusted. The new headers use
+the line terminator of the message.
+*/
+func (report *Report) WithHeaders(message []byte) []byte {
+	newline := "\r\n"
+	if !bytes.Contains(message, []byte("\r\n")) {
+		newline = "\n"
+	}
+	var out bytes.Buffer
+	out.WriteString(HeaderSpamStatus + ": " + report.Header() + newline)
+	if report.action() != ActionAccept {
+		out.WriteString(HeaderSpamFlag + ": YES" + newline)
+	}
+	// Copy the header fields except the spam headers, and then the body.
+	var skipping, inBody bool
+	for _, line := range bytes.SplitAfter(message, []byte("\n")) {
+		if !inBody {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				inBody = true
+			} else if line[0] == ' ' || line[0] == '\t' {
+				// A folded line continues the previous header field
+				if skipping {
+					continue
+				}
+			} else {
+				name := string(line)
+				if colon := strings.IndexByte(name, ':'); colon != -1 {
+					name = strings.TrimSpace(name[:colon])
+				}
+				skipping = strings.EqualFold(name, HeaderSpamStatus) || strings.EqualFold(name, HeaderSpamFlag)
+				if skipping {
+					continue
+				}
+			}
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// Config is the configuration of the spam filter, it is used to construct a pipeline of checks.
+type Config struct {
+	TagScore    float64 `json:"TagScore"`    // TagScore is the score at which a mail is tagged as spam.
+	RejectScore float64 `json:"RejectScore"` // RejectScore is the score at which a mail is rejected.
+
+	DNSBLZones []string `json:"DNSBLZones"` // DNSBLZones are the DNS blacklist zones to look up the client IP in, e.g. "zen.spamhaus.org".
+	DNSBLScore float64  `json:"DNSBLScore"` // DNSBLScore is the score given for each DNS blacklist zone that lists the client IP.
+
+	GreylistDelaySec int    `json:"GreylistDelaySec"` // GreylistDelaySec is the delay before a client may retry a greylisted mail, 0 disables greylisting.
+	GreylistFilePath string `json:"GreylistFilePath"` // GreylistFilePath is the file that keeps greylist triplets, they are kept in memory only if it is empty.
+
+	URLBlacklistScore float64 `json:"URLBlacklistScore"` // URLBlacklistScore is the score given to a mail that links to a blacklisted domain name or IP.
+}
+
+/*
+NewPipeline returns a pipeline of checks constructed according to the configuration. HELO and header checks are always
+present, whereas the other checks are present only if they are configured. The URL blacklist check also requires the
+blacklist function.
+*/
+func (config *Config) NewPipeline(myDomains []string, isBlacklisted func(nameOrIP string) bool) (*Pipeline, error) {
+	if config.TagScore == 0 {
+		config.TagScore = DefaultTagScore
+	}
+	if config.RejectScore == 0 {
+		config.RejectScore = DefaultRejectScore
+	}
+	if config.TagScore < 0 || config.RejectScore <= config.TagScore {
+		return nil, errors.New("antispam.NewPipeline: reject score must be greater than tag score, and both must be positive")
+	}
+	if config.DNSBLScore < 0 || config.URLBlacklistScore < 0 || config.GreylistDelaySec < 0 {
+		return nil, errors.New("antispam.NewPipeline: scores and greylist delay must not be negative")
+	}
+	pipeline := &Pipeline{
+		Checks:      []Check{&HELOCheck{MyDomains: myDomains}, &HeaderCheck{}},
+		TagScore:    config.TagScore,
+		RejectScore: config.RejectScore,
+	}
+	if len(config.DNSBLZones) > 0 {
+		if config.DNSBLScore == 0 {
+			config.DNSBLScore = DefaultDNSBLScore
+		}
+		pipeline.Checks = append(pipeline.Checks, &DNSBL{Zones: config.DNSBLZones, Score: config.DNSBLScore})
+	}
+	if config.GreylistDelaySec > 0 {
+		greylist := &Greylist{DelaySec: config.GreylistDelaySec, FilePath: config.GreylistFilePath}
+		if err := greylist.Initialise(); err != nil {
+			return nil, fmt.Errorf("antispam.NewPipeline: %v", err)
+		}
+		pipeline.Checks = append(pipeline.Checks, greylist)
+	}
+	if config.URLBlacklistScore > 0 && isBlacklisted != nil {
+		pipeline.Checks = append(pipeline.Checks, &URLCheck{IsBlacklisted: isBlacklisted, Score: config.URLBlacklistScore})
+	}
+	return pipeline, nil
+}
+
+// privateNetworks are the networks of IP addresses that do not belong to the public Internet.
+var privateNetworks = []net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)},
+}
+
+// publicIP returns the parsed IP address if it belongs to the public Internet, or nil otherwise.
+func publicIP(ip string) net.IP {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() || parsed.IsUnspecified() {
+		return nil
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(parsed) {
+			return nil
+		}
+	}
+	return parsed
+}
@@ -0,0 +1,104 @@
+package antispam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fixedCheck gives the same results to all conversations.
+type fixedCheck struct {
+	recipient, message Result
+}
+
+func (check *fixedCheck) CheckRecipient(*Conversation) Result {
+	return check.recipient
+}
+
+func (check *fixedCheck) CheckMessage(*Conversation) Result {
+	return check.message
+}
+
+func TestPipeline(t *testing.T) {
+	dnsbl := &fixedCheck{recipient: Result{Score: 3, Tests: []string{"DNSBL:a"}}}
+	greylist := &fixedCheck{recipient: Result{Defer: true}}
+	header := &fixedCheck{message: Result{Score: 2.5, Tests: []string{"MISSING_DATE", "MISSING_FROM"}}}
+	pipeline := &Pipeline{Checks: []Check{dnsbl, greylist, header}, TagScore: 5, RejectScore: 10}
+
+	report := pipeline.NewReport()
+	if action := report.Recipient(&Conversation{}); action != ActionDefer {
+		t.Fatal(action)
+	}
+	greylist.recipient.Defer = false
+	// The score of a check counts only once no matter how many recipients there are
+	for i := 0; i < 3; i++ {
+		if action := report.Recipient(&Conversation{}); action != ActionAccept || report.Score() != 3 {
+			t.Fatal(action, report.Score())
+		}
+	}
+	if action := report.Message(&Conversation{}); action != ActionTag || report.Score() != 5.5 {
+		t.Fatal(action, report.Score())
+	}
+	if tests := report.Tests(); !reflect.DeepEqual(tests, []string{"DNSBL:a", "MISSING_DATE", "MISSING_FROM"}) {
+		t.Fatal(tests)
+	}
+	if header := report.Header(); header != "Yes, score=5.5 required=5.0 tests=DNSBL:a,MISSING_DATE,MISSING_FROM" {
+		t.Fatal(header)
+	}
+
+	// Rejection takes precedence over greylisting
+	dnsbl.recipient.Score = 10
+	greylist.recipient.Defer = true
+	report = pipeline.NewReport()
+	if action := report.Recipient(&Conversation{}); action != ActionReject {
+		t.Fatal(action)
+	}
+}
+
+func TestReport_WithHeaders(t *testing.T) {
+	pipeline := &Pipeline{TagScore: 5, RejectScore: 10}
+	report := pipeline.NewReport()
+	message := "X-Spam-Status: No, score=0.0\r\n\tforged\r\nFrom: a@example.com\r\nX-Spam-Flag: NO\r\n\r\nX-Spam-Flag: body\r\n"
+	if out := string(report.WithHeaders([]byte(message))); out != "X-Spam-Status: No, score=0.0 required=5.0 tests=none\r\nFrom: a@example.com\r\n\r\nX-Spam-Flag: body\r\n" {
+		t.Fatal(out)
+	}
+	pipeline.Checks = []Check{&fixedCheck{message: Result{Score: 6, Tests: []string{"T"}}}}
+	report = pipeline.NewReport()
+	report.Message(&Conversation{})
+	if out := string(report.WithHeaders([]byte("Subject: s\n\nbody\n"))); out != "X-Spam-Status: Yes, score=6.0 required=5.0 tests=T\nX-Spam-Flag: YES\nSubject: s\n\nbody\n" {
+		t.Fatal(out)
+	}
+}
+
+func TestConfig_NewPipeline(t *testing.T) {
+	config := Config{TagScore: 5, RejectScore: 4}
+	if _, err := config.NewPipeline(nil, nil); err == nil || !strings.Contains(err.Error(), "reject score") {
+		t.Fatal(err)
+	}
+	config = Config{}
+	pipeline, err := config.NewPipeline([]string{"example.com"}, nil)
+	if err != nil || len(pipeline.Checks) != 2 || pipeline.TagScore != DefaultTagScore || pipeline.RejectScore != DefaultRejectScore {
+		t.Fatal(pipeline, err)
+	}
+	config = Config{DNSBLZones: []string{"zen.spamhaus.org"}, GreylistDelaySec: 60, URLBlacklistScore: 3}
+	pipeline, err = config.NewPipeline([]string{"example.com"}, func(string) bool { return false })
+	if err != nil || len(pipeline.Checks) != 5 || config.DNSBLScore != DefaultDNSBLScore {
+		t.Fatal(pipeline, err)
+	}
+	if err := pipeline.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, ip := range []string{"", "bad", "127.0.0.1", "::1", "10.1.2.3", "192.168.1.1", "172.20.0.1", "fd00::1", "169.254.1.1"} {
+		if publicIP(ip) != nil {
+			t.Fatal(ip)
+		}
+	}
+	for _, ip := range []string{"1.2.3.4", "2001:db8::1"} {
+		if publicIP(ip) == nil {
+			t.Fatal(ip)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package antispam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDNSBLScore      = 5       // DefaultDNSBLScore is the default score given for each DNS blacklist zone that lists the client IP.
+	DefaultDNSBLTimeoutSec = 5       // DefaultDNSBLTimeoutSec is the default timeout of the DNS lookups of all zones.
+	DNSBLCacheTTLSec       = 30 * 60 // DNSBLCacheTTLSec is the number of seconds to memorise the lookup results of a client IP.
+	DNSBLMaxCacheEntries   = 10000   // DNSBLMaxCacheEntries is the maximum number of client IPs to memorise, the cache is cleared when it is full.
+)
+
+// Resolver looks up the DNS records used by DNS blacklist. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dnsblCacheEntry memorises the DNS blacklist zones that listed a client IP.
+type dnsblCacheEntry struct {
+	listedIn []string
+	expiry   time.Time
+}
+
+/*
+DNSBL looks up the client IP in DNS blacklists (RFC 5782) when the client names a recipient, the check gives a score
+for each zone that lists the IP. The check does not apply to the client IPs outside of the public Internet.
+*/
+type DNSBL struct {
+	Zones      []string // Zones are the DNS blacklist zones, e.g. "zen.spamhaus.org".
+	Score      float64  // Score is given for each zone that lists the client IP.
+	Resolver   Resolver // Resolver looks up DNS records, it defaults to net.DefaultResolver.
+	TimeoutSec int      // TimeoutSec is the timeout of the DNS lookups of all zones.
+
+	cache map[string]dnsblCacheEntry
+	mutex sync.Mutex
+}
+
+// reverseIP returns the DNS blacklist query prefix of the IP address, e.g. "4.3.2.1" for 1.2.3.4.
+func reverseIP(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+	// An IPv6 address is queried by its nibbles in reverse order
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hexDigits[ip[i]&0xf]), string(hexDigits[ip[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+/*
+isListing returns true only if the DNS blacklist answered with a listing, which is an address among 127.0.0.0/8.
+Spamhaus answers with an address among 127.255.255.0/24 to tell a failure of the query, which is not a listing.
+*/
+func isListing(addrs []net.IPAddr) bool {
+	for _, addr := range addrs {
+		if ipv4 := addr.IP.To4(); ipv4 != nil && ipv4[0] == 127 && !(ipv4[1] == 255 && ipv4[2] == 255) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the zones that list the IP address. The result is memorised unless a lookup failed.
+func (dnsbl *DNSBL) lookup(ip net.IP, now time.Time) []string {
+	dnsbl.mutex.Lock()
+	if entry, exists := dnsbl.cache[ip.String()]; exists && now.Before(entry.expiry) {
+		dnsbl.mutex.Unlock()
+		return entry.listedIn
+	}
+	dnsbl.mutex.Unlock()
+
+	resolver := dnsbl.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeoutSec := dnsbl.TimeoutSec
+	if timeoutSec < 1 {
+		timeoutSec = DefaultDNSBLTimeoutSec
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSec)*time.Second)
+	defer cancel()
+	// Look up the IP in all zones in parallel
+	listed := make([]bool, len(dnsbl.Zones))
+	failed := make([]bool, len(dnsbl.Zones))
+	reversed := reverseIP(ip)
+	wg := new(sync.WaitGroup)
+	for i, zone := range dnsbl.Zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			addrs, err := resolver.LookupIPAddr(ctx, reversed+"."+strings.Trim(zone, "."))
+			if err != nil {
+				dnsErr, ok := err.(*net.DNSError)
+				failed[i] = !ok || !dnsErr.IsNotFound
+				return
+			}
+			listed[i] = isListing(addrs)
+		}(i, zone)
+	}
+	wg.Wait()
+	var listedIn []string
+	var anyFailure bool
+	for i, zone := range dnsbl.Zones {
+		if listed[i] {
+			listedIn = append(listedIn, zone)
+		}
+		anyFailure = anyFailure || failed[i]
+	}
+	if !anyFailure {
+		dnsbl.mutex.Lock()
+		if dnsbl.cache == nil || len(dnsbl.cache) >= DNSBLMaxCacheEntries {
+			dnsbl.cache = make(map[string]dnsblCacheEntry)
+		}
+		dnsbl.cache[ip.String()] = dnsblCacheEntry{listedIn: listedIn, expiry: now.Add(DNSBLCacheTTLSec * time.Second)}
+		dnsbl.mutex.Unlock()
+	}
+	return listedIn
+}
+
+// CheckRecipient gives a score for each DNS blacklist zone that lists the client IP.
+func (dnsbl *DNSBL) CheckRecipient(conv *Conversation) (result Result) {
+	ip := publicIP(conv.ClientIP)
+	if ip == nil {
+		return
+	}
+	for _, zone := range dnsbl.lookup(ip, time.Now()) {
+		result.Score += dnsbl.Score
+		result.Tests = append(result.Tests, "DNSBL:"+zone)
+	}
+	return
+}
+
+// CheckMessage does not examine the message.
+func (dnsbl *DNSBL) CheckMessage(*Conversation) Result {
+	return Result{}
+}
@@ -0,0 +1,74 @@
+package antispam
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers DNS queries from its map, and fails every query with the temporary error if it is set.
+type fakeResolver struct {
+	ip      map[string]string
+	queries int
+	tempErr error
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.queries++
+	if r.tempErr != nil {
+		return nil, r.tempErr
+	}
+	if ip, exists := r.ip[host]; exists {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestReverseIP(t *testing.T) {
+	if reversed := reverseIP(net.ParseIP("1.2.3.4")); reversed != "4.3.2.1" {
+		t.Fatal(reversed)
+	}
+	if reversed := reverseIP(net.ParseIP("2001:db8::567:89ab")); reversed != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Fatal(reversed)
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	resolver := &fakeResolver{ip: map[string]string{
+		"4.3.2.1.bl1.example": "127.0.0.2",
+		"4.3.2.1.bl2.example": "127.255.255.254", // Query refused rather than listed
+		"4.3.2.1.bl3.example": "127.0.0.4",
+	}}
+	dnsbl := &DNSBL{Zones: []string{"bl1.example", "bl2.example", "bl3.example."}, Score: 2, Resolver: resolver}
+	result := dnsbl.CheckRecipient(&Conversation{ClientIP: "1.2.3.4"})
+	if result.Score != 4 || !reflect.DeepEqual(result.Tests, []string{"DNSBL:bl1.example", "DNSBL:bl3.example."}) {
+		t.Fatalf("%+v", result)
+	}
+	// The result is memorised
+	if result := dnsbl.CheckRecipient(&Conversation{ClientIP: "1.2.3.4"}); result.Score != 4 || resolver.queries != 3 {
+		t.Fatalf("%+v %d", result, resolver.queries)
+	}
+	if result := dnsbl.CheckRecipient(&Conversation{ClientIP: "5.6.7.8"}); result.Score != 0 || resolver.queries != 6 {
+		t.Fatalf("%+v %d", result, resolver.queries)
+	}
+	// Client IPs outside of the public Internet are not looked up
+	if result := dnsbl.CheckRecipient(&Conversation{ClientIP: "127.0.0.1"}); result.Score != 0 || resolver.queries != 6 {
+		t.Fatalf("%+v %d", result, resolver.queries)
+	}
+	// Failed lookups are not memorised
+	resolver.tempErr = errors.New("timeout")
+	dnsbl.lookup(net.ParseIP("2.3.4.5"), time.Now())
+	dnsbl.lookup(net.ParseIP("2.3.4.5"), time.Now())
+	if resolver.queries != 12 {
+		t.Fatal(resolver.queries)
+	}
+	// Memorised results expire
+	resolver.tempErr = nil
+	dnsbl.lookup(net.ParseIP("1.2.3.4"), time.Now().Add(DNSBLCacheTTLSec*time.Second))
+	if resolver.queries != 15 {
+		t.Fatal(resolver.queries)
+	}
+}
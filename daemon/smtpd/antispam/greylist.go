@@ -0,0 +1,174 @@
+package antispam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// GreylistRetryWindowSec is the number of seconds after the delay, during which a greylisted client must retry its mail.
+	GreylistRetryWindowSec = 24 * 3600
+	// GreylistPassExpirySec is the number of seconds to remember a triplet that passed greylisting since it was last seen.
+	GreylistPassExpirySec = 36 * 24 * 3600
+	// GreylistMaxTriplets is the maximum number of triplets to remember, new triplets are not greylisted if there are too many.
+	GreylistMaxTriplets = 100000
+	// GreylistSaveIntervalSec is the minimum interval between writing the changed triplets to disk.
+	GreylistSaveIntervalSec = 60
+)
+
+// greylistTriplet memorises the first and latest attempts of a greylist triplet.
+type greylistTriplet struct {
+	FirstSeen int64 `json:"FirstSeen"` // FirstSeen is the Unix timestamp in seconds of the first attempt.
+	LastSeen  int64 `json:"LastSeen"`  // LastSeen is the Unix timestamp in seconds of the latest attempt.
+	Passed    bool  `json:"Passed"`    // Passed is true if the client has retried after the delay.
+}
+
+// expired returns true only if the triplet is no longer relevant to greylisting.
+func (triplet *greylistTriplet) expired(delaySec int, now int64) bool {
+	if triplet.Passed {
+		return now-triplet.LastSeen > GreylistPassExpirySec
+	}
+	return now-triplet.FirstSeen > int64(delaySec)+GreylistRetryWindowSec
+}
+
+/*
+Greylist asks a client to deliver the mail later when the client names a recipient for the first time, as spammers
+seldom try again. A mail is identified by a triplet of client network, sender address, and recipient address - the
+client network is the /24 network of an IPv4 address or the /64 network of an IPv6 address, because large mail
+services often retry from a different IP address. After a triplet passes greylisting, its mails are no longer delayed.
+The check does not apply to the client IPs outside of the public Internet.
+*/
+type Greylist struct {
+	DelaySec int    // DelaySec is the number of seconds a client has to wait before retrying a greylisted mail.
+	FilePath string // FilePath is the file that keeps the triplets, they are kept in memory only if it is empty.
+
+	triplets map[string]*greylistTriplet
+	changed  bool      // changed is true if the triplets have changed since they were saved last time.
+	lastSave time.Time // lastSave is the time the triplets were saved last time.
+	mutex    sync.Mutex
+}
+
+// Initialise reads the triplets from the file if it exists.
+func (greylist *Greylist) Initialise() error {
+	greylist.mutex.Lock()
+	defer greylist.mutex.Unlock()
+	greylist.triplets = make(map[string]*greylistTriplet)
+	if greylist.FilePath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(greylist.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("antispam.Initialise: failed to read file - %v", err)
+	}
+	if err := json.Unmarshal(content, &greylist.triplets); err != nil {
+		return fmt.Errorf("antispam.Initialise: failed to decode file \"%s\" - %v", greylist.FilePath, err)
+	}
+	return nil
+}
+
+// tripletKey returns the greylist triplet of the client network, sender address, and recipient address.
+func tripletKey(ip net.IP, mailFrom, recipient string) string {
+	var network net.IP
+	if ipv4 := ip.To4(); ipv4 != nil {
+		network = ipv4.Mask(net.CIDRMask(24, 32))
+	} else {
+		network = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return fmt.Sprintf("%s/%s/%s", network, strings.ToLower(mailFrom), strings.ToLower(recipient))
+}
+
+// pass returns true only if the mail identified by the triplet may be delivered now.
+func (greylist *Greylist) pass(key string, now time.Time) bool {
+	greylist.mutex.Lock()
+	defer greylist.mutex.Unlock()
+	nowSec := now.Unix()
+	triplet, exists := greylist.triplets[key]
+	if exists && triplet.expired(greylist.DelaySec, nowSec) {
+		exists = false
+	}
+	var passed bool
+	if !exists {
+		if len(greylist.triplets) >= GreylistMaxTriplets {
+			greylist.removeExpired(nowSec)
+		}
+		if len(greylist.triplets) >= GreylistMaxTriplets {
+			// Rather than delaying every new mail, let them through until the old triplets expire.
+			return true
+		}
+		greylist.triplets[key] = &greylistTriplet{FirstSeen: nowSec, LastSeen: nowSec}
+	} else {
+		triplet.LastSeen = nowSec
+		if !triplet.Passed && nowSec-triplet.FirstSeen >= int64(greylist.DelaySec) {
+			triplet.Passed = true
+		}
+		passed = triplet.Passed
+	}
+	greylist.changed = true
+	if greylist.FilePath != "" && now.Sub(greylist.lastSave) >= GreylistSaveIntervalSec*time.Second {
+		// The failure is not fatal, the triplets will be saved again later.
+		_ = greylist.save(now)
+	}
+	return passed
+}
+
+// removeExpired removes the triplets that are no longer relevant to greylisting. Caller must hold the mutex.
+func (greylist *Greylist) removeExpired(nowSec int64) {
+	for key, triplet := range greylist.triplets {
+		if triplet.expired(greylist.DelaySec, nowSec) {
+			delete(greylist.triplets, key)
+			greylist.changed = true
+		}
+	}
+}
+
+// save writes the triplets to the file if they have changed. Caller must hold the mutex.
+func (greylist *Greylist) save(now time.Time) error {
+	greylist.lastSave = now
+	if greylist.FilePath == "" || !greylist.changed {
+		return nil
+	}
+	greylist.removeExpired(now.Unix())
+	content, err := json.Marshal(greylist.triplets)
+	if err != nil {
+		return fmt.Errorf("antispam.Save: %v", err)
+	}
+	// Write to a temporary file first so that a crash does not leave behind a partially written file
+	tmpPath := greylist.FilePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return fmt.Errorf("antispam.Save: failed to write file - %v", err)
+	}
+	if err := os.Rename(tmpPath, greylist.FilePath); err != nil {
+		return fmt.Errorf("antispam.Save: failed to rename file - %v", err)
+	}
+	greylist.changed = false
+	return nil
+}
+
+// Save writes the triplets to the file if they have changed since they were saved last time.
+func (greylist *Greylist) Save() error {
+	greylist.mutex.Lock()
+	defer greylist.mutex.Unlock()
+	return greylist.save(time.Now())
+}
+
+// CheckRecipient asks the client to deliver the mail to the recipient later, unless the client has retried after the delay.
+func (greylist *Greylist) CheckRecipient(conv *Conversation) Result {
+	ip := publicIP(conv.ClientIP)
+	if ip == nil || greylist.pass(tripletKey(ip, conv.MailFrom, conv.Recipient), time.Now()) {
+		return Result{}
+	}
+	return Result{Defer: true}
+}
+
+// CheckMessage does not examine the message.
+func (greylist *Greylist) CheckMessage(*Conversation) Result {
+	return Result{}
+}
@@ -0,0 +1,75 @@
+package antispam
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestGreylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	greylist := &Greylist{DelaySec: 300, FilePath: filepath.Join(dir, "greylist.json")}
+	if err := greylist.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if key := tripletKey(net.ParseIP("1.2.3.4"), "A@example.com", "B@example.com"); key != "1.2.3.0/a@example.com/b@example.com" {
+		t.Fatal(key)
+	}
+	if key := tripletKey(net.ParseIP("2001:db8::1:2:3:4"), "", "b@example.com"); key != "2001:db8:://b@example.com" {
+		t.Fatal(key)
+	}
+	start := time.Now()
+	key := tripletKey(net.ParseIP("1.2.3.4"), "a@example.com", "b@example.com")
+	if greylist.pass(key, start) || greylist.pass(key, start.Add(299*time.Second)) {
+		t.Fatal("should have been greylisted")
+	}
+	if !greylist.pass(key, start.Add(300*time.Second)) {
+		t.Fatal("should have passed")
+	}
+	// The client may retry from another IP of the same network
+	if !greylist.pass(tripletKey(net.ParseIP("1.2.3.5"), "a@example.com", "b@example.com"), start.Add(301*time.Second)) {
+		t.Fatal("should have passed")
+	}
+	// A different recipient is greylisted on its own
+	if greylist.pass(tripletKey(net.ParseIP("1.2.3.4"), "a@example.com", "c@example.com"), start.Add(301*time.Second)) {
+		t.Fatal("should have been greylisted")
+	}
+	// A client that does not retry in time is greylisted again
+	late := tripletKey(net.ParseIP("5.6.7.8"), "a@example.com", "b@example.com")
+	greylist.pass(late, start)
+	if greylist.pass(late, start.Add((300+GreylistRetryWindowSec+1)*time.Second)) {
+		t.Fatal("should have been greylisted")
+	}
+	// Client IPs outside of the public Internet are not greylisted
+	if result := greylist.CheckRecipient(&Conversation{ClientIP: "127.0.0.1", MailFrom: "a@example.com", Recipient: "b@example.com"}); result.Defer {
+		t.Fatal("should not have deferred")
+	}
+	if result := greylist.CheckRecipient(&Conversation{ClientIP: "9.9.9.9", MailFrom: "a@example.com", Recipient: "b@example.com"}); !result.Defer {
+		t.Fatal("should have deferred")
+	}
+
+	// The triplets survive a restart
+	if err := greylist.Save(); err != nil {
+		t.Fatal(err)
+	}
+	greylist = &Greylist{DelaySec: 300, FilePath: filepath.Join(dir, "greylist.json")}
+	if err := greylist.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !greylist.pass(key, time.Now()) {
+		t.Fatal("should have passed")
+	}
+	if err := ioutil.WriteFile(greylist.FilePath, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := greylist.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+}
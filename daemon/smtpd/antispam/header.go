@@ -0,0 +1,90 @@
+package antispam
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Scores of the indications found by header check.
+const (
+	MalformedHeaderScore   = 3   // MalformedHeaderScore is given if the mail header cannot be parsed.
+	MissingFromScore       = 2   // MissingFromScore is given if the mail does not have a From header.
+	MissingDateScore       = 1   // MissingDateScore is given if the mail does not have a valid Date header.
+	MissingMessageIDScore  = 1   // MissingMessageIDScore is given if the mail does not have a Message-ID header.
+	DateInFutureScore      = 1.5 // DateInFutureScore is given if the mail is dated more than a day into the future.
+	SubjectAllCapsScore    = 1   // SubjectAllCapsScore is given if the subject is written in capital letters.
+	FromNameHasAddrScore   = 1.5 // FromNameHasAddrScore is given if the display name of the sender carries a different address.
+	ManyRecipientsScore    = 1   // ManyRecipientsScore is given if the mail is addressed to an excessive number of recipients.
+	ManyRecipientsMinCount = 30  // ManyRecipientsMinCount is the number of To and Cc addresses considered excessive.
+)
+
+// HeaderCheck examines the mail header for the traits common among spam mails and rare among legitimate mails.
+type HeaderCheck struct{}
+
+// isAllCaps returns true only if the text has a handful of letters and all of them are in capital.
+func isAllCaps(text string) bool {
+	var letters int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 10
+}
+
+// checkHeader gives a score to the mail header.
+func checkHeader(message []byte, now time.Time) (result Result) {
+	add := func(score float64, test string) {
+		result.Score += score
+		result.Tests = append(result.Tests, test)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		add(MalformedHeaderScore, "MALFORMED_HEADER")
+		return
+	}
+	if from := msg.Header.Get("From"); from == "" {
+		add(MissingFromScore, "MISSING_FROM")
+	} else if addr, err := mail.ParseAddress(from); err == nil && strings.Contains(addr.Name, "@") &&
+		!strings.Contains(strings.ToLower(addr.Name), strings.ToLower(addr.Address)) {
+		// e.g. "support@bank.example" <someone@elsewhere.example>
+		add(FromNameHasAddrScore, "FROM_NAME_HAS_ADDR")
+	}
+	if date, err := msg.Header.Date(); err != nil {
+		add(MissingDateScore, "MISSING_DATE")
+	} else if date.After(now.Add(24 * time.Hour)) {
+		add(DateInFutureScore, "DATE_IN_FUTURE")
+	}
+	if msg.Header.Get("Message-ID") == "" {
+		add(MissingMessageIDScore, "MISSING_MESSAGE_ID")
+	}
+	if isAllCaps(msg.Header.Get("Subject")) {
+		add(SubjectAllCapsScore, "SUBJECT_ALL_CAPS")
+	}
+	var numRecipients int
+	for _, field := range []string{"To", "Cc"} {
+		if addrs, err := msg.Header.AddressList(field); err == nil {
+			numRecipients += len(addrs)
+		}
+	}
+	if numRecipients >= ManyRecipientsMinCount {
+		add(ManyRecipientsScore, "MANY_RECIPIENTS")
+	}
+	return
+}
+
+// CheckRecipient does not examine the conversation before the message arrives.
+func (check *HeaderCheck) CheckRecipient(*Conversation) Result {
+	return Result{}
+}
+
+// CheckMessage gives a score to the mail header.
+func (check *HeaderCheck) CheckMessage(conv *Conversation) Result {
+	return checkHeader(conv.Message, time.Now())
+}
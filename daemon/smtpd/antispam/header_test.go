@@ -0,0 +1,30 @@
+package antispam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHeader(t *testing.T) {
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	good := "From: Alice <alice@example.com>\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\nMessage-ID: <1@example.com>\r\nSubject: Hello there\r\n\r\nbody\r\n"
+	if result := checkHeader([]byte(good), now); result.Score != 0 || len(result.Tests) != 0 {
+		t.Fatalf("%+v", result)
+	}
+	bad := "From: \"support@bank.example\" <someone@elsewhere.example>\r\nDate: Wed, 4 Jan 2006 15:04:05 +0000\r\nSubject: YOU HAVE WON A PRIZE!!!\r\nTo: " +
+		strings.Repeat("a@example.com, ", ManyRecipientsMinCount-1) + "a@example.com\r\n\r\nbody\r\n"
+	result := checkHeader([]byte(bad), now)
+	if !reflect.DeepEqual(result.Tests, []string{"FROM_NAME_HAS_ADDR", "DATE_IN_FUTURE", "MISSING_MESSAGE_ID", "SUBJECT_ALL_CAPS", "MANY_RECIPIENTS"}) ||
+		result.Score != FromNameHasAddrScore+DateInFutureScore+MissingMessageIDScore+SubjectAllCapsScore+ManyRecipientsScore {
+		t.Fatalf("%+v", result)
+	}
+	result = checkHeader([]byte("Subject: hi\n\nbody\n"), now)
+	if !reflect.DeepEqual(result.Tests, []string{"MISSING_FROM", "MISSING_DATE", "MISSING_MESSAGE_ID"}) {
+		t.Fatalf("%+v", result)
+	}
+	if result := checkHeader([]byte("not a header"), now); !reflect.DeepEqual(result.Tests, []string{"MALFORMED_HEADER"}) {
+		t.Fatalf("%+v", result)
+	}
+}
@@ -0,0 +1,61 @@
+package antispam
+
+import (
+	"net"
+	"strings"
+)
+
+// Scores of the indications found by HELO check.
+const (
+	HELOMissingScore    = 3   // HELOMissingScore is given if the client did not introduce itself.
+	HELOLocalhostScore  = 3   // HELOLocalhostScore is given if the client introduced itself as localhost.
+	HELOMyDomainScore   = 3   // HELOMyDomainScore is given if the client introduced itself by one of my domain names.
+	HELOBareIPScore     = 2   // HELOBareIPScore is given if the client introduced itself by an IP address without brackets.
+	HELOIPMismatchScore = 2   // HELOIPMismatchScore is given if the client introduced itself by an IP address literal of another host.
+	HELONotFQDNScore    = 1.5 // HELONotFQDNScore is given if the client introduced itself by a host name that is not fully qualified.
+)
+
+/*
+HELOCheck examines the host name that the client introduced itself with. A legitimate mail server introduces itself by
+its fully qualified domain name, or by its IP address literal in square brackets. The check does not apply to the
+client IPs outside of the public Internet.
+*/
+type HELOCheck struct {
+	MyDomains []string // MyDomains are the domain names of this mail server, a client must not impersonate them.
+}
+
+// CheckRecipient gives a score to the HELO name if it does not look like it comes from a legitimate mail server.
+func (check *HELOCheck) CheckRecipient(conv *Conversation) Result {
+	clientIP := publicIP(conv.ClientIP)
+	if clientIP == nil {
+		return Result{}
+	}
+	helo := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(conv.HELO), "."))
+	switch {
+	case helo == "":
+		return Result{Score: HELOMissingScore, Tests: []string{"HELO_MISSING"}}
+	case helo == "localhost" || strings.HasPrefix(helo, "localhost."):
+		return Result{Score: HELOLocalhostScore, Tests: []string{"HELO_LOCALHOST"}}
+	case strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]"):
+		literal := strings.TrimPrefix(helo[1:len(helo)-1], "ipv6:")
+		if ip := net.ParseIP(literal); ip == nil || !ip.Equal(clientIP) {
+			return Result{Score: HELOIPMismatchScore, Tests: []string{"HELO_IP_MISMATCH"}}
+		}
+	case net.ParseIP(helo) != nil:
+		return Result{Score: HELOBareIPScore, Tests: []string{"HELO_BARE_IP"}}
+	case !strings.Contains(helo, "."):
+		return Result{Score: HELONotFQDNScore, Tests: []string{"HELO_NOT_FQDN"}}
+	default:
+		for _, domain := range check.MyDomains {
+			if helo == strings.ToLower(domain) {
+				return Result{Score: HELOMyDomainScore, Tests: []string{"HELO_MY_DOMAIN"}}
+			}
+		}
+	}
+	return Result{}
+}
+
+// CheckMessage does not examine the message.
+func (check *HELOCheck) CheckMessage(*Conversation) Result {
+	return Result{}
+}
@@ -0,0 +1,36 @@
+package antispam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHELOCheck(t *testing.T) {
+	check := &HELOCheck{MyDomains: []string{"Example.com"}}
+	for helo, tests := range map[string][]string{
+		"":                 nil,
+		"mail.example.org": nil,
+		"[1.2.3.4]":        nil,
+		"localhost":        {"HELO_LOCALHOST"},
+		"1.2.3.4":          {"HELO_BARE_IP"},
+		"[5.6.7.8]":        {"HELO_IP_MISMATCH"},
+		"[nonsense]":       {"HELO_IP_MISMATCH"},
+		"mailserver":       {"HELO_NOT_FQDN"},
+		"example.com.":     {"HELO_MY_DOMAIN"},
+	} {
+		result := check.CheckRecipient(&Conversation{ClientIP: "1.2.3.4", HELO: helo})
+		if helo == "" {
+			tests = []string{"HELO_MISSING"}
+		}
+		if !reflect.DeepEqual(result.Tests, tests) || (len(tests) > 0) != (result.Score > 0) {
+			t.Fatalf("%s: %+v", helo, result)
+		}
+	}
+	if result := check.CheckRecipient(&Conversation{ClientIP: "2001:db8::1", HELO: "[IPv6:2001:db8::1]"}); result.Score != 0 {
+		t.Fatalf("%+v", result)
+	}
+	// Client IPs outside of the public Internet are not checked
+	if result := check.CheckRecipient(&Conversation{ClientIP: "127.0.0.1", HELO: "localhost"}); result.Score != 0 {
+		t.Fatalf("%+v", result)
+	}
+}
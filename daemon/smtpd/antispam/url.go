@@ -0,0 +1,66 @@
+package antispam
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// MaxURLHosts is the maximum number of distinct URL host names to check in a mail.
+const MaxURLHosts = 100
+
+var (
+	// urlHostRegex finds the host name or IP address of the URLs in mail content.
+	urlHostRegex = regexp.MustCompile(`(?i)\bhttps?://(?:[^\s/?#@"'<>]*@)?([a-z0-9.-]+)`)
+	// softLineBreakRegex finds the soft line breaks of quoted-printable encoding, which may split a URL.
+	softLineBreakRegex = regexp.MustCompile(`=\r?\n`)
+)
+
+/*
+URLCheck looks for the URLs in the mail message that link to blacklisted domain names and IP addresses, usually it uses
+the blacklist of the DNS daemon. It examines the plain text and quoted-printable content, the base64 encoded content is
+not decoded.
+*/
+type URLCheck struct {
+	IsBlacklisted func(nameOrIP string) bool // IsBlacklisted returns true only if the domain name or IP address is blacklisted.
+	Score         float64                    // Score is given if the mail links to any blacklisted host.
+}
+
+// getURLHosts returns the distinct lower case host names of the URLs in mail content.
+func getURLHosts(message []byte) (hosts []string) {
+	content := softLineBreakRegex.ReplaceAll(message, nil)
+	// Quoted-printable encoding may also encode the equal sign of URL query strings, though it does not affect host names.
+	content = bytes.Replace(content, []byte("=3D"), []byte("="), -1)
+	seen := make(map[string]struct{})
+	for _, match := range urlHostRegex.FindAllSubmatch(content, -1) {
+		host := strings.Trim(strings.ToLower(string(match[1])), ".-")
+		if host == "" {
+			continue
+		}
+		if _, exists := seen[host]; exists {
+			continue
+		}
+		seen[host] = struct{}{}
+		hosts = append(hosts, host)
+		if len(hosts) >= MaxURLHosts {
+			break
+		}
+	}
+	return
+}
+
+// CheckRecipient does not examine the conversation before the message arrives.
+func (check *URLCheck) CheckRecipient(*Conversation) Result {
+	return Result{}
+}
+
+// CheckMessage gives a score to the mail if it links to any blacklisted host.
+func (check *URLCheck) CheckMessage(conv *Conversation) (result Result) {
+	for _, host := range getURLHosts(conv.Message) {
+		if check.IsBlacklisted(host) {
+			result.Score = check.Score
+			result.Tests = append(result.Tests, "URL_BLACKLISTED:"+host)
+		}
+	}
+	return
+}
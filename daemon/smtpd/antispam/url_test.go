@@ -0,0 +1,24 @@
+package antispam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestURLCheck(t *testing.T) {
+	message := "Subject: s\r\n\r\nVisit http://Good.example/a and HTTPS://user@bad.exa=\r\nmple/?x=3Dy and http://good.example/b.\r\n" +
+		"<a href=\"http://1.2.3.4:8080/\">link</a>\r\n"
+	if hosts := getURLHosts([]byte(message)); !reflect.DeepEqual(hosts, []string{"good.example", "bad.example", "1.2.3.4"}) {
+		t.Fatal(hosts)
+	}
+	check := &URLCheck{Score: 3, IsBlacklisted: func(nameOrIP string) bool {
+		return nameOrIP == "bad.example" || nameOrIP == "1.2.3.4"
+	}}
+	result := check.CheckMessage(&Conversation{Message: []byte(message)})
+	if result.Score != 3 || !reflect.DeepEqual(result.Tests, []string{"URL_BLACKLISTED:bad.example", "URL_BLACKLISTED:1.2.3.4"}) {
+		t.Fatalf("%+v", result)
+	}
+	if result := check.CheckMessage(&Conversation{Message: []byte("Subject: s\r\n\r\nno link\r\n")}); result.Score != 0 {
+		t.Fatalf("%+v", result)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+imap package implements the server side of a minimal IMAP4rev1 conversation. Each user logs in to read the mails of
+their own mailbox, which is presented to the client as INBOX. The conversation supports LOGIN, SELECT, EXAMINE, LIST,
+STATUS, FETCH, SEARCH, STORE, EXPUNGE, and CLOSE, as well as their UID variants; it does not support message structure
+(BODYSTRUCTURE), multiple folders, nor uploading mails.
+*/
+package imap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// MaxCommandLength is the maximum acceptable length of a command, including the literal strings that come along.
+	MaxCommandLength = 64 * 1024
+	// MaxLoginAttempts is the maximum number of failed login attempts before the server closes the connection.
+	MaxLoginAttempts = 3
+	// MaxConsecutiveBadCommands is the maximum number of consecutive malformed or unknown commands before the server closes the connection.
+	MaxConsecutiveBadCommands = 10
+	// InboxName is the only mailbox name of each user.
+	InboxName = "INBOX"
+	// capabilities are the capabilities advertised by the server.
+	capabilities = "IMAP4rev1 LITERAL+"
+)
+
+var (
+	ErrCommandTooLong = errors.New("command is too long")
+
+	// literalRegex matches the length of a literal string at the end of a line.
+	literalRegex = regexp.MustCompile(`\{(\d+)(\+?)\}$`)
+)
+
+// Config provides the mailboxes and user authentication to IMAP conversations.
+type Config struct {
+	// IOTimeout governs the timeout of each read and write operation, it also serves as the idle timeout of a logged-in client.
+	IOTimeout time.Duration
+	// Store keeps the mailboxes of all users.
+	Store *maildir.Store
+	// Authenticate returns the mailbox name of the user if the user name and password are correct.
+	Authenticate func(user, password string) (mailbox string, ok bool)
+}
+
+// Connection converses with an IMAP client on behalf of the user who logs in.
+type Connection struct {
+	Config Config
+
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	logger  lalog.Logger
+
+	mailbox     string            // mailbox is the mailbox name of the logged-in user
+	selected    bool              // selected is true only if INBOX is selected or examined
+	readOnly    bool              // readOnly is true only if INBOX is examined rather than selected
+	uidValidity uint32            // uidValidity is the UID validity of the selected mailbox
+	uidNext     uint32            // uidNext is the predicted UID of the next mail to arrive
+	messages    []maildir.Message // messages are the mails of the selected mailbox, indexed by their sequence number minus one.
+}
+
+// NewConnection returns an IMAP connection that is ready to converse with the client.
+func NewConnection(netConn net.Conn, config Config, logger lalog.Logger) *Connection {
+	return &Connection{
+		Config:  config,
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		logger:  logger,
+	}
+}
+
+// untagged writes an untagged response to the client.
+func (conn *Connection) untagged(format string, a ...interface{}) {
+	_, _ = conn.writer.WriteString("* " + fmt.Sprintf(format, a...) + "\r\n")
+}
+
+// flush sends the buffered responses to the client.
+func (conn *Connection) flush() error {
+	conn.logger.MaybeMinorError(conn.netConn.SetWriteDeadline(time.Now().Add(conn.Config.IOTimeout)))
+	return conn.writer.Flush()
+}
+
+// readCommand reads a command line along with the literal strings that come along, the line terminator is not included.
+func (conn *Connection) readCommand() (string, error) {
+	var command strings.Builder
+	for {
+		conn.logger.MaybeMinorError(conn.netConn.SetReadDeadline(time.Now().Add(conn.Config.IOTimeout)))
+		var line []byte
+		for {
+			chunk, err := conn.reader.ReadSlice('\n')
+			line = append(line, chunk...)
+			if command.Len()+len(line) > MaxCommandLength {
+				return "", ErrCommandTooLong
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			} else if err != nil {
+				return "", err
+			}
+			break
+		}
+		line = []byte(strings.TrimRight(string(line), "\r\n"))
+		command.Write(line)
+		// A literal string continues on the next line
+		match := literalRegex.FindSubmatch(line)
+		if match == nil {
+			return command.String(), nil
+		}
+		length, err := strconv.Atoi(string(match[1]))
+		if err != nil || command.Len()+length > MaxCommandLength {
+			return "", ErrCommandTooLong
+		}
+		if len(match[2]) == 0 {
+			_, _ = conn.writer.WriteString("+ Ready for literal data\r\n")
+			if err := conn.flush(); err != nil {
+				return "", err
+			}
+		}
+		literal := make([]byte, length)
+		if _, err := io.ReadFull(conn.reader, literal); err != nil {
+			return "", err
+		}
+		command.WriteString("\r\n")
+		command.Write(literal)
+	}
+}
+
+/*
+Converse carries on the IMAP conversation until the client logs out or disconnects, or until the client misbehaves. It
+returns a brief description of how the conversation ended.
+*/
+func (conn *Connection) Converse() string {
+	conn.untagged("OK [CAPABILITY %s] laitos IMAP server is ready", capabilities)
+	if err := conn.flush(); err != nil {
+		return fmt.Sprintf("failed to greet the client - %v", err)
+	}
+	var loginAttempts, badCommands int
+	for {
+		line, err := conn.readCommand()
+		if err != nil {
+			if err == ErrCommandTooLong {
+				conn.untagged("BYE %v", err)
+				_ = conn.flush()
+			}
+			return fmt.Sprintf("stopped reading commands - %v", err)
+		}
+		var tag, verb, args string
+		fields := strings.SplitN(line, " ", 3)
+		tag = fields[0]
+		if len(fields) > 1 {
+			verb = strings.ToUpper(fields[1])
+		}
+		if len(fields) > 2 {
+			args = fields[2]
+		}
+		var response string
+		if tag == "" || verb == "" {
+			tag = "*"
+			response = "BAD missing command tag or name"
+		} else if tokens, err := parseArgs(args); err != nil {
+			response = fmt.Sprintf("BAD %v", err)
+		} else {
+			switch verb {
+			case "LOGOUT":
+				conn.untagged("BYE laitos IMAP server logging out")
+				_, _ = conn.writer.WriteString(tag + " OK LOGOUT completed\r\n")
+				_ = conn.flush()
+				return "client logged out"
+			case "LOGIN":
+				if response = conn.login(tokens); strings.HasPrefix(response, "NO") {
+					if loginAttempts++; loginAttempts >= MaxLoginAttempts {
+						conn.untagged("BYE too many failed login attempts")
+						_ = conn.flush()
+						return "too many failed login attempts"
+					}
+				}
+			default:
+				response = conn.execute(verb, tokens)
+			}
+		}
+		if strings.HasPrefix(response, "BAD") {
+			if badCommands++; badCommands >= MaxConsecutiveBadCommands {
+				conn.untagged("BYE too many bad commands")
+				_ = conn.flush()
+				return "too many bad commands"
+			}
+		} else {
+			badCommands = 0
+		}
+		_, _ = conn.writer.WriteString(tag + " " + response + "\r\n")
+		if err := conn.flush(); err != nil {
+			return fmt.Sprintf("failed to respond - %v", err)
+		}
+	}
+}
+
+// login authenticates the user, and returns the tagged response.
+func (conn *Connection) login(args []token) string {
+	if conn.mailbox != "" {
+		return "BAD already logged in"
+	}
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return "BAD LOGIN expects user name and password"
+	}
+	mailbox, ok := conn.Config.Authenticate(args[0].value, args[1].value)
+	if !ok {
+		return "NO [AUTHENTICATIONFAILED] invalid user name or password"
+	}
+	conn.mailbox = mailbox
+	return fmt.Sprintf("OK [CAPABILITY %s] LOGIN completed", capabilities)
+}
+
+// execute runs a command other than LOGIN and LOGOUT, and returns the tagged response.
+func (conn *Connection) execute(verb string, args []token) string {
+	switch verb {
+	case "CAPABILITY":
+		conn.untagged("CAPABILITY %s", capabilities)
+		return "OK CAPABILITY completed"
+	case "NOOP", "CHECK":
+		if conn.selected {
+			conn.refresh()
+		}
+		return "OK " + verb + " completed"
+	}
+	if conn.mailbox == "" {
+		return "BAD " + verb + " is not allowed before LOGIN"
+	}
+	switch verb {
+	case "SELECT", "EXAMINE":
+		return conn.selectInbox(verb, args)
+	case "LIST", "LSUB":
+		return conn.list(verb, args)
+	case "STATUS":
+		return conn.status(args)
+	}
+	if !conn.selected {
+		return "BAD " + verb + " is not allowed before SELECT"
+	}
+	useUID := false
+	if verb == "UID" {
+		if len(args) == 0 || args[0].isList {
+			return "BAD UID expects a command"
+		}
+		useUID = true
+		verb = strings.ToUpper(args[0].value)
+		args = args[1:]
+	}
+	switch verb {
+	case "FETCH":
+		return conn.fetch(args, useUID)
+	case "SEARCH":
+		return conn.search(args, useUID)
+	case "STORE":
+		return conn.store(args, useUID)
+	}
+	if useUID {
+		return "BAD unsupported UID command"
+	}
+	switch verb {
+	case "EXPUNGE":
+		return conn.expunge(false)
+	case "CLOSE":
+		// Closing an examined mailbox does not remove any mail
+		response := "OK CLOSE completed"
+		if !conn.readOnly {
+			if expunged := conn.expunge(true); strings.HasPrefix(expunged, "NO") {
+				response = expunged
+			}
+		}
+		conn.selected = false
+		conn.messages = nil
+		return response
+	}
+	return "BAD unknown or unsupported command"
+}
@@ -0,0 +1,174 @@
+package imap
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+// testClient converses with the IMAP server over an in-memory connection.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	ended  chan string
+}
+
+func newTestClient(t *testing.T, config Config) *testClient {
+	clientConn, serverConn := net.Pipe()
+	client := &testClient{t: t, conn: clientConn, reader: bufio.NewReader(clientConn), ended: make(chan string, 1)}
+	go func() {
+		client.ended <- NewConnection(serverConn, config, lalog.Logger{}).Converse()
+		_ = serverConn.Close()
+	}()
+	if greeting := client.readLine(); !strings.HasPrefix(greeting, "* OK [CAPABILITY IMAP4rev1") {
+		t.Fatal(greeting)
+	}
+	return client
+}
+
+func (client *testClient) readLine() string {
+	_ = client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// command sends the tagged command and returns the response, the tagged status line comes last.
+func (client *testClient) command(cmd string) string {
+	return client.send("tag " + cmd)
+}
+
+// send sends a line and returns the response, the tagged status line comes last.
+func (client *testClient) send(line string) string {
+	_ = client.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.conn.Write([]byte(line + "\r\n")); err != nil {
+		client.t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line := client.readLine()
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "tag ") || strings.HasPrefix(line, "* BYE") {
+			return strings.Join(lines, "\n")
+		}
+	}
+}
+
+func (client *testClient) expect(cmd string, wantInResponse ...string) string {
+	response := client.command(cmd)
+	for _, want := range wantInResponse {
+		if !strings.Contains(response, want) {
+			client.t.Fatalf("command: %s\nwant: %s\nresponse:\n%s", cmd, want, response)
+		}
+	}
+	return response
+}
+
+func TestConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestConnection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &maildir.Store{Dir: dir}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, mail := range []string{
+		"From: Alice <alice@example.com>\nTo: howard@example.com\nSubject: first\nDate: Mon, 2 Jan 2006 15:04:05 -0700\n\nfirst body\n",
+		"From: bob@example.com\nTo: howard@example.com\nSubject: second\n\nsecond body\n",
+		"From: bob@example.com\nTo: howard@example.com\nSubject: third\n\nthird body\n",
+	} {
+		if _, err := store.Deliver("howard@example.com", []byte(mail), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := Config{
+		IOTimeout: 5 * time.Second,
+		Store:     store,
+		Authenticate: func(user, password string) (string, bool) {
+			return "howard@example.com", user == "howard@example.com" && password == "pass word"
+		},
+	}
+
+	client := newTestClient(t, config)
+	client.expect("CAPABILITY", "* CAPABILITY IMAP4rev1", "tag OK")
+	client.expect("SELECT INBOX", "tag BAD")
+	client.expect("LOGIN howard@example.com wrong", "tag NO [AUTHENTICATIONFAILED]")
+	// Log in with a synchronising literal and a non-synchronising literal
+	if _, err := client.conn.Write([]byte("tag LOGIN {18}\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line := client.readLine(); !strings.HasPrefix(line, "+ ") {
+		t.Fatal(line)
+	}
+	if response := client.send("howard@example.com {9+}\r\npass word"); !strings.HasPrefix(response, "tag OK [CAPABILITY") {
+		t.Fatal(response)
+	}
+	client.expect(`LIST "" ""`, `* LIST (\Noselect) "/" ""`, "tag OK")
+	client.expect(`LIST "" "*"`, `* LIST (\HasNoChildren) "/" INBOX`, "tag OK")
+	client.expect(`STATUS INBOX (MESSAGES UNSEEN UIDNEXT)`, "* STATUS INBOX (MESSAGES 3 UNSEEN 3 UIDNEXT 4)", "tag OK")
+	client.expect("SELECT Junk", "tag NO [NONEXISTENT]")
+	client.expect("FETCH 1 UID", "tag BAD")
+
+	// Reading mails of an examined mailbox does not change their flags
+	client.expect("EXAMINE INBOX", "* 3 EXISTS", "tag OK [READ-ONLY]")
+	if response := client.expect("FETCH 1 BODY[]", "tag OK"); strings.Contains(response, "FLAGS") {
+		t.Fatal(response)
+	}
+	client.expect(`STORE 1 +FLAGS (\Seen)`, "tag NO")
+
+	client.expect("SELECT INBOX", "* 3 EXISTS", "* OK [UNSEEN 1]", "* OK [UIDNEXT 4]", "* OK [PERMANENTFLAGS (", "tag OK [READ-WRITE]")
+	client.expect("FETCH 1:* (UID FLAGS RFC822.SIZE)", "* 1 FETCH (UID 1 FLAGS () RFC822.SIZE 125)", "* 3 FETCH (UID 3 FLAGS () RFC822.SIZE 77)", "tag OK")
+	client.expect("FETCH 2 BODY.PEEK[HEADER.FIELDS (Subject)]", "* 2 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {19}\nSubject: second\n\n)", "tag OK")
+	client.expect("FETCH 1 BODY.PEEK[TEXT]<0.5>", "* 1 FETCH (BODY[TEXT]<0> {5}\nfirst)", "tag OK")
+	client.expect("FETCH 1 ENVELOPE", `* 1 FETCH (ENVELOPE ("Mon, 2 Jan 2006 15:04:05 -0700" "first" (("Alice" NIL "alice" "example.com")) (("Alice" NIL "alice" "example.com"))`, "tag OK")
+	client.expect("FETCH 1 BODYSTRUCTURE", "tag BAD")
+	// Reading the mail sets the \Seen flag
+	client.expect("UID FETCH 1 RFC822.TEXT", "* 1 FETCH (FLAGS (\\Seen) UID 1 RFC822.TEXT {12}\nfirst body\n)", "tag OK")
+
+	client.expect("SEARCH UNSEEN", "* SEARCH 2 3\ntag OK")
+	client.expect("SEARCH FROM alice", "* SEARCH 1\ntag OK")
+	client.expect(`UID SEARCH OR SUBJECT second BODY "THIRD body"`, "* SEARCH 2 3\ntag OK")
+	client.expect("SEARCH CHARSET UTF-8 NOT 1:2", "* SEARCH 3\ntag OK")
+	client.expect("SEARCH SENTON 2-Jan-2006 SEEN", "* SEARCH 1\ntag OK")
+	client.expect("SEARCH CHARSET KOI8-R ALL", "tag NO [BADCHARSET")
+	client.expect("SEARCH NONSENSE", "tag BAD")
+
+	client.expect(`UID STORE 2 +FLAGS (\Deleted \Flagged)`, "* 2 FETCH (UID 2 FLAGS (\\Flagged \\Deleted))", "tag OK")
+	client.expect(`STORE 2 -FLAGS.SILENT (\Flagged)`, "tag OK")
+	client.expect("FETCH 2 FLAGS", "* 2 FETCH (FLAGS (\\Deleted))", "tag OK")
+
+	// A new mail arrives
+	if _, err := store.Deliver("howard@example.com", []byte("Subject: fourth\r\n\r\nfourth body\r\n"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	client.expect("NOOP", "* 4 EXISTS", "tag OK")
+	client.expect("EXPUNGE", "* 2 EXPUNGE", "tag OK")
+	client.expect("FETCH 2:* UID", "* 2 FETCH (UID 3)", "* 3 FETCH (UID 4)", "tag OK")
+	client.expect("CLOSE", "tag OK")
+	client.expect("FETCH 1 UID", "tag BAD")
+	client.expect("LOGOUT", "* BYE")
+	if ended := <-client.ended; ended != "client logged out" {
+		t.Fatal(ended)
+	}
+
+	// Too many failed login attempts
+	client = newTestClient(t, config)
+	for i := 0; i < MaxLoginAttempts; i++ {
+		client.command("LOGIN howard@example.com wrong")
+	}
+	if ended := <-client.ended; ended != "too many failed login attempts" {
+		t.Fatal(ended)
+	}
+}
@@ -0,0 +1,324 @@
+package imap
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
+)
+
+// partialRegex matches the partial range of a body section, e.g. <0.1024>.
+var partialRegex = regexp.MustCompile(`^<(\d+)\.(\d+)>$`)
+
+// lazyMessage reads the content of a mail only when it is needed.
+type lazyMessage struct {
+	conn    *Connection
+	msg     maildir.Message
+	content []byte
+	header  mail.Header
+	err     error
+	loaded  bool
+}
+
+// get returns the content of the mail.
+func (lazy *lazyMessage) get() ([]byte, error) {
+	if !lazy.loaded {
+		lazy.loaded = true
+		lazy.content, lazy.err = lazy.conn.Config.Store.Read(lazy.conn.mailbox, lazy.msg)
+		lazy.header = mail.Header{}
+		if lazy.err == nil {
+			header, _ := splitMessage(lazy.content)
+			if parsed, err := mail.ReadMessage(bytes.NewReader(header)); err == nil {
+				lazy.header = parsed.Header
+			}
+		}
+	}
+	return lazy.content, lazy.err
+}
+
+// getHeader returns the parsed mail header, it is empty if the mail cannot be read.
+func (lazy *lazyMessage) getHeader() mail.Header {
+	_, _ = lazy.get()
+	return lazy.header
+}
+
+// splitMessage returns the header (including the blank line that ends it) and the text of the mail.
+func splitMessage(content []byte) (header, text []byte) {
+	if end := bytes.Index(content, []byte("\r\n\r\n")); end != -1 {
+		return content[:end+4], content[end+4:]
+	}
+	return content, nil
+}
+
+// headerFields returns the header fields of the mail, each field includes its folded lines and line terminator.
+func headerFields(header []byte) (fields []string) {
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" || line == "\r\n" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+		} else {
+			fields = append(fields, line)
+		}
+	}
+	return
+}
+
+// literal returns the data in the form of an IMAP literal string.
+func literal(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// nString returns the string quoted, or as a literal if it cannot be quoted. An empty string is NIL.
+func nString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	for _, c := range []byte(s) {
+		if c == '\r' || c == '\n' || c == 0 || c > 0x7f {
+			return literal([]byte(s))
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// envelopeAddresses returns the address list of the header field in the form of an envelope structure.
+func envelopeAddresses(header mail.Header, key string) string {
+	addrs, err := header.AddressList(key)
+	if err != nil || len(addrs) == 0 {
+		return "NIL"
+	}
+	var list strings.Builder
+	list.WriteByte('(')
+	for _, addr := range addrs {
+		mailbox, host := addr.Address, ""
+		if at := strings.LastIndexByte(addr.Address, '@'); at != -1 {
+			mailbox, host = addr.Address[:at], addr.Address[at+1:]
+		}
+		list.WriteString(fmt.Sprintf("(%s NIL %s %s)", nString(addr.Name), nString(mailbox), nString(host)))
+	}
+	list.WriteByte(')')
+	return list.String()
+}
+
+// envelope returns the envelope structure of the mail header.
+func envelope(header mail.Header) string {
+	from := envelopeAddresses(header, "From")
+	sender, replyTo := envelopeAddresses(header, "Sender"), envelopeAddresses(header, "Reply-To")
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nString(header.Get("Date")), nString(header.Get("Subject")), from, sender, replyTo,
+		envelopeAddresses(header, "To"), envelopeAddresses(header, "Cc"), envelopeAddresses(header, "Bcc"),
+		nString(header.Get("In-Reply-To")), nString(header.Get("Message-ID")))
+}
+
+// fetchItem is a data item requested by the FETCH command.
+type fetchItem struct {
+	name      string   // name is the name of the item in the response, e.g. FLAGS or BODY[HEADER].
+	isBody    bool     // isBody is true only if the item requests (a section of) the mail content.
+	peek      bool     // peek is true only if reading the mail content does not set the \Seen flag.
+	section   string   // section is HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT, or empty for the entire mail.
+	fields    []string // fields are the header field names of HEADER.FIELDS and HEADER.FIELDS.NOT.
+	offset    int      // offset is the start of the partial range.
+	count     int      // count is the length of the partial range, or -1 for no partial range.
+	wantFlags bool     // wantFlags is true only if the item is FLAGS.
+}
+
+// parseBodyItem parses BODY[section]<partial> or BODY.PEEK[section]<partial>.
+func parseBodyItem(atom string) (item fetchItem, err error) {
+	upper := strings.ToUpper(atom)
+	start := strings.IndexByte(upper, '[')
+	end := strings.LastIndexByte(upper, ']')
+	if start == -1 || end < start || upper[:start] != "BODY" && upper[:start] != "BODY.PEEK" {
+		return item, fmt.Errorf("unsupported data item %s", atom)
+	}
+	item = fetchItem{isBody: true, peek: upper[:start] == "BODY.PEEK", count: -1}
+	sectionSpec := upper[start+1 : end]
+	switch {
+	case sectionSpec == "", sectionSpec == "HEADER", sectionSpec == "TEXT":
+		item.section = sectionSpec
+	case strings.HasPrefix(sectionSpec, "HEADER.FIELDS"):
+		item.section = "HEADER.FIELDS"
+		if strings.HasPrefix(sectionSpec, "HEADER.FIELDS.NOT") {
+			item.section = "HEADER.FIELDS.NOT"
+		}
+		fieldList, err := parseArgs(sectionSpec[len(item.section):])
+		if err != nil || len(fieldList) != 1 || !fieldList[0].isList || len(fieldList[0].list) == 0 {
+			return item, fmt.Errorf("bad header field list in %s", atom)
+		}
+		item.fields = tokenStrings(fieldList[0].list)
+		sectionSpec = item.section + " (" + strings.Join(item.fields, " ") + ")"
+	default:
+		return item, fmt.Errorf("unsupported body section %s", atom)
+	}
+	item.name = "BODY[" + sectionSpec + "]"
+	if partial := upper[end+1:]; partial != "" {
+		match := partialRegex.FindStringSubmatch(partial)
+		if match == nil {
+			return item, fmt.Errorf("bad partial range in %s", atom)
+		}
+		item.offset, _ = strconv.Atoi(match[1])
+		item.count, _ = strconv.Atoi(match[2])
+		item.name += fmt.Sprintf("<%d>", item.offset)
+	}
+	return item, nil
+}
+
+// parseFetchItems parses the data items of FETCH command, which is either a single item, a macro, or a list of items.
+func parseFetchItems(arg token) (items []fetchItem, err error) {
+	var names []string
+	if arg.isList {
+		names = tokenStrings(arg.list)
+	} else {
+		switch strings.ToUpper(arg.value) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		default:
+			names = []string{arg.value}
+		}
+	}
+	for _, name := range names {
+		switch upper := strings.ToUpper(name); upper {
+		case "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE":
+			items = append(items, fetchItem{name: upper})
+		case "FLAGS":
+			items = append(items, fetchItem{name: upper, wantFlags: true})
+		case "RFC822":
+			items = append(items, fetchItem{name: upper, isBody: true, count: -1})
+		case "RFC822.HEADER":
+			items = append(items, fetchItem{name: upper, isBody: true, peek: true, section: "HEADER", count: -1})
+		case "RFC822.TEXT":
+			items = append(items, fetchItem{name: upper, isBody: true, section: "TEXT", count: -1})
+		default:
+			item, err := parseBodyItem(name)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// bodySection returns the section of mail content requested by the data item.
+func bodySection(content []byte, item fetchItem) []byte {
+	header, text := splitMessage(content)
+	var data []byte
+	switch item.section {
+	case "":
+		data = content
+	case "HEADER":
+		data = header
+	case "TEXT":
+		data = text
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		var selected bytes.Buffer
+		for _, field := range headerFields(header) {
+			name := field
+			if colon := strings.IndexByte(field, ':'); colon != -1 {
+				name = field[:colon]
+			}
+			var listed bool
+			for _, wanted := range item.fields {
+				listed = listed || strings.EqualFold(strings.TrimSpace(name), wanted)
+			}
+			if listed == (item.section == "HEADER.FIELDS") {
+				selected.WriteString(field)
+			}
+		}
+		selected.WriteString("\r\n")
+		data = selected.Bytes()
+	}
+	if item.count >= 0 {
+		if item.offset >= len(data) {
+			return nil
+		}
+		data = data[item.offset:]
+		if item.count < len(data) {
+			data = data[:item.count]
+		}
+	}
+	return data
+}
+
+// fetch retrieves the data items of mails.
+func (conn *Connection) fetch(args []token, useUID bool) string {
+	if len(args) != 2 || args[0].isList {
+		return "BAD FETCH expects a message set and data items"
+	}
+	indexes, err := conn.selectMessages(args[0].value, useUID)
+	if err != nil {
+		return fmt.Sprintf("BAD %v", err)
+	}
+	items, err := parseFetchItems(args[1])
+	if err != nil {
+		return fmt.Sprintf("BAD %v", err)
+	}
+	// The response to UID FETCH always carries the UID
+	var hasUID, hasFlags, setsSeen bool
+	for _, item := range items {
+		hasUID = hasUID || item.name == "UID"
+		hasFlags = hasFlags || item.wantFlags
+		setsSeen = setsSeen || item.isBody && !item.peek
+	}
+	if useUID && !hasUID {
+		items = append([]fetchItem{{name: "UID"}}, items...)
+	}
+	var failed bool
+	for _, i := range indexes {
+		lazy := &lazyMessage{conn: conn, msg: conn.messages[i]}
+		if setsSeen && !conn.readOnly && !lazy.msg.HasFlag(`\Seen`) {
+			if updated, err := conn.Config.Store.SetFlags(conn.mailbox, lazy.msg, append(append([]string{}, lazy.msg.Flags...), `\Seen`)); err == nil {
+				conn.messages[i], lazy.msg = updated, updated
+				if !hasFlags {
+					// Let the client know about the flag that has just been set, ahead of the potentially long mail content.
+					items = append([]fetchItem{{name: "FLAGS", wantFlags: true}}, items...)
+					hasFlags = true
+				}
+			}
+		}
+		var values []string
+		for _, item := range items {
+			switch {
+			case item.name == "UID":
+				values = append(values, fmt.Sprintf("UID %d", lazy.msg.UID))
+			case item.wantFlags:
+				values = append(values, fmt.Sprintf("FLAGS (%s)", strings.Join(lazy.msg.Flags, " ")))
+			case item.name == "INTERNALDATE":
+				values = append(values, fmt.Sprintf(`INTERNALDATE "%s"`, lazy.msg.Delivered.Format("02-Jan-2006 15:04:05 -0700")))
+			case item.name == "RFC822.SIZE":
+				values = append(values, fmt.Sprintf("RFC822.SIZE %d", lazy.msg.Size))
+			case item.name == "ENVELOPE":
+				values = append(values, "ENVELOPE "+envelope(lazy.getHeader()))
+			case item.isBody:
+				content, err := lazy.get()
+				if err != nil {
+					break
+				}
+				values = append(values, item.name+" "+literal(bodySection(content, item)))
+			}
+		}
+		if lazy.err != nil {
+			conn.logger.Warning("fetch", conn.mailbox, lazy.err, "failed to read mail")
+			failed = true
+			continue
+		}
+		conn.untagged("%d FETCH (%s)", i+1, strings.Join(values, " "))
+	}
+	if failed {
+		return "NO some of the messages no longer exist"
+	}
+	return "OK FETCH completed"
+}
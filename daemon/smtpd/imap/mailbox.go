@@ -0,0 +1,234 @@
+package imap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
+)
+
+// permanentFlags are the flags that a client may set on the mails.
+var permanentFlags = strings.Join(maildir.SystemFlags, " ")
+
+// isInbox returns true only if the mailbox name refers to the user's only mailbox.
+func isInbox(name string) bool {
+	return strings.EqualFold(name, InboxName)
+}
+
+// selectInbox selects (read-write) or examines (read-only) the user's mailbox.
+func (conn *Connection) selectInbox(verb string, args []token) string {
+	// A failed attempt leaves no mailbox selected
+	conn.selected = false
+	conn.messages = nil
+	if len(args) != 1 || args[0].isList {
+		return "BAD " + verb + " expects a mailbox name"
+	}
+	if !isInbox(args[0].value) {
+		return "NO [NONEXISTENT] mailbox does not exist"
+	}
+	validity, next, msgs, err := conn.Config.Store.List(conn.mailbox, time.Now())
+	if err != nil {
+		return fmt.Sprintf("NO [SERVERBUG] %v", err)
+	}
+	conn.selected = true
+	conn.readOnly = verb == "EXAMINE"
+	conn.uidValidity, conn.uidNext, conn.messages = validity, next, msgs
+	conn.untagged("%d EXISTS", len(msgs))
+	conn.untagged("0 RECENT")
+	for i, msg := range msgs {
+		if !msg.HasFlag(`\Seen`) {
+			conn.untagged("OK [UNSEEN %d] first unseen message", i+1)
+			break
+		}
+	}
+	conn.untagged("OK [UIDVALIDITY %d] UIDs are valid", validity)
+	conn.untagged("OK [UIDNEXT %d] predicted next UID", next)
+	conn.untagged("FLAGS (%s)", permanentFlags)
+	if conn.readOnly {
+		conn.untagged("OK [PERMANENTFLAGS ()] no permanent flags permitted")
+		return "OK [READ-ONLY] EXAMINE completed"
+	}
+	conn.untagged("OK [PERMANENTFLAGS (%s)] flags permitted", permanentFlags)
+	return "OK [READ-WRITE] SELECT completed"
+}
+
+// list lists the user's mailbox if its name matches the pattern.
+func (conn *Connection) list(verb string, args []token) string {
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return "BAD " + verb + " expects a reference name and a mailbox name"
+	}
+	if args[1].value == "" {
+		// An empty mailbox name asks for the hierarchy delimiter
+		conn.untagged(`%s (\Noselect) "/" ""`, verb)
+		return "OK " + verb + " completed"
+	}
+	// Both wildcards match the mailbox name as there is only one level of hierarchy
+	pattern := regexp.QuoteMeta(args[0].value + args[1].value)
+	pattern = strings.NewReplacer(`\*`, ".*", "%", ".*").Replace(pattern)
+	if matched, _ := regexp.MatchString("(?i)^"+pattern+"$", InboxName); matched {
+		conn.untagged(`%s (\HasNoChildren) "/" %s`, verb, InboxName)
+	}
+	return "OK " + verb + " completed"
+}
+
+// status returns the number of mails and UID information of the user's mailbox.
+func (conn *Connection) status(args []token) string {
+	if len(args) != 2 || args[0].isList || !args[1].isList {
+		return "BAD STATUS expects a mailbox name and a list of status items"
+	}
+	if !isInbox(args[0].value) {
+		return "NO [NONEXISTENT] mailbox does not exist"
+	}
+	validity, next, msgs, err := conn.Config.Store.List(conn.mailbox, time.Now())
+	if err != nil {
+		return fmt.Sprintf("NO [SERVERBUG] %v", err)
+	}
+	var items []string
+	for _, item := range tokenStrings(args[1].list) {
+		switch item = strings.ToUpper(item); item {
+		case "MESSAGES":
+			items = append(items, fmt.Sprintf("MESSAGES %d", len(msgs)))
+		case "RECENT":
+			items = append(items, "RECENT 0")
+		case "UIDNEXT":
+			items = append(items, fmt.Sprintf("UIDNEXT %d", next))
+		case "UIDVALIDITY":
+			items = append(items, fmt.Sprintf("UIDVALIDITY %d", validity))
+		case "UNSEEN":
+			var unseen int
+			for _, msg := range msgs {
+				if !msg.HasFlag(`\Seen`) {
+					unseen++
+				}
+			}
+			items = append(items, fmt.Sprintf("UNSEEN %d", unseen))
+		default:
+			return "BAD unknown status item " + item
+		}
+	}
+	conn.untagged("STATUS %s (%s)", InboxName, strings.Join(items, " "))
+	return "OK STATUS completed"
+}
+
+// refresh informs the client of the mails that have arrived since the mailbox was selected.
+func (conn *Connection) refresh() {
+	_, next, msgs, err := conn.Config.Store.List(conn.mailbox, time.Now())
+	if err != nil {
+		conn.logger.Warning("refresh", conn.mailbox, err, "failed to list mails")
+		return
+	}
+	var lastUID uint32
+	if len(conn.messages) > 0 {
+		lastUID = conn.messages[len(conn.messages)-1].UID
+	}
+	numBefore := len(conn.messages)
+	for _, msg := range msgs {
+		if msg.UID > lastUID {
+			conn.messages = append(conn.messages, msg)
+		}
+	}
+	conn.uidNext = next
+	if len(conn.messages) != numBefore {
+		conn.untagged("%d EXISTS", len(conn.messages))
+	}
+}
+
+// selectMessages returns the indexes of mails that belong to the set of sequence numbers or UIDs.
+func (conn *Connection) selectMessages(set string, useUID bool) ([]int, error) {
+	largest := uint32(len(conn.messages))
+	if useUID && len(conn.messages) > 0 {
+		largest = conn.messages[len(conn.messages)-1].UID
+	}
+	seqSet, err := parseSequenceSet(set, largest)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for i, msg := range conn.messages {
+		if useUID && seqSet.contains(msg.UID) || !useUID && seqSet.contains(uint32(i+1)) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// store adds, removes, or replaces the flags of mails.
+func (conn *Connection) store(args []token, useUID bool) string {
+	if conn.readOnly {
+		return "NO mailbox is read-only"
+	}
+	if len(args) < 3 || args[0].isList || args[1].isList {
+		return "BAD STORE expects a message set, data item name, and flags"
+	}
+	indexes, err := conn.selectMessages(args[0].value, useUID)
+	if err != nil {
+		return fmt.Sprintf("BAD %v", err)
+	}
+	item := strings.ToUpper(args[1].value)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return "BAD unknown data item " + args[1].value
+	}
+	flags := tokenStrings(args[2:])
+	var failed bool
+	for _, i := range indexes {
+		msg := conn.messages[i]
+		newFlags := flags
+		if item == "+FLAGS" {
+			newFlags = append(append([]string{}, msg.Flags...), flags...)
+		} else if item == "-FLAGS" {
+			newFlags = nil
+			for _, existing := range msg.Flags {
+				var remove bool
+				for _, flag := range flags {
+					remove = remove || strings.EqualFold(existing, flag)
+				}
+				if !remove {
+					newFlags = append(newFlags, existing)
+				}
+			}
+		}
+		updated, err := conn.Config.Store.SetFlags(conn.mailbox, msg, newFlags)
+		if err != nil {
+			failed = true
+			continue
+		}
+		conn.messages[i] = updated
+		if !silent {
+			if useUID {
+				conn.untagged("%d FETCH (UID %d FLAGS (%s))", i+1, updated.UID, strings.Join(updated.Flags, " "))
+			} else {
+				conn.untagged("%d FETCH (FLAGS (%s))", i+1, strings.Join(updated.Flags, " "))
+			}
+		}
+	}
+	if failed {
+		return "NO some of the messages no longer exist"
+	}
+	return "OK STORE completed"
+}
+
+// expunge permanently removes the mails that carry the \Deleted flag.
+func (conn *Connection) expunge(silent bool) string {
+	if conn.readOnly {
+		return "NO mailbox is read-only"
+	}
+	for i := 0; i < len(conn.messages); {
+		if !conn.messages[i].HasFlag(`\Deleted`) {
+			i++
+			continue
+		}
+		if err := conn.Config.Store.Remove(conn.mailbox, conn.messages[i]); err != nil {
+			return fmt.Sprintf("NO [SERVERBUG] %v", err)
+		}
+		// The sequence numbers of the subsequent mails decrease by one
+		conn.messages = append(conn.messages[:i], conn.messages[i+1:]...)
+		if !silent {
+			conn.untagged("%d EXPUNGE", i+1)
+		}
+	}
+	return "OK EXPUNGE completed"
+}
@@ -0,0 +1,196 @@
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBadSyntax      = errors.New("bad command syntax")
+	ErrBadSequenceSet = errors.New("bad message sequence set")
+)
+
+/*
+token is an argument of an IMAP command. It is either a string (atom, quoted string, or literal) or a parenthesised
+list of tokens. An atom keeps its bracketed section intact, e.g. BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.100>.
+*/
+type token struct {
+	value  string
+	list   []token
+	isList bool
+}
+
+// argParser breaks down command arguments into tokens.
+type argParser struct {
+	s   string
+	pos int
+}
+
+// parseArgs returns the tokens of IMAP command arguments.
+func parseArgs(s string) ([]token, error) {
+	parser := &argParser{s: s}
+	return parser.parse(0)
+}
+
+// parse returns the tokens up to the closing character, or up to the end of the input if the closing character is 0.
+func (parser *argParser) parse(closing byte) (tokens []token, err error) {
+	for {
+		for parser.pos < len(parser.s) && parser.s[parser.pos] == ' ' {
+			parser.pos++
+		}
+		if parser.pos >= len(parser.s) {
+			if closing != 0 {
+				return nil, ErrBadSyntax
+			}
+			return tokens, nil
+		}
+		switch c := parser.s[parser.pos]; {
+		case closing != 0 && c == closing:
+			parser.pos++
+			return tokens, nil
+		case c == '(':
+			parser.pos++
+			list, err := parser.parse(')')
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{list: list, isList: true})
+		case c == ')':
+			return nil, ErrBadSyntax
+		case c == '"':
+			value, err := parser.quoted()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{value: value})
+		case c == '{':
+			value, err := parser.literal()
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{value: value})
+		default:
+			tokens = append(tokens, token{value: parser.atom()})
+		}
+	}
+}
+
+// quoted returns the content of a quoted string with its escape characters removed.
+func (parser *argParser) quoted() (string, error) {
+	var value strings.Builder
+	for parser.pos++; parser.pos < len(parser.s); parser.pos++ {
+		switch c := parser.s[parser.pos]; c {
+		case '\\':
+			if parser.pos++; parser.pos == len(parser.s) {
+				return "", ErrBadSyntax
+			}
+			value.WriteByte(parser.s[parser.pos])
+		case '"':
+			parser.pos++
+			return value.String(), nil
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", ErrBadSyntax
+}
+
+// literal returns the content of a literal string "{length}\r\n...", the connection has already read the content.
+func (parser *argParser) literal() (string, error) {
+	end := strings.Index(parser.s[parser.pos:], "}\r\n")
+	if end == -1 {
+		return "", ErrBadSyntax
+	}
+	length, err := strconv.Atoi(strings.TrimSuffix(parser.s[parser.pos+1:parser.pos+end], "+"))
+	start := parser.pos + end + 3
+	if err != nil || length < 0 || start+length > len(parser.s) {
+		return "", ErrBadSyntax
+	}
+	parser.pos = start + length
+	return parser.s[start:parser.pos], nil
+}
+
+// atom returns an atom that ends at a space or parenthesis, except for those inside of a bracketed section.
+func (parser *argParser) atom() string {
+	start := parser.pos
+	depth := 0
+	for ; parser.pos < len(parser.s); parser.pos++ {
+		switch parser.s[parser.pos] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ', '(', ')':
+			if depth <= 0 {
+				return parser.s[start:parser.pos]
+			}
+		}
+	}
+	return parser.s[start:]
+}
+
+// tokenStrings returns the string value of the tokens, a list token yields its string members.
+func tokenStrings(tokens []token) (ret []string) {
+	for _, tok := range tokens {
+		if tok.isList {
+			ret = append(ret, tokenStrings(tok.list)...)
+		} else {
+			ret = append(ret, tok.value)
+		}
+	}
+	return
+}
+
+// sequenceSet is a set of message sequence numbers or UIDs, each element is an inclusive range.
+type sequenceSet [][2]uint32
+
+/*
+parseSequenceSet parses a message set such as "1,3:5,7:*", in which * stands for the largest number in use. If the
+mailbox is empty, the set will not contain any message.
+*/
+func parseSequenceSet(s string, largest uint32) (set sequenceSet, err error) {
+	if s == "" {
+		return nil, ErrBadSequenceSet
+	}
+	parseNumber := func(num string) (uint32, error) {
+		if num == "*" {
+			return largest, nil
+		}
+		n, err := strconv.ParseUint(num, 10, 32)
+		if err != nil || n == 0 {
+			return 0, ErrBadSequenceSet
+		}
+		return uint32(n), nil
+	}
+	for _, element := range strings.Split(s, ",") {
+		bounds := strings.SplitN(element, ":", 2)
+		low, err := parseNumber(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = parseNumber(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if low > high {
+			low, high = high, low
+		}
+		if high > 0 {
+			set = append(set, [2]uint32{low, high})
+		}
+	}
+	return set, nil
+}
+
+// contains returns true only if the number is among the set.
+func (set sequenceSet) contains(n uint32) bool {
+	for _, bounds := range set {
+		if n >= bounds[0] && n <= bounds[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tokens, err := parseArgs(`1:* (UID BODY.PEEK[HEADER.FIELDS (From To)]<0.10>) "quoted \"str\"" {5}` + "\r\nab cd" + ` atom`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []token{
+		{value: "1:*"},
+		{isList: true, list: []token{{value: "UID"}, {value: "BODY.PEEK[HEADER.FIELDS (From To)]<0.10>"}}},
+		{value: `quoted "str"`},
+		{value: "ab cd"},
+		{value: "atom"},
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("%+v", tokens)
+	}
+	if strs := tokenStrings(tokens[1:3]); !reflect.DeepEqual(strs, []string{"UID", "BODY.PEEK[HEADER.FIELDS (From To)]<0.10>", `quoted "str"`}) {
+		t.Fatal(strs)
+	}
+	for _, bad := range []string{`(unbalanced`, `unbalanced)`, `"unterminated`, "{10}\r\nshort"} {
+		if _, err := parseArgs(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestParseSequenceSet(t *testing.T) {
+	set, err := parseSequenceSet("1,3:5,*:7", 10)
+	if err != nil || !reflect.DeepEqual(set, sequenceSet{{1, 1}, {3, 5}, {7, 10}}) {
+		t.Fatal(set, err)
+	}
+	if !set.contains(4) || set.contains(2) || !set.contains(10) || set.contains(11) {
+		t.Fatal("wrong membership")
+	}
+	// An empty mailbox does not have any message
+	if set, err := parseSequenceSet("*", 0); err != nil || len(set) != 0 {
+		t.Fatal(set, err)
+	}
+	for _, bad := range []string{"", "0", "a", "1:b", "1,,2"} {
+		if _, err := parseSequenceSet(bad, 10); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
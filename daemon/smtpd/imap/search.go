@@ -0,0 +1,234 @@
+package imap
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchKey tells whether a mail satisfies a search criterion.
+type searchKey func(seq uint32, lazy *lazyMessage) bool
+
+// searchFlags are the search keys that look for mails with or without a flag.
+var searchFlags = map[string]string{
+	"ANSWERED": `\Answered`,
+	"DELETED":  `\Deleted`,
+	"DRAFT":    `\Draft`,
+	"FLAGGED":  `\Flagged`,
+	"SEEN":     `\Seen`,
+}
+
+// containsFold returns true only if the substring is among the string, ignoring case differences.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// headerContains returns a search key that looks for the string among the values of a header field.
+func headerContains(field, value string) searchKey {
+	return func(_ uint32, lazy *lazyMessage) bool {
+		for _, v := range lazy.getHeader()[textproto.CanonicalMIMEHeaderKey(field)] {
+			if containsFold(v, value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// dateOnly returns the calendar date of the time in its own time zone, the date is expressed as midnight UTC for comparison.
+func dateOnly(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// compareDate returns a search key that compares the date of a mail against the date argument of BEFORE, ON, or SINCE.
+func compareDate(comparison, arg string, getDate func(*lazyMessage) (time.Time, bool)) (searchKey, error) {
+	date, err := time.Parse("2-Jan-2006", arg)
+	if err != nil {
+		return nil, fmt.Errorf("bad date %s", arg)
+	}
+	return func(_ uint32, lazy *lazyMessage) bool {
+		mailDate, ok := getDate(lazy)
+		if !ok {
+			return false
+		}
+		mailDate = dateOnly(mailDate)
+		switch comparison {
+		case "BEFORE":
+			return mailDate.Before(date)
+		case "ON":
+			return mailDate.Equal(date)
+		default:
+			return !mailDate.Before(date)
+		}
+	}, nil
+}
+
+// parseSearchKey parses the first search key among the arguments, and returns the remaining arguments.
+func (conn *Connection) parseSearchKey(args []token) (key searchKey, rest []token, err error) {
+	if len(args) == 0 {
+		return nil, nil, ErrBadSyntax
+	}
+	arg := args[0]
+	rest = args[1:]
+	if arg.isList {
+		key, err = conn.parseSearchKeys(arg.list)
+		return
+	}
+	// next takes the string argument of the search key
+	next := func() (string, error) {
+		if len(rest) == 0 || rest[0].isList {
+			return "", ErrBadSyntax
+		}
+		value := rest[0].value
+		rest = rest[1:]
+		return value, nil
+	}
+	var value, field string
+	switch name := strings.ToUpper(arg.value); name {
+	case "ALL", "OLD":
+		key = func(uint32, *lazyMessage) bool { return true }
+	case "NEW", "RECENT":
+		// None of the mails is recent, it is not a concept supported by the server.
+		key = func(uint32, *lazyMessage) bool { return false }
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		key = func(_ uint32, lazy *lazyMessage) bool { return lazy.msg.HasFlag(searchFlags[name]) }
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		key = func(_ uint32, lazy *lazyMessage) bool { return !lazy.msg.HasFlag(searchFlags[name[2:]]) }
+	case "KEYWORD", "UNKEYWORD":
+		// Keywords are not stored, no mail carries a keyword.
+		if _, err = next(); err == nil {
+			key = func(uint32, *lazyMessage) bool { return name == "UNKEYWORD" }
+		}
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		if value, err = next(); err == nil {
+			key = headerContains(name, value)
+		}
+	case "HEADER":
+		if field, err = next(); err == nil {
+			if value, err = next(); err == nil {
+				key = headerContains(field, value)
+			}
+		}
+	case "BODY", "TEXT":
+		if value, err = next(); err == nil {
+			key = func(_ uint32, lazy *lazyMessage) bool {
+				content, err := lazy.get()
+				if err != nil {
+					return false
+				}
+				if name == "BODY" {
+					_, content = splitMessage(content)
+				}
+				return containsFold(string(content), value)
+			}
+		}
+	case "BEFORE", "ON", "SINCE":
+		if value, err = next(); err == nil {
+			key, err = compareDate(name, value, func(lazy *lazyMessage) (time.Time, bool) {
+				return lazy.msg.Delivered, true
+			})
+		}
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		if value, err = next(); err == nil {
+			key, err = compareDate(name[4:], value, func(lazy *lazyMessage) (time.Time, bool) {
+				sent, err := lazy.getHeader().Date()
+				return sent, err == nil
+			})
+		}
+	case "LARGER", "SMALLER":
+		if value, err = next(); err == nil {
+			size, parseErr := strconv.ParseInt(value, 10, 64)
+			if parseErr != nil {
+				return nil, nil, ErrBadSyntax
+			}
+			key = func(_ uint32, lazy *lazyMessage) bool {
+				return name == "LARGER" && lazy.msg.Size > size || name == "SMALLER" && lazy.msg.Size < size
+			}
+		}
+	case "UID":
+		if value, err = next(); err == nil {
+			var largest uint32
+			if len(conn.messages) > 0 {
+				largest = conn.messages[len(conn.messages)-1].UID
+			}
+			var set sequenceSet
+			if set, err = parseSequenceSet(value, largest); err == nil {
+				key = func(_ uint32, lazy *lazyMessage) bool { return set.contains(lazy.msg.UID) }
+			}
+		}
+	case "NOT":
+		var negated searchKey
+		if negated, rest, err = conn.parseSearchKey(rest); err == nil {
+			key = func(seq uint32, lazy *lazyMessage) bool { return !negated(seq, lazy) }
+		}
+	case "OR":
+		var key1, key2 searchKey
+		if key1, rest, err = conn.parseSearchKey(rest); err == nil {
+			if key2, rest, err = conn.parseSearchKey(rest); err == nil {
+				key = func(seq uint32, lazy *lazyMessage) bool { return key1(seq, lazy) || key2(seq, lazy) }
+			}
+		}
+	default:
+		// A message sequence set
+		var set sequenceSet
+		if set, err = parseSequenceSet(arg.value, uint32(len(conn.messages))); err != nil {
+			return nil, nil, fmt.Errorf("unknown search key %s", arg.value)
+		}
+		key = func(seq uint32, _ *lazyMessage) bool { return set.contains(seq) }
+	}
+	return
+}
+
+// parseSearchKeys parses all of the search keys among the arguments, a mail must satisfy all of them.
+func (conn *Connection) parseSearchKeys(args []token) (searchKey, error) {
+	var keys []searchKey
+	for len(args) > 0 {
+		key, rest, err := conn.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		args = rest
+	}
+	if len(keys) == 0 {
+		return nil, ErrBadSyntax
+	}
+	return func(seq uint32, lazy *lazyMessage) bool {
+		for _, key := range keys {
+			if !key(seq, lazy) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// search looks for the mails that satisfy the search criteria, and responds with their sequence numbers or UIDs.
+func (conn *Connection) search(args []token, useUID bool) string {
+	if len(args) > 1 && !args[0].isList && strings.EqualFold(args[0].value, "CHARSET") {
+		if charset := strings.ToUpper(args[1].value); charset != "US-ASCII" && charset != "UTF-8" {
+			return "NO [BADCHARSET (US-ASCII UTF-8)] unsupported charset"
+		}
+		args = args[2:]
+	}
+	key, err := conn.parseSearchKeys(args)
+	if err != nil {
+		return fmt.Sprintf("BAD %v", err)
+	}
+	var results strings.Builder
+	results.WriteString("SEARCH")
+	for i, msg := range conn.messages {
+		if key(uint32(i+1), &lazyMessage{conn: conn, msg: msg}) {
+			if useUID {
+				results.WriteString(fmt.Sprintf(" %d", msg.UID))
+			} else {
+				results.WriteString(fmt.Sprintf(" %d", i+1))
+			}
+		}
+	}
+	conn.untagged("%s", results.String())
+	return "OK SEARCH completed"
+}
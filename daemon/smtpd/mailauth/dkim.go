@@ -0,0 +1,353 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HeaderDKIMSignature is the name of the header that carries a DKIM signature.
+	HeaderDKIMSignature = "DKIM-Signature"
+	// MaxDKIMSignatures is the maximum number of signatures verified in a mail, the remaining ones are ignored.
+	MaxDKIMSignatures = 5
+	// MinDKIMRSAKeyBits is the minimum size of an RSA signing key, signatures made by smaller keys are not acceptable (RFC 8301).
+	MinDKIMRSAKeyBits = 1024
+)
+
+var (
+	ErrDKIMBodyHashMismatch = errors.New("body hash does not match")
+	ErrDKIMBadSignature     = errors.New("signature does not verify")
+	ErrDKIMKeyRevoked       = errors.New("signing key has been revoked")
+	ErrDKIMUnsignedBody     = errors.New("body carries content beyond the signed length")
+)
+
+// dkimSignature is a parsed DKIM-Signature header.
+type dkimSignature struct {
+	keyType     string // keyType is either "rsa" or "ed25519".
+	hash        crypto.Hash
+	signature   []byte
+	bodyHash    []byte
+	headerCanon string // headerCanon is the header canonicalisation algorithm, either "simple" or "relaxed".
+	bodyCanon   string // bodyCanon is the body canonicalisation algorithm, either "simple" or "relaxed".
+	domain      string
+	selector    string
+	headers     []string // headers are the names of signed header fields.
+	bodyLength  int      // bodyLength is the number of canonicalised body bytes that are signed, or -1 for all of them.
+}
+
+// parseTags parses a tag list such as "v=1; a=rsa-sha256" into a map of tag names and values.
+func parseTags(list string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(list, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		eq := strings.IndexByte(spec, '=')
+		if eq < 1 {
+			return nil, fmt.Errorf("malformed tag \"%s\"", spec)
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, exists := tags[name]; exists {
+			return nil, fmt.Errorf("duplicated tag \"%s\"", name)
+		}
+		tags[name] = strings.TrimSpace(spec[eq+1:])
+	}
+	return tags, nil
+}
+
+// removeWhitespace returns the string without any space, tab, and line terminator.
+func removeWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// parseDKIMSignature parses the value of a DKIM-Signature header. The returned signature carries domain and selector even if an error occurs.
+func parseDKIMSignature(value string) (*dkimSignature, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return &dkimSignature{}, err
+	}
+	sig := &dkimSignature{domain: strings.ToLower(tags["d"]), selector: tags["s"], bodyLength: -1}
+	if tags["v"] != "1" {
+		return sig, fmt.Errorf("unsupported version \"%s\"", tags["v"])
+	}
+	for _, required := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[required] == "" {
+			return sig, fmt.Errorf("missing tag \"%s\"", required)
+		}
+	}
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		sig.keyType, sig.hash = "rsa", crypto.SHA256
+	case "rsa-sha1":
+		// SHA-1 is no longer acceptable for DKIM signatures (RFC 8301)
+		return sig, errors.New("algorithm rsa-sha1 is no longer acceptable")
+	case "ed25519-sha256":
+		sig.keyType, sig.hash = "ed25519", crypto.SHA256
+	default:
+		return sig, fmt.Errorf("unsupported algorithm \"%s\"", tags["a"])
+	}
+	if sig.signature, err = base64.StdEncoding.DecodeString(removeWhitespace(tags["b"])); err != nil {
+		return sig, fmt.Errorf("malformed signature - %v", err)
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(removeWhitespace(tags["bh"])); err != nil {
+		return sig, fmt.Errorf("malformed body hash - %v", err)
+	}
+	sig.headerCanon, sig.bodyCanon = "simple", "simple"
+	if canon := strings.ToLower(tags["c"]); canon != "" {
+		algorithms := strings.SplitN(canon, "/", 2)
+		sig.headerCanon = algorithms[0]
+		if len(algorithms) == 2 {
+			sig.bodyCanon = algorithms[1]
+		}
+		for _, algorithm := range algorithms {
+			if algorithm != "simple" && algorithm != "relaxed" {
+				return sig, fmt.Errorf("unsupported canonicalisation \"%s\"", canon)
+			}
+		}
+	}
+	var signsFrom bool
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		sig.headers = append(sig.headers, name)
+		signsFrom = signsFrom || strings.EqualFold(name, "From")
+	}
+	if !signsFrom {
+		return sig, errors.New("From header is not signed")
+	}
+	if identity := strings.ToLower(tags["i"]); identity != "" {
+		identityDomain := identity[strings.LastIndexByte(identity, '@')+1:]
+		if identityDomain != sig.domain && !strings.HasSuffix(identityDomain, "."+sig.domain) {
+			return sig, fmt.Errorf("identity \"%s\" does not belong to domain \"%s\"", identity, sig.domain)
+		}
+	}
+	if length := tags["l"]; length != "" {
+		if sig.bodyLength, err = strconv.Atoi(length); err != nil || sig.bodyLength < 0 {
+			return sig, fmt.Errorf("malformed body length \"%s\"", length)
+		}
+	}
+	if expiry := tags["x"]; expiry != "" {
+		expiryUnix, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil {
+			return sig, fmt.Errorf("malformed expiry \"%s\"", expiry)
+		}
+		if time.Now().Unix() > expiryUnix {
+			return sig, errors.New("signature has expired")
+		}
+	}
+	return sig, nil
+}
+
+// canonicaliseHeader returns the header field canonicalised by the algorithm (RFC 6376 section 3.4).
+func canonicaliseHeader(raw, algorithm string) string {
+	if algorithm != "relaxed" {
+		return raw
+	}
+	colon := strings.IndexByte(raw, ':')
+	if colon == -1 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":\r\n"
+	}
+	unfolded := strings.NewReplacer("\r", "", "\n", "").Replace(raw[colon+1:])
+	return strings.ToLower(strings.TrimSpace(raw[:colon])) + ":" + strings.Join(strings.Fields(unfolded), " ") + "\r\n"
+}
+
+// canonicaliseBody returns the body (without the empty line that separates it from the header) canonicalised by the algorithm.
+func canonicaliseBody(body []byte, algorithm string) []byte {
+	crlf := []byte("\r\n")
+	if algorithm == "relaxed" {
+		lines := bytes.Split(body, crlf)
+		for i, line := range lines {
+			lines[i] = bytes.Join(bytes.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' }), []byte(" "))
+			// A line that begins with a whitespace keeps a single space in place of the leading whitespaces
+			if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines[i]) > 0 {
+				lines[i] = append([]byte(" "), lines[i]...)
+			}
+		}
+		body = bytes.Join(lines, crlf)
+	}
+	for bytes.HasSuffix(body, crlf) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 && algorithm == "relaxed" {
+		return []byte{}
+	}
+	return append(append([]byte{}, body...), crlf...)
+}
+
+// withoutSignatureValue returns the DKIM-Signature header field with the value of b= tag removed.
+func withoutSignatureValue(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	segments := strings.Split(raw[colon+1:], ";")
+	for i, segment := range segments {
+		if eq := strings.IndexByte(segment, '='); eq != -1 && strings.TrimSpace(segment[:eq]) == "b" {
+			segments[i] = segment[:eq+1]
+		}
+	}
+	return raw[:colon+1] + strings.Join(segments, ";")
+}
+
+/*
+headerHash returns the hash of the signed header fields and the signature header field itself, the header fields of
+the same name are selected from the bottom up.
+*/
+func headerHash(fields []headerField, sigRaw string, headerCanon string, hashAlgorithm crypto.Hash, signedHeaders []string) []byte {
+	hash := hashAlgorithm.New()
+	used := make(map[int]bool)
+	for _, name := range signedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				_, _ = hash.Write([]byte(canonicaliseHeader(fields[i].raw, headerCanon)))
+				break
+			}
+		}
+	}
+	sigField := strings.TrimSuffix(canonicaliseHeader(withoutSignatureValue(sigRaw), headerCanon), "\r\n")
+	_, _ = hash.Write([]byte(sigField))
+	return hash.Sum(nil)
+}
+
+/*
+bodyHash returns the hash of the canonicalised body, limited to the length if it is not negative. Content appended
+beyond the signed length could be anything at all, hence the function returns ErrDKIMUnsignedBody for such a body.
+*/
+func bodyHash(body []byte, bodyCanon string, hashAlgorithm crypto.Hash, length int) ([]byte, error) {
+	canonBody := canonicaliseBody(body, bodyCanon)
+	if length >= 0 {
+		if length > len(canonBody) {
+			return nil, fmt.Errorf("body length %d exceeds the actual length %d", length, len(canonBody))
+		} else if length < len(canonBody) {
+			return nil, ErrDKIMUnsignedBody
+		}
+	}
+	hash := hashAlgorithm.New()
+	_, _ = hash.Write(canonBody)
+	return hash.Sum(nil), nil
+}
+
+// lookupDKIMKey retrieves the public key of the signature from DNS.
+func lookupDKIMKey(ctx context.Context, resolver Resolver, sig *dkimSignature) (crypto.PublicKey, Result, error) {
+	txts, err := resolver.LookupTXT(ctx, sig.selector+"._domainkey."+sig.domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ResultPermError, errors.New("signing key does not exist")
+		}
+		return nil, ResultTempError, err
+	}
+	if len(txts) == 0 {
+		return nil, ResultPermError, errors.New("signing key does not exist")
+	}
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, ResultPermError, err
+	}
+	if version, exists := tags["v"]; exists && version != "DKIM1" {
+		return nil, ResultPermError, fmt.Errorf("unsupported key version \"%s\"", version)
+	}
+	if keyType := strings.ToLower(tags["k"]); keyType != "" && keyType != sig.keyType || keyType == "" && sig.keyType != "rsa" {
+		return nil, ResultPermError, fmt.Errorf("key type \"%s\" does not match the signature", tags["k"])
+	}
+	encodedKey := removeWhitespace(tags["p"])
+	if encodedKey == "" {
+		return nil, ResultFail, ErrDKIMKeyRevoked
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, ResultPermError, fmt.Errorf("malformed key - %v", err)
+	}
+	if sig.keyType == "ed25519" {
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return nil, ResultPermError, errors.New("malformed ed25519 key")
+		}
+		return ed25519.PublicKey(keyBytes), ResultPass, nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(keyBytes); err == nil {
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, ResultPermError, errors.New("key is not an RSA key")
+		}
+		return checkRSAKeySize(rsaKey)
+	}
+	rsaKey, err := x509.ParsePKCS1PublicKey(keyBytes)
+	if err != nil {
+		return nil, ResultPermError, fmt.Errorf("malformed RSA key - %v", err)
+	}
+	return checkRSAKeySize(rsaKey)
+}
+
+// checkRSAKeySize returns the RSA key if it is sufficiently large, or a permanent error otherwise.
+func checkRSAKeySize(key *rsa.PublicKey) (crypto.PublicKey, Result, error) {
+	if bits := key.N.BitLen(); bits < MinDKIMRSAKeyBits {
+		return nil, ResultPermError, fmt.Errorf("RSA key of %d bits is too small", bits)
+	}
+	return key, ResultPass, nil
+}
+
+// verifySignature verifies the signature carried by the DKIM-Signature header field of the mail.
+func verifySignature(ctx context.Context, resolver Resolver, fields []headerField, sigField headerField, body []byte) (result DKIMResult) {
+	sig, err := parseDKIMSignature(sigField.value())
+	result.Domain, result.Selector = sig.domain, sig.selector
+	if err != nil {
+		result.Result, result.Err = ResultPermError, err
+		return
+	}
+	actualBodyHash, err := bodyHash(body, sig.bodyCanon, sig.hash, sig.bodyLength)
+	if err == ErrDKIMUnsignedBody {
+		result.Result, result.Err = ResultFail, err
+		return
+	} else if err != nil {
+		result.Result, result.Err = ResultPermError, err
+		return
+	}
+	if !bytes.Equal(actualBodyHash, sig.bodyHash) {
+		result.Result, result.Err = ResultFail, ErrDKIMBodyHashMismatch
+		return
+	}
+	key, keyResult, err := lookupDKIMKey(ctx, resolver, sig)
+	if err != nil {
+		result.Result, result.Err = keyResult, err
+		return
+	}
+	digest := headerHash(fields, sigField.raw, sig.headerCanon, sig.hash, sig.headers)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, sig.hash, digest, sig.signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig.signature) {
+			err = ErrDKIMBadSignature
+		}
+	}
+	if err != nil {
+		result.Result, result.Err = ResultFail, ErrDKIMBadSignature
+		return
+	}
+	result.Result = ResultPass
+	return
+}
+
+// VerifyDKIM verifies the DKIM signatures of the mail message, and returns an empty slice if the mail is not signed.
+func VerifyDKIM(ctx context.Context, resolver Resolver, message []byte) (results []DKIMResult) {
+	fields, body := splitHeader(normaliseCRLF(message))
+	// The body to be canonicalised does not include the empty line that separates it from the header
+	body = bytes.TrimPrefix(body, []byte("\r\n"))
+	for _, field := range fields {
+		if !strings.EqualFold(field.name, HeaderDKIMSignature) {
+			continue
+		}
+		if len(results) == MaxDKIMSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, resolver, fields, field, body))
+	}
+	return
+}
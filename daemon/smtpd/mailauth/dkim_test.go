@@ -0,0 +1,219 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// publishedRSAKey returns the DNS TXT record that publishes the public key.
+func publishedRSAKey(t *testing.T, key *rsa.PrivateKey) string {
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// signForTest returns the message with a DKIM-Signature header on top, the header carries the extra tags if there are any.
+func signForTest(t *testing.T, message string, key crypto.Signer, domain, selector, canon, headers string, extraTags ...string) string {
+	algorithm := "rsa-sha256"
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+	canonAlgorithms := strings.SplitN(canon+"/simple", "/", 3)
+	fields, body := splitHeader(normaliseCRLF([]byte(message)))
+	bh, err := bodyHash(body[2:], canonAlgorithms[1], crypto.SHA256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigField := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=%s; d=%s; s=%s;\r\n\th=%s; bh=%s; %sb=",
+		algorithm, canon, domain, selector, headers, base64.StdEncoding.EncodeToString(bh), strings.Join(append(extraTags, ""), "; "))
+	digest := headerHash(fields, sigField, canonAlgorithms[0], crypto.SHA256, strings.Split(headers, ":"))
+	var sig []byte
+	if edKey, ok := key.(ed25519.PrivateKey); ok {
+		sig = ed25519.Sign(edKey, digest)
+	} else if sig, err = key.Sign(rand.Reader, digest, crypto.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	return sigField + encoded[:20] + "\r\n\t " + encoded[20:] + "\r\n" + message
+}
+
+func TestCanonicalise(t *testing.T) {
+	// The examples come from RFC 6376 section 3.4.5
+	header := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	fields, _ := splitHeader([]byte(header + "\r\n"))
+	var relaxed, simple string
+	for _, field := range fields {
+		relaxed += canonicaliseHeader(field.raw, "relaxed")
+		simple += canonicaliseHeader(field.raw, "simple")
+	}
+	if relaxed != "a:X\r\nb:Y Z\r\n" || simple != header {
+		t.Fatalf("%q %q", relaxed, simple)
+	}
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+	if got := string(canonicaliseBody(body, "relaxed")); got != " C\r\nD E\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if got := string(canonicaliseBody(body, "simple")); got != " C \r\nD \t E\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if got := string(canonicaliseBody(nil, "simple")); got != "\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if got := string(canonicaliseBody([]byte("\r\n \r\n"), "relaxed")); got != "" {
+		t.Fatalf("%q", got)
+	}
+	if got := withoutSignatureValue("DKIM-Signature: v=1; b=abc\r\n\t def; bh=xyz\r\n"); got != "DKIM-Signature: v=1; b=; bh=xyz\r\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A 512 bits RSA key is too small to be acceptable
+	weakKey := x509.MarshalPKCS1PublicKey(&rsa.PublicKey{N: new(big.Int).SetBit(big.NewInt(1), 511, 1), E: 65537})
+	resolver := &fakeResolver{txt: map[string][]string{
+		"rsa._domainkey.example.com":     {publishedRSAKey(t, rsaKey)},
+		"ed._domainkey.example.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		"weak._domainkey.example.com":    {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(weakKey)},
+	}}
+	message := "From: Howard <howard@example.com>\r\nTo: a@example.net\r\nSubject: test\r\n\r\nHello  there \r\n\r\n"
+	verify := func(message string) []DKIMResult {
+		return VerifyDKIM(context.Background(), resolver, []byte(message))
+	}
+
+	if results := verify(message); len(results) != 0 {
+		t.Fatal(results)
+	}
+	for _, canon := range []string{"relaxed/relaxed", "simple/simple", "relaxed", "simple/relaxed"} {
+		for selector, key := range map[string]crypto.Signer{"rsa": rsaKey, "ed": edKey} {
+			signed := signForTest(t, message, key, "example.com", selector, canon, "From:To:Subject")
+			if results := verify(signed); len(results) != 1 || results[0].Result != ResultPass || results[0].Domain != "example.com" || results[0].Selector != selector {
+				t.Fatal(canon, selector, results)
+			}
+			// Line terminators do not matter
+			if results := verify(strings.Replace(signed, "\r\n", "\n", -1)); len(results) != 1 || results[0].Result != ResultPass {
+				t.Fatal(canon, selector, results)
+			}
+			// Body has been tampered with
+			if results := verify(strings.Replace(signed, "there", "where", 1)); len(results) != 1 || results[0].Err != ErrDKIMBodyHashMismatch {
+				t.Fatal(canon, selector, results)
+			}
+			// Header has been tampered with
+			if results := verify(strings.Replace(signed, "Subject: test", "Subject: tesT", 1)); len(results) != 1 || results[0].Err != ErrDKIMBadSignature {
+				t.Fatal(canon, selector, results)
+			}
+		}
+	}
+	// Relaxed canonicalisation tolerates whitespace changes
+	signed := signForTest(t, message, rsaKey, "example.com", "rsa", "relaxed/relaxed", "From:To:Subject")
+	if results := verify(strings.Replace(strings.Replace(signed, "Subject: test", "subject:   test", 1), "Hello  there", "Hello there", 1)); results[0].Result != ResultPass {
+		t.Fatal(results)
+	}
+	// An added header of a signed name is noticed, whereas an added header of unsigned name does not matter
+	if results := verify(strings.Replace(signed, "Subject: test", "Subject: test\r\nSubject: evil", 1)); results[0].Err != ErrDKIMBadSignature {
+		t.Fatal(results)
+	}
+	if results := verify(strings.Replace(signed, "Subject: test", "Subject: test\r\nX-Extra: ok", 1)); results[0].Result != ResultPass {
+		t.Fatal(results)
+	}
+	// Problems with the key
+	for selector, result := range map[string]Result{"revoked": ResultFail, "nothing": ResultPermError, "weak": ResultPermError} {
+		if results := verify(signForTest(t, message, rsaKey, "example.com", selector, "relaxed", "From")); results[0].Result != result {
+			t.Fatal(selector, results)
+		}
+	}
+	if results := verify(signForTest(t, message, edKey, "example.com", "rsa", "relaxed", "From")); results[0].Result != ResultPermError {
+		t.Fatal(results)
+	}
+	// The body may not carry content beyond the signed length
+	bodyLen := len(canonicaliseBody([]byte("Hello  there \r\n\r\n"), "relaxed"))
+	signed = signForTest(t, message, rsaKey, "example.com", "rsa", "relaxed/relaxed", "From:To:Subject", fmt.Sprintf("l=%d", bodyLen))
+	if results := verify(signed); results[0].Result != ResultPass {
+		t.Fatal(results)
+	}
+	if results := verify(signed + "Appended evil\r\n"); results[0].Result != ResultFail || results[0].Err != ErrDKIMUnsignedBody {
+		t.Fatal(results)
+	}
+	// Malformed signatures
+	for _, sig := range []string{
+		"DKIM-Signature: v=1; a=rsa-sha1; d=example.com; s=rsa; h=From; bh=AA==; b=AA==\r\n",
+		"DKIM-Signature: v=2; a=rsa-sha256; d=example.com; s=rsa; h=From; bh=AA==; b=AA==\r\n",
+		"DKIM-Signature: v=1; a=rsa-md5; d=example.com; s=rsa; h=From; bh=AA==; b=AA==\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=Subject; bh=AA==; b=AA==\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=From; bh=AA==\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=From; bh=AA==; b=AA==; x=1\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=From; bh=AA==; b=AA==; i=@example.net\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa; h=From; bh=AA==; b=AA==; l=99999\r\n",
+		"DKIM-Signature: v=1; v=1; a=rsa-sha256\r\n",
+	} {
+		if results := verify(sig + message); len(results) != 1 || results[0].Result != ResultPermError {
+			t.Fatal(sig, results)
+		}
+	}
+	resolver.tempErr = errors.New("network is unreachable")
+	if results := verify(signed); results[0].Result != ResultTempError {
+		t.Fatal(results)
+	}
+}
+
+func TestVerifyDKIM_OutgoingMail(t *testing.T) {
+	rsaKey := newTestRSAKey(t)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &fakeResolver{txt: map[string][]string{
+		"rsa._domainkey.example.com": {publishedRSAKey(t, rsaKey)},
+		"ed._domainkey.example.com":  {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	message := "MIME-Version: 1.0\nContent-type: text/plain; charset=utf-8\nFrom: howard@example.com\nTo: a@example.net\nSubject: test\n\n" +
+		strings.Repeat("a long line of text ", 100) + "\n\n"
+	// The signatures placed by the mail client on outgoing mails verify
+	for _, signer := range []*inet.DKIMSigner{
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey},
+		{Domain: "example.com", Selector: "ed", Key: edKey},
+	} {
+		signed, err := signer.Sign([]byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results := VerifyDKIM(context.Background(), resolver, signed); len(results) != 1 || results[0].Result != ResultPass {
+			t.Fatal(signer.Selector, results)
+		}
+		// Sign the signed mail once more, both signatures verify.
+		signedTwice, err := signer.Sign(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results := VerifyDKIM(context.Background(), resolver, signedTwice); len(results) != 2 || results[0].Result != ResultPass || results[1].Result != ResultPass {
+			t.Fatal(signer.Selector, results)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// dmarcRecord is a parsed DMARC policy record.
+type dmarcRecord struct {
+	policy          string // policy applies to the domain that publishes the record.
+	subdomainPolicy string // subdomainPolicy applies to subdomains of the organisational domain.
+	strictDKIM      bool   // strictDKIM requires DKIM signing domain to exactly match the From domain.
+	strictSPF       bool   // strictSPF requires SPF domain to exactly match the From domain.
+}
+
+/*
+GetOrganisationalDomain returns the registered domain of a domain name, e.g. "example.com" of "mail.example.com". In the
+absence of a public suffix list, a two-letter top level domain preceded by a short label such as "co.uk" is considered
+to be a public suffix.
+*/
+func GetOrganisationalDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	keep := 2
+	if len(labels) >= 3 && len(labels[len(labels)-1]) == 2 && len(labels[len(labels)-2]) <= 3 {
+		keep = 3
+	}
+	if len(labels) <= keep {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-keep:], ".")
+}
+
+// lookupDMARCRecord retrieves and parses the DMARC policy record published by the domain.
+func lookupDMARCRecord(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, Result, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ResultNone, nil
+		}
+		return nil, ResultTempError, err
+	}
+	var recordTXTs []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			recordTXTs = append(recordTXTs, txt)
+		}
+	}
+	if len(recordTXTs) == 0 {
+		return nil, ResultNone, nil
+	} else if len(recordTXTs) > 1 {
+		return nil, ResultPermError, fmt.Errorf("domain %s has %d DMARC records", domain, len(recordTXTs))
+	}
+	tags, err := parseTags(recordTXTs[0])
+	if err != nil {
+		return nil, ResultPermError, err
+	}
+	record := &dmarcRecord{
+		policy:          strings.ToLower(tags["p"]),
+		subdomainPolicy: strings.ToLower(tags["sp"]),
+		strictDKIM:      strings.EqualFold(tags["adkim"], "s"),
+		strictSPF:       strings.EqualFold(tags["aspf"], "s"),
+	}
+	if record.policy != "none" && record.policy != "quarantine" && record.policy != "reject" {
+		return nil, ResultPermError, fmt.Errorf("domain %s has an invalid policy \"%s\"", domain, tags["p"])
+	}
+	if record.subdomainPolicy == "" {
+		record.subdomainPolicy = record.policy
+	}
+	return record, ResultPass, nil
+}
+
+// isAligned returns true only if the authenticated domain is aligned with the From domain.
+func isAligned(authDomain, fromDomain string, strict bool) bool {
+	authDomain = strings.TrimSuffix(strings.ToLower(authDomain), ".")
+	if strict {
+		return authDomain == fromDomain
+	}
+	return authDomain != "" && GetOrganisationalDomain(authDomain) == GetOrganisationalDomain(fromDomain)
+}
+
+/*
+CheckDMARC evaluates the DMARC policy of the From header domain. The mail passes when either SPF or any of the DKIM
+signatures passes with a domain aligned with the From header domain.
+*/
+func CheckDMARC(ctx context.Context, resolver Resolver, fromDomain string, spf SPFResult, dkim []DKIMResult) (result DMARCResult) {
+	result.FromDomain = fromDomain
+	if fromDomain == "" {
+		result.Result, result.Err = ResultPermError, errors.New("mail does not have exactly one From address")
+		return
+	}
+	record, lookupResult, err := lookupDMARCRecord(ctx, resolver, fromDomain)
+	isSubdomain := false
+	if err == nil && record == nil {
+		if orgDomain := GetOrganisationalDomain(fromDomain); orgDomain != fromDomain {
+			record, lookupResult, err = lookupDMARCRecord(ctx, resolver, orgDomain)
+			isSubdomain = true
+		}
+	}
+	if record == nil {
+		result.Result, result.Err = lookupResult, err
+		return
+	}
+	result.Policy = record.policy
+	if isSubdomain {
+		result.Policy = record.subdomainPolicy
+	}
+	result.Result = ResultFail
+	if spf.Result == ResultPass && isAligned(spf.Domain, fromDomain, record.strictSPF) {
+		result.Result = ResultPass
+		return
+	}
+	for _, sig := range dkim {
+		if sig.Result == ResultPass && isAligned(sig.Domain, fromDomain, record.strictDKIM) {
+			result.Result = ResultPass
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package mailauth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGetOrganisationalDomain(t *testing.T) {
+	for domain, orgDomain := range map[string]string{
+		"com":                  "com",
+		"example.com":          "example.com",
+		"Mail.Example.COM.":    "example.com",
+		"a.b.mail.example.com": "example.com",
+		"example.co.uk":        "example.co.uk",
+		"mail.example.co.uk":   "example.co.uk",
+		"mail.example.de":      "example.de",
+	} {
+		if got := GetOrganisationalDomain(domain); got != orgDomain {
+			t.Fatal(domain, got)
+		}
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := &fakeResolver{txt: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.org":  {"v=DMARC1; p=none; adkim=s; aspf=s"},
+		"_dmarc.twice.org":   {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		"_dmarc.invalid.org": {"v=DMARC1; p=whatever"},
+		"_dmarc.other.org":   {"some other record"},
+	}}
+	spfPass := func(domain string) SPFResult { return SPFResult{Result: ResultPass, Domain: domain} }
+	dkimPass := func(domain string) []DKIMResult { return []DKIMResult{{Result: ResultPass, Domain: domain}} }
+	for _, c := range []struct {
+		fromDomain string
+		spf        SPFResult
+		dkim       []DKIMResult
+		result     Result
+		policy     string
+	}{
+		{"example.com", spfPass("example.com"), nil, ResultPass, "reject"},
+		{"example.com", spfPass("bounce.example.com"), nil, ResultPass, "reject"},
+		{"example.com", SPFResult{Result: ResultFail, Domain: "example.com"}, dkimPass("example.com"), ResultPass, "reject"},
+		{"example.com", spfPass("example.net"), []DKIMResult{{Result: ResultFail, Domain: "example.com"}}, ResultFail, "reject"},
+		{"mail.example.com", spfPass("example.net"), dkimPass("example.com"), ResultPass, "quarantine"},
+		{"mail.example.com", spfPass("example.net"), nil, ResultFail, "quarantine"},
+		{"strict.org", spfPass("mail.strict.org"), dkimPass("mail.strict.org"), ResultFail, "none"},
+		{"strict.org", spfPass("strict.org"), nil, ResultPass, "none"},
+		{"twice.org", spfPass("twice.org"), nil, ResultPermError, ""},
+		{"invalid.org", spfPass("invalid.org"), nil, ResultPermError, ""},
+		{"other.org", spfPass("other.org"), nil, ResultNone, ""},
+		{"nothing.org", spfPass("nothing.org"), nil, ResultNone, ""},
+		{"", spfPass("example.com"), nil, ResultPermError, ""},
+	} {
+		result := CheckDMARC(context.Background(), resolver, c.fromDomain, c.spf, c.dkim)
+		if result.Result != c.result || result.Policy != c.policy || result.FromDomain != c.fromDomain {
+			t.Fatalf("%+v %+v", c, result)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package mailauth
+
+import (
+	"bytes"
+	"strings"
+)
+
+// headerField is a mail header field in its original form.
+type headerField struct {
+	name string // name is the field name without the colon.
+	raw  string // raw is the complete field including folded lines and line terminators.
+}
+
+// value returns the unfolded field value without leading and trailing spaces.
+func (field headerField) value() string {
+	colon := strings.IndexByte(field.raw, ':')
+	if colon == -1 {
+		return ""
+	}
+	return strings.TrimSpace(strings.NewReplacer("\r", "", "\n", "").Replace(field.raw[colon+1:]))
+}
+
+/*
+splitHeader returns the header fields of the mail message, and the body that begins with the empty line separating it
+from the header. If the message does not have a body, the body will be empty.
+*/
+func splitHeader(message []byte) (fields []headerField, body []byte) {
+	for pos := 0; pos < len(message); {
+		end := bytes.IndexByte(message[pos:], '\n')
+		if end == -1 {
+			end = len(message)
+		} else {
+			end += pos + 1
+		}
+		line := string(message[pos:end])
+		if line == "\r\n" || line == "\n" {
+			return fields, message[pos:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+		} else {
+			name := line
+			if colon := strings.IndexByte(line, ':'); colon != -1 {
+				name = line[:colon]
+			}
+			fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+		}
+		pos = end
+	}
+	return fields, nil
+}
+
+// normaliseCRLF returns the message with all line terminators turned into CRLF.
+func normaliseCRLF(message []byte) []byte {
+	return bytes.Replace(bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
@@ -0,0 +1,187 @@
+/*
+mailauth package verifies the authenticity of mails arriving at the SMTP server using SPF (RFC 7208), DKIM (RFC 6376),
+and DMARC (RFC 7489), and summarises the outcome in an Authentication-Results header (RFC 8601).
+*/
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTimeoutSec is the default timeout of all DNS lookups made to verify a mail.
+	DefaultTimeoutSec = 10
+	// HeaderAuthenticationResults is the name of the header that carries verification results.
+	HeaderAuthenticationResults = "Authentication-Results"
+)
+
+// Resolver looks up the DNS records used by mail authentication methods. It is satisfied by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Result is the outcome of an authentication method, the values are defined by RFC 8601.
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultNeutral   Result = "neutral"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// SPFResult is the outcome of SPF verification of the connecting IP.
+type SPFResult struct {
+	Result Result
+	Domain string // Domain is the domain of MAIL FROM address, or of HELO name if the MAIL FROM address is empty.
+	Err    error
+}
+
+// DKIMResult is the outcome of verifying a DKIM signature.
+type DKIMResult struct {
+	Result   Result
+	Domain   string // Domain is the signing domain (d= tag).
+	Selector string // Selector is the selector of signing key (s= tag).
+	Err      error
+}
+
+// DMARCResult is the outcome of DMARC verification of the From header domain.
+type DMARCResult struct {
+	Result     Result
+	FromDomain string // FromDomain is the domain of the From header.
+	Policy     string // Policy is the domain owner's policy for the mails that fail DMARC verification, e.g. "reject".
+	Err        error
+}
+
+// Results are the outcome of all authentication methods applied to a mail.
+type Results struct {
+	AuthServID string // AuthServID identifies the server that verified the mail.
+	SPF        SPFResult
+	DKIM       []DKIMResult
+	DMARC      DMARCResult
+}
+
+// DMARCPassed returns true only if the mail passed DMARC verification.
+func (results *Results) DMARCPassed() bool {
+	return results != nil && results.DMARC.Result == ResultPass
+}
+
+// Header returns the value of Authentication-Results header.
+func (results *Results) Header() string {
+	var out strings.Builder
+	out.WriteString(results.AuthServID)
+	out.WriteString(fmt.Sprintf(";\r\n\tspf=%s smtp.mailfrom=%s", results.SPF.Result, orNone(results.SPF.Domain)))
+	if len(results.DKIM) == 0 {
+		out.WriteString(";\r\n\tdkim=none")
+	}
+	for _, dkim := range results.DKIM {
+		out.WriteString(fmt.Sprintf(";\r\n\tdkim=%s header.d=%s header.s=%s", dkim.Result, orNone(dkim.Domain), orNone(dkim.Selector)))
+	}
+	out.WriteString(fmt.Sprintf(";\r\n\tdmarc=%s", results.DMARC.Result))
+	if results.DMARC.Policy != "" {
+		out.WriteString(fmt.Sprintf(" (p=%s)", results.DMARC.Policy))
+	}
+	out.WriteString(fmt.Sprintf(" header.from=%s", orNone(results.DMARC.FromDomain)))
+	return out.String()
+}
+
+// orNone returns the string, or "none" if the string is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// Verifier applies SPF, DKIM, and DMARC verification to mails.
+type Verifier struct {
+	AuthServID string   // AuthServID identifies this server in Authentication-Results header, usually it is the server's domain name.
+	Resolver   Resolver // Resolver looks up DNS records, it defaults to net.DefaultResolver.
+	TimeoutSec int      // TimeoutSec is the timeout of all DNS lookups made to verify a mail.
+}
+
+// Verify applies all authentication methods to the mail, which arrived from the client IP with the HELO name and MAIL FROM address.
+func (verifier *Verifier) Verify(clientIP, helo, mailFrom string, message []byte) *Results {
+	resolver := verifier.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeoutSec := verifier.TimeoutSec
+	if timeoutSec < 1 {
+		timeoutSec = DefaultTimeoutSec
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSec)*time.Second)
+	defer cancel()
+	results := &Results{AuthServID: verifier.AuthServID}
+	results.SPF = CheckSPF(ctx, resolver, net.ParseIP(clientIP), helo, mailFrom)
+	results.DKIM = VerifyDKIM(ctx, resolver, message)
+	results.DMARC = CheckDMARC(ctx, resolver, GetFromDomain(message), results.SPF, results.DKIM)
+	return results
+}
+
+// GetFromDomain returns the lower case domain name of the address in From header, or an empty string if there is not exactly one address.
+func GetFromDomain(message []byte) string {
+	fields, _ := splitHeader(normaliseCRLF(message))
+	var from string
+	var numFrom int
+	for _, field := range fields {
+		if strings.EqualFold(field.name, "From") {
+			from = field.value()
+			numFrom++
+		}
+	}
+	if numFrom != 1 {
+		return ""
+	}
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil || len(addrs) != 1 {
+		return ""
+	}
+	if at := strings.LastIndexByte(addrs[0].Address, '@'); at != -1 {
+		return strings.ToLower(addrs[0].Address[at+1:])
+	}
+	return ""
+}
+
+/*
+WithAuthenticationResults returns the mail message with an Authentication-Results header of the verification results
+placed on top. Headers of the same name that claim to come from this server are removed, as they must have been forged.
+The new header uses the line terminator of the message.
+*/
+func WithAuthenticationResults(message []byte, results *Results) []byte {
+	fields, body := splitHeader(message)
+	header := HeaderAuthenticationResults + ": " + results.Header() + "\r\n"
+	if !bytes.Contains(message, []byte("\r\n")) {
+		header = strings.Replace(header, "\r\n", "\n", -1)
+	}
+	var out bytes.Buffer
+	out.WriteString(header)
+	for _, field := range fields {
+		if strings.EqualFold(field.name, HeaderAuthenticationResults) {
+			servID := strings.TrimSpace(strings.SplitN(field.value(), ";", 2)[0])
+			if strings.EqualFold(servID, results.AuthServID) {
+				continue
+			}
+		}
+		out.WriteString(field.raw)
+	}
+	out.Write(body)
+	return out.Bytes()
+}
+
+// isNotFound returns true only if the DNS lookup error says that the name or record does not exist.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
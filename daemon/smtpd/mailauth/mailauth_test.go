@@ -0,0 +1,149 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers DNS queries from its maps, and fails every query with the temporary error if it is set.
+type fakeResolver struct {
+	txt     map[string][]string
+	ip      map[string][]string
+	mx      map[string][]string
+	tempErr error
+}
+
+func (r *fakeResolver) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if r.tempErr != nil {
+		return nil, r.tempErr
+	}
+	if txts, exists := r.txt[name]; exists {
+		return txts, nil
+	}
+	return nil, r.notFound(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) (addrs []net.IPAddr, err error) {
+	if r.tempErr != nil {
+		return nil, r.tempErr
+	}
+	ips, exists := r.ip[strings.TrimSuffix(host, ".")]
+	if !exists {
+		return nil, r.notFound(host)
+	}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return
+}
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) (mxs []*net.MX, err error) {
+	if r.tempErr != nil {
+		return nil, r.tempErr
+	}
+	hosts, exists := r.mx[name]
+	if !exists {
+		return nil, r.notFound(name)
+	}
+	for _, host := range hosts {
+		mxs = append(mxs, &net.MX{Host: host + ".", Pref: 10})
+	}
+	return
+}
+
+func TestGetFromDomain(t *testing.T) {
+	for message, domain := range map[string]string{
+		"From: Howard <Howard@Example.COM>\r\nTo: a@b.c\r\n\r\nbody": "example.com",
+		"To: a@b.c\nfrom: howard@example.com\n\nbody":                "example.com",
+		"From: a@example.com, b@example.net\r\n\r\nbody":             "",
+		"From: a@example.com\r\nFrom: b@example.com\r\n\r\nbody":     "",
+		"Subject: no from\r\n\r\nbody":                               "",
+		"From: not an address\r\n\r\nbody":                           "",
+	} {
+		if got := GetFromDomain([]byte(message)); got != domain {
+			t.Fatal(message, got)
+		}
+	}
+}
+
+func TestWithAuthenticationResults(t *testing.T) {
+	results := &Results{
+		AuthServID: "mx.example.org",
+		SPF:        SPFResult{Result: ResultPass, Domain: "example.com"},
+		DMARC:      DMARCResult{Result: ResultFail, FromDomain: "example.com", Policy: "reject"},
+	}
+	message := "Authentication-Results: mx.example.org; dmarc=pass (forged)\r\n" +
+		"Authentication-Results: other.example.net;\r\n\tdkim=pass\r\n" +
+		"From: howard@example.com\r\n\r\nbody\r\n"
+	want := "Authentication-Results: mx.example.org;\r\n\tspf=pass smtp.mailfrom=example.com;\r\n\tdkim=none;\r\n\tdmarc=fail (p=reject) header.from=example.com\r\n" +
+		"Authentication-Results: other.example.net;\r\n\tdkim=pass\r\n" +
+		"From: howard@example.com\r\n\r\nbody\r\n"
+	if got := string(WithAuthenticationResults([]byte(message), results)); got != want {
+		t.Fatalf("\n%q\n%q", got, want)
+	}
+	results.DKIM = []DKIMResult{{Result: ResultPass, Domain: "example.com", Selector: "s1"}, {Result: ResultFail, Domain: "example.net", Selector: "s2"}}
+	if header := results.Header(); !strings.Contains(header, "dkim=pass header.d=example.com header.s=s1;\r\n\tdkim=fail header.d=example.net header.s=s2;") {
+		t.Fatal(header)
+	}
+	if results.DMARCPassed() {
+		t.Fatal("should not have passed")
+	}
+	var nilResults *Results
+	if nilResults.DMARCPassed() {
+		t.Fatal("should not have passed")
+	}
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	key := newTestRSAKey(t)
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":                     {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"_dmarc.example.com":              {"v=DMARC1; p=reject"},
+			"sel._domainkey.example.com":      {publishedRSAKey(t, key)},
+			"sel._domainkey.mail.example.com": {publishedRSAKey(t, key)},
+		},
+	}
+	verifier := &Verifier{AuthServID: "mx.example.org", Resolver: resolver}
+	message := signForTest(t, "From: howard@example.com\r\nSubject: hi\r\n\r\nhello\r\n", key, "example.com", "sel", "relaxed/relaxed", "From:Subject")
+
+	// Both SPF and DKIM pass
+	results := verifier.Verify("192.0.2.1", "mail.example.com", "howard@example.com", []byte(message))
+	if results.SPF.Result != ResultPass || len(results.DKIM) != 1 || results.DKIM[0].Result != ResultPass || !results.DMARCPassed() || results.DMARC.Policy != "reject" {
+		t.Fatalf("%+v", results)
+	}
+	// SPF fails yet the aligned DKIM signature passes
+	results = verifier.Verify("10.0.0.1", "mail.example.com", "howard@example.com", []byte(message))
+	if results.SPF.Result != ResultFail || !results.DMARCPassed() {
+		t.Fatalf("%+v", results)
+	}
+	// The signature of an aligned subdomain passes in relaxed alignment mode
+	message = signForTest(t, "From: howard@example.com\r\nSubject: hi\r\n\r\nhello\r\n", key, "mail.example.com", "sel", "relaxed/relaxed", "From")
+	results = verifier.Verify("10.0.0.1", "mail.example.com", "howard@example.com", []byte(message))
+	if !results.DMARCPassed() {
+		t.Fatalf("%+v", results)
+	}
+	// Neither SPF nor DKIM passes
+	results = verifier.Verify("10.0.0.1", "mail.example.com", "howard@example.com", []byte("From: howard@example.com\r\n\r\nforged\r\n"))
+	if results.SPF.Result != ResultFail || len(results.DKIM) != 0 || results.DMARCPassed() || results.DMARC.Result != ResultFail {
+		t.Fatalf("%+v", results)
+	}
+	// SPF passes for a domain that is not aligned with From
+	results = verifier.Verify("192.0.2.1", "mail.example.com", "howard@example.com", []byte("From: howard@example.net\r\n\r\nforged\r\n"))
+	if results.SPF.Result != ResultPass || results.DMARCPassed() || results.DMARC.Result != ResultNone {
+		t.Fatalf("%+v", results)
+	}
+	// DNS does not work at all
+	resolver.tempErr = errors.New("network is unreachable")
+	results = verifier.Verify("192.0.2.1", "mail.example.com", "howard@example.com", []byte(message))
+	if results.SPF.Result != ResultTempError || results.DKIM[0].Result != ResultTempError || results.DMARC.Result != ResultTempError || results.DMARCPassed() {
+		t.Fatalf("%+v", results)
+	}
+}
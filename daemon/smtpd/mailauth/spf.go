@@ -0,0 +1,403 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// MaxSPFLookups is the maximum number of DNS querying mechanisms and modifiers evaluated for an SPF check (RFC 7208 section 4.6.4).
+const MaxSPFLookups = 10
+
+var (
+	ErrSPFTooManyLookups = fmt.Errorf("exceeded the limit of %d DNS lookups", MaxSPFLookups)
+	ErrSPFBadMacro       = errors.New("malformed macro")
+)
+
+// spfError is an error that occurred while evaluating an SPF record, the result tells whether it is temporary or permanent.
+type spfError struct {
+	result Result
+	err    error
+}
+
+func (e *spfError) Error() string {
+	return e.err.Error()
+}
+
+// spfCheck carries the parameters and DNS lookup count of an SPF check.
+type spfCheck struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+}
+
+/*
+CheckSPF evaluates the SPF record of the MAIL FROM domain, or of the HELO name if MAIL FROM address is empty, for the
+client IP that delivered the mail.
+*/
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, helo, mailFrom string) (result SPFResult) {
+	sender := strings.TrimSpace(mailFrom)
+	helo = strings.TrimSuffix(strings.TrimSpace(helo), ".")
+	if at := strings.LastIndexByte(sender, '@'); at == -1 || at == len(sender)-1 {
+		sender = "postmaster@" + helo
+	}
+	result.Domain = strings.ToLower(sender[strings.LastIndexByte(sender, '@')+1:])
+	if ip == nil || result.Domain == "" {
+		result.Result = ResultNone
+		return
+	}
+	check := &spfCheck{ctx: ctx, resolver: resolver, ip: ip, sender: sender, helo: helo}
+	result.Result, result.Err = check.checkHost(result.Domain)
+	return
+}
+
+// checkHost implements check_host() function of RFC 7208 section 4.
+func (check *spfCheck) checkHost(domain string) (Result, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	txts, err := check.resolver.LookupTXT(check.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return ResultNone, nil
+		}
+		return ResultTempError, err
+	}
+	var record string
+	var numRecords int
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			record = txt
+			numRecords++
+		}
+	}
+	if numRecords == 0 {
+		return ResultNone, nil
+	} else if numRecords > 1 {
+		return ResultPermError, fmt.Errorf("domain %s has %d SPF records", domain, numRecords)
+	}
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers look like name=value, whereas mechanisms may only carry an equal sign after a colon or slash.
+		if eq := strings.IndexByte(term, '='); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			if strings.EqualFold(term[:eq], "redirect") {
+				redirect = term[eq+1:]
+			}
+			// The explanation modifier and unknown modifiers do not affect the result
+			continue
+		}
+		qualifier := ResultPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = ResultFail
+			term = term[1:]
+		case '~':
+			qualifier = ResultSoftFail
+			term = term[1:]
+		case '?':
+			qualifier = ResultNeutral
+			term = term[1:]
+		}
+		matched, err := check.matchMechanism(domain, term)
+		if err != nil {
+			if spfErr, ok := err.(*spfError); ok {
+				return spfErr.result, spfErr.err
+			}
+			return ResultPermError, err
+		}
+		if matched {
+			return qualifier, nil
+		}
+	}
+	if redirect != "" {
+		if err := check.countLookup(); err != nil {
+			return ResultPermError, err
+		}
+		target, err := check.expand(redirect, domain)
+		if err != nil {
+			return ResultPermError, err
+		}
+		result, err := check.checkHost(target)
+		if result == ResultNone {
+			return ResultPermError, fmt.Errorf("redirect domain %s does not have an SPF record", target)
+		}
+		return result, err
+	}
+	return ResultNeutral, nil
+}
+
+// countLookup counts a DNS querying term toward the limit.
+func (check *spfCheck) countLookup() error {
+	check.lookups++
+	if check.lookups > MaxSPFLookups {
+		return ErrSPFTooManyLookups
+	}
+	return nil
+}
+
+// matchMechanism returns true only if the client IP matches the mechanism, which does not carry a qualifier.
+func (check *spfCheck) matchMechanism(domain, mechanism string) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i != -1 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, fmt.Errorf("malformed mechanism %s", mechanism)
+		}
+		return true, nil
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("malformed mechanism %s", mechanism)
+		}
+		if err := check.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := check.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		switch result, err := check.checkHost(target); result {
+		case ResultPass:
+			return true, nil
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, nil
+		case ResultTempError:
+			return false, &spfError{result: ResultTempError, err: err}
+		default:
+			if err == nil {
+				err = fmt.Errorf("included domain %s does not have an SPF record", target)
+			}
+			return false, &spfError{result: ResultPermError, err: err}
+		}
+	case "a", "mx":
+		if err := check.countLookup(); err != nil {
+			return false, err
+		}
+		target, prefix4, prefix6, err := check.parseDomainAndPrefix(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			mxs, err := check.resolver.LookupMX(check.ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, &spfError{result: ResultTempError, err: err}
+			}
+			if len(mxs) > MaxSPFLookups {
+				return false, fmt.Errorf("domain %s has more than %d MX records", target, MaxSPFLookups)
+			}
+			hosts = make([]string, 0, len(mxs))
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			matched, err := check.matchHostIP(host, prefix4, prefix6)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		// The mechanism is deprecated by RFC 7208 section 5.5, it counts toward the limit yet never matches.
+		return false, check.countLookup()
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("malformed mechanism %s", mechanism)
+		}
+		addr := arg[1:]
+		if !strings.Contains(addr, "/") {
+			if strings.EqualFold(name, "ip4") {
+				addr += "/32"
+			} else {
+				addr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil || (network.IP.To4() != nil) != strings.EqualFold(name, "ip4") {
+			return false, fmt.Errorf("malformed mechanism %s", mechanism)
+		}
+		return network.Contains(check.ip), nil
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, fmt.Errorf("malformed mechanism %s", mechanism)
+		}
+		if err := check.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := check.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := check.resolver.LookupIPAddr(check.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, &spfError{result: ResultTempError, err: err}
+		}
+		return len(addrs) > 0, nil
+	default:
+		return false, fmt.Errorf("unknown mechanism %s", mechanism)
+	}
+}
+
+// matchHostIP returns true only if the client IP belongs to the networks of the host's addresses.
+func (check *spfCheck) matchHostIP(host string, prefix4, prefix6 int) (bool, error) {
+	addrs, err := check.resolver.LookupIPAddr(check.ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, &spfError{result: ResultTempError, err: err}
+	}
+	clientIsV4 := check.ip.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) != clientIsV4 {
+			continue
+		}
+		mask := net.CIDRMask(prefix6, 128)
+		if clientIsV4 {
+			mask = net.CIDRMask(prefix4, 32)
+		}
+		network := net.IPNet{IP: addr.IP.Mask(mask), Mask: mask}
+		if network.Contains(check.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/*
+parseDomainAndPrefix parses the argument of "a" and "mx" mechanisms, which looks like ":domain/24//64" with every part
+being optional, and returns the target domain as well as IPv4 and IPv6 network prefix lengths.
+*/
+func (check *spfCheck) parseDomainAndPrefix(arg, domain string) (target string, prefix4, prefix6 int, err error) {
+	target, prefix4, prefix6 = domain, 32, 128
+	if slash := strings.IndexByte(arg, '/'); slash != -1 {
+		prefixes := arg[slash:]
+		arg = arg[:slash]
+		if dual := strings.Index(prefixes, "//"); dual != -1 {
+			if prefix6, err = strconv.Atoi(prefixes[dual+2:]); err != nil || prefix6 < 0 || prefix6 > 128 {
+				return "", 0, 0, fmt.Errorf("malformed IPv6 prefix length in %s", prefixes)
+			}
+			prefixes = prefixes[:dual]
+		}
+		if prefixes != "" {
+			if prefix4, err = strconv.Atoi(prefixes[1:]); err != nil || prefix4 < 0 || prefix4 > 32 {
+				return "", 0, 0, fmt.Errorf("malformed IPv4 prefix length in %s", prefixes)
+			}
+		}
+	}
+	if strings.HasPrefix(arg, ":") {
+		target, err = check.expand(arg[1:], domain)
+	}
+	return
+}
+
+// expand expands the macros of a domain specification (RFC 7208 section 7).
+func (check *spfCheck) expand(spec, domain string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", ErrSPFBadMacro
+		}
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", ErrSPFBadMacro
+			}
+			expanded, err := check.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(expanded)
+			i += end
+		default:
+			return "", ErrSPFBadMacro
+		}
+	}
+	return out.String(), nil
+}
+
+// expandMacro expands a single macro, e.g. "d2r" is the last two labels of the domain in reverse order.
+func (check *spfCheck) expandMacro(macro, domain string) (string, error) {
+	if macro == "" {
+		return "", ErrSPFBadMacro
+	}
+	at := strings.LastIndexByte(check.sender, '@')
+	var value string
+	switch strings.ToLower(macro[:1]) {
+	case "s":
+		value = check.sender
+	case "l":
+		value = check.sender[:at]
+	case "o":
+		value = check.sender[at+1:]
+	case "d":
+		value = domain
+	case "h":
+		value = check.helo
+	case "i":
+		if ip4 := check.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range check.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	case "v":
+		value = "ip6"
+		if check.ip.To4() != nil {
+			value = "in-addr"
+		}
+	default:
+		return "", ErrSPFBadMacro
+	}
+	transformer := macro[1:]
+	var numDigits int
+	for numDigits < len(transformer) && transformer[numDigits] >= '0' && transformer[numDigits] <= '9' {
+		numDigits++
+	}
+	keep, _ := strconv.Atoi(transformer[:numDigits])
+	transformer = transformer[numDigits:]
+	reverse := strings.HasPrefix(strings.ToLower(transformer), "r")
+	if reverse {
+		transformer = transformer[1:]
+	}
+	delimiters := "."
+	if transformer != "" {
+		if strings.Trim(transformer, ".-+,/_=") != "" {
+			return "", ErrSPFBadMacro
+		}
+		delimiters = transformer
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, "."), nil
+}
@@ -0,0 +1,110 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSPFCheck_Expand(t *testing.T) {
+	check := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	// The examples come from RFC 7208 section 7.4
+	for spec, expanded := range map[string]string{
+		"%{s}":                            "strong-bad@email.example.com",
+		"%{o}":                            "email.example.com",
+		"%{d}":                            "email.example.com",
+		"%{d4}":                           "email.example.com",
+		"%{d3}":                           "email.example.com",
+		"%{d2}":                           "example.com",
+		"%{d1}":                           "com",
+		"%{dr}":                           "com.example.email",
+		"%{d2r}":                          "example.email",
+		"%{l}":                            "strong-bad",
+		"%{l-}":                           "strong.bad",
+		"%{lr}":                           "strong-bad",
+		"%{lr-}":                          "bad.strong",
+		"%{l1r-}":                         "strong",
+		"%{ir}.%{v}._spf.%{d2}":           "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":            "bad.strong.lp._spf.example.com",
+		"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}": "bad.strong.lp.3.2.0.192.in-addr._spf.example.com",
+		"%{h}%%%_%-":                      "mx.example.org% %20",
+	} {
+		if got, err := check.expand(spec, "email.example.com"); err != nil || got != expanded {
+			t.Fatal(spec, got, err)
+		}
+	}
+	check.ip = net.ParseIP("2001:db8::cb01")
+	if got, err := check.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); err != nil ||
+		got != "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com" {
+		t.Fatal(got, err)
+	}
+	for _, spec := range []string{"%", "%{", "%{}", "%{x}", "%{d2!}", "%a"} {
+		if _, err := check.expand(spec, "email.example.com"); err != ErrSPFBadMacro {
+			t.Fatal(spec, err)
+		}
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	resolver := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":         {"some other record", "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net a:mail.example.com mx/30 -all"},
+			"_spf.example.net":    {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"soft.example.org":    {"v=spf1 ?ip4:10.0.0.1 redirect=example.com"},
+			"macro.example.org":   {"v=spf1 exists:%{i}.%{l}._spf.%{d} -all"},
+			"twice.example.org":   {"v=spf1 -all", "v=spf1 +all"},
+			"loop.example.org":    {"v=spf1 include:loop.example.org -all"},
+			"bad.example.org":     {"v=spf1 ip4:not-an-ip -all"},
+			"empty.example.org":   {"v=spf1 include:nothing.example.org -all"},
+			"void.example.org":    {"v=spf1 redirect=nothing.example.org"},
+			"neutral.example.org": {"v=spf1"},
+		},
+		ip: map[string][]string{
+			"mail.example.com": {"198.51.100.1"},
+			"mx.example.com":   {"203.0.113.5"},
+			"192.0.2.200.howard._spf.macro.example.org": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"example.com": {"mx.example.com"},
+		},
+	}
+	for _, c := range []struct {
+		ip, helo, mailFrom string
+		result             Result
+		domain             string
+	}{
+		{"192.0.2.9", "mx.example.com", "howard@example.com", ResultPass, "example.com"},
+		{"2001:db8::1", "mx.example.com", "howard@example.com", ResultPass, "example.com"},
+		{"198.51.100.1", "mx.example.com", "howard@example.com", ResultPass, "example.com"},
+		{"203.0.113.6", "mx.example.com", "howard@example.com", ResultPass, "example.com"},
+		{"203.0.113.9", "mx.example.com", "howard@example.com", ResultFail, "example.com"},
+		{"10.9.9.9", "mx.example.com", "howard@example.com", ResultFail, "example.com"},
+		{"2001:db9::1", "mx.example.com", "howard@example.com", ResultFail, "example.com"},
+		{"192.0.2.9", "example.com", "", ResultPass, "example.com"},
+		{"192.0.2.9", "", "", ResultNone, ""},
+		{"10.0.0.1", "mx.example.com", "howard@soft.example.org", ResultNeutral, "soft.example.org"},
+		{"10.9.9.9", "mx.example.com", "howard@soft.example.org", ResultFail, "soft.example.org"},
+		{"192.0.2.200", "mx.example.com", "howard@macro.example.org", ResultPass, "macro.example.org"},
+		{"192.0.2.201", "mx.example.com", "howard@macro.example.org", ResultFail, "macro.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@twice.example.org", ResultPermError, "twice.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@loop.example.org", ResultPermError, "loop.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@bad.example.org", ResultPermError, "bad.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@empty.example.org", ResultPermError, "empty.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@void.example.org", ResultPermError, "void.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@neutral.example.org", ResultNeutral, "neutral.example.org"},
+		{"192.0.2.9", "mx.example.com", "howard@nothing.example.org", ResultNone, "nothing.example.org"},
+	} {
+		result := CheckSPF(context.Background(), resolver, net.ParseIP(c.ip), c.helo, c.mailFrom)
+		if result.Result != c.result || result.Domain != c.domain {
+			t.Fatalf("%+v %+v", c, result)
+		}
+	}
+	if result := CheckSPF(context.Background(), resolver, net.ParseIP("192.0.2.9"), "", "howard@loop.example.org"); result.Err != ErrSPFTooManyLookups {
+		t.Fatal(result.Err)
+	}
+	resolver.tempErr = errors.New("network is unreachable")
+	if result := CheckSPF(context.Background(), resolver, net.ParseIP("192.0.2.9"), "", "howard@example.com"); result.Result != ResultTempError {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,116 @@
+package smtpd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/imap"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// initialiseMailboxes checks the configuration of local mailboxes and IMAP, and prepares the mail store.
+func (daemon *Daemon) initialiseMailboxes() error {
+	daemon.mailStore = nil
+	daemon.mailboxPasswords = map[string]string{}
+	if (daemon.MaildirPath == "") != (len(daemon.Mailboxes) == 0) {
+		return errors.New("smtpd.Initialise: maildir path and mailboxes must be configured together")
+	}
+	if daemon.IMAPPort > 0 {
+		if len(daemon.Mailboxes) == 0 {
+			return errors.New("smtpd.Initialise: IMAP requires mailboxes to be configured")
+		}
+		if daemon.smtpConfig.TLSConfig == nil {
+			return errors.New("smtpd.Initialise: IMAP requires TLS certificate and key")
+		}
+		if daemon.IMAPPort == daemon.Port {
+			return errors.New("smtpd.Initialise: IMAP port must not be the same as SMTP port")
+		}
+	}
+	if len(daemon.Mailboxes) == 0 {
+		return nil
+	}
+	for addr, password := range daemon.Mailboxes {
+		atSign := strings.IndexRune(addr, '@')
+		if atSign == -1 {
+			return fmt.Errorf("smtpd.Initialise: mailbox address \"%s\" must have an at sign", addr)
+		}
+		if _, exists := daemon.myDomainsHash[addr[atSign+1:]]; !exists {
+			return fmt.Errorf("smtpd.Initialise: mailbox address \"%s\" must belong to one of my domain names", addr)
+		}
+		if password == "" {
+			return fmt.Errorf("smtpd.Initialise: mailbox address \"%s\" must have a password", addr)
+		}
+		daemon.mailboxPasswords[strings.ToLower(addr)] = password
+	}
+	daemon.mailStore = &maildir.Store{
+		Dir:         daemon.MaildirPath,
+		MaxMessages: daemon.MailboxMaxMessages,
+		MaxAgeDays:  daemon.MailboxMaxAgeDays,
+	}
+	if err := daemon.mailStore.Initialise(); err != nil {
+		return fmt.Errorf("smtpd.Initialise: %v", err)
+	}
+	return nil
+}
+
+// deliverToMailboxes keeps the mail in the local mailboxes of its recipients, recipients without a mailbox are skipped.
+func (daemon *Daemon) deliverToMailboxes(fromAddr string, toAddrs []string, mailBody []byte) {
+	if daemon.mailStore == nil {
+		return
+	}
+	delivered := make(map[string]struct{})
+	for _, addr := range toAddrs {
+		mailbox := strings.ToLower(addr)
+		if _, exists := daemon.mailboxPasswords[mailbox]; !exists {
+			continue
+		}
+		if _, exists := delivered[mailbox]; exists {
+			continue
+		}
+		delivered[mailbox] = struct{}{}
+		if uid, err := daemon.mailStore.Deliver(mailbox, mailBody, time.Now()); err == nil {
+			daemon.logger.Info("deliverToMailboxes", fromAddr, nil, "stored mail in mailbox %s with UID %d", mailbox, uid)
+		} else {
+			daemon.logger.Warning("deliverToMailboxes", fromAddr, err, "failed to store mail in mailbox %s", mailbox)
+		}
+	}
+}
+
+// authenticateMailbox returns the mailbox of the IMAP user if the password is correct.
+func (daemon *Daemon) authenticateMailbox(user, password string) (string, bool) {
+	mailbox := strings.ToLower(user)
+	expected, exists := daemon.mailboxPasswords[mailbox]
+	if !exists {
+		return "", false
+	}
+	return mailbox, subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// imapApp serves IMAP clients over TLS for mailbox owners to read their mails.
+type imapApp struct {
+	daemon *Daemon
+}
+
+// GetTCPStatsCollector returns the stats collector of the SMTP daemon, IMAP conversations are counted along with the SMTP conversations.
+func (app *imapApp) GetTCPStatsCollector() *misc.Stats {
+	return misc.SMTPDStats
+}
+
+// HandleTCPConnection converses with an IMAP client over TLS. The client connection is closed by server upon returning from the implementation.
+func (app *imapApp) HandleTCPConnection(logger lalog.Logger, ip string, client *net.TCPConn) {
+	tlsConn := tls.Server(client, app.daemon.smtpConfig.TLSConfig)
+	logger.MaybeMinorError(tlsConn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second)))
+	if err := tlsConn.Handshake(); err != nil {
+		logger.Warning("HandleTCPConnection", ip, err, "failed to complete TLS handshake")
+		return
+	}
+	status := imap.NewConnection(tlsConn, app.daemon.imapConfig, logger).Converse()
+	logger.Info("HandleTCPConnection", ip, nil, "IMAP conversation ended: %s", status)
+}
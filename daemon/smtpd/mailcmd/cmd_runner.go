@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailauth"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
@@ -16,6 +17,9 @@ import (
 
 const CommandTimeoutSec = 120 // CommandTimeoutSec is the default command timeout in seconds
 
+// ErrDMARCNotPassed is returned when the command runner requires mails to pass DMARC verification yet the mail did not.
+var ErrDMARCNotPassed = errors.New("mail did not pass DMARC verification")
+
 /*
 CommandRunner looks for exactly one feature command from an incoming mail, runs it and reply the sender with command
 results. Usually used in combination of laitos' own SMTP daemon, but it can also work independently with another MTA
@@ -27,7 +31,14 @@ type CommandRunner struct {
 	Undocumented3   Undocumented3             `json:"Undocumented3"` // Intentionally undocumented he he he he
 	Processor       *toolbox.CommandProcessor `json:"-"`             // Feature configuration
 	ReplyMailClient inet.MailClient           `json:"-"`             // To deliver Email replies
-	logger          lalog.Logger
+
+	/*
+		RequireDMARCPass refuses to run commands from mails that did not pass DMARC verification of laitos SMTP daemon,
+		which stops a forged sender address from receiving command results.
+	*/
+	RequireDMARCPass bool `json:"RequireDMARCPass"`
+
+	logger lalog.Logger
 
 	// processTestCaseFunc works along side of command processing routine, it offers execution result to test case for inspection.
 	processTestCaseFunc func(*toolbox.Result)
@@ -113,9 +124,25 @@ Process only one command (if found) in the incoming mail. If reply addresses are
 to the specified addresses. If they are not specified, use the incoming mail sender's address as reply address.
 */
 func (runner *CommandRunner) Process(clientIP string, mailContent []byte, replyAddresses ...string) error {
+	return runner.ProcessAuthenticated(clientIP, nil, mailContent, replyAddresses...)
+}
+
+/*
+ProcessAuthenticated works like Process, and it takes into account the SPF, DKIM, and DMARC verification results of the
+mail. The results may be nil if the mail has not been verified.
+*/
+func (runner *CommandRunner) ProcessAuthenticated(clientIP string, auth *mailauth.Results, mailContent []byte, replyAddresses ...string) error {
 	if misc.EmergencyLockDown {
 		return misc.ErrEmergencyLockDown
 	}
+	if runner.RequireDMARCPass && !auth.DMARCPassed() {
+		var dmarcResult mailauth.Result = "unverified"
+		if auth != nil {
+			dmarcResult = auth.DMARC.Result
+		}
+		runner.logger.Warning("Process", clientIP, ErrDMARCNotPassed, "refuse to process mail with DMARC result \"%s\"", dmarcResult)
+		return ErrDMARCNotPassed
+	}
 	var commandIsProcessed bool
 	walkErr := inet.WalkMailMessage(mailContent, func(prop inet.BasicMail, body []byte) (bool, error) {
 		// Avoid recursive processing
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailauth"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -119,3 +120,36 @@ func TestMailProcessor_Process_Undocumented3Reply(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMailProcessor_RequireDMARCPass(t *testing.T) {
+	runner := CommandRunner{
+		Processor:        toolbox.GetTestCommandProcessor(),
+		ReplyMailClient:  inet.MailClient{MTAHost: "127.0.0.1", MTAPort: 25, MailFrom: "howard@localhost"},
+		RequireDMARCPass: true,
+	}
+	if err := runner.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var lastResult *toolbox.Result
+	runner.processTestCaseFunc = func(result *toolbox.Result) {
+		lastResult = result
+	}
+	mail := []byte("From: howard@example.com\r\nSubject: hi\r\n\r\nverysecret.s echo hi\r\n")
+	// Mails that have not been verified or failed verification do not run commands
+	if err := runner.Process("", mail); err != ErrDMARCNotPassed {
+		t.Fatal(err)
+	}
+	if err := runner.ProcessAuthenticated("", &mailauth.Results{DMARC: mailauth.DMARCResult{Result: mailauth.ResultFail}}, mail); err != ErrDMARCNotPassed {
+		t.Fatal(err)
+	}
+	if lastResult != nil {
+		t.Fatalf("should not have executed any command %+v", lastResult)
+	}
+	// A mail that passed verification gets to the command processor
+	passed := &mailauth.Results{DMARC: mailauth.DMARCResult{Result: mailauth.ResultPass}}
+	if err := runner.ProcessAuthenticated("", passed, []byte("From: howard@example.com\r\nSubject: hi\r\nContent-Type: text/plain\r\n\r\nPIN mismatch\r\n")); err != toolbox.ErrPINAndShortcutNotFound {
+		t.Fatal(err)
+	} else if lastResult == nil || lastResult.Error != toolbox.ErrPINAndShortcutNotFound {
+		t.Fatalf("%+v", lastResult)
+	}
+}
@@ -0,0 +1,358 @@
+/*
+maildir package stores received mails on disk in Maildir format, one Maildir for each mailbox. Each stored mail carries
+a unique ID (UID) that increases with every delivery, which allows IMAP clients to keep track of the mails.
+*/
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// UIDFileName is the name of the file that memorises UID validity and the next UID in the directory of each mailbox.
+	UIDFileName = "laitos-uids"
+	// DefaultMaxMessages is the default maximum number of mails to keep in a mailbox.
+	DefaultMaxMessages = 1000
+	// DefaultMaxAgeDays is the default number of days to keep a mail in a mailbox.
+	DefaultMaxAgeDays = 60
+)
+
+var (
+	ErrBadMailboxName  = errors.New("bad mailbox name")
+	ErrMessageNotFound = errors.New("the mail no longer exists")
+
+	// fileNameRegex matches the file name of a stored mail: seconds of delivery, UID, and optionally the Maildir flags.
+	fileNameRegex = regexp.MustCompile(`^(\d+)\.U(\d+)\.laitos(?:[:!]2,([A-Za-z]*))?$`)
+	// infoSeparator separates the Maildir flags from the unique file name. Windows does not allow colon in file names.
+	infoSeparator = func() string {
+		if runtime.GOOS == "windows" {
+			return "!"
+		}
+		return ":"
+	}()
+	// SystemFlags are the IMAP flags that are stored along with the mails, in the order of their Maildir flag letters.
+	SystemFlags     = []string{`\Draft`, `\Flagged`, `\Answered`, `\Seen`, `\Deleted`}
+	systemFlagChars = "DFRST"
+)
+
+// Message describes a mail stored in a mailbox.
+type Message struct {
+	UID       uint32    // UID is the unique ID of the mail in its mailbox.
+	Flags     []string  // Flags are the IMAP system flags of the mail, e.g. \Seen.
+	Size      int64     // Size is the number of bytes of the mail.
+	Delivered time.Time // Delivered is the time of delivery.
+	fileName  string
+}
+
+// HasFlag returns true only if the mail carries the flag.
+func (msg Message) HasFlag(flag string) bool {
+	for _, f := range msg.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the mails of any number of mailboxes under a directory, and removes old mails according to retention limits.
+type Store struct {
+	Dir         string // Dir is the directory in which each mailbox has its own Maildir.
+	MaxMessages int    // MaxMessages is the maximum number of mails to keep in each mailbox, the oldest mails are removed first.
+	MaxAgeDays  int    // MaxAgeDays is the number of days to keep a mail.
+
+	mutex *sync.Mutex
+}
+
+// Initialise creates the store directory and sets default retention limits.
+func (store *Store) Initialise() error {
+	if store.Dir == "" {
+		return errors.New("maildir.Initialise: directory must not be empty")
+	}
+	if store.MaxMessages < 1 {
+		store.MaxMessages = DefaultMaxMessages
+	}
+	if store.MaxAgeDays < 1 {
+		store.MaxAgeDays = DefaultMaxAgeDays
+	}
+	store.mutex = new(sync.Mutex)
+	if err := os.MkdirAll(store.Dir, 0700); err != nil {
+		return fmt.Errorf("maildir.Initialise: %v", err)
+	}
+	return nil
+}
+
+// mailboxDir returns the Maildir directory of the mailbox, the directory is created if it does not yet exist.
+func (store *Store) mailboxDir(mailbox string) (string, error) {
+	mailbox = strings.ToLower(mailbox)
+	if mailbox == "" || strings.HasPrefix(mailbox, ".") || strings.ContainsAny(mailbox, `/\:*?"<>|`) {
+		return "", ErrBadMailboxName
+	}
+	dir := filepath.Join(store.Dir, mailbox)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// readUIDs returns the UID validity and the next UID of the mailbox. New values are made up if the mailbox does not have them yet.
+func readUIDs(dir string) (validity, next uint32) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, UIDFileName))
+	if err == nil {
+		if fields := strings.Fields(string(content)); len(fields) == 2 {
+			v, errV := strconv.ParseUint(fields[0], 10, 32)
+			n, errN := strconv.ParseUint(fields[1], 10, 32)
+			if errV == nil && errN == nil && v > 0 && n > 0 {
+				return uint32(v), uint32(n)
+			}
+		}
+	}
+	// Start over with a new validity, the next UID must not collide with the mails that are already there.
+	next = 1
+	for _, sub := range []string{"new", "cur"} {
+		entries, _ := ioutil.ReadDir(filepath.Join(dir, sub))
+		for _, entry := range entries {
+			if match := fileNameRegex.FindStringSubmatch(entry.Name()); match != nil {
+				if uid, _ := strconv.ParseUint(match[2], 10, 32); uint32(uid) >= next {
+					next = uint32(uid) + 1
+				}
+			}
+		}
+	}
+	return uint32(time.Now().Unix()), next
+}
+
+// writeUIDs memorises the UID validity and the next UID of the mailbox.
+func writeUIDs(dir string, validity, next uint32) error {
+	return ioutil.WriteFile(filepath.Join(dir, UIDFileName), []byte(fmt.Sprintf("%d %d\n", validity, next)), 0600)
+}
+
+// withCRLF returns the mail message with every line terminated by CRLF, which is how IMAP clients expect to read it.
+func withCRLF(message []byte) []byte {
+	return bytes.Replace(bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
+
+// Deliver stores the mail in the mailbox, and then removes old mails that are beyond the retention limits.
+func (store *Store) Deliver(mailbox string, message []byte, now time.Time) (uid uint32, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	dir, err := store.mailboxDir(mailbox)
+	if err != nil {
+		return 0, fmt.Errorf("maildir.Deliver: %v", err)
+	}
+	validity, uid := readUIDs(dir)
+	if err := writeUIDs(dir, validity, uid+1); err != nil {
+		return 0, fmt.Errorf("maildir.Deliver: %v", err)
+	}
+	// Write the mail into tmp and then move it into new, so that a reader never sees a partially written mail.
+	name := fmt.Sprintf("%d.U%d.laitos", now.Unix(), uid)
+	tmpPath := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, withCRLF(message), 0600); err != nil {
+		return 0, fmt.Errorf("maildir.Deliver: %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, "new", name)); err != nil {
+		_ = os.Remove(tmpPath)
+		return 0, fmt.Errorf("maildir.Deliver: %v", err)
+	}
+	if _, err := store.purge(dir, now); err != nil {
+		return uid, fmt.Errorf("maildir.Deliver: %v", err)
+	}
+	return uid, nil
+}
+
+// flagsFromInfo converts Maildir flag letters to IMAP system flags.
+func flagsFromInfo(info string) (flags []string) {
+	for i, char := range systemFlagChars {
+		if strings.ContainsRune(info, char) {
+			flags = append(flags, SystemFlags[i])
+		}
+	}
+	return
+}
+
+// infoFromFlags converts IMAP system flags to Maildir flag letters, flags that are not system flags are ignored.
+func infoFromFlags(flags []string) string {
+	var info []byte
+	for i, systemFlag := range SystemFlags {
+		for _, flag := range flags {
+			if strings.EqualFold(flag, systemFlag) {
+				info = append(info, systemFlagChars[i])
+				break
+			}
+		}
+	}
+	return string(info)
+}
+
+// list returns all mails of the mailbox directory in the order of their UIDs. Newly delivered mails are moved into cur.
+func (store *Store) list(dir string) (msgs []Message, err error) {
+	newEntries, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range newEntries {
+		if fileNameRegex.MatchString(entry.Name()) {
+			if err := os.Rename(filepath.Join(dir, "new", entry.Name()), filepath.Join(dir, "cur", entry.Name()+infoSeparator+"2,")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		match := fileNameRegex.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		sec, _ := strconv.ParseInt(match[1], 10, 64)
+		uid, _ := strconv.ParseUint(match[2], 10, 32)
+		msgs = append(msgs, Message{
+			UID:       uint32(uid),
+			Flags:     flagsFromInfo(match[3]),
+			Size:      entry.Size(),
+			Delivered: time.Unix(sec, 0),
+			fileName:  entry.Name(),
+		})
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].UID < msgs[j].UID
+	})
+	return msgs, nil
+}
+
+// purge removes the mails that are older than the maximum age, as well as the oldest mails in excess of the maximum number of mails.
+func (store *Store) purge(dir string, now time.Time) (numRemoved int, err error) {
+	msgs, err := store.list(dir)
+	if err != nil {
+		return 0, err
+	}
+	oldest := now.Add(-time.Duration(store.MaxAgeDays) * 24 * time.Hour)
+	for i, msg := range msgs {
+		if len(msgs)-i > store.MaxMessages || msg.Delivered.Before(oldest) {
+			if err := os.Remove(filepath.Join(dir, "cur", msg.fileName)); err != nil && !os.IsNotExist(err) {
+				return numRemoved, err
+			}
+			numRemoved++
+		}
+	}
+	return numRemoved, nil
+}
+
+/*
+List removes old mails that are beyond the retention limits, and then returns the UID validity, the next UID, and all
+mails of the mailbox in the order of their UIDs.
+*/
+func (store *Store) List(mailbox string, now time.Time) (validity, next uint32, msgs []Message, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	dir, err := store.mailboxDir(mailbox)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("maildir.List: %v", err)
+	}
+	if _, err := store.purge(dir, now); err != nil {
+		return 0, 0, nil, fmt.Errorf("maildir.List: %v", err)
+	}
+	// Memorise the UIDs if they were just made up
+	validity, next = readUIDs(dir)
+	if err := writeUIDs(dir, validity, next); err != nil {
+		return 0, 0, nil, fmt.Errorf("maildir.List: %v", err)
+	}
+	if msgs, err = store.list(dir); err != nil {
+		return 0, 0, nil, fmt.Errorf("maildir.List: %v", err)
+	}
+	return
+}
+
+// find returns the file name of the mail, in case it has been renamed since the mailbox was listed.
+func (store *Store) find(dir string, msg Message) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, "cur", msg.fileName)); err == nil {
+		return msg.fileName, nil
+	}
+	msgs, err := store.list(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, current := range msgs {
+		if current.UID == msg.UID {
+			return current.fileName, nil
+		}
+	}
+	return "", ErrMessageNotFound
+}
+
+// Read returns the content of the mail.
+func (store *Store) Read(mailbox string, msg Message) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	dir, err := store.mailboxDir(mailbox)
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Read: %v", err)
+	}
+	fileName, err := store.find(dir, msg)
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Read: %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "cur", fileName))
+	if err != nil {
+		return nil, fmt.Errorf("maildir.Read: %v", err)
+	}
+	return content, nil
+}
+
+// SetFlags replaces the system flags of the mail and returns the updated mail.
+func (store *Store) SetFlags(mailbox string, msg Message, flags []string) (Message, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	dir, err := store.mailboxDir(mailbox)
+	if err != nil {
+		return msg, fmt.Errorf("maildir.SetFlags: %v", err)
+	}
+	fileName, err := store.find(dir, msg)
+	if err != nil {
+		return msg, fmt.Errorf("maildir.SetFlags: %v", err)
+	}
+	info := infoFromFlags(flags)
+	match := fileNameRegex.FindStringSubmatch(fileName)
+	updated := msg
+	updated.fileName = fmt.Sprintf("%s.U%s.laitos%s2,%s", match[1], match[2], infoSeparator, info)
+	updated.Flags = flagsFromInfo(info)
+	if err := os.Rename(filepath.Join(dir, "cur", fileName), filepath.Join(dir, "cur", updated.fileName)); err != nil {
+		return msg, fmt.Errorf("maildir.SetFlags: %v", err)
+	}
+	return updated, nil
+}
+
+// Remove permanently removes the mail from mailbox. It is not an error if the mail no longer exists.
+func (store *Store) Remove(mailbox string, msg Message) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	dir, err := store.mailboxDir(mailbox)
+	if err != nil {
+		return fmt.Errorf("maildir.Remove: %v", err)
+	}
+	fileName, err := store.find(dir, msg)
+	if err == ErrMessageNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("maildir.Remove: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "cur", fileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("maildir.Remove: %v", err)
+	}
+	return nil
+}
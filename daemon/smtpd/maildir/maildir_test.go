@@ -0,0 +1,92 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &Store{Dir: dir, MaxMessages: 3, MaxAgeDays: 2}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Deliver("../escape", []byte("a"), time.Now()); err == nil {
+		t.Fatal("did not error")
+	}
+	// Deliver three mails, the oldest of which is beyond the maximum age.
+	now := time.Now()
+	for i, delivered := range []time.Time{now.Add(-72 * time.Hour), now.Add(-time.Hour), now} {
+		if uid, err := store.Deliver("Howard@example.com", []byte("Subject: hi\n\nbody\n"), delivered); err != nil || uid != uint32(i+1) {
+			t.Fatal(uid, err)
+		}
+	}
+	validity, next, msgs, err := store.List("howard@example.com", now)
+	if err != nil || validity == 0 || next != 4 || len(msgs) != 2 {
+		t.Fatal(validity, next, msgs, err)
+	}
+	if msgs[0].UID != 2 || msgs[1].UID != 3 || msgs[0].Size != 21 || len(msgs[0].Flags) != 0 || msgs[1].Delivered.Unix() != now.Unix() {
+		t.Fatalf("%+v", msgs)
+	}
+	if content, err := store.Read("howard@example.com", msgs[0]); err != nil || string(content) != "Subject: hi\r\n\r\nbody\r\n" {
+		t.Fatal(string(content), err)
+	}
+	// The mails have been moved from new into cur
+	if entries, err := ioutil.ReadDir(filepath.Join(dir, "howard@example.com", "new")); err != nil || len(entries) != 0 {
+		t.Fatal(entries, err)
+	}
+
+	// Set and clear flags
+	updated, err := store.SetFlags("howard@example.com", msgs[0], []string{`\seen`, `\Deleted`, "custom"})
+	if err != nil || !reflect.DeepEqual(updated.Flags, []string{`\Seen`, `\Deleted`}) || !updated.HasFlag(`\SEEN`) || updated.HasFlag(`\Draft`) {
+		t.Fatalf("%+v %v", updated, err)
+	}
+	// The outdated mail information still reaches the mail
+	if content, err := store.Read("howard@example.com", msgs[0]); err != nil || len(content) != 21 {
+		t.Fatal(err)
+	}
+	if _, err := store.SetFlags("howard@example.com", updated, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, msgs, err = store.List("howard@example.com", now)
+	if err != nil || len(msgs) != 2 || len(msgs[0].Flags) != 0 {
+		t.Fatalf("%+v %v", msgs, err)
+	}
+
+	// Deliver more mails in excess of the maximum number
+	for i := 0; i < 3; i++ {
+		if _, err := store.Deliver("howard@example.com", []byte("Subject: hi\r\n\r\nbody\r\n"), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, next, msgs, err = store.List("howard@example.com", now)
+	if err != nil || next != 7 || len(msgs) != 3 || msgs[0].UID != 4 {
+		t.Fatalf("%+v %v", msgs, err)
+	}
+
+	// Remove a mail, removing it again is not an error.
+	for i := 0; i < 2; i++ {
+		if err := store.Remove("howard@example.com", msgs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Read("howard@example.com", msgs[0]); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Losing the UID file must not lead to reuse of UIDs
+	if err := os.Remove(filepath.Join(dir, "howard@example.com", UIDFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if uid, err := store.Deliver("howard@example.com", []byte("Subject: hi\r\n\r\nbody\r\n"), now); err != nil || uid != 7 {
+		t.Fatal(uid, err)
+	}
+}
@@ -232,6 +232,25 @@ func (conn *Connection) AnswerNegative() {
 	conn.answered = true
 }
 
+// AnswerRejected produces a negative reply that rejects the latest recipient or mail data for a policy reason, such as spam.
+func (conn *Connection) AnswerRejected(reason string) {
+	if conn.latestProtocolVerb == VerbDATA {
+		conn.reply("554 5.7.1 %s", reason)
+	} else {
+		conn.reply("550 5.7.1 %s", reason)
+	}
+	conn.answered = true
+}
+
+/*
+AnswerTryAgainLater produces a transient negative reply that asks the client to try the latest command again later, for
+example, when the recipient is greylisted. The conversation carries on.
+*/
+func (conn *Connection) AnswerTryAgainLater(reason string) {
+	conn.reply("451 4.7.1 %s", reason)
+	conn.answered = true
+}
+
 /*
 AnswerRateLimited produces a negative answer to the SMTP conversation to inform SMTP client that it has been rate
 limited. The connection is closed afterwards.
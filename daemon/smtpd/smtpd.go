@@ -1,6 +1,7 @@
 package smtpd
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -12,7 +13,12 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/antispam"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/imap"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailauth"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/maildir"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/smtp"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -24,6 +30,8 @@ const (
 	IOTimeoutSec          = 60  // IO timeout for both read and write operations
 	MaxConversationLength = 256 // Only converse up to this number of exchanges in an SMTP connection
 	MaxNumRecipients      = 100 // MaxNumRecipients is the maximum number of recipients an SMTP conversation will accept
+	// IMAPIdleTimeoutSec is the IO timeout of IMAP conversations, it allows a logged-in client to stay idle for a while.
+	IMAPIdleTimeoutSec = 30 * 60
 )
 
 // Daemon implements an SMTP server that receives mails addressed to configured set of domain names, and optionally forward the received mails to other addresses.
@@ -37,16 +45,52 @@ type Daemon struct {
 	MyDomains []string `json:"MyDomains"`
 	// ForwardTo are the recipients (email addresses) to receive emails that are delivered to this SMTP server.
 	ForwardTo []string `json:"ForwardTo"`
+	/*
+		SRSSecret (optional) enables Sender Rewriting Scheme for the envelope sender of forwarded mails, the rewritten
+		addresses belong to the first domain name of MyDomains. Bounce messages that return to a rewritten address are
+		relayed to the original sender.
+	*/
+	SRSSecret string `json:"SRSSecret"`
+	/*
+		MaildirPath (optional) is the directory in which each address of Mailboxes keeps its received mails in Maildir
+		format. The mails are kept there in addition to being forwarded to the forward addresses, if there are any.
+	*/
+	MaildirPath string `json:"MaildirPath"`
+	// Mailboxes are the addresses of MyDomains that have a local mailbox, mapped to the password of the mailbox owner for logging in via IMAP.
+	Mailboxes map[string]string `json:"Mailboxes"`
+	// MailboxMaxMessages is the maximum number of mails to keep in each local mailbox, the oldest mails are removed first.
+	MailboxMaxMessages int `json:"MailboxMaxMessages"`
+	// MailboxMaxAgeDays is the number of days to keep a mail in the local mailboxes.
+	MailboxMaxAgeDays int `json:"MailboxMaxAgeDays"`
+	// IMAPPort (optional) is the port number to serve IMAP over TLS for mailbox owners to read their mails. It requires TLS certificate and key.
+	IMAPPort int `json:"IMAPPort"`
+	/*
+		SpamFilter (optional) gives a spam score to each SMTP conversation using DNS blacklists, greylisting, HELO and
+		header heuristics, and the blacklist of DNS daemon. The mail is rejected or tagged as spam according to the score.
+	*/
+	SpamFilter *antispam.Config `json:"SpamFilter"`
 
 	CommandRunner     *mailcmd.CommandRunner `json:"-"` // Process feature commands from incoming mails
 	ForwardMailClient inet.MailClient        `json:"-"` // ForwardMailClient is used to forward arriving emails.
+	// Resolver looks up DNS records to verify SPF, DKIM, and DMARC of arriving mails. It defaults to the system resolver.
+	Resolver mailauth.Resolver `json:"-"`
+	// DNSDaemon (optional) offers its blacklist to the spam filter for checking the URLs found in mail content.
+	DNSDaemon *dnsd.Daemon `json:"-"`
 
 	myDomainsHash map[string]struct{} // myDomainHash has "MyDomains" in map keys
+	mailVerifier  *mailauth.Verifier  // mailVerifier verifies SPF, DKIM, and DMARC of arriving mails
+	srs           *SenderRewriting    // srs rewrites envelope sender of forwarded mails if SRS secret is configured
 	smtpConfig    smtp.Config
 	tlsCert       tls.Certificate
 	tcpServer     *common.TCPServer
 	logger        lalog.Logger
 
+	mailboxPasswords map[string]string // mailboxPasswords has lower case "Mailboxes" addresses in map keys
+	mailStore        *maildir.Store    // mailStore keeps the mails of local mailboxes if mailboxes are configured
+	imapConfig       imap.Config
+	imapServer       *common.TCPServer  // imapServer serves IMAP clients if IMAP port is configured
+	spamPipeline     *antispam.Pipeline // spamPipeline gives spam score to SMTP conversations if spam filter is configured
+
 	// processMailTestCaseFunc works along side normal delivery routine, it offers mail message to test case for inspection.
 	processMailTestCaseFunc func(string, string)
 }
@@ -66,8 +110,11 @@ func (daemon *Daemon) Initialise() error {
 		ComponentName: "smtpd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "Port", Value: daemon.Port}},
 	}
-	if daemon.ForwardTo == nil || len(daemon.ForwardTo) == 0 || !daemon.ForwardMailClient.IsConfigured() {
-		return errors.New("smtpd.Initialise: forward address and forward mail client must be configured")
+	if len(daemon.ForwardTo) == 0 && len(daemon.Mailboxes) == 0 {
+		return errors.New("smtpd.Initialise: forward address and forward mail client, or local mailboxes must be configured")
+	}
+	if len(daemon.ForwardTo) > 0 && !daemon.ForwardMailClient.IsConfigured() {
+		return errors.New("smtpd.Initialise: forward mail client must be configured")
 	}
 	if daemon.MyDomains == nil || len(daemon.MyDomains) == 0 {
 		return errors.New("smtpd.Initialise: my domain names must be configured")
@@ -123,6 +170,26 @@ func (daemon *Daemon) Initialise() error {
 			return fmt.Errorf("smtpd.Initialise: forward address \"%s\" must not loop back to this mail server's domain", fwd)
 		}
 	}
+	// Arriving mails are verified by the first domain name, which is also the authentication service ID in their Authentication-Results header
+	daemon.mailVerifier = &mailauth.Verifier{AuthServID: daemon.MyDomains[0], Resolver: daemon.Resolver}
+	daemon.srs = nil
+	if daemon.SRSSecret != "" {
+		daemon.srs = &SenderRewriting{Secret: daemon.SRSSecret, Domain: daemon.MyDomains[0]}
+	}
+	if err := daemon.initialiseMailboxes(); err != nil {
+		return err
+	}
+	daemon.spamPipeline = nil
+	if daemon.SpamFilter != nil {
+		var isBlacklisted func(string) bool
+		if daemon.DNSDaemon != nil {
+			isBlacklisted = daemon.DNSDaemon.IsInBlacklist
+		}
+		var err error
+		if daemon.spamPipeline, err = daemon.SpamFilter.NewPipeline(daemon.MyDomains, isBlacklisted); err != nil {
+			return fmt.Errorf("smtpd.Initialise: %v", err)
+		}
+	}
 	// Initialise the optional toolbox command runner
 	if daemon.CommandRunner == nil || daemon.CommandRunner.Processor == nil || daemon.CommandRunner.Processor.IsEmpty() {
 		daemon.logger.Info("Initialise", "", nil, "daemon will not be able to execute toolbox commands due to lack of command processor filter configuration")
@@ -150,26 +217,57 @@ func (daemon *Daemon) Initialise() error {
 		LimitPerSec: daemon.PerIPLimit,
 	}
 	daemon.tcpServer.Initialise()
+	daemon.imapServer = nil
+	if daemon.IMAPPort > 0 {
+		daemon.imapConfig = imap.Config{
+			IOTimeout:    IMAPIdleTimeoutSec * time.Second,
+			Store:        daemon.mailStore,
+			Authenticate: daemon.authenticateMailbox,
+		}
+		daemon.imapServer = &common.TCPServer{
+			ListenAddr:  daemon.Address,
+			ListenPort:  daemon.IMAPPort,
+			AppName:     "imapd",
+			App:         &imapApp{daemon: daemon},
+			LimitPerSec: daemon.PerIPLimit,
+		}
+		daemon.imapServer.Initialise()
+	}
 	return nil
 }
 
-// Unconditionally forward the mail to forward addresses, then process feature commands if they are found.
-func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
-	bodyBytes := []byte(mailBody)
-	// Determine whether the sender enforces DMARC policy
-	fromAddrWithoutDmarc := GetFromAddressWithDmarcWorkaround(fromAddr, rand.Intn(100000))
-	if fromAddrWithoutDmarc != fromAddr {
-		// Change the sender's domain to the non-existent domain without a DMARC policy
-		daemon.logger.Info("ProcessMail", fromAddr, nil, "rewriting From address from %s to %s to evade DMARC validation", fromAddr, fromAddrWithoutDmarc)
-		fromAddr = fromAddrWithoutDmarc
-		// Change the sender's domain in "From:" header
-		bodyBytes = WithHeaderFromAddr(bodyBytes, fromAddrWithoutDmarc)
-	}
-	// Forward the mail to all recipients
-	if err := daemon.ForwardMailClient.SendRaw(daemon.ForwardMailClient.MailFrom, bodyBytes, daemon.ForwardTo...); err == nil {
-		daemon.logger.Info("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v", daemon.ForwardTo)
-	} else {
-		daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to forward email")
+/*
+Verify SPF, DKIM, and DMARC of the mail and note down the results in its header, then keep the mail in the local
+mailboxes of its recipients, then unconditionally forward the mail to forward addresses, then process feature commands
+if they are found.
+*/
+func (daemon *Daemon) ProcessMail(clientIP, helo, fromAddr string, toAddrs []string, mailBody string) {
+	// Verify the mail as it arrived, before the DMARC workaround alters its From header.
+	auth := daemon.mailVerifier.Verify(clientIP, helo, fromAddr, []byte(mailBody))
+	daemon.logger.Info("ProcessMail", fromAddr, nil, "verification results: spf=%s dkim=%d signature(s) dmarc=%s", auth.SPF.Result, len(auth.DKIM), auth.DMARC.Result)
+	bodyBytes := mailauth.WithAuthenticationResults([]byte(mailBody), auth)
+	daemon.deliverToMailboxes(fromAddr, toAddrs, bodyBytes)
+	if len(daemon.ForwardTo) > 0 {
+		// Rewrite the envelope sender so that the forwarded mail passes SPF verification at its destination
+		envelopeFrom := daemon.ForwardMailClient.MailFrom
+		if daemon.srs != nil && fromAddr != "" {
+			envelopeFrom = daemon.srs.Forward(fromAddr, time.Now())
+		}
+		// Determine whether the sender enforces DMARC policy
+		fromAddrWithoutDmarc := GetFromAddressWithDmarcWorkaround(fromAddr, rand.Intn(100000))
+		if fromAddrWithoutDmarc != fromAddr {
+			// Change the sender's domain to the non-existent domain without a DMARC policy
+			daemon.logger.Info("ProcessMail", fromAddr, nil, "rewriting From address from %s to %s to evade DMARC validation", fromAddr, fromAddrWithoutDmarc)
+			fromAddr = fromAddrWithoutDmarc
+			// Change the sender's domain in "From:" header
+			bodyBytes = WithHeaderFromAddr(bodyBytes, fromAddrWithoutDmarc)
+		}
+		// Forward the mail to all recipients
+		if err := daemon.ForwardMailClient.SendRaw(envelopeFrom, bodyBytes, daemon.ForwardTo...); err == nil {
+			daemon.logger.Info("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v with envelope sender %s", daemon.ForwardTo, envelopeFrom)
+		} else {
+			daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to forward email")
+		}
 	}
 	// Offer the processed mail to test case
 	if daemon.processMailTestCaseFunc != nil {
@@ -177,12 +275,24 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 	}
 	// Run feature command from mail body
 	if daemon.CommandRunner != nil && daemon.CommandRunner.Processor != nil && !daemon.CommandRunner.Processor.IsEmpty() {
-		if err := daemon.CommandRunner.Process(clientIP, bodyBytes); err != nil {
+		if err := daemon.CommandRunner.ProcessAuthenticated(clientIP, auth, bodyBytes); err != nil {
 			daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to process toolbox command from mail body")
 		}
 	}
 }
 
+/*
+ReturnBounce relays the bounce message that arrived at rewritten addresses to the original senders. The relayed bounce
+uses the null sender like the original bounce does, so that it never bounces again.
+*/
+func (daemon *Daemon) ReturnBounce(clientIP, fromAddr, mailBody string, originalSenders []string) {
+	if err := daemon.ForwardMailClient.SendBounce([]byte(mailBody), originalSenders...); err == nil {
+		daemon.logger.Info("ReturnBounce", clientIP, nil, "successfully relayed bounce message from \"%s\" to %v", fromAddr, originalSenders)
+	} else {
+		daemon.logger.Warning("ReturnBounce", clientIP, err, "failed to relay bounce message")
+	}
+}
+
 // GetTCPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
 func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
 	return misc.SMTPDStats
@@ -195,9 +305,18 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 	var completionStatus string
 	// memorise latest conversations for logging purpose
 	latestConv := lalog.NewRingBuffer(4)
-	// fromAddr, mailBody, and toAddrs will be filled as SMTP conversation goes on
-	var fromAddr, mailBody string
+	// helo, fromAddr, mailBody, toAddrs, and bounceTo will be filled as SMTP conversation goes on
+	var helo, fromAddr, mailBody string
 	toAddrs := make([]string, 0, 4)
+	// bounceTo are the original senders of the rewritten recipient addresses
+	bounceTo := make([]string, 0, 1)
+	// spamReport accumulates the spam score of the conversation if spam filter is configured
+	var spamReport *antispam.Report
+	if daemon.spamPipeline != nil {
+		spamReport = daemon.spamPipeline.NewReport()
+	}
+	// rejected is set to true after the server has rejected the conversation with an explanation
+	var rejected bool
 
 	smtpConn := smtp.NewConnection(client, daemon.smtpConfig, nil)
 	for {
@@ -228,13 +347,39 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 			goto done
 		case smtp.ConvReceivedCommand:
 			switch ev.Verb {
+			case smtp.VerbHELO, smtp.VerbEHLO:
+				helo = ev.Parameter
 			case smtp.VerbMAILFROM:
 				fromAddr = ev.Parameter
 			case smtp.VerbRCPTTO:
 				atSign := strings.IndexRune(ev.Parameter, '@')
 				if atSign > 0 {
 					if domain, exists := daemon.myDomainsHash[ev.Parameter[atSign+1:]]; exists {
-						if len(toAddrs) < MaxNumRecipients {
+						if daemon.srs != nil && IsSRSAddress(ev.Parameter) {
+							// A bounce message returns to the rewritten address, the address must be genuine.
+							originalSender, err := daemon.srs.Reverse(ev.Parameter, time.Now())
+							if err != nil {
+								completionStatus = fmt.Sprintf("rejected SRS address \"%s\" - %v", ev.Parameter, err)
+								smtpConn.AnswerNegative()
+								goto done
+							}
+							if len(bounceTo) < MaxNumRecipients {
+								bounceTo = append(bounceTo, originalSender)
+							}
+						} else if len(toAddrs) < MaxNumRecipients {
+							if spamReport != nil {
+								conv := &antispam.Conversation{ClientIP: ip, HELO: helo, MailFrom: fromAddr, Recipient: ev.Parameter}
+								switch spamReport.Recipient(conv) {
+								case antispam.ActionReject:
+									completionStatus = fmt.Sprintf("rejected spam (%s)", spamReport.Header())
+									smtpConn.AnswerRejected("Rejected as spam")
+									rejected = true
+									goto done
+								case antispam.ActionDefer:
+									smtpConn.AnswerTryAgainLater("Greylisted, please try again later")
+									continue
+								}
+							}
 							toAddrs = append(toAddrs, ev.Parameter)
 						}
 					} else {
@@ -246,14 +391,32 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 			}
 		case smtp.ConvReceivedData:
 			mailBody = ev.Parameter
+			if spamReport != nil && len(toAddrs) > 0 {
+				conv := &antispam.Conversation{ClientIP: ip, HELO: helo, MailFrom: fromAddr, Message: []byte(mailBody)}
+				if spamReport.Message(conv) == antispam.ActionReject {
+					completionStatus = fmt.Sprintf("rejected spam (%s)", spamReport.Header())
+					smtpConn.AnswerRejected("Rejected as spam")
+					rejected = true
+					mailBody = ""
+					goto done
+				}
+				mailBody = string(spamReport.WithHeaders([]byte(mailBody)))
+			}
 		}
 	}
 done:
+	// A bounce message usually comes from an empty sender address
+	if len(bounceTo) > 0 && mailBody != "" {
+		daemon.ReturnBounce(ip, fromAddr, mailBody, bounceTo)
+	}
 	if fromAddr != "" && len(toAddrs) > 0 && mailBody != "" {
 		daemon.logger.Info("HandleTCPConnection", ip, nil, "received mail from \"%s\" addressed to %s", fromAddr, strings.Join(toAddrs, ", "))
-		// Forward the mail to forward-recipients, hence the original To-Addresses are not relevant.
-		daemon.ProcessMail(ip, fromAddr, mailBody)
-	} else {
+		if spamReport != nil {
+			daemon.logger.Info("HandleTCPConnection", ip, nil, "spam status of mail from \"%s\": %s", fromAddr, spamReport.Header())
+		}
+		// The original To-Addresses are only relevant to local mailboxes, the mail is forwarded to forward-recipients.
+		daemon.ProcessMail(ip, helo, fromAddr, toAddrs, mailBody)
+	} else if !rejected && (len(bounceTo) == 0 || mailBody == "") {
 		smtpConn.AnswerNegative()
 		completionStatus += " & rejected mail due to missing parameters"
 	}
@@ -266,12 +429,59 @@ You may call this function only after having called Initialise()!
 Start SMTP daemon and block until daemon is told to stop.
 */
 func (daemon *Daemon) StartAndBlock() (err error) {
-	return daemon.tcpServer.StartAndBlock()
+	if daemon.imapServer == nil {
+		return daemon.tcpServer.StartAndBlock()
+	}
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- daemon.tcpServer.StartAndBlock()
+	}()
+	go func() {
+		errChan <- daemon.imapServer.StartAndBlock()
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != nil {
+			daemon.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSpamFilter writes the latest state of the spam filter, such as greylist triplets, to disk.
+func (daemon *Daemon) saveSpamFilter() {
+	if daemon.spamPipeline != nil {
+		if err := daemon.spamPipeline.Save(); err != nil {
+			daemon.logger.Warning("saveSpamFilter", "", err, "failed to save spam filter state")
+		}
+	}
 }
 
-// If SMTP daemon has started (i.e. listener is set), close the listener so that its connection loop will terminate.
+// If SMTP daemon has started (i.e. listener is set), close the SMTP and IMAP listeners so that their connection loops will terminate.
 func (daemon *Daemon) Stop() {
 	daemon.tcpServer.Stop()
+	if daemon.imapServer != nil {
+		daemon.imapServer.Stop()
+	}
+	daemon.saveSpamFilter()
+}
+
+// Shutdown stops accepting new SMTP and IMAP clients, and waits for ongoing mail conversations to complete.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	defer daemon.saveSpamFilter()
+	if daemon.imapServer == nil {
+		return daemon.tcpServer.Shutdown(ctx)
+	}
+	return common.ShutdownConcurrently(ctx, daemon.tcpServer.Shutdown, daemon.imapServer.Shutdown)
+}
+
+/*
+isVerifiedMail returns true only if the processed mail is the original message with an Authentication-Results header
+of this server on top. Keep in mind that server reads input mail message through the textproto.DotReader.
+*/
+func isVerifiedMail(smtpd *Daemon, processedMail, originalMessage string) bool {
+	return strings.HasPrefix(processedMail, mailauth.HeaderAuthenticationResults+": "+smtpd.MyDomains[0]+";\n") &&
+		strings.HasSuffix(processedMail, "\n"+strings.Replace(originalMessage, "\r\n", "\n", -1))
 }
 
 // Run unit tests on Daemon. See TestSMTPD_StartAndBlock for daemon setup.
@@ -305,7 +515,7 @@ func TestSMTPD(smtpd *Daemon, t testingstub.T) {
 	}
 	// Due to unknown circumstance, netSMTP.SendMail often returns successfully before SMTP server has completely processed the mail.
 	time.Sleep(1 * time.Second)
-	if lastEmailFrom != "ClientFrom@localhost" || lastEmailBody != strings.Replace(testMessage, "\r\n", "\n", -1) {
+	if lastEmailFrom != "ClientFrom@localhost" || !isVerifiedMail(smtpd, lastEmailBody, testMessage) {
 		// Keep in mind that server reads input mail message through the textproto.DotReader
 		t.Fatalf("%+v\n'%+v'\n'%+v'\n", lastEmailFrom, []byte(testMessage), []byte(lastEmailBody))
 	}
@@ -336,6 +546,14 @@ func TestSMTPD(smtpd *Daemon, t testingstub.T) {
 		t.Fatal(lastEmailFrom, lastEmailBody)
 	}
 
+	// Send a bounce message to a forged rewritten address, which will be rejected.
+	if smtpd.srs != nil {
+		forgedSRS := "SRS0=abcd=AA=example.com=a@" + smtpd.MyDomains[0]
+		if err := netSMTP.SendMail(addr, nil, "", []string{forgedSRS}, []byte(testMessage)); err == nil || !strings.Contains(err.Error(), "Bad address") {
+			t.Fatal(err)
+		}
+	}
+
 	// Try run a command via email
 	testMessage = "Content-type: text/plain; charset=utf-8\r\nFrom: MsgFrom@whatever\r\nTo: MsgTo@whatever\r\nSubject: command subject\r\n\r\nverysecret.s echo hi\r\n"
 	lastEmailFrom = ""
@@ -344,7 +562,7 @@ func TestSMTPD(smtpd *Daemon, t testingstub.T) {
 		t.Fatal(err)
 	}
 	time.Sleep(1 * time.Second)
-	if lastEmailFrom != "ClientFrom@localhost" || lastEmailBody != strings.Replace(testMessage, "\r\n", "\n", -1) {
+	if lastEmailFrom != "ClientFrom@localhost" || !isVerifiedMail(smtpd, lastEmailBody, testMessage) {
 		// Keep in mind that server reads input mail message through the textproto.DotReader
 		t.Fatal(lastEmailFrom, lastEmailBody)
 	}
@@ -1,9 +1,14 @@
 package smtpd
 
 import (
+	"io/ioutil"
+	netSMTP "net/smtp"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/antispam"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -76,6 +81,7 @@ func TestSMTPD_StartAndBlock(t *testing.T) {
 	daemon.Address = "127.0.0.1"
 	daemon.Port = 61358   // do not loop back to myself
 	daemon.PerIPLimit = 5 // limit must be high enough to tolerate consecutive mail tests
+	daemon.SRSSecret = "verysecret"
 	// If parameter values are satisfactory, daemon should properly and successfully initialise even without the presence of a mail command runner
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
@@ -120,3 +126,140 @@ func TestSMTPD_StartAndBlock(t *testing.T) {
 
 	TestSMTPD(&daemon, t)
 }
+
+func TestSMTPD_Mailboxes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestSMTPD_Mailboxes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	daemon := Daemon{
+		Address:   "127.0.0.1",
+		Port:      61359,
+		MyDomains: []string{"example.com"},
+		Mailboxes: map[string]string{"Howard@example.com": "pass"},
+		IMAPPort:  61360,
+	}
+	// Test bad mailbox configuration
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "maildir path") {
+		t.Fatal(err)
+	}
+	daemon.MaildirPath = dir
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLS") {
+		t.Fatal(err)
+	}
+	daemon.TLSCertPath = "../../sample-config.crt.txt"
+	daemon.TLSKeyPath = "../../sample-config.crt.key.txt"
+	daemon.Mailboxes = map[string]string{"howard@example.net": "pass"}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "my domain names") {
+		t.Fatal(err)
+	}
+	// Keep mails in local mailboxes without forwarding them
+	daemon.Mailboxes = map[string]string{"Howard@example.com": "pass"}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(1 * time.Second)
+	testMessage := "From: sender@example.net\r\nTo: howard@example.com\r\nSubject: mailbox subject\r\nContent-Type: text/plain\r\n\r\nmailbox body\r\n"
+	daemon.ProcessMail("127.0.0.1", "localhost", "sender@example.net", []string{"howard@example.com", "HOWARD@example.com", "other@example.com"}, testMessage)
+
+	// Read the mail using the IMAP app
+	accounts := toolbox.IMAPAccounts{Accounts: map[string]*toolbox.IMAPS{
+		"laitos": {Host: daemon.Address, Port: daemon.IMAPPort, InsecureSkipVerify: true, AuthUsername: "howard@example.com", AuthPassword: "pass"},
+	}}
+	if err := accounts.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if result := accounts.Execute(toolbox.Command{Content: "l laitos 0 10"}); result.Error != nil || result.Output != "1 sender@example.net mailbox subject\n" {
+		t.Fatalf("%+v", result)
+	}
+	if result := accounts.Execute(toolbox.Command{Content: "r laitos 1"}); result.Error != nil || !strings.Contains(result.Output, "mailbox body") {
+		t.Fatalf("%+v", result)
+	}
+	accounts.Accounts["laitos"].AuthPassword = "wrong"
+	if err := accounts.SelfTest(); err == nil {
+		t.Fatal("did not error")
+	}
+
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+}
+
+func TestSMTPD_SpamFilter(t *testing.T) {
+	daemon := Daemon{
+		Address:           "127.0.0.1",
+		Port:              61361,
+		MyDomains:         []string{"example.com"},
+		ForwardTo:         []string{"howard@forward-to.example.com"},
+		ForwardMailClient: inet.MailClient{MailFrom: "howard@localhost", MTAHost: "smtp.example.com", MTAPort: 25},
+		SpamFilter:        &antispam.Config{TagScore: 5, RejectScore: 4},
+	}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "reject score") {
+		t.Fatal(err)
+	}
+	daemon.SpamFilter = &antispam.Config{TagScore: 2, RejectScore: 5}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(1 * time.Second)
+	var lastEmailBody string
+	daemon.processMailTestCaseFunc = func(_ string, body string) {
+		lastEmailBody = body
+	}
+	addr := "127.0.0.1:61361"
+
+	// A good mail is marked as not spam, the forged spam header is removed.
+	goodMessage := "X-Spam-Status: No, score=-100\r\nFrom: a@example.net\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\nMessage-ID: <1@example.net>\r\nSubject: hi\r\n\r\nbody\r\n"
+	if err := netSMTP.SendMail(addr, nil, "a@example.net", []string{"howard@example.com"}, []byte(goodMessage)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if !strings.Contains(lastEmailBody, "\nX-Spam-Status: No, score=0.0 required=2.0 tests=none\nFrom: a@example.net\n") ||
+		strings.Contains(lastEmailBody, "score=-100") {
+		t.Fatal(lastEmailBody)
+	}
+	// A suspicious mail is tagged as spam
+	lastEmailBody = ""
+	if err := netSMTP.SendMail(addr, nil, "a@example.net", []string{"howard@example.com"}, []byte("From: a@example.net\r\nSubject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if !strings.Contains(lastEmailBody, "\nX-Spam-Status: Yes, score=2.0 required=2.0 tests=MISSING_DATE,MISSING_MESSAGE_ID\nX-Spam-Flag: YES\n") {
+		t.Fatal(lastEmailBody)
+	}
+	// A spam mail is rejected
+	lastEmailBody = ""
+	if err := netSMTP.SendMail(addr, nil, "a@example.net", []string{"howard@example.com"}, []byte("Subject: YOU HAVE WON A PRIZE\r\n\r\nbody\r\n")); err == nil || !strings.Contains(err.Error(), "Rejected as spam") {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if lastEmailBody != "" {
+		t.Fatal(lastEmailBody)
+	}
+
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+}
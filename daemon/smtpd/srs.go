@@ -0,0 +1,123 @@
+package smtpd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// SRSMaxAgeDays is the number of days a rewritten address remains valid for bounce messages to return to the original sender.
+	SRSMaxAgeDays = 21
+	// srsTimestampAlphabet encodes the day number of rewritten addresses in base32.
+	srsTimestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	// srsTimestampPeriod is the number of days it takes for the two-character day number to wrap around.
+	srsTimestampPeriod = 1024
+)
+
+var (
+	ErrSRSMalformed = errors.New("malformed SRS address")
+	ErrSRSBadHash   = errors.New("SRS address hash does not match")
+	ErrSRSExpired   = errors.New("SRS address has expired")
+)
+
+/*
+SenderRewriting implements Sender Rewriting Scheme (SRS). It rewrites the envelope sender of forwarded mails into an
+address of this server's domain, so that the forwarded mail passes SPF verification at its destination, and bounce
+messages addressed to the rewritten address find their way back to the original sender.
+An address "name@example.com" is rewritten into "SRS0=HHHH=TT=example.com=name@my-domain", in which HHHH is the hash
+that prevents forgery and TT is the day number.
+*/
+type SenderRewriting struct {
+	Secret string // Secret is the key of the hash that protects rewritten addresses from forgery.
+	Domain string // Domain is the domain name of rewritten addresses, this server must receive mails for the domain.
+}
+
+// IsSRSAddress returns true only if the mail address looks like a rewritten address.
+func IsSRSAddress(addr string) bool {
+	upperAddr := strings.ToUpper(addr)
+	return strings.HasPrefix(upperAddr, "SRS0=") || strings.HasPrefix(upperAddr, "SRS1=")
+}
+
+// hash returns the first four characters of the HMAC of the input strings.
+func (srs *SenderRewriting) hash(values ...string) string {
+	mac := hmac.New(sha1.New, []byte(srs.Secret))
+	for _, value := range values {
+		_, _ = mac.Write([]byte(strings.ToLower(value)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+// srsTimestamp returns the day number of the time in two base32 characters.
+func srsTimestamp(now time.Time) string {
+	day := now.Unix() / 86400 % srsTimestampPeriod
+	return string([]byte{srsTimestampAlphabet[day>>5], srsTimestampAlphabet[day&31]})
+}
+
+/*
+Forward returns the rewritten address of the original sender. If the sender address is empty, or it already belongs to
+the rewriting domain, the address is returned as-is. If the sender address has been rewritten by another forwarder,
+the result will point to the first forwarder.
+*/
+func (srs *SenderRewriting) Forward(addr string, now time.Time) string {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 1 || at == len(addr)-1 {
+		return addr
+	}
+	local, domain := addr[:at], addr[at+1:]
+	if strings.EqualFold(domain, srs.Domain) {
+		return addr
+	}
+	switch upperLocal := strings.ToUpper(local); {
+	case strings.HasPrefix(upperLocal, "SRS0="):
+		// SRS1=HHHH=first-forwarder.com==HHHH=TT=example.com=name
+		return fmt.Sprintf("SRS1=%s=%s==%s@%s", srs.hash(domain, local[5:]), domain, local[5:], srs.Domain)
+	case strings.HasPrefix(upperLocal, "SRS1="):
+		// Keep the first forwarder and the original sender while replacing the hash
+		if parts := strings.SplitN(local[5:], "=", 3); len(parts) == 3 && strings.HasPrefix(parts[2], "=") {
+			return fmt.Sprintf("SRS1=%s=%s==%s@%s", srs.hash(parts[1], parts[2][1:]), parts[1], parts[2][1:], srs.Domain)
+		}
+	}
+	timestamp := srsTimestamp(now)
+	return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", srs.hash(timestamp, domain, local), timestamp, domain, local, srs.Domain)
+}
+
+// Reverse returns the original sender address of the rewritten address, or the rewritten address of the first forwarder.
+func (srs *SenderRewriting) Reverse(addr string, now time.Time) (string, error) {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 5 || !IsSRSAddress(addr) {
+		return "", ErrSRSMalformed
+	}
+	local := addr[:at]
+	if strings.EqualFold(local[:5], "SRS1=") {
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || !strings.HasPrefix(parts[2], "=") || len(parts[2]) < 2 {
+			return "", ErrSRSMalformed
+		}
+		if !strings.EqualFold(parts[0], srs.hash(parts[1], parts[2][1:])) {
+			return "", ErrSRSBadHash
+		}
+		return "SRS0=" + parts[2][1:] + "@" + parts[1], nil
+	}
+	parts := strings.SplitN(local[5:], "=", 4)
+	if len(parts) != 4 || len(parts[1]) != 2 || parts[2] == "" || parts[3] == "" {
+		return "", ErrSRSMalformed
+	}
+	hash, timestamp, domain, origLocal := parts[0], strings.ToUpper(parts[1]), parts[2], parts[3]
+	if !strings.EqualFold(hash, srs.hash(timestamp, domain, origLocal)) {
+		return "", ErrSRSBadHash
+	}
+	high, low := strings.IndexByte(srsTimestampAlphabet, timestamp[0]), strings.IndexByte(srsTimestampAlphabet, timestamp[1])
+	if high == -1 || low == -1 {
+		return "", ErrSRSMalformed
+	}
+	today := now.Unix() / 86400 % srsTimestampPeriod
+	if age := (today - int64(high<<5|low) + srsTimestampPeriod) % srsTimestampPeriod; age > SRSMaxAgeDays {
+		return "", ErrSRSExpired
+	}
+	return origLocal + "@" + domain, nil
+}
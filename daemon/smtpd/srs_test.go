@@ -0,0 +1,71 @@
+package smtpd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSenderRewriting(t *testing.T) {
+	srs := &SenderRewriting{Secret: "verysecret", Domain: "forwarder.example.com"}
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	// Addresses that are not rewritten
+	for _, addr := range []string{"", "howard", "howard@", "@example.com", "howard@Forwarder.Example.COM"} {
+		if got := srs.Forward(addr, now); got != addr {
+			t.Fatal(addr, got)
+		}
+	}
+	rewritten := srs.Forward("howard@example.com", now)
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=example.com=howard@forwarder.example.com") || !IsSRSAddress(rewritten) {
+		t.Fatal(rewritten)
+	}
+	// Bounce messages return to the original sender within the valid period, mail servers may change the letter case.
+	for _, addr := range []string{rewritten, strings.ToLower(rewritten)} {
+		for _, days := range []int{0, 1, SRSMaxAgeDays} {
+			if orig, err := srs.Reverse(addr, now.AddDate(0, 0, days)); err != nil || orig != "howard@example.com" {
+				t.Fatal(addr, days, orig, err)
+			}
+		}
+	}
+	if _, err := srs.Reverse(rewritten, now.AddDate(0, 0, SRSMaxAgeDays+1)); err != ErrSRSExpired {
+		t.Fatal(err)
+	}
+	// The day number wraps around without affecting validity
+	wrapTime := time.Unix((srsTimestampPeriod*100-1)*86400, 0)
+	if orig, err := srs.Reverse(srs.Forward("howard@example.com", wrapTime), wrapTime.AddDate(0, 0, 2)); err != nil || orig != "howard@example.com" {
+		t.Fatal(orig, err)
+	}
+	// Forged and malformed addresses
+	forged := strings.Replace(rewritten, "=howard@", "=root@", 1)
+	if _, err := srs.Reverse(forged, now); err != ErrSRSBadHash {
+		t.Fatal(err)
+	}
+	otherSecret := &SenderRewriting{Secret: "othersecret", Domain: "forwarder.example.com"}
+	if _, err := otherSecret.Reverse(rewritten, now); err != ErrSRSBadHash {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"howard@example.com", "SRS0=@f.com", "SRS0=abcd=AA=example.com@f.com", "SRS0=abcd=A=example.com=a@f.com", "SRS1=abcd=f.com=a@f.com"} {
+		if _, err := srs.Reverse(addr, now); err != ErrSRSMalformed {
+			t.Fatal(addr, err)
+		}
+	}
+
+	// Another forwarder forwards the rewritten address, its bounce returns to the first forwarder.
+	second := &SenderRewriting{Secret: "secondsecret", Domain: "second.example.net"}
+	rewrittenTwice := second.Forward(rewritten, now)
+	if !strings.HasPrefix(rewrittenTwice, "SRS1=") || !strings.HasSuffix(rewrittenTwice, "=forwarder.example.com=="+rewritten[len("SRS0="):strings.LastIndexByte(rewritten, '@')]+"@second.example.net") {
+		t.Fatal(rewrittenTwice)
+	}
+	if orig, err := second.Reverse(rewrittenTwice, now); err != nil || orig != rewritten {
+		t.Fatal(orig, err)
+	}
+	// The third forwarder keeps pointing to the first forwarder
+	third := &SenderRewriting{Secret: "thirdsecret", Domain: "third.example.org"}
+	rewrittenThrice := third.Forward(rewrittenTwice, now)
+	if orig, err := third.Reverse(rewrittenThrice, now); err != nil || orig != rewritten {
+		t.Fatal(rewrittenThrice, orig, err)
+	}
+	if _, err := third.Reverse(strings.Replace(rewrittenThrice, "=howard", "=root", 1), now); err != ErrSRSBadHash {
+		t.Fatal(err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/asn1"
 	"runtime"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
@@ -71,6 +72,14 @@ var (
 		115: func() interface{} {
 			return int64(misc.OutstandingMailBytes)
 		},
+		// 1.3.6.1.4.1.52535.121.116 Integer - number of DNS queries answered from response cache
+		116: func() interface{} {
+			return atomic.LoadInt64(&misc.DNSDResponseCacheHits)
+		},
+		// 1.3.6.1.4.1.52535.121.117 Integer - number of DNS queries that missed response cache
+		117: func() interface{} {
+			return atomic.LoadInt64(&misc.DNSDResponseCacheMisses)
+		},
 	}
 	/*
 		OIDSuffixList is a sorted list of suffix number among the OID nodes supported by laitos SNMP server. It is
@@ -79,11 +79,15 @@ func TestGetNextNode(t *testing.T) {
 		t.Fatal(oid, endOfView)
 	}
 	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 115})
-	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 115}) || !endOfView {
+	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 116}) || endOfView {
+		t.Fatal(oid, endOfView)
+	}
+	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 117})
+	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 117}) || !endOfView {
 		t.Fatal(oid, endOfView)
 	}
 	// Not entirely sure if this one conforms to SNMP standard:
-	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 116})
+	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 118})
 	if !oid.Equal(FirstOID) || endOfView {
 		t.Fatal(oid, endOfView)
 	}
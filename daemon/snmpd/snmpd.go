@@ -3,6 +3,7 @@ package snmpd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/subtle"
 	"fmt"
 	"net"
@@ -164,6 +165,11 @@ func (daemon *Daemon) Stop() {
 	daemon.udpServer.Stop()
 }
 
+// Shutdown stops accepting new SNMP requests, and waits for ongoing requests to be answered.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	return daemon.udpServer.Shutdown(ctx)
+}
+
 // TestSNMPD conducts unit tests on SNMP daemon, see TestSNMPD for daemon setup.
 func TestSNMPD(daemon *Daemon, t testingstub.T) {
 	// Server should start within two seconds
@@ -263,7 +269,7 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 		t.Fatalf("%s\n%#v", string(packetBuf), packetBuf)
 	}
 
-	// Send a GetNextRequest on the very last of supported OID, 1.3.6.1.4.1.52535.121.115
+	// Send a GetNextRequest on the very last of supported OID, 1.3.6.1.4.1.52535.121.117
 	lastValidOIDTest := func() []byte {
 		// Re-dial because this function is used going to be used for rate limit test
 		clientConn, err := net.DialUDP("udp", nil, serverAddr)
@@ -278,8 +284,8 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 			0x01, 0x04, 0x06, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0xa1, 0x1d, 0x02, 0x04, 0x1b, 0x6e, 0x63,
 			//..   INT   SZ   NoErr  INT   SZ  EIDX0  ASN1    SZ  ASN1    SZ   OID    SZ   1.3    .6    .1
 			0x8a, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00, 0x30, 0x0f, 0x30, 0x0d, 0x06, 0x0a, 0x2b, 0x06, 0x01,
-			//.4  .1  .52535..........  .121  .115   NUL    SZ
-			0x4, 0x1, 0x83, 0x9a, 0x37, 0x79, 0x73, 0x05, 0x00,
+			//.4  .1  .52535..........  .121  .117   NUL    SZ
+			0x4, 0x1, 0x83, 0x9a, 0x37, 0x79, 0x75, 0x05, 0x00,
 		}
 		if _, err := clientConn.Write(getNextRequest); err != nil {
 			t.Fatal(err)
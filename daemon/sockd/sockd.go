@@ -2,6 +2,7 @@ package sockd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/testingstub"
@@ -225,3 +227,18 @@ func (daemon *Daemon) Stop() {
 	daemon.tcpDaemons = make([]*TCPDaemon, 0)
 	daemon.udpDaemons = make([]*UDPDaemon, 0)
 }
+
+// Shutdown stops all TCP and UDP proxies from accepting new clients, and waits for ongoing connections to complete.
+func (daemon *Daemon) Shutdown(ctx context.Context) error {
+	shutdownFuns := make([]func(context.Context) error, 0, len(daemon.tcpDaemons)+len(daemon.udpDaemons))
+	for _, tcpDaemon := range daemon.tcpDaemons {
+		shutdownFuns = append(shutdownFuns, tcpDaemon.Shutdown)
+	}
+	for _, udpDaemon := range daemon.udpDaemons {
+		shutdownFuns = append(shutdownFuns, udpDaemon.Shutdown)
+	}
+	err := common.ShutdownConcurrently(ctx, shutdownFuns...)
+	daemon.tcpDaemons = make([]*TCPDaemon, 0)
+	daemon.udpDaemons = make([]*UDPDaemon, 0)
+	return err
+}
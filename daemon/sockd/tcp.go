@@ -1,6 +1,7 @@
 package sockd
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -102,6 +103,10 @@ func (daemon *TCPDaemon) Stop() {
 	daemon.tcpServer.Stop()
 }
 
+func (daemon *TCPDaemon) Shutdown(ctx context.Context) error {
+	return daemon.tcpServer.Shutdown(ctx)
+}
+
 type TCPCipherConnection struct {
 	net.Conn
 	*Cipher
@@ -1,6 +1,7 @@
 package sockd
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -114,6 +115,10 @@ func (daemon *UDPDaemon) Stop() {
 	daemon.udpServer.Stop()
 }
 
+func (daemon *UDPDaemon) Shutdown(ctx context.Context) error {
+	return daemon.udpServer.Shutdown(ctx)
+}
+
 type UDPBackLog struct {
 	mutex   *sync.Mutex
 	backlog map[string][]byte
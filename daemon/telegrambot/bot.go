@@ -1,6 +1,7 @@
 package telegrambot
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -78,6 +79,7 @@ type Daemon struct {
 	Processor          *toolbox.CommandProcessor `json:"-"`                  // Feature command processor
 
 	messageOffset int64           // Process chat messages arrived after this point
+	parseMode     string          // parseMode is the Telegram formatting option that matches the markup of command results
 	userRateLimit *misc.RateLimit // Prevent user from flooding bot with new messages
 	loopIsRunning int32           // Value is 1 only when message loop is running
 	stop          chan bool       // Signal message loop to stop
@@ -106,19 +108,40 @@ func (bot *Daemon) Initialise() error {
 		Logger:   bot.logger,
 	}
 	bot.userRateLimit.Initialise()
+	// Let Telegram render the command results marked up by the channel profile
+	bot.parseMode = ""
+	for _, filter := range bot.Processor.ResultFilters {
+		if profile, ok := filter.(*toolbox.ChannelProfile); ok {
+			switch profile.ChatMarkup {
+			case toolbox.ChatMarkupMarkdown:
+				bot.parseMode = "MarkdownV2"
+			case toolbox.ChatMarkupHTML:
+				bot.parseMode = "HTML"
+			}
+		}
+	}
 	bot.stop = make(chan bool)
 	return nil
 }
 
 // Send a text reply to the telegram chat.
 func (bot *Daemon) ReplyTo(chatID int64, text string) error {
+	return bot.sendMessage(chatID, text, "")
+}
+
+// sendMessage sends the text to the telegram chat, the text is formatted according to the parse mode unless it is empty.
+func (bot *Daemon) sendMessage(chatID int64, text, parseMode string) error {
+	params := url.Values{
+		"chat_id": []string{strconv.FormatInt(chatID, 10)},
+		"text":    []string{text},
+	}
+	if parseMode != "" {
+		params.Set("parse_mode", parseMode)
+	}
 	resp, err := inet.DoHTTP(inet.HTTPRequest{
 		Method:     http.MethodPost,
 		TimeoutSec: APICallTimeoutSec,
-		Body: strings.NewReader(url.Values{
-			"chat_id": []string{strconv.FormatInt(chatID, 10)},
-			"text":    []string{text},
-		}.Encode()),
+		Body:       strings.NewReader(params.Encode()),
 	}, "https://api.telegram.org/bot%s/sendMessage", bot.AuthorizationToken)
 	if err != nil || resp.StatusCode/200 != 1 {
 		return fmt.Errorf("telegrambot.ReplyTo: failed to reply to %d - HTTP %d - %v %s", chatID, resp.StatusCode, err, string(resp.Body))
@@ -162,13 +185,24 @@ func (bot *Daemon) ProcessMessages(updates APIUpdates) {
 		}
 		// Find and run command in background
 		go func(ding APIUpdate, beginTimeNano int64) {
+			// The chat may ask for the result in JSON
+			content, structured := toolbox.TrimPrefixStructuredResult(ding.Message.Text)
 			result := bot.Processor.Process(toolbox.Command{
 				DaemonName: "telegrambot",
 				ClientID:   ding.Message.Chat.UserName,
 				TimeoutSec: CommandTimeoutSec,
-				Content:    ding.Message.Text,
+				Content:    content,
 			}, true)
-			if err := bot.ReplyTo(ding.Message.Chat.ID, result.CombinedOutput); err != nil {
+			reply, parseMode := result.CombinedOutput, bot.parseMode
+			if structured {
+				serialised, err := result.ToJSON()
+				if err != nil {
+					bot.logger.Warning("ProcessMessages", ding.Message.Chat.UserName, err, "failed to serialise result")
+					return
+				}
+				reply, parseMode = string(serialised), ""
+			}
+			if err := bot.sendMessage(ding.Message.Chat.ID, reply, parseMode); err != nil {
 				bot.logger.Warning("ProcessMessages", ding.Message.Chat.UserName, err, "failed to send message reply")
 			}
 			misc.TelegramBotStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
@@ -255,6 +289,12 @@ func (bot *Daemon) Stop() {
 	}
 }
 
+// Shutdown stops the message handling loop. Replies that are being sent in the background are not waited for.
+func (bot *Daemon) Shutdown(_ context.Context) error {
+	bot.Stop()
+	return nil
+}
+
 // Run unit tests on telegram bot. See TestSMTPD_StartAndBlock for bot setup.
 func TestTelegramBot(bot *Daemon, t testingstub.T) {
 	// Well then it is really difficult to test the chat routine
@@ -10,6 +10,7 @@ import (
 	"net/smtp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,6 +27,8 @@ const (
 		after this limit is reached will cause earlier mails to be dropped permanently.
 	*/
 	MaxOutstandingMailSize = 200 * 1048576
+	// MaxDeliveryAttempts is the number of attempts made to deliver a mail before giving up.
+	MaxDeliveryAttempts = 12
 )
 
 /*
@@ -108,6 +111,37 @@ func sendMail(smtpClient *smtp.Client, serverTLSName string, auth smtp.Auth, fro
 	return smtpClient.Quit()
 }
 
+var (
+	// pendingMails is the number of mails being delivered in background.
+	pendingMails int64
+	// flushMails is closed by FlushPendingMails to tell background deliveries to retry right away.
+	flushMails     = make(chan struct{})
+	flushMailsOnce = new(sync.Once)
+)
+
+/*
+FlushPendingMails tells the mails that are waiting for a delivery retry to make the next attempt right away, and then
+waits for all background deliveries to complete until the context is done. Program should call this function only
+before it exits, because each of the mails that arrive afterwards will be attempted several times in a row without
+delay.
+*/
+func FlushPendingMails(ctx context.Context) error {
+	flushMailsOnce.Do(func() {
+		close(flushMails)
+	})
+	for {
+		numPending := atomic.LoadInt64(&pendingMails)
+		if numPending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("inet.FlushPendingMails: %d mails are still undelivered - %v", numPending, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 // CommonMailLogger is shared by all mail clients to log mail delivery progress.
 var CommonMailLogger = lalog.Logger{
 	ComponentName: "mailclient",
@@ -121,6 +155,17 @@ type MailClient struct {
 	MTAPort      int    `json:"MTAPort"`      // Port number of SMTP service on mail transportation agent
 	AuthUsername string `json:"AuthUsername"` // (Optional) Username for plain authentication, if the SMTP server requires it.
 	AuthPassword string `json:"AuthPassword"` // (Optional) Password for plain authentication, if the SMTP server requires it.
+	// SpoolDirectory (optional) keeps outgoing mails on disk until they are delivered, so that they survive program restarts.
+	SpoolDirectory string `json:"SpoolDirectory"`
+
+	// DKIMDomain (optional) is the signing domain of DKIM signatures placed on outgoing mails.
+	DKIMDomain string `json:"DKIMDomain"`
+	// DKIMSelector is the selector of DKIM public key, which is published as DNS TXT record "selector._domainkey.domain".
+	DKIMSelector string `json:"DKIMSelector"`
+	// DKIMPrivateKey is the PEM-encoded RSA or ed25519 private key for DKIM signatures.
+	DKIMPrivateKey string `json:"DKIMPrivateKey"`
+	// DKIMPrivateKeyPath is the path to the PEM-encoded private key file as an alternative to DKIMPrivateKey, the file may be encrypted.
+	DKIMPrivateKeyPath string `json:"DKIMPrivateKeyPath"`
 }
 
 // Return true only if all mail parameters are present.
@@ -128,14 +173,90 @@ func (client *MailClient) IsConfigured() bool {
 	return client.MailFrom != "" && client.MTAHost != "" && client.MTAPort != 0
 }
 
+var (
+	// dkimSigners are the DKIM signers made of mail client configuration, the keys are the concatenated DKIM configuration.
+	dkimSigners      = make(map[string]*DKIMSigner)
+	dkimSignersMutex = new(sync.Mutex)
+)
+
+// getDKIMSigner returns the DKIM signer made of the client's configuration, or nil if DKIM signing is not configured.
+func (client *MailClient) getDKIMSigner() (*DKIMSigner, error) {
+	if client.DKIMDomain == "" {
+		return nil, nil
+	}
+	if client.DKIMSelector == "" || (client.DKIMPrivateKey == "") == (client.DKIMPrivateKeyPath == "") {
+		return nil, errors.New("inet.getDKIMSigner: DKIM signing requires a selector and either a private key or a private key file")
+	}
+	cacheKey := strings.Join([]string{client.DKIMDomain, client.DKIMSelector, client.DKIMPrivateKey, client.DKIMPrivateKeyPath}, "\n")
+	dkimSignersMutex.Lock()
+	defer dkimSignersMutex.Unlock()
+	if signer, exists := dkimSigners[cacheKey]; exists {
+		return signer, nil
+	}
+	pemKey := []byte(client.DKIMPrivateKey)
+	if client.DKIMPrivateKeyPath != "" {
+		contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, client.DKIMPrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("inet.getDKIMSigner: failed to read private key file - %v", err)
+		}
+		pemKey = contents[0]
+	}
+	key, err := ParseDKIMPrivateKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	signer := &DKIMSigner{Domain: client.DKIMDomain, Selector: client.DKIMSelector, Key: key}
+	dkimSigners[cacheKey] = signer
+	return signer, nil
+}
+
+// signMessage returns the mail message with a DKIM signature if signing is configured. Should signing fail, the unsigned message is returned.
+func (client *MailClient) signMessage(message []byte) []byte {
+	signer, err := client.getDKIMSigner()
+	if err == nil && signer != nil {
+		var signed []byte
+		if signed, err = signer.Sign(message); err == nil {
+			return signed
+		}
+	}
+	if err != nil {
+		CommonMailLogger.Warning("signMessage", client.DKIMDomain, err, "sending the mail without a DKIM signature")
+	}
+	return message
+}
+
 /*
-sendMailWithRetry collects addresses of the MTA host via DNS lookup, and tries to deliver the input mail using a
-randomly selected MTA IP for up to 12 times within couple of days. The function blocks caller until it has exhausted
-all delivery attempts.
+deliverOnce collects addresses of the MTA host via DNS lookup, and makes a single attempt to deliver the input mail
+using one of the MTA IPs, which is selected by the attempt number.
 */
-func (client *MailClient) sendMailWithRetry(from string, recipients []string, message []byte) {
+func (client *MailClient) deliverOnce(attempt int, from string, recipients []string, message []byte) (tlsErr, err error) {
 	var auth smtp.Auth
+	// Find the latest set of IP addresses belonging to the MTA
+	timeout, cancel := context.WithTimeout(context.Background(), MailIOTimeoutSec*time.Second)
+	defer cancel()
+	mtaIPs, err := net.DefaultResolver.LookupIPAddr(timeout, client.MTAHost)
+	if err != nil {
+		return
+	}
+	// Try connecting to one of the MTA's IP addresses to deliver the mail
+	mtaIP := mtaIPs[attempt%len(mtaIPs)].IP.String()
+	if client.AuthUsername != "" {
+		auth = smtp.PlainAuth("", client.AuthUsername, client.AuthPassword, mtaIP)
+	}
+	smtpClient, tlsErr, err := dialMTA(mtaIP, client.MTAHost, client.MTAPort)
+	if err != nil {
+		return
+	}
+	defer smtpClient.Close()
+	err = sendMail(smtpClient, client.MTAHost, auth, from, recipients, message)
+	return
+}
 
+/*
+sendMailWithRetry tries to deliver the input mail for up to 12 times within couple of days. The function blocks caller
+until it has exhausted all delivery attempts.
+*/
+func (client *MailClient) sendMailWithRetry(from string, recipients []string, message []byte) {
 	// Count the size of this Email
 	atomic.AddInt64(&misc.OutstandingMailBytes, int64(len(message)))
 	defer func() {
@@ -145,50 +266,49 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 	CommonMailLogger.Info("sendMailWithRetry", from, nil, "attempting to deliver mail to %v", recipients)
 	// Retry mail delivery up to couple of days, introduce a random initial delay to avoid triggering MTA's rate limit.
 	sleep := time.Duration(30+rand.Intn(30)) * time.Second
-	for i := 0; i < 12; i++ {
-		var smtpClient *smtp.Client
-		var mtaIP string
-		var tlsErr error
-
-		// Find the latest set of IP addresses belonging to the MTA
-		timeout, cancel := context.WithTimeout(context.Background(), MailIOTimeoutSec*time.Second)
-		mtaIPs, err := net.DefaultResolver.LookupIPAddr(timeout, client.MTAHost)
-		if err != nil {
-			goto sleepAndRetry
-		}
-		// Try connecting to one of the MTA's IP addresses to deliver the mail
-		mtaIP = mtaIPs[i%len(mtaIPs)].IP.String()
-		if client.AuthUsername != "" {
-			auth = smtp.PlainAuth("", client.AuthUsername, client.AuthPassword, mtaIP)
-		}
-		smtpClient, tlsErr, err = dialMTA(mtaIP, client.MTAHost, client.MTAPort)
-		if err != nil {
-			goto sleepAndRetry
-		}
-		if err = sendMail(smtpClient, client.MTAHost, auth, from, recipients, message); err != nil {
-			smtpClient.Close()
-			goto sleepAndRetry
+	for i := 0; i < MaxDeliveryAttempts; i++ {
+		tlsErr, err := client.deliverOnce(i, from, recipients, message)
+		if err == nil {
+			CommonMailLogger.Info("sendMailWithRetry", from, nil, "successfully delivered mail to %v", recipients)
+			return
 		}
-		// Success!
-		cancel()
-		CommonMailLogger.Info("sendMailWithRetry", from, nil, "successfully delivered mail to %v", recipients)
-		smtpClient.Close()
-		return
-	sleepAndRetry:
-		cancel()
 		CommonMailLogger.Warning("sendMailWithRetry", from, err, "failed to deliver mail to %v in the attempt %d (tls error? %v)", recipients, i, tlsErr)
 		// At least one attempt of mail delivery must have been made in order to consider dropping the mail
 		if atomic.LoadInt64(&misc.OutstandingMailBytes) > MaxOutstandingMailSize {
 			CommonMailLogger.Warning("sendMailWithRetry", from, nil, "max outstanding mail size is reached, permanently dropping mail of size %d", len(message))
 			return
 		}
-		// Exponentially prolong sleep interval
-		time.Sleep(sleep)
+		// Exponentially prolong sleep interval, unless the pending mails are being flushed.
+		select {
+		case <-time.After(sleep):
+		case <-flushMails:
+		}
 		sleep = sleep * 2
 	}
 	CommonMailLogger.Warning("sendMailWithRetry", from, nil, "all attempts ultimately failed to deliver mail to %v", recipients)
 }
 
+/*
+deliverInBackground signs the mail if DKIM signing is configured, then hands the mail over to the spool if the spool
+directory is configured, or otherwise delivers the mail in a background goroutine.
+*/
+func (client *MailClient) deliverInBackground(from string, recipients []string, message []byte) error {
+	message = client.signMessage(message)
+	if client.SpoolDirectory != "" {
+		spool, err := GetMailSpool(*client)
+		if err != nil {
+			return err
+		}
+		return spool.Enqueue(from, recipients, message)
+	}
+	atomic.AddInt64(&pendingMails, 1)
+	go func() {
+		defer atomic.AddInt64(&pendingMails, -1)
+		client.sendMailWithRetry(from, recipients, message)
+	}()
+	return nil
+}
+
 // Deliver mail to all recipients. Block until mail is sent or an error has occurred.
 func (client *MailClient) Send(subject string, textBody string, recipients ...string) error {
 	if len(recipients) == 0 {
@@ -197,17 +317,32 @@ func (client *MailClient) Send(subject string, textBody string, recipients ...st
 	// Construct appropriate mail headers
 	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
 		client.MailFrom, strings.Join(recipients, ", "), subject, textBody)
-	go client.sendMailWithRetry(client.MailFrom, recipients, []byte(mailBody))
-	return nil
+	return client.deliverInBackground(client.MailFrom, recipients, []byte(mailBody))
 }
 
-// Deliver unmodified mail body to all recipients. Block until mail is sent or an error has occurred.
+/*
+Deliver mail body to all recipients without modification other than the DKIM signature, using the from address as
+envelope sender, or MailFrom if the from address is empty. Block until mail is sent or an error has occurred.
+*/
 func (client *MailClient) SendRaw(fromAddr string, rawMailBody []byte, recipients ...string) error {
 	if len(recipients) == 0 {
 		return fmt.Errorf("no recipient specified for mail from \"%s\"", fromAddr)
 	}
-	go client.sendMailWithRetry(client.MailFrom, recipients, rawMailBody)
-	return nil
+	if fromAddr == "" {
+		fromAddr = client.MailFrom
+	}
+	return client.deliverInBackground(fromAddr, recipients, rawMailBody)
+}
+
+/*
+SendBounce delivers the bounce message to the recipients using the null sender "<>" as envelope sender, hence the
+message itself will never bounce (RFC 5321 section 4.5.5). Block until mail is sent or an error has occurred.
+*/
+func (client *MailClient) SendBounce(rawMailBody []byte, recipients ...string) error {
+	if len(recipients) == 0 {
+		return errors.New("no recipient specified for bounce message")
+	}
+	return client.deliverInBackground("", recipients, rawMailBody)
 }
 
 // Try to contact MTA and see if connection is possible.
@@ -217,5 +352,8 @@ func (client *MailClient) SelfTest() error {
 		return fmt.Errorf("MailClient.SelfTest: connection test failed - %v (TLS error? %v)", err, tlsErr)
 	}
 	smtpClient.Close()
+	if _, err := client.getDKIMSigner(); err != nil {
+		return fmt.Errorf("MailClient.SelfTest: DKIM signing configuration is not usable - %v", err)
+	}
 	return nil
 }
@@ -1,8 +1,19 @@
 package inet
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMailer_Send(t *testing.T) {
@@ -35,3 +46,127 @@ func TestMailer_Send(t *testing.T) {
 		}
 	}
 }
+
+func TestFlushPendingMails(t *testing.T) {
+	// Nobody listens on the MTA port, hence the delivery will fail and wait for a retry.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtaPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	m := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: mtaPort}
+	if err := m.Send("laitos flush test subject", "test body", "howard@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if pending := atomic.LoadInt64(&pendingMails); pending != 1 {
+		t.Fatal(pending)
+	}
+	// The remaining delivery attempts are made right away
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := FlushPendingMails(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Give up waiting on the mails that cannot be delivered in time
+	atomic.AddInt64(&pendingMails, 1)
+	defer atomic.AddInt64(&pendingMails, -1)
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := FlushPendingMails(ctx); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestMailClient_DKIM(t *testing.T) {
+	port, received, stop := startSMTPStub(t, 0)
+	defer stop()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile, err := ioutil.TempFile("", "laitos-TestMailClient_DKIM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	if _, err := keyFile.Write(pemKey); err != nil {
+		t.Fatal(err)
+	}
+	_ = keyFile.Close()
+
+	// Incomplete DKIM configuration does not stop mails from being delivered
+	client := MailClient{MailFrom: "howard@example.com", MTAHost: "127.0.0.1", MTAPort: port, DKIMDomain: "example.com"}
+	if err := client.SelfTest(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.Send("laitos dkim test subject", "unsigned body", "a@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if strings.Contains(msg, "DKIM-Signature") || !strings.Contains(msg, "unsigned body") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not deliver mail")
+	}
+	// Sign with the key from configuration and from file
+	for _, keyConfig := range []MailClient{{DKIMPrivateKey: string(pemKey)}, {DKIMPrivateKeyPath: keyFile.Name()}} {
+		client.DKIMSelector = "sel"
+		client.DKIMPrivateKey = keyConfig.DKIMPrivateKey
+		client.DKIMPrivateKeyPath = keyConfig.DKIMPrivateKeyPath
+		if err := client.SelfTest(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SendRaw("", []byte("From: howard@example.com\r\nSubject: hi\r\n\r\nsigned body"), "a@localhost"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-received:
+			if !strings.HasPrefix(msg, "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=sel;") || !strings.Contains(msg, "signed body") {
+				t.Fatal(msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("did not deliver mail")
+		}
+	}
+	// Let the deliveries finish before other test cases count outstanding mail size
+	waitFor(t, func() bool { return atomic.LoadInt64(&pendingMails) == 0 })
+}
+
+func TestMailClient_SendBounce(t *testing.T) {
+	port, _, stop := startSMTPStub(t, 550)
+	defer stop()
+	spoolDir, err := ioutil.TempDir("", "laitos-TestMailClient_SendBounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	client := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: port, SpoolDirectory: spoolDir}
+	if err := client.SendBounce([]byte("Subject: bounce\r\n\r\nbounce body")); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.SendBounce([]byte("Subject: bounce\r\n\r\nbounce body"), "a@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	// The rejected bounce message becomes a dead letter of the null sender, and it does not bounce again.
+	waitFor(t, func() bool {
+		queued, dead := countSpoolFiles(t, spoolDir)
+		return queued == 0 && dead == 1
+	})
+	spool, err := GetMailSpool(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := spool.readDir(filepath.Join(spoolDir, DeadLetterDirName))
+	if err != nil || len(dead) != 1 || dead[0].From != "" {
+		t.Fatal(dead, err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if queued, dead := countSpoolFiles(t, spoolDir); queued != 0 || dead != 1 {
+		t.Fatal(queued, dead)
+	}
+}
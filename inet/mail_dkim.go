@@ -0,0 +1,179 @@
+package inet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DKIMSignedHeaders are the names of header fields that are signed when they are present in a mail.
+var DKIMSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// ParseDKIMPrivateKey decodes a PEM-encoded RSA private key (PKCS#1 or PKCS#8) or ed25519 private key (PKCS#8) for signing mails.
+func ParseDKIMPrivateKey(pemKey []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("inet.ParseDKIMPrivateKey: the key is not PEM-encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("inet.ParseDKIMPrivateKey: %v", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("inet.ParseDKIMPrivateKey: unsupported key type %T", key)
+	}
+}
+
+// dkimHeaderField is a mail header field in its original form, including folded lines and line terminators.
+type dkimHeaderField struct {
+	name string
+	raw  string
+}
+
+// splitDKIMHeader returns the header fields of a mail message that uses CRLF line terminators, and the body that follows the empty line.
+func splitDKIMHeader(message []byte) (fields []dkimHeaderField, body []byte) {
+	for pos := 0; pos < len(message); {
+		end := bytes.IndexByte(message[pos:], '\n')
+		if end == -1 {
+			end = len(message)
+		} else {
+			end += pos + 1
+		}
+		line := string(message[pos:end])
+		if line == "\r\n" {
+			return fields, message[end:]
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+		} else {
+			name := line
+			if colon := strings.IndexByte(line, ':'); colon != -1 {
+				name = line[:colon]
+			}
+			fields = append(fields, dkimHeaderField{name: strings.TrimSpace(name), raw: line})
+		}
+		pos = end
+	}
+	return fields, nil
+}
+
+// relaxedDKIMHeader returns the header field canonicalised by the relaxed algorithm (RFC 6376 section 3.4.2).
+func relaxedDKIMHeader(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	if colon == -1 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":\r\n"
+	}
+	unfolded := strings.NewReplacer("\r", "", "\n", "").Replace(raw[colon+1:])
+	return strings.ToLower(strings.TrimSpace(raw[:colon])) + ":" + strings.Join(strings.Fields(unfolded), " ") + "\r\n"
+}
+
+// relaxedDKIMBody returns the body canonicalised by the relaxed algorithm (RFC 6376 section 3.4.4).
+func relaxedDKIMBody(body []byte) []byte {
+	crlf := []byte("\r\n")
+	lines := bytes.Split(body, crlf)
+	for i, line := range lines {
+		lines[i] = bytes.Join(bytes.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' }), []byte(" "))
+		// A line that begins with a whitespace keeps a single space in place of the leading whitespaces
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines[i]) > 0 {
+			lines[i] = append([]byte(" "), lines[i]...)
+		}
+	}
+	body = bytes.Join(lines, crlf)
+	for bytes.HasSuffix(body, crlf) {
+		body = body[:len(body)-2]
+	}
+	if len(body) == 0 {
+		return []byte{}
+	}
+	return append(body, crlf...)
+}
+
+// DKIMSigner places DKIM signatures on outgoing mails using relaxed canonicalisation for both header and body.
+type DKIMSigner struct {
+	Domain   string        // Domain is the signing domain (d= tag).
+	Selector string        // Selector is the selector of the key (s= tag), the public key is published under "selector._domainkey.domain".
+	Key      crypto.Signer // Key is either *rsa.PrivateKey or ed25519.PrivateKey.
+}
+
+// Sign returns the mail message with line terminators turned into CRLF and a DKIM-Signature header placed on top.
+func (signer *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	var algorithm string
+	switch signer.Key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algorithm = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("inet.DKIMSigner.Sign: unsupported key type %T", signer.Key)
+	}
+	message = bytes.Replace(bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+	fields, body := splitDKIMHeader(message)
+	var signedHeaders []string
+	for _, name := range DKIMSignedHeaders {
+		for _, field := range fields {
+			if strings.EqualFold(field.name, name) {
+				signedHeaders = append(signedHeaders, name)
+			}
+		}
+	}
+	if len(signedHeaders) == 0 || signedHeaders[0] != "From" {
+		return nil, errors.New("inet.DKIMSigner.Sign: the mail does not have a From header")
+	}
+	bh := sha256.Sum256(relaxedDKIMBody(body))
+	sigField := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, signer.Domain, signer.Selector, time.Now().Unix(),
+		strings.Join(signedHeaders, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	// The header fields of the same name are signed from the bottom up, followed by the signature field itself.
+	hash := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range signedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				_, _ = hash.Write([]byte(relaxedDKIMHeader(fields[i].raw)))
+				break
+			}
+		}
+	}
+	_, _ = hash.Write([]byte(strings.TrimSuffix(relaxedDKIMHeader(sigField), "\r\n")))
+	digest := hash.Sum(nil)
+	var sig []byte
+	var err error
+	if edKey, isEd25519 := signer.Key.(ed25519.PrivateKey); isEd25519 {
+		sig = ed25519.Sign(edKey, digest)
+	} else if sig, err = signer.Key.Sign(rand.Reader, digest, crypto.SHA256); err != nil {
+		return nil, fmt.Errorf("inet.DKIMSigner.Sign: %v", err)
+	}
+	// Fold the signature value into lines of reasonable length
+	var out bytes.Buffer
+	out.WriteString(sigField)
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	for len(encoded) > 64 {
+		out.WriteString(encoded[:64] + "\r\n\t ")
+		encoded = encoded[64:]
+	}
+	out.WriteString(encoded + "\r\n")
+	out.Write(message)
+	return out.Bytes(), nil
+}
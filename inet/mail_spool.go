@@ -0,0 +1,406 @@
+package inet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DeadLetterDirName is the sub-directory of spool that keeps the mails that ultimately failed to be delivered.
+	DeadLetterDirName = "dead"
+	// spooledMailSuffix is the file name suffix of each spooled mail.
+	spooledMailSuffix = ".json"
+	// MaxBounceQuoteSize is the maximum size of the undelivered mail quoted in a bounce message.
+	MaxBounceQuoteSize = 4096
+)
+
+var (
+	// ErrMailSpoolFull is returned by Enqueue when the outstanding mails have reached MaxOutstandingMailSize.
+	ErrMailSpoolFull = errors.New("mail spool is full")
+	// ErrBadMailSpoolCommand reminds user of the proper syntax to manage the mail spool.
+	ErrBadMailSpoolCommand = errors.New(`list | retry [ID] | purge ID|dead|all`)
+
+	// spoolRetryInterval is the interval between the first and second delivery attempts, the interval doubles after each attempt.
+	spoolRetryInterval = 30 * time.Second
+
+	// mailSpools are the opened spools keyed by their directory.
+	mailSpools      = make(map[string]*MailSpool)
+	mailSpoolsMutex = new(sync.Mutex)
+)
+
+// SpooledMail is a mail waiting in the spool to be delivered, along with its delivery progress.
+type SpooledMail struct {
+	ID          string    `json:"ID"`          // ID is unique among spooled mails, it is also the file name.
+	From        string    `json:"From"`        // From is the envelope sender address.
+	Recipients  []string  `json:"Recipients"`  // Recipients are the envelope recipient addresses.
+	Message     []byte    `json:"Message"`     // Message is the mail content made of headers and body.
+	Attempts    int       `json:"Attempts"`    // Attempts is the number of delivery attempts made so far.
+	NextAttempt time.Time `json:"NextAttempt"` // NextAttempt is the earliest time to make the next delivery attempt.
+	LastError   string    `json:"LastError"`   // LastError is the error of the latest delivery attempt.
+	IsBounce    bool      `json:"IsBounce"`    // IsBounce is true if the mail reports an earlier mail that could not be delivered.
+}
+
+/*
+MailSpool keeps outgoing mails in a directory, one file per mail, until they are delivered. A mail that cannot be
+delivered after MaxDeliveryAttempts, or is rejected permanently by the MTA, becomes a dead letter and the mail sender
+receives a bounce message. The spool runner resumes delivery of the spooled mails after program restarts.
+*/
+type MailSpool struct {
+	Directory string // Directory keeps a file for each spooled mail, and a sub-directory of dead letters.
+
+	client MailClient    // client delivers the spooled mails, it comes from the latest call to GetMailSpool.
+	wake   chan struct{} // wake tells the spool runner to look for mails to deliver right away.
+	mutex  *sync.Mutex   // mutex protects the client and spool files from concurrent modification.
+	logger lalog.Logger
+}
+
+/*
+GetMailSpool returns the spool of the mail client's spool directory. The first call for a directory creates the
+directory, counts the size of mails already in there, and starts the spool runner to deliver them. Each call hands the
+mail client over to the spool, which uses the latest client to deliver all the spooled mails, including those enqueued
+earlier.
+*/
+func GetMailSpool(client MailClient) (*MailSpool, error) {
+	if client.SpoolDirectory == "" {
+		return nil, errors.New("GetMailSpool: SpoolDirectory must not be empty")
+	}
+	mailSpoolsMutex.Lock()
+	defer mailSpoolsMutex.Unlock()
+	if spool, exists := mailSpools[client.SpoolDirectory]; exists {
+		spool.mutex.Lock()
+		spool.client = client
+		spool.mutex.Unlock()
+		return spool, nil
+	}
+	spool := &MailSpool{
+		Directory: client.SpoolDirectory,
+		client:    client,
+		wake:      make(chan struct{}, 1),
+		mutex:     new(sync.Mutex),
+		logger:    lalog.Logger{ComponentName: "mailspool", ComponentID: []lalog.LoggerIDField{{Key: "Dir", Value: client.SpoolDirectory}}},
+	}
+	if err := os.MkdirAll(filepath.Join(spool.Directory, DeadLetterDirName), 0700); err != nil {
+		return nil, fmt.Errorf("GetMailSpool: failed to create spool directory - %v", err)
+	}
+	queued, err := spool.readDir(spool.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("GetMailSpool: %v", err)
+	}
+	for _, mail := range queued {
+		atomic.AddInt64(&misc.OutstandingMailBytes, int64(len(mail.Message)))
+	}
+	if len(queued) > 0 {
+		spool.logger.Info("GetMailSpool", "", nil, "resuming delivery of %d mails", len(queued))
+	}
+	mailSpools[client.SpoolDirectory] = spool
+	go spool.run()
+	return spool, nil
+}
+
+// readDir reads all spooled mails from the directory, sorted by ID.
+func (spool *MailSpool) readDir(dir string) (mails []*SpooledMail, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory - %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spooledMailSuffix) {
+			continue
+		}
+		mail, err := readSpooledMail(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			spool.logger.Warning("readDir", entry.Name(), err, "ignore malformed spool file")
+			continue
+		}
+		mails = append(mails, mail)
+	}
+	sort.Slice(mails, func(i, j int) bool {
+		return mails[i].ID < mails[j].ID
+	})
+	return
+}
+
+// readSpooledMail reads a spooled mail from its file.
+func readSpooledMail(filePath string) (*SpooledMail, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	mail := new(SpooledMail)
+	if err := json.Unmarshal(content, mail); err != nil {
+		return nil, err
+	}
+	return mail, nil
+}
+
+// writeFile writes the mail into the directory. A temporary file is written first so that a crash does not leave the mail half-written.
+func (mail *SpooledMail) writeFile(dir string) error {
+	content, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	filePath := filepath.Join(dir, mail.ID+spooledMailSuffix)
+	if err := ioutil.WriteFile(filePath+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// queuedPath returns the file path of the mail waiting to be delivered.
+func (spool *MailSpool) queuedPath(id string) string {
+	return filepath.Join(spool.Directory, id+spooledMailSuffix)
+}
+
+// deadPath returns the file path of the dead letter.
+func (spool *MailSpool) deadPath(id string) string {
+	return filepath.Join(spool.Directory, DeadLetterDirName, id+spooledMailSuffix)
+}
+
+// wakeUp tells the spool runner to look for mails to deliver right away.
+func (spool *MailSpool) wakeUp() {
+	select {
+	case spool.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue saves the mail into the spool and returns, the spool runner will deliver the mail in background.
+func (spool *MailSpool) Enqueue(from string, recipients []string, message []byte) error {
+	return spool.enqueue(&SpooledMail{From: from, Recipients: recipients, Message: message})
+}
+
+func (spool *MailSpool) enqueue(mail *SpooledMail) error {
+	if atomic.LoadInt64(&misc.OutstandingMailBytes)+int64(len(mail.Message)) > MaxOutstandingMailSize {
+		return ErrMailSpoolFull
+	}
+	mail.ID = fmt.Sprintf("%d-%08x", time.Now().UnixNano(), rand.Uint32())
+	mail.NextAttempt = time.Now()
+	spool.mutex.Lock()
+	err := mail.writeFile(spool.Directory)
+	spool.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("MailSpool.Enqueue: failed to save mail - %v", err)
+	}
+	atomic.AddInt64(&misc.OutstandingMailBytes, int64(len(mail.Message)))
+	spool.logger.Info("Enqueue", mail.ID, nil, "spooled mail to %v", mail.Recipients)
+	spool.wakeUp()
+	return nil
+}
+
+// run is the spool runner that delivers the spooled mails when their next attempts are due. It never returns.
+func (spool *MailSpool) run() {
+	for {
+		nextDue := spool.deliverDue()
+		select {
+		case <-spool.wake:
+		case <-time.After(time.Until(nextDue)):
+		}
+	}
+}
+
+// deliverDue makes a delivery attempt for each of the mails that are due, and returns the time when the next attempt is due.
+func (spool *MailSpool) deliverDue() (nextDue time.Time) {
+	// Look for new mails at least once an hour
+	nextDue = time.Now().Add(time.Hour)
+	spool.mutex.Lock()
+	queued, err := spool.readDir(spool.Directory)
+	spool.mutex.Unlock()
+	if err != nil {
+		spool.logger.Warning("deliverDue", "", err, "")
+		return
+	}
+	for _, mail := range queued {
+		if time.Now().Before(mail.NextAttempt) {
+			if mail.NextAttempt.Before(nextDue) {
+				nextDue = mail.NextAttempt
+			}
+			continue
+		}
+		if next := spool.attempt(mail); !next.IsZero() && next.Before(nextDue) {
+			nextDue = next
+		}
+	}
+	return
+}
+
+/*
+attempt makes a delivery attempt for the mail, and then removes the mail from spool if it is delivered or cannot be
+delivered. It returns the time of next attempt if the mail remains in the spool.
+*/
+func (spool *MailSpool) attempt(mail *SpooledMail) time.Time {
+	spool.mutex.Lock()
+	client := spool.client
+	spool.mutex.Unlock()
+	tlsErr, err := client.deliverOnce(mail.Attempts, mail.From, mail.Recipients, mail.Message)
+	mail.Attempts++
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	// The mail may have been purged during the attempt
+	if _, statErr := os.Stat(spool.queuedPath(mail.ID)); statErr != nil {
+		return time.Time{}
+	}
+	if err == nil {
+		spool.logger.Info("attempt", mail.ID, nil, "successfully delivered mail to %v", mail.Recipients)
+		spool.remove(spool.queuedPath(mail.ID), mail)
+		return time.Time{}
+	}
+	spool.logger.Warning("attempt", mail.ID, err, "failed to deliver mail to %v in the attempt %d (tls error? %v)", mail.Recipients, mail.Attempts, tlsErr)
+	mail.LastError = err.Error()
+	// An MTA rejects a mail permanently using a reply code of 5xx
+	var protoErr *textproto.Error
+	if mail.Attempts >= MaxDeliveryAttempts || errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		spool.bury(mail, client)
+		return time.Time{}
+	}
+	// Exponentially prolong the interval between attempts, and randomise it to avoid triggering MTA's rate limit.
+	interval := spoolRetryInterval * time.Duration(1<<uint(mail.Attempts-1))
+	mail.NextAttempt = time.Now().Add(interval + time.Duration(rand.Int63n(int64(interval))))
+	if err := mail.writeFile(spool.Directory); err != nil {
+		spool.logger.Warning("attempt", mail.ID, err, "failed to save delivery progress")
+	}
+	return mail.NextAttempt
+}
+
+// remove deletes the spooled mail file and stops counting its size. The caller must hold the mutex.
+func (spool *MailSpool) remove(filePath string, mail *SpooledMail) {
+	if err := os.Remove(filePath); err != nil {
+		spool.logger.Warning("remove", mail.ID, err, "failed to remove spooled mail")
+		return
+	}
+	if filepath.Dir(filePath) == filepath.Clean(spool.Directory) {
+		atomic.AddInt64(&misc.OutstandingMailBytes, -int64(len(mail.Message)))
+	}
+}
+
+/*
+bury moves the mail that ultimately failed to be delivered into the dead letters, and queues a bounce message from the
+mail client for the mail sender. The caller must hold the mutex.
+*/
+func (spool *MailSpool) bury(mail *SpooledMail, client MailClient) {
+	spool.logger.Warning("bury", mail.ID, nil, "giving up on delivering mail to %v after %d attempts", mail.Recipients, mail.Attempts)
+	if err := mail.writeFile(filepath.Join(spool.Directory, DeadLetterDirName)); err != nil {
+		spool.logger.Warning("bury", mail.ID, err, "failed to save dead letter")
+		return
+	}
+	spool.remove(spool.queuedPath(mail.ID), mail)
+	// Never bounce a bounce, or the two may go back and forth forever.
+	if mail.IsBounce || mail.From == "" || client.MailFrom == "" {
+		return
+	}
+	quote := mail.Message
+	if len(quote) > MaxBounceQuoteSize {
+		quote = quote[:MaxBounceQuoteSize]
+	}
+	bounce := &SpooledMail{
+		From:       client.MailFrom,
+		Recipients: []string{mail.From},
+		IsBounce:   true,
+		Message: client.signMessage([]byte(fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s mail delivery failed\r\n\r\n"+
+			"The mail to %s could not be delivered after %d attempts. The last error was:\r\n%s\r\n\r\nThe undelivered mail is kept as %s, it begins with:\r\n\r\n%s",
+			client.MailFrom, mail.From, OutgoingMailSubjectKeyword, strings.Join(mail.Recipients, ", "), mail.Attempts, mail.LastError, mail.ID, quote))),
+	}
+	// Enqueue takes the mutex that is already held by caller
+	go func() {
+		if err := spool.enqueue(bounce); err != nil {
+			spool.logger.Warning("bury", mail.ID, err, "failed to queue bounce message")
+		}
+	}()
+}
+
+/*
+Manage lists, retries, or purges the spooled mails according to the parameters:
+  - "list" (or empty) lists the mails waiting to be delivered and the dead letters.
+  - "retry" makes the next delivery attempt right away for all mails waiting to be delivered. "retry ID" does the same
+    for a single mail, and if the mail is a dead letter, it returns to the spool with a fresh start.
+  - "purge ID" removes a mail, "purge dead" removes all dead letters, and "purge all" removes all mails.
+*/
+func (spool *MailSpool) Manage(params string) (string, error) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	words := strings.Fields(params)
+	if len(words) == 0 {
+		words = []string{"list"}
+	}
+	queued, err := spool.readDir(spool.Directory)
+	if err != nil {
+		return "", err
+	}
+	dead, err := spool.readDir(filepath.Join(spool.Directory, DeadLetterDirName))
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(words[0]) {
+	case "list":
+		var out bytes.Buffer
+		for _, mail := range queued {
+			out.WriteString(fmt.Sprintf("%s queued attempts=%d next=%s to=%s size=%d err=%s\n", mail.ID, mail.Attempts,
+				mail.NextAttempt.Format("2006-01-02 15:04:05"), strings.Join(mail.Recipients, ","), len(mail.Message), mail.LastError))
+		}
+		for _, mail := range dead {
+			out.WriteString(fmt.Sprintf("%s dead attempts=%d to=%s size=%d err=%s\n", mail.ID, mail.Attempts,
+				strings.Join(mail.Recipients, ","), len(mail.Message), mail.LastError))
+		}
+		return out.String(), nil
+	case "retry":
+		count := 0
+		for _, mail := range queued {
+			if len(words) == 1 || words[1] == mail.ID {
+				mail.NextAttempt = time.Now()
+				if err := mail.writeFile(spool.Directory); err != nil {
+					return "", err
+				}
+				count++
+			}
+		}
+		for _, mail := range dead {
+			if len(words) > 1 && words[1] == mail.ID {
+				mail.Attempts = 0
+				mail.NextAttempt = time.Now()
+				if err := mail.writeFile(spool.Directory); err != nil {
+					return "", err
+				}
+				if err := os.Remove(spool.deadPath(mail.ID)); err != nil {
+					return "", err
+				}
+				atomic.AddInt64(&misc.OutstandingMailBytes, int64(len(mail.Message)))
+				count++
+			}
+		}
+		spool.wakeUp()
+		return fmt.Sprintf("retrying %d mails", count), nil
+	case "purge":
+		if len(words) < 2 {
+			return "", ErrBadMailSpoolCommand
+		}
+		count := 0
+		for _, mail := range queued {
+			if words[1] == "all" || words[1] == mail.ID {
+				spool.remove(spool.queuedPath(mail.ID), mail)
+				count++
+			}
+		}
+		for _, mail := range dead {
+			if words[1] == "all" || words[1] == "dead" || words[1] == mail.ID {
+				spool.remove(spool.deadPath(mail.ID), mail)
+				count++
+			}
+		}
+		return fmt.Sprintf("purged %d mails", count), nil
+	}
+	return "", ErrBadMailSpoolCommand
+}
@@ -0,0 +1,290 @@
+package inet
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// startSMTPStub starts a minimal SMTP server that rejects senders with the reply code if it is not 0, or otherwise accepts and forwards the mail messages to the channel.
+func startSMTPStub(t *testing.T, rejectCode int) (port int, received chan string, stop func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+				reader := textproto.NewReader(bufio.NewReader(conn))
+				reply := func(format string, a ...interface{}) {
+					_, _ = conn.Write([]byte(fmt.Sprintf(format, a...) + "\r\n"))
+				}
+				reply("220 stub")
+				for {
+					line, err := reader.ReadLine()
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+					case "EHLO", "HELO":
+						reply("250 stub")
+					case "MAIL":
+						if rejectCode != 0 {
+							reply("%d rejected", rejectCode)
+						} else {
+							reply("250 ok")
+						}
+					case "RCPT":
+						reply("250 ok")
+					case "DATA":
+						reply("354 go ahead")
+						lines, err := reader.ReadDotLines()
+						if err != nil {
+							return
+						}
+						received <- strings.Join(lines, "\n")
+						reply("250 ok")
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("500 unknown command")
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port, received, func() { _ = listener.Close() }
+}
+
+// waitFor waits up to 10 seconds for the condition to become true.
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the condition")
+}
+
+// countSpoolFiles returns the number of mails waiting to be delivered and dead letters in the spool directory.
+func countSpoolFiles(t *testing.T, dir string) (queued, dead int) {
+	for _, subDir := range []string{"", DeadLetterDirName} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, subDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), spooledMailSuffix) {
+				if subDir == "" {
+					queued++
+				} else {
+					dead++
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestMailSpool_Deliver(t *testing.T) {
+	port, received, stop := startSMTPStub(t, 0)
+	defer stop()
+	spoolDir, err := ioutil.TempDir("", "laitos-TestMailSpool_Deliver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	// A mail left in spool by the previous run is delivered right away
+	leftOver := &SpooledMail{ID: "1-left", From: "howard@localhost", Recipients: []string{"a@localhost"}, Message: []byte("Subject: left over\r\n\r\nleft over body")}
+	if err := leftOver.writeFile(spoolDir); err != nil {
+		t.Fatal(err)
+	}
+	outstanding := atomic.LoadInt64(&misc.OutstandingMailBytes)
+	client := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: port, SpoolDirectory: spoolDir}
+	if _, err := GetMailSpool(client); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "left over body") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not deliver left over mail")
+	}
+	if err := client.Send("laitos spool test subject", "spool test body", "b@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "spool test body") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not deliver mail")
+	}
+	waitFor(t, func() bool {
+		queued, dead := countSpoolFiles(t, spoolDir)
+		return queued == 0 && dead == 0 && atomic.LoadInt64(&misc.OutstandingMailBytes) == outstanding
+	})
+}
+
+func TestMailSpool_Bounce(t *testing.T) {
+	port, _, stop := startSMTPStub(t, 550)
+	defer stop()
+	spoolDir, err := ioutil.TempDir("", "laitos-TestMailSpool_Bounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	client := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: port, SpoolDirectory: spoolDir}
+	if err := client.SendRaw("howard@localhost", []byte("Subject: rejected\r\n\r\nrejected body"), "a@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	// The permanently rejected mail and its bounce message both become dead letters, the bounce does not bounce again.
+	waitFor(t, func() bool {
+		queued, dead := countSpoolFiles(t, spoolDir)
+		return queued == 0 && dead == 2
+	})
+	spool, err := GetMailSpool(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := spool.Manage("")
+	if err != nil || strings.Count(list, " dead attempts=1 ") != 2 || !strings.Contains(list, "err=550") {
+		t.Fatal(list, err)
+	}
+	for _, params := range []string{"nothing", "purge"} {
+		if _, err := spool.Manage(params); err == nil {
+			t.Fatal("did not error", params)
+		}
+	}
+	// A dead letter returns to the spool upon retry, and it bounces again when rejected again.
+	deadID := strings.Fields(list)[0]
+	if out, err := spool.Manage("retry " + deadID); err != nil || out != "retrying 1 mails" {
+		t.Fatal(out, err)
+	}
+	waitFor(t, func() bool {
+		queued, dead := countSpoolFiles(t, spoolDir)
+		return queued == 0 && dead == 3
+	})
+	if out, err := spool.Manage("purge dead"); err != nil || out != "purged 3 mails" {
+		t.Fatal(out, err)
+	}
+	if list, err := spool.Manage("list"); err != nil || list != "" {
+		t.Fatal(list, err)
+	}
+}
+
+func TestMailSpool_Retry(t *testing.T) {
+	// Nobody listens on the MTA port, hence the delivery will fail and wait for a retry.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtaPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	spoolDir, err := ioutil.TempDir("", "laitos-TestMailSpool_Retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	outstanding := atomic.LoadInt64(&misc.OutstandingMailBytes)
+	client := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: mtaPort, SpoolDirectory: spoolDir}
+	if err := client.Send("laitos spool retry subject", "test body", "a@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := GetMailSpool(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		list, _ := spool.Manage("list")
+		return strings.Contains(list, " queued attempts=1 ")
+	})
+	if out, err := spool.Manage("retry"); err != nil || out != "retrying 1 mails" {
+		t.Fatal(out, err)
+	}
+	waitFor(t, func() bool {
+		list, _ := spool.Manage("list")
+		return strings.Contains(list, " queued attempts=2 ")
+	})
+	if atomic.LoadInt64(&misc.OutstandingMailBytes) <= outstanding {
+		t.Fatal("did not count outstanding mail size")
+	}
+	if out, err := spool.Manage("purge all"); err != nil || out != "purged 1 mails" {
+		t.Fatal(out, err)
+	}
+	if queued, dead := countSpoolFiles(t, spoolDir); queued != 0 || dead != 0 || atomic.LoadInt64(&misc.OutstandingMailBytes) != outstanding {
+		t.Fatal(queued, dead)
+	}
+}
+
+func TestMailSpool_LatestClient(t *testing.T) {
+	// The first client of the spool directory delivers to an MTA port that nobody listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	spoolDir, err := ioutil.TempDir("", "laitos-TestMailSpool_LatestClient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+	oldClient := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: deadPort, SpoolDirectory: spoolDir}
+	if err := oldClient.Send("laitos spool old client", "test body", "a@localhost"); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := GetMailSpool(oldClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		list, _ := spool.Manage("list")
+		return strings.Contains(list, " queued attempts=1 ")
+	})
+	// The spool delivers the mail enqueued earlier using the client that reopens the spool directory.
+	port, received, stop := startSMTPStub(t, 0)
+	defer stop()
+	newClient := MailClient{MailFrom: "howard@localhost", MTAHost: "127.0.0.1", MTAPort: port, SpoolDirectory: spoolDir}
+	if reopened, err := GetMailSpool(newClient); err != nil || reopened != spool {
+		t.Fatal(reopened, err)
+	}
+	if out, err := spool.Manage("retry"); err != nil || out != "retrying 1 mails" {
+		t.Fatal(out, err)
+	}
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "laitos spool old client") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not deliver the mail using the latest client")
+	}
+	waitFor(t, func() bool {
+		queued, dead := countSpoolFiles(t, spoolDir)
+		return queued == 0 && dead == 0
+	})
+}
@@ -4,10 +4,12 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"sync"
 
 	"github.com/HouzuoGuo/laitos/daemon/phonehome"
+	"github.com/HouzuoGuo/laitos/daemon/scheduler"
 	"github.com/HouzuoGuo/laitos/daemon/serialport"
 
 	"github.com/HouzuoGuo/laitos/daemon/autounlock"
@@ -51,6 +53,7 @@ type StandardFilters struct {
 	// For command execution result
 	NotifyViaEmail toolbox.NotifyViaEmail `json:"NotifyViaEmail"`
 	LintText       toolbox.LintText       `json:"LintText"`
+	ChannelProfile toolbox.ChannelProfile `json:"ChannelProfile"`
 }
 
 // Configure path to HTTP handlers and handler themselves.
@@ -66,8 +69,10 @@ type HTTPHandlers struct {
 	VirtualMachineEndpoint       string                       `json:"VirtualMachineEndpoint"`
 	VirtualMachineEndpointConfig handler.HandleVirtualMachine `json:"VirtualMachineEndpointConfig"`
 
-	CommandFormEndpoint string `json:"CommandFormEndpoint"`
-	FileUploadEndpoint  string `json:"FileUploadEndpoint"`
+	CommandFormEndpoint   string `json:"CommandFormEndpoint"`
+	DNSOverHTTPSEndpoint  string `json:"DNSOverHTTPSEndpoint"`
+	DNSQueryStatsEndpoint string `json:"DNSQueryStatsEndpoint"`
+	FileUploadEndpoint    string `json:"FileUploadEndpoint"`
 
 	GitlabBrowserEndpoint       string                      `json:"GitlabBrowserEndpoint"`
 	GitlabBrowserEndpointConfig handler.HandleGitlabBrowser `json:"GitlabBrowserEndpointConfig"`
@@ -93,6 +98,7 @@ type HTTPHandlers struct {
 	TheThingsNetworkEndpoint string `json:"TheThingsNetworkEndpoint"`
 
 	TwilioSMSEndpoint        string                       `json:"TwilioSMSEndpoint"`
+	TwilioSMSEndpointConfig  handler.HandleTwilioSMSHook  `json:"TwilioSMSEndpointConfig"`
 	TwilioCallEndpoint       string                       `json:"TwilioCallEndpoint"`
 	TwilioCallEndpointConfig handler.HandleTwilioCallHook `json:"TwilioCallEndpointConfig"`
 
@@ -148,6 +154,9 @@ type Config struct {
 
 	AutoUnlock *autounlock.Daemon `json:"AutoUnlock"` // AutoUnlock daemon
 
+	Scheduler        *scheduler.Daemon `json:"Scheduler"`        // Scheduler runs app commands on cron expressions
+	SchedulerFilters StandardFilters   `json:"SchedulerFilters"` // SchedulerFilters configure the command processor of scheduled commands
+
 	SupervisorNotificationRecipients []string `json:"SupervisorNotificationRecipients"` // Email addresses of supervisor notification recipients
 
 	logger                lalog.Logger // logger handles log output from configuration serialisation and initialisation routines.
@@ -164,10 +173,33 @@ type Config struct {
 	sockDaemonInit        *sync.Once
 	telegramBotInit       *sync.Once
 	autoUnlockInit        *sync.Once
+	schedulerInit         *sync.Once
+
+	// reloading is true when the configuration comes from a reload, daemon initialisation failures are then remembered in initErr rather than aborting the program.
+	reloading bool
+	initErr   error
 }
 
 // Initialise decorates feature configuration and command bridge configuration in preparation for daemon operations.
 func (config *Config) Initialise() error {
+	// A user written as null in JSON would not be able to authenticate anyone
+	for sectionName, filters := range map[string]*StandardFilters{
+		"DNSFilters":              &config.DNSFilters,
+		"HTTPFilters":             &config.HTTPFilters,
+		"MailFilters":             &config.MailFilters,
+		"MessageProcessorFilters": &config.MessageProcessorFilters,
+		"PhoneHomeFilters":        &config.PhoneHomeFilters,
+		"PlainSocketFilters":      &config.PlainSocketFilters,
+		"SchedulerFilters":        &config.SchedulerFilters,
+		"SerialPortFilters":       &config.SerialPortFilters,
+		"TelegramFilters":         &config.TelegramFilters,
+	} {
+		for userName, user := range filters.PINAndShortcuts.Users {
+			if user == nil {
+				return fmt.Errorf("Config.Initialise: user \"%s\" of %s must not be empty", userName, sectionName)
+			}
+		}
+	}
 	// An empty FeatureSet can still offer several useful features such as program environment control and public institution contacts.
 	if config.Features == nil {
 		config.Features = &toolbox.FeatureSet{}
@@ -177,16 +209,18 @@ func (config *Config) Initialise() error {
 		Even though MessageProcessor is an app, it has its own command processor just like a daemon.
 		The command processor is initialised from configuration input.
 	*/
-	if config.MessageProcessorFilters.PINAndShortcuts.PIN != "" {
+	if pinFilter := config.MessageProcessorFilters.PINAndShortcuts; pinFilter.PIN != "" || len(pinFilter.Users) > 0 {
 		messageProcessorCommandProcessor := &toolbox.CommandProcessor{
 			Features: config.Features,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.MessageProcessorFilters.PINAndShortcuts,
 				&config.MessageProcessorFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.MessageProcessorFilters.LintText,
 				&toolbox.SayEmptyOutput{},
+				&config.MessageProcessorFilters.ChannelProfile,
 				&config.MessageProcessorFilters.NotifyViaEmail,
 			},
 		}
@@ -253,6 +287,10 @@ func (config *Config) Initialise() error {
 	if config.AutoUnlock == nil {
 		config.AutoUnlock = &autounlock.Daemon{}
 	}
+	config.schedulerInit = new(sync.Once)
+	if config.Scheduler == nil {
+		config.Scheduler = &scheduler.Daemon{}
+	}
 	// All notification filters share the common mail client
 	config.MessageProcessorFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.DNSFilters.NotifyViaEmail.MailClient = config.MailClient
@@ -261,6 +299,7 @@ func (config *Config) Initialise() error {
 	config.PhoneHomeFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.PlainSocketFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.TelegramFilters.NotifyViaEmail.MailClient = config.MailClient
+	config.SchedulerFilters.NotifyViaEmail.MailClient = config.MailClient
 	// SendMail feature also shares the common mail client
 	config.Features.SendMail.MailClient = config.MailClient
 	if err := config.Features.Initialise(); err != nil {
@@ -285,6 +324,21 @@ func (config *Config) DeserialiseFromJSON(in []byte) error {
 	return nil
 }
 
+/*
+initFailed aborts the program upon failure of daemon initialisation. If the configuration comes from a reload, the
+program continues to run with the daemons of previous configuration, hence the failure is only remembered.
+*/
+func (config *Config) initFailed(funcName string, err error) {
+	if !config.reloading {
+		config.logger.Abort(funcName, "", err, "failed to initialise")
+		return
+	}
+	config.logger.Warning(funcName, "", err, "failed to initialise")
+	if config.initErr == nil {
+		config.initErr = fmt.Errorf("%s: %v", funcName, err)
+	}
+}
+
 // Construct a DNS daemon from configuration and return.
 func (config *Config) GetDNSD() *dnsd.Daemon {
 	config.dnsDaemonInit.Do(func() {
@@ -294,17 +348,21 @@ func (config *Config) GetDNSD() *dnsd.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.DNSFilters.PINAndShortcuts,
 				&config.DNSFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.DNSFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.DNSFilters.ChannelProfile,
 				&config.DNSFilters.NotifyViaEmail,
 			},
 		}
 		if err := config.DNSDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetDNSD", "", err, "failed to initialise")
+			config.initFailed("GetDNSD", err)
 			return
 		}
+		// Let app command inspect DNS queries
+		config.Features.EnvControl.GetDNSQueryStats = config.DNSDaemon.GetQueryStatsReport
 	})
 	return config.DNSDaemon
 }
@@ -317,15 +375,17 @@ func (config *Config) GetSerialPortDaemon() *serialport.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.SerialPortFilters.PINAndShortcuts,
 				&config.SerialPortFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.SerialPortFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.SerialPortFilters.ChannelProfile,
 				&config.SerialPortFilters.NotifyViaEmail,
 			},
 		}
 		if err := config.SerialPortDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetSerialPortDaemon", "", err, "failed to initialise")
+			config.initFailed("GetSerialPortDaemon", err)
 			return
 		}
 	})
@@ -336,7 +396,7 @@ func (config *Config) GetSerialPortDaemon() *serialport.Daemon {
 func (config *Config) GetSNMPD() *snmpd.Daemon {
 	config.snmpDaemonInit.Do(func() {
 		if err := config.SNMPDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetSNMP", "", err, "failed to initialise")
+			config.initFailed("GetSNMP", err)
 			return
 		}
 	})
@@ -347,7 +407,7 @@ func (config *Config) GetSNMPD() *snmpd.Daemon {
 func (config *Config) GetSimpleIPSvcD() *simpleipsvcd.Daemon {
 	config.simpleIPSvcDaemonInit.Do(func() {
 		if err := config.SimpleIPSvcDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetSimpleIPSvcD", "", err, "failed to initialise")
+			config.initFailed("GetSimpleIPSvcD", err)
 			return
 		}
 	})
@@ -362,7 +422,7 @@ func (config *Config) GetMaintenance() *maintenance.Daemon {
 		config.Maintenance.MailCmdRunnerToTest = config.GetMailCommandRunner()
 		config.Maintenance.HTTPHandlersToCheck = config.GetHTTPD().HandlerCollection
 		if err := config.Maintenance.Initialise(); err != nil {
-			config.logger.Abort("GetMaintenance", "", err, "failed to initialise")
+			config.initFailed("GetMaintenance", err)
 			return
 		}
 	})
@@ -379,10 +439,12 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.HTTPFilters.PINAndShortcuts,
 				&config.HTTPFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.HTTPFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.HTTPFilters.ChannelProfile,
 				&config.HTTPFilters.NotifyViaEmail,
 			},
 		}
@@ -404,7 +466,7 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			randBytes := make([]byte, 32)
 			_, err := rand.Read(randBytes)
 			if err != nil {
-				config.logger.Abort("GetHTTPD", "", err, "failed to read random number")
+				config.initFailed("GetHTTPD", fmt.Errorf("failed to read random number - %v", err))
 				return
 			}
 			// Image handler needs to operate on browser handler's browser instances
@@ -422,7 +484,7 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			randBytes := make([]byte, 32)
 			_, err := rand.Read(randBytes)
 			if err != nil {
-				config.logger.Abort("GetHTTPD", "", err, "failed to read random number")
+				config.initFailed("GetHTTPD", fmt.Errorf("failed to read random number - %v", err))
 				return
 			}
 			// Image handler needs to operate on browser handler's browser instances
@@ -441,7 +503,7 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			randBytes := make([]byte, 32)
 			_, err := rand.Read(randBytes)
 			if err != nil {
-				config.logger.Abort("GetHTTPD", "", err, "failed to read random number")
+				config.initFailed("GetHTTPD", fmt.Errorf("failed to read random number - %v", err))
 				return
 			}
 			// The screenshot endpoint
@@ -458,6 +520,13 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 		if config.HTTPHandlers.CommandFormEndpoint != "" {
 			handlers[config.HTTPHandlers.CommandFormEndpoint] = &handler.HandleCommandForm{}
 		}
+		if config.HTTPHandlers.DNSOverHTTPSEndpoint != "" {
+			// DNS-over-HTTPS shares the blacklist and query restriction of DNS daemon
+			handlers[config.HTTPHandlers.DNSOverHTTPSEndpoint] = &handler.HandleDNSOverHTTPS{DNSDaemon: config.GetDNSD()}
+		}
+		if config.HTTPHandlers.DNSQueryStatsEndpoint != "" {
+			handlers[config.HTTPHandlers.DNSQueryStatsEndpoint] = &handler.HandleDNSQueryStats{DNSDaemon: config.GetDNSD()}
+		}
 		if config.HTTPHandlers.FileUploadEndpoint != "" {
 			handlers[config.HTTPHandlers.FileUploadEndpoint] = &handler.HandleFileUpload{}
 		}
@@ -498,7 +567,8 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			handlers[ttnEndpoint] = &handler.HandleTheThingsNetworkHTTPIntegration{}
 		}
 		if config.HTTPHandlers.TwilioSMSEndpoint != "" {
-			handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &handler.HandleTwilioSMSHook{}
+			hand := config.HTTPHandlers.TwilioSMSEndpointConfig
+			handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &hand
 		}
 		if config.HTTPHandlers.TwilioCallEndpoint != "" {
 			/*
@@ -508,7 +578,7 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			randBytes := make([]byte, 32)
 			_, err := rand.Read(randBytes)
 			if err != nil {
-				config.logger.Abort("GetHTTPD", "", err, "failed to read random number")
+				config.initFailed("GetHTTPD", fmt.Errorf("failed to read random number - %v", err))
 				return
 			}
 			callbackEndpoint := urlPrefix + "/" + hex.EncodeToString(randBytes)
@@ -528,7 +598,7 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 		}
 		config.HTTPDaemon.HandlerCollection = handlers
 		if err := config.HTTPDaemon.Initialise(urlPrefix); err != nil {
-			config.logger.Abort("GetHTTPD", "", err, "failed to initialise")
+			config.initFailed("GetHTTPD", err)
 			return
 		}
 	})
@@ -549,10 +619,12 @@ func (config *Config) GetMailCommandRunner() *mailcmd.CommandRunner {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.MailFilters.PINAndShortcuts,
 				&config.MailFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.MailFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.MailFilters.ChannelProfile,
 				&config.MailFilters.NotifyViaEmail,
 			},
 		}
@@ -569,8 +641,12 @@ func (config *Config) GetMailDaemon() *smtpd.Daemon {
 	config.mailDaemonInit.Do(func() {
 		config.MailDaemon.CommandRunner = config.GetMailCommandRunner()
 		config.MailDaemon.ForwardMailClient = config.MailClient
+		// The spam filter checks the URLs in mail content against the blacklist of DNS daemon
+		if config.MailDaemon.SpamFilter != nil && config.MailDaemon.SpamFilter.URLBlacklistScore > 0 {
+			config.MailDaemon.DNSDaemon = config.GetDNSD()
+		}
 		if err := config.MailDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetMailDaemon", "", err, "failed to initialise")
+			config.initFailed("GetMailDaemon", err)
 			return
 		}
 	})
@@ -585,16 +661,18 @@ func (config *Config) GetPhoneHomeDaemon() *phonehome.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.PhoneHomeFilters.PINAndShortcuts,
 				&config.PhoneHomeFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.PhoneHomeFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.PhoneHomeFilters.ChannelProfile,
 				&config.PhoneHomeFilters.NotifyViaEmail,
 			},
 		}
 		// Call initialise so that daemon is ready to start
 		if err := config.PhoneHomeDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetPhoneHomeDaemon", "", err, "failed to initialise")
+			config.initFailed("GetPhoneHomeDaemon", err)
 			return
 		}
 	})
@@ -613,16 +691,18 @@ func (config *Config) GetPlainSocketDaemon() *plainsocket.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.PlainSocketFilters.PINAndShortcuts,
 				&config.PlainSocketFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.PlainSocketFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.PlainSocketFilters.ChannelProfile,
 				&config.PlainSocketFilters.NotifyViaEmail,
 			},
 		}
 		// Call initialise so that daemon is ready to start
 		if err := config.PlainSocketDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetPlainSocketDaemon", "", err, "failed to initialise")
+			config.initFailed("GetPlainSocketDaemon", err)
 			return
 		}
 	})
@@ -634,13 +714,29 @@ func (config *Config) GetSockDaemon() *sockd.Daemon {
 	config.sockDaemonInit.Do(func() {
 		config.SockDaemon.DNSDaemon = config.GetDNSD()
 		if err := config.SockDaemon.Initialise(); err != nil {
-			config.logger.Abort("GetSockDaemon", "", err, "failed to initialise")
+			config.initFailed("GetSockDaemon", err)
 			return
 		}
 	})
 	return config.SockDaemon
 }
 
+/*
+openMailSpool resumes delivery of the outgoing mails left in spool by the previous run, and lets the environment control
+app manage the spool. Only the process that runs daemons should open the spool.
+*/
+func (config *Config) openMailSpool() error {
+	if config.MailClient.SpoolDirectory == "" {
+		return nil
+	}
+	spool, err := inet.GetMailSpool(config.MailClient)
+	if err != nil {
+		return err
+	}
+	config.Features.EnvControl.ManageMailSpool = spool.Manage
+	return nil
+}
+
 // Construct a telegram bot from configuration and return.
 func (config *Config) GetTelegramBot() *telegrambot.Daemon {
 	config.telegramBotInit.Do(func() {
@@ -650,15 +746,17 @@ func (config *Config) GetTelegramBot() *telegrambot.Daemon {
 			CommandFilters: []toolbox.CommandFilter{
 				&config.TelegramFilters.PINAndShortcuts,
 				&config.TelegramFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.TelegramFilters.LintText,
 				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.TelegramFilters.ChannelProfile,
 				&config.TelegramFilters.NotifyViaEmail,
 			},
 		}
 		if err := config.TelegramBot.Initialise(); err != nil {
-			config.logger.Abort("GetTelegramBot", "", err, "failed to initialise")
+			config.initFailed("GetTelegramBot", err)
 			return
 		}
 	})
@@ -669,9 +767,40 @@ func (config *Config) GetTelegramBot() *telegrambot.Daemon {
 func (config *Config) GetAutoUnlock() *autounlock.Daemon {
 	config.autoUnlockInit.Do(func() {
 		if err := config.AutoUnlock.Initialise(); err != nil {
-			config.logger.Abort("GetAutoUnlock", "", err, "failed to initialise")
+			config.initFailed("GetAutoUnlock", err)
 			return
 		}
 	})
 	return config.AutoUnlock
 }
+
+// GetScheduler constructs the scheduler of app commands and returns.
+func (config *Config) GetScheduler() *scheduler.Daemon {
+	config.schedulerInit.Do(func() {
+		config.Scheduler.MailClient = config.MailClient
+		// Deliver results to telegram chats via the telegram bot, unless the scheduler has its own bot.
+		if config.Scheduler.TelegramAuthorizationToken == "" {
+			config.Scheduler.TelegramAuthorizationToken = config.TelegramBot.AuthorizationToken
+		}
+		config.Scheduler.Processor = &toolbox.CommandProcessor{
+			Features: config.Features,
+			CommandFilters: []toolbox.CommandFilter{
+				&config.SchedulerFilters.PINAndShortcuts,
+				&config.SchedulerFilters.TranslateSequences,
+				&toolbox.ExpandAliases{Aliases: &config.Features.CommandAliases}, // aliases are configured by Features.CommandAliases
+			},
+			ResultFilters: []toolbox.ResultFilter{
+				&config.SchedulerFilters.LintText,
+				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&config.SchedulerFilters.ChannelProfile,
+				&config.SchedulerFilters.NotifyViaEmail,
+			},
+		}
+		if err := config.Scheduler.Initialise(); err != nil {
+			config.initFailed("GetScheduler", err)
+			return
+		}
+		config.Features.EnvControl.ManageSchedules = config.Scheduler.Manage
+	})
+	return config.Scheduler
+}
@@ -1,6 +1,7 @@
 package launcher
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -101,6 +102,8 @@ var sampleConfigJSON = `
   },
   "HTTPHandlers": {
     "CommandFormEndpoint": "/cmd_form",
+    "DNSOverHTTPSEndpoint": "/dns-query",
+    "DNSQueryStatsEndpoint": "/dns-stats",
     "FileUploadEndpoint": "/upload",
     "GitlabBrowserEndpoint": "/gitlab",
     "GitlabBrowserEndpointConfig": {
@@ -421,3 +424,11 @@ func TestConfig(t *testing.T) {
 
 	autounlock.TestAutoUnlock(config.GetAutoUnlock(), t)
 }
+
+func TestConfig_EmptyUser(t *testing.T) {
+	var config Config
+	err := config.DeserialiseFromJSON([]byte(`{"DNSFilters": {"PINAndShortcuts": {"Users": {"alice": null}}}}`))
+	if err == nil || !strings.Contains(err.Error(), `user "alice" of DNSFilters`) {
+		t.Fatal(err)
+	}
+}
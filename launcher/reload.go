@@ -0,0 +1,453 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/httpd"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// DefaultShutdownTimeoutSec is the default amount of time given to a daemon replaced by configuration reload to shut down gracefully.
+const DefaultShutdownTimeoutSec = 30
+
+var (
+	// featuresConfigKeys are the configuration sections of app features that are shared by all command processors.
+	featuresConfigKeys = []string{"Features", "MessageProcessorFilters", "MailClient"}
+	// dnsdConfigKeys are the configuration sections that a DNS daemon is constructed from.
+	dnsdConfigKeys = append([]string{"DNSDaemon", "DNSFilters"}, featuresConfigKeys...)
+	// mailCommandRunnerConfigKeys are the configuration sections that a mail command runner is constructed from.
+	mailCommandRunnerConfigKeys = append([]string{"MailCommandRunner", "MailFilters"}, featuresConfigKeys...)
+	// httpdConfigKeys are the configuration sections that a web server is constructed from, its handlers use a DNS daemon and mail command runner.
+	httpdConfigKeys = append(append([]string{"HTTPDaemon", "HTTPFilters", "HTTPHandlers"}, dnsdConfigKeys...), mailCommandRunnerConfigKeys...)
+)
+
+/*
+DaemonConfigKeys are the top-level configuration sections that each daemon is constructed from, including the sections
+of features and other daemons that it uses. A change made to any of the sections requires the daemon to be
+re-initialised.
+*/
+var DaemonConfigKeys = map[string][]string{
+	AutoUnlockName:       {"AutoUnlock"},
+	DNSDName:             dnsdConfigKeys,
+	HTTPDName:            httpdConfigKeys,
+	InsecureHTTPDName:    httpdConfigKeys,
+	MaintenanceName:      append([]string{"Maintenance"}, httpdConfigKeys...),
+	PhoneHomeName:        append([]string{"PhoneHomeDaemon", "PhoneHomeFilters"}, featuresConfigKeys...),
+	PlainSocketName:      append([]string{"PlainSocketDaemon", "PlainSocketFilters"}, featuresConfigKeys...),
+	SchedulerName:        append([]string{"Scheduler", "SchedulerFilters", "TelegramBot"}, featuresConfigKeys...),
+	SerialPortDaemonName: append([]string{"SerialPortDaemon", "SerialPortFilters"}, featuresConfigKeys...),
+	SimpleIPSvcName:      {"SimpleIPSvcDaemon"},
+	SMTPDName:            append([]string{"MailDaemon"}, mailCommandRunnerConfigKeys...),
+	SNMPDName:            {"SNMPDaemon"},
+	SOCKDName:            append([]string{"SockDaemon"}, dnsdConfigKeys...),
+	TelegramName:         append([]string{"TelegramBot", "TelegramFilters"}, featuresConfigKeys...),
+}
+
+// ReadConfigFile reads the configuration file, and decrypts it using the program data decryption password if it is encrypted.
+func ReadConfigFile(filePath string) ([]byte, error) {
+	content, isEncrypted, err := misc.IsEncrypted(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if isEncrypted {
+		if misc.ProgramDataDecryptionPassword == "" {
+			return nil, errors.New("the configuration file is encrypted but decryption password is unknown")
+		}
+		return misc.Decrypt(filePath, misc.ProgramDataDecryptionPassword)
+	}
+	return content, nil
+}
+
+// getConfigSections returns the top-level sections of configuration JSON, keyed by lower case section name.
+func getConfigSections(configJSON []byte) (map[string]interface{}, error) {
+	var sections map[string]interface{}
+	if err := json.Unmarshal(configJSON, &sections); err != nil {
+		return nil, err
+	}
+	// JSON deserialisation matches section names case-insensitively
+	ret := make(map[string]interface{})
+	for key, value := range sections {
+		ret[strings.ToLower(key)] = value
+	}
+	return ret, nil
+}
+
+// configSectionsDiffer returns true only if any of the sections differ between the two configurations.
+func configSectionsDiffer(oldSections, newSections map[string]interface{}, keys []string) bool {
+	for _, key := range keys {
+		key = strings.ToLower(key)
+		if !reflect.DeepEqual(oldSections[key], newSections[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// runningDaemon is a daemon started by DaemonLauncher.
+type runningDaemon struct {
+	name    string
+	daemon  common.Daemon
+	stopped int32
+}
+
+// httpdWithTLS runs the web server with its TLS listener.
+type httpdWithTLS struct {
+	*httpd.Daemon
+}
+
+func (daemon httpdWithTLS) StartAndBlock() error {
+	return daemon.StartAndBlockWithTLS()
+}
+
+func (daemon httpdWithTLS) Stop() {
+	daemon.StopTLS()
+}
+
+// httpdNoTLS runs the web server with its TLS-free listener.
+type httpdNoTLS struct {
+	*httpd.Daemon
+}
+
+func (daemon httpdNoTLS) StartAndBlock() error {
+	/*
+		There is not an independent port settings for launching both TLS-enabled and TLS-free HTTP servers
+		at the same time. If user really wishes to launch both at the same time, the TLS-free HTTP server
+		will fallback to use port number 80.
+	*/
+	return daemon.StartAndBlockNoTLS(80)
+}
+
+func (daemon httpdNoTLS) Stop() {
+	daemon.StopNoTLS()
+}
+
+/*
+shutdownTarget returns the daemon that gracefully shuts down the daemon. The web server listeners with and without TLS
+share the same web server instance, which shuts down both of them at once, hence they share the same shutdown target.
+*/
+func shutdownTarget(daemon common.Daemon) common.Daemon {
+	if server, isNoTLS := daemon.(httpdNoTLS); isNoTLS {
+		return httpdWithTLS{server.Daemon}
+	}
+	return daemon
+}
+
+/*
+DaemonLauncher starts daemons from configuration. Upon request it reloads the configuration file, and re-initialises
+only the daemons whose configuration has changed while the others continue to run undisturbed.
+*/
+type DaemonLauncher struct {
+	ConfigFilePath string   // ConfigFilePath is the absolute path to the configuration file, which is decrypted using the program data decryption password if necessary.
+	DaemonNames    []string // DaemonNames are the names of daemons to start.
+	// AutoRestart runs a daemon function and restarts it when it returns an error, it returns after the function returns nil.
+	AutoRestart func(logger lalog.Logger, logActorName string, fun func() error)
+	// ShutdownTimeoutSec is the amount of time given to a daemon replaced by configuration reload to shut down gracefully. It defaults to DefaultShutdownTimeoutSec.
+	ShutdownTimeoutSec int
+
+	config         *Config
+	configSections map[string]interface{}
+	running        map[string]*runningDaemon
+	mutex          *sync.Mutex // mutex protects the configuration and running daemons
+	reloadMutex    *sync.Mutex // reloadMutex serialises reloads, so that mutex is not held while the replaced daemons stop.
+	logger         lalog.Logger
+}
+
+/*
+Start initialises and starts all daemons from the configuration in background. The configuration JSON must be the one
+that the configuration was deserialised from.
+*/
+func (launcher *DaemonLauncher) Start(config *Config, configJSON []byte) error {
+	launcher.logger = lalog.Logger{ComponentName: "launcher", ComponentID: []lalog.LoggerIDField{{Key: "Daemons", Value: launcher.DaemonNames}}}
+	launcher.mutex = new(sync.Mutex)
+	launcher.reloadMutex = new(sync.Mutex)
+	launcher.running = make(map[string]*runningDaemon)
+	if launcher.ShutdownTimeoutSec < 1 {
+		launcher.ShutdownTimeoutSec = DefaultShutdownTimeoutSec
+	}
+	for _, daemonName := range launcher.DaemonNames {
+		if _, exists := DaemonConfigKeys[daemonName]; !exists {
+			return fmt.Errorf("DaemonLauncher.Start: unknown daemon name \"%s\"", daemonName)
+		}
+	}
+	sections, err := getConfigSections(configJSON)
+	if err != nil {
+		return fmt.Errorf("DaemonLauncher.Start: %v", err)
+	}
+	launcher.mutex.Lock()
+	defer launcher.mutex.Unlock()
+	launcher.config = config
+	launcher.configSections = sections
+	config.Features.EnvControl.ReloadConfig = launcher.Reload
+	if err := config.openMailSpool(); err != nil {
+		return fmt.Errorf("DaemonLauncher.Start: %v", err)
+	}
+	for _, daemonName := range launcher.DaemonNames {
+		// Daemons are started asynchronously and the order does not matter
+		launcher.run(launcher.register(daemonName, config.getDaemon(daemonName)))
+	}
+	return nil
+}
+
+// GetConfig returns the configuration that the daemons presently run with.
+func (launcher *DaemonLauncher) GetConfig() *Config {
+	launcher.mutex.Lock()
+	defer launcher.mutex.Unlock()
+	return launcher.config
+}
+
+// register places the daemon among the running ones and returns it. Caller must lock the mutex.
+func (launcher *DaemonLauncher) register(daemonName string, daemon common.Daemon) *runningDaemon {
+	running := &runningDaemon{name: daemonName, daemon: daemon}
+	launcher.running[daemonName] = running
+	return running
+}
+
+// run starts the registered daemon in background, the daemon is restarted upon failure until it is stopped.
+func (launcher *DaemonLauncher) run(running *runningDaemon) {
+	go launcher.AutoRestart(launcher.logger, running.name, func() error {
+		if atomic.LoadInt32(&running.stopped) == 1 {
+			return nil
+		}
+		err := running.daemon.StartAndBlock()
+		// A daemon stopped by reload or shutdown may return an error from its listener, there is no need to restart it.
+		if atomic.LoadInt32(&running.stopped) == 1 {
+			return nil
+		}
+		return err
+	})
+}
+
+/*
+Shutdown stops all daemons from accepting new clients, waits for their ongoing conversations and pending work to
+complete, and then waits for the outgoing mails to be delivered. If the context is done before then, the function
+gives up waiting and returns an error.
+*/
+func (launcher *DaemonLauncher) Shutdown(ctx context.Context) error {
+	launcher.mutex.Lock()
+	defer launcher.mutex.Unlock()
+	shutdownFuns := make([]func(context.Context) error, 0, len(launcher.running))
+	shutdownTargets := make(map[common.Daemon]bool)
+	for _, running := range launcher.running {
+		atomic.StoreInt32(&running.stopped, 1)
+		if target := shutdownTarget(running.daemon); !shutdownTargets[target] {
+			shutdownTargets[target] = true
+			shutdownFuns = append(shutdownFuns, target.Shutdown)
+		}
+	}
+	launcher.logger.Info("Shutdown", "", nil, "shutting down %d daemons", len(shutdownFuns))
+	daemonErr := common.ShutdownConcurrently(ctx, shutdownFuns...)
+	// Daemons may have sent mails (e.g. command responses) right before shutting down
+	if err := inet.FlushPendingMails(ctx); err != nil {
+		return err
+	}
+	return daemonErr
+}
+
+// shutdownReplaced gracefully shuts down a daemon that has been replaced by configuration reload.
+func (launcher *DaemonLauncher) shutdownReplaced(daemonName string, daemon common.Daemon) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(launcher.ShutdownTimeoutSec)*time.Second)
+	defer cancel()
+	if err := daemon.Shutdown(ctx); err != nil {
+		launcher.logger.Warning("shutdownReplaced", daemonName, err, "failed to shut down gracefully")
+	}
+}
+
+/*
+Reload reads the configuration file again and validates it. If the new configuration differs from the present one in
+sections that a daemon is constructed from, the daemon is initialised from the new configuration and replaces the
+running one. If the new configuration fails to deserialise or any of the daemons fails to initialise, all daemons
+continue to run with the present configuration.
+The function returns a summary of the daemons that have been re-initialised.
+*/
+func (launcher *DaemonLauncher) Reload() (string, error) {
+	launcher.reloadMutex.Lock()
+	defer launcher.reloadMutex.Unlock()
+	launcher.mutex.Lock()
+	replaced, summary, err := launcher.reinitialise()
+	launcher.mutex.Unlock()
+	if err != nil || len(replaced) == 0 {
+		return summary, err
+	}
+	/*
+		Old daemons stop accepting new clients right away, which frees their ports for the new daemons, and continue to
+		serve their ongoing conversations in background. A UDP listener is the exception - the ongoing conversations
+		reply to their clients through it, hence it waits for them to complete before closing.
+	*/
+	shutdownTargets := make(map[common.Daemon]bool)
+	for _, old := range replaced {
+		old.daemon.Stop()
+		if target := shutdownTarget(old.daemon); !shutdownTargets[target] {
+			shutdownTargets[target] = true
+			go launcher.shutdownReplaced(old.name, target)
+		}
+	}
+	launcher.mutex.Lock()
+	defer launcher.mutex.Unlock()
+	for _, old := range replaced {
+		// The launcher might have shut down in the meantime, the new daemon then remains stopped.
+		launcher.run(launcher.running[old.name])
+	}
+	launcher.logger.Info("Reload", "", nil, "%s", summary)
+	return summary, nil
+}
+
+/*
+reinitialise reads the configuration file again, initialises the daemons affected by configuration change, and
+registers them in place of the old daemons. It returns the old daemons that are to be stopped and replaced, as well as
+a summary of the change. Caller must lock the mutex.
+*/
+func (launcher *DaemonLauncher) reinitialise() (replaced []*runningDaemon, summary string, err error) {
+	configJSON, err := ReadConfigFile(launcher.ConfigFilePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("DaemonLauncher.Reload: failed to read configuration file - %v", err)
+	}
+	newSections, err := getConfigSections(configJSON)
+	if err != nil {
+		return nil, "", fmt.Errorf("DaemonLauncher.Reload: failed to deserialise configuration - %v", err)
+	}
+	newConfig := &Config{reloading: true}
+	if err := newConfig.DeserialiseFromJSON(configJSON); err != nil {
+		return nil, "", fmt.Errorf("DaemonLauncher.Reload: failed to deserialise configuration - %v", err)
+	}
+	oldConfig := launcher.config
+	changed := make([]string, 0)
+	for _, daemonName := range launcher.DaemonNames {
+		if configSectionsDiffer(launcher.configSections, newSections, DaemonConfigKeys[daemonName]) {
+			changed = append(changed, daemonName)
+		}
+	}
+	sort.Strings(changed)
+	if len(changed) == 0 {
+		launcher.logger.Info("Reload", "", nil, "none of the daemons is affected by configuration change")
+		return nil, "none of the daemons is affected by configuration change", nil
+	}
+	// Unaffected features and daemons carry on with their instances, the re-initialised daemons share them too.
+	if !configSectionsDiffer(launcher.configSections, newSections, featuresConfigKeys) {
+		newConfig.Features = oldConfig.Features
+	}
+	if err := newConfig.openMailSpool(); err != nil {
+		return nil, "", fmt.Errorf("DaemonLauncher.Reload: %v", err)
+	}
+	if !configSectionsDiffer(launcher.configSections, newSections, mailCommandRunnerConfigKeys) {
+		newConfig.MailCommandRunner = oldConfig.GetMailCommandRunner()
+		newConfig.mailCommandRunnerInit.Do(func() {})
+	}
+	for _, daemonName := range launcher.DaemonNames {
+		if !configSectionsDiffer(launcher.configSections, newSections, DaemonConfigKeys[daemonName]) {
+			newConfig.adoptDaemon(oldConfig, daemonName)
+		}
+	}
+	// Initialise the daemons from new configuration before stopping the old ones, so that a bad configuration does no harm.
+	newDaemons := make(map[string]common.Daemon)
+	for _, daemonName := range changed {
+		newDaemons[daemonName] = newConfig.getDaemon(daemonName)
+	}
+	if newConfig.initErr != nil {
+		return nil, "", fmt.Errorf("DaemonLauncher.Reload: daemons continue to run with the present configuration - %v", newConfig.initErr)
+	}
+	for _, daemonName := range changed {
+		old := launcher.running[daemonName]
+		atomic.StoreInt32(&old.stopped, 1)
+		replaced = append(replaced, old)
+		launcher.register(daemonName, newDaemons[daemonName])
+	}
+	newConfig.Features.EnvControl.ReloadConfig = launcher.Reload
+	launcher.config = newConfig
+	launcher.configSections = newSections
+	return replaced, fmt.Sprintf("re-initialised %s", strings.Join(changed, ", ")), nil
+}
+
+/*
+getDaemon initialises a daemon and returns it. If the configuration comes from a reload, caller should check initErr
+for initialisation failures.
+*/
+func (config *Config) getDaemon(daemonName string) common.Daemon {
+	switch daemonName {
+	case DNSDName:
+		return config.GetDNSD()
+	case HTTPDName:
+		return httpdWithTLS{config.GetHTTPD()}
+	case InsecureHTTPDName:
+		return httpdNoTLS{config.GetHTTPD()}
+	case MaintenanceName:
+		return config.GetMaintenance()
+	case PhoneHomeName:
+		return config.GetPhoneHomeDaemon()
+	case PlainSocketName:
+		return config.GetPlainSocketDaemon()
+	case SchedulerName:
+		return config.GetScheduler()
+	case SerialPortDaemonName:
+		return config.GetSerialPortDaemon()
+	case SimpleIPSvcName:
+		return config.GetSimpleIPSvcD()
+	case SMTPDName:
+		return config.GetMailDaemon()
+	case SNMPDName:
+		return config.GetSNMPD()
+	case SOCKDName:
+		return config.GetSockDaemon()
+	case TelegramName:
+		return config.GetTelegramBot()
+	case AutoUnlockName:
+		return config.GetAutoUnlock()
+	}
+	return nil
+}
+
+// adoptDaemon makes the configuration use the already initialised daemon instance of the old configuration.
+func (config *Config) adoptDaemon(old *Config, daemonName string) {
+	switch daemonName {
+	case DNSDName:
+		config.DNSDaemon = old.DNSDaemon
+		config.dnsDaemonInit.Do(func() {})
+	case HTTPDName, InsecureHTTPDName:
+		config.HTTPDaemon = old.HTTPDaemon
+		config.httpDaemonInit.Do(func() {})
+	case MaintenanceName:
+		config.Maintenance = old.Maintenance
+		config.maintenanceInit.Do(func() {})
+	case PhoneHomeName:
+		config.PhoneHomeDaemon = old.PhoneHomeDaemon
+		config.phoneHomeDaemonInit.Do(func() {})
+	case PlainSocketName:
+		config.PlainSocketDaemon = old.PlainSocketDaemon
+		config.plainSocketDaemonInit.Do(func() {})
+	case SchedulerName:
+		config.Scheduler = old.Scheduler
+		config.schedulerInit.Do(func() {})
+	case SerialPortDaemonName:
+		config.SerialPortDaemon = old.SerialPortDaemon
+		config.serialPortDaemonInit.Do(func() {})
+	case SimpleIPSvcName:
+		config.SimpleIPSvcDaemon = old.SimpleIPSvcDaemon
+		config.simpleIPSvcDaemonInit.Do(func() {})
+	case SMTPDName:
+		config.MailDaemon = old.MailDaemon
+		config.mailDaemonInit.Do(func() {})
+	case SNMPDName:
+		config.SNMPDaemon = old.SNMPDaemon
+		config.snmpDaemonInit.Do(func() {})
+	case SOCKDName:
+		config.SockDaemon = old.SockDaemon
+		config.sockDaemonInit.Do(func() {})
+	case TelegramName:
+		config.TelegramBot = old.TelegramBot
+		config.telegramBotInit.Do(func() {})
+	case AutoUnlockName:
+		config.AutoUnlock = old.AutoUnlock
+		config.autoUnlockInit.Do(func() {})
+	}
+}
@@ -0,0 +1,171 @@
+package launcher
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+var reloadConfigJSON = `
+{
+  "PlainSocketDaemon": {
+    "Address": "127.0.0.1",
+    "TCPPort": PLAIN_PORT
+  },
+  "PlainSocketFilters": {
+    "LintText": {
+      "MaxLength": 120
+    },
+    "PINAndShortcuts": {
+      "PIN": "PLAIN_PIN"
+    }
+  },
+  "SimpleIPSvcDaemon": {
+    "Address": "127.0.0.1",
+    "ActiveUsersPort": 61511,
+    "DayTimePort": 61512,
+    "QOTDPort": 61513
+  }
+}
+`
+
+func TestDaemonLauncher_Reload(t *testing.T) {
+	configFilePath := filepath.Join(os.TempDir(), "laitos-TestDaemonLauncher_Reload.json")
+	defer os.Remove(configFilePath)
+	writeConfig := func(configJSON string) {
+		if err := ioutil.WriteFile(configFilePath, []byte(configJSON), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	makeConfig := func(port, pin string) string {
+		return strings.NewReplacer("PLAIN_PORT", port, "PLAIN_PIN", pin).Replace(reloadConfigJSON)
+	}
+	isListening := func(port string) bool {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:"+port, 3*time.Second)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+		return true
+	}
+
+	configJSON := makeConfig("61514", "reloadpin1")
+	writeConfig(configJSON)
+	var config Config
+	if err := config.DeserialiseFromJSON([]byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	launcher := &DaemonLauncher{
+		ConfigFilePath: configFilePath,
+		DaemonNames:    []string{PlainSocketName, SimpleIPSvcName},
+		AutoRestart: func(logger lalog.Logger, logActorName string, fun func() error) {
+			for fun() != nil {
+				time.Sleep(100 * time.Millisecond)
+			}
+		},
+	}
+	if err := launcher.Start(&config, []byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if !isListening("61514") || !isListening("61511") {
+		t.Fatal("daemons did not start")
+	}
+	simpleIPSvcD := config.GetSimpleIPSvcD()
+
+	// Nothing is re-initialised if the configuration is unchanged
+	if summary, err := launcher.Reload(); err != nil || summary != "none of the daemons is affected by configuration change" {
+		t.Fatal(summary, err)
+	}
+	if launcher.GetConfig() != &config {
+		t.Fatal("config should not have changed")
+	}
+
+	// Bad configuration does not affect the running daemons
+	writeConfig("this is not JSON")
+	if _, err := launcher.Reload(); err == nil {
+		t.Fatal("did not error")
+	}
+	writeConfig(makeConfig("0", "reloadpin2"))
+	if _, err := launcher.Reload(); err == nil || !strings.Contains(err.Error(), "GetPlainSocketDaemon") {
+		t.Fatal(err)
+	}
+	if launcher.GetConfig() != &config || !isListening("61514") {
+		t.Fatal("daemons should continue with the present configuration")
+	}
+
+	// Only the plain socket daemon is re-initialised after changing its port and PIN
+	writeConfig(makeConfig("61515", "reloadpin2"))
+	if summary, err := launcher.Reload(); err != nil || summary != "re-initialised plainsocket" {
+		t.Fatal(summary, err)
+	}
+	time.Sleep(1 * time.Second)
+	newConfig := launcher.GetConfig()
+	if isListening("61514") || !isListening("61515") {
+		t.Fatal("plain socket daemon did not restart")
+	}
+	if pin := newConfig.GetPlainSocketDaemon().Processor.CommandFilters[0].(*toolbox.PINAndShortcuts).PIN; pin != "reloadpin2" {
+		t.Fatal(pin)
+	}
+	if newConfig.GetSimpleIPSvcD() != simpleIPSvcD || !isListening("61511") {
+		t.Fatal("simple IP service daemon should not have been re-initialised")
+	}
+	// Unchanged features are shared by the old and new daemons, and the reload app command is available.
+	if newConfig.Features != config.Features {
+		t.Fatal("features should not have been re-initialised")
+	}
+	if ret := newConfig.Features.EnvControl.Execute(toolbox.Command{Content: "reload", TimeoutSec: 10}); ret.Error != nil || ret.Output != "none of the daemons is affected by configuration change" {
+		t.Fatal(ret)
+	}
+	newConfig.GetPlainSocketDaemon().Stop()
+	simpleIPSvcD.Stop()
+}
+
+func TestDaemonLauncher_Shutdown(t *testing.T) {
+	configJSON := strings.NewReplacer("PLAIN_PORT", "61516", "PLAIN_PIN", "shutdownpin").Replace(reloadConfigJSON)
+	var config Config
+	if err := config.DeserialiseFromJSON([]byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	launcher := &DaemonLauncher{
+		DaemonNames: []string{PlainSocketName},
+		AutoRestart: func(logger lalog.Logger, logActorName string, fun func() error) {
+			for fun() != nil {
+				time.Sleep(100 * time.Millisecond)
+			}
+		},
+	}
+	if err := launcher.Start(&config, []byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	// Keep a conversation going, shutdown should wait for it until the deadline.
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:61516", 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := launcher.Shutdown(ctx); err == nil || !strings.Contains(err.Error(), "closed 1 ongoing connections") {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Fatal("shutdown did not wait for the ongoing conversation", elapsed)
+	}
+	// The daemon must not be restarted after shutdown
+	time.Sleep(1 * time.Second)
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:61516", 3*time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("daemon should not be listening after shutdown")
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
@@ -25,6 +28,7 @@ const (
 	InsecureHTTPDName    = "insecurehttpd"
 	MaintenanceName      = "maintenance"
 	PlainSocketName      = "plainsocket"
+	SchedulerName        = "scheduler"
 	SerialPortDaemonName = "serialport"
 	SimpleIPSvcName      = "simpleipsvcd"
 	SMTPDName            = "smtpd"
@@ -48,7 +52,7 @@ const (
 // AllDaemons is an unsorted list of string daemon names.
 var AllDaemons = []string{
 	AutoUnlockName, DNSDName, HTTPDName, InsecureHTTPDName, MaintenanceName, PhoneHomeName,
-	PlainSocketName, SerialPortDaemonName, SimpleIPSvcName, SMTPDName, SNMPDName, SOCKDName, TelegramName,
+	PlainSocketName, SchedulerName, SerialPortDaemonName, SimpleIPSvcName, SMTPDName, SNMPDName, SOCKDName, TelegramName,
 }
 
 /*
@@ -72,7 +76,7 @@ var ShedOrder = []string{
 	SerialPortDaemonName, SimpleIPSvcName, // 2
 	SNMPDName, DNSDName, // 3
 	SOCKDName, SMTPDName, HTTPDName, // 4
-	InsecureHTTPDName, PlainSocketName, TelegramName, PhoneHomeName, // 5
+	InsecureHTTPDName, PlainSocketName, TelegramName, PhoneHomeName, SchedulerName, // 5
 	// Never shed - AutoUnlockName
 }
 
@@ -128,6 +132,11 @@ type Supervisor struct {
 	mainStdout *lalog.ByteLogWriter
 	// mainStderr keeps last several KB of program stderr content for failure notification and forward everything to stderr.
 	mainStderr *lalog.ByteLogWriter
+	// mainProcess is the latest laitos main program process started by supervisor.
+	mainProcess      *os.Process
+	mainProcessMutex *sync.Mutex
+	// shuttingDown becomes true after supervisor has relayed SIGTERM to main program, which will then not be restarted.
+	shuttingDown bool
 
 	logger lalog.Logger
 }
@@ -140,6 +149,7 @@ func (sup *Supervisor) initialise() {
 	}
 	sup.mainStdout = lalog.NewByteLogWriter(os.Stdout, MemoriseOutputCapacity)
 	sup.mainStderr = lalog.NewByteLogWriter(os.Stderr, MemoriseOutputCapacity)
+	sup.mainProcessMutex = new(sync.Mutex)
 	// Remove daemon names from CLI flags, because they will be appended by GetLaunchParameters.
 	sup.CLIFlags = RemoveFromFlags(func(s string) bool {
 		return strings.HasPrefix(s, "-"+DaemonsFlagName)
@@ -228,15 +238,48 @@ func FeedDecryptionPasswordToStdinAndStart(decryptionPassword string, cmd *exec.
 	return stdin.Close()
 }
 
+/*
+relaySignals installs a signal handler that relays SIGHUP to laitos main program for reloading its configuration, and
+SIGTERM for shutting down its daemons gracefully.
+*/
+func (sup *Supervisor) relaySignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			sup.mainProcessMutex.Lock()
+			if sig == syscall.SIGTERM {
+				sup.shuttingDown = true
+			}
+			mainProcess := sup.mainProcess
+			sup.mainProcessMutex.Unlock()
+			if mainProcess == nil {
+				continue
+			}
+			if err := mainProcess.Signal(sig); err != nil {
+				sup.logger.Warning("relaySignals", strconv.Itoa(mainProcess.Pid), err, "failed to relay %v to main program", sig)
+			}
+		}
+	}()
+}
+
+// isShuttingDown returns true if supervisor has been asked to shut down main program.
+func (sup *Supervisor) isShuttingDown() bool {
+	sup.mainProcessMutex.Lock()
+	defer sup.mainProcessMutex.Unlock()
+	return sup.shuttingDown
+}
+
 /*
 Start will fork and launch laitos main program and restarts it in case of crash.
 If consecutive crashes occur within 20 minutes, each crash will lead to reduced set of daemons being restarted
 with the main program. If Email notification recipients are configured, a crash report will be delivered to those
 recipients.
-The function blocks caller indefinitely.
+The function blocks caller until SIGTERM is received and main program has exited.
 */
 func (sup *Supervisor) Start() {
 	sup.initialise()
+	sup.relaySignals()
 	paramChoice := 0
 	lastAttemptTime := time.Now().Unix()
 	executablePath, err := os.Executable()
@@ -245,7 +288,7 @@ func (sup *Supervisor) Start() {
 		return
 	}
 
-	for {
+	for !sup.isShuttingDown() {
 		cliFlags, _ := sup.GetLaunchParameters(paramChoice)
 		sup.logger.Info("Start", strconv.Itoa(paramChoice), nil, "attempting to start main program with CLI flags - %v", cliFlags)
 
@@ -263,7 +306,19 @@ func (sup *Supervisor) Start() {
 			continue
 		}
 		lastAttemptTime = time.Now().Unix()
-		if err := mainProgram.Wait(); err != nil {
+		sup.mainProcessMutex.Lock()
+		sup.mainProcess = mainProgram.Process
+		if sup.shuttingDown {
+			// SIGTERM arrived while main program was starting
+			_ = mainProgram.Process.Signal(syscall.SIGTERM)
+		}
+		sup.mainProcessMutex.Unlock()
+		err := mainProgram.Wait()
+		if sup.isShuttingDown() {
+			sup.logger.Info("Start", strconv.Itoa(paramChoice), err, "main program has shut down")
+			return
+		}
+		if err != nil {
 			sup.logger.Warning("Start", strconv.Itoa(paramChoice), err, "main program has crashed")
 			/*
 				Unsure what's going on - the main program crashes, the buffer storing latest stderr content just barely
@@ -34,6 +34,7 @@ import (
 	"github.com/HouzuoGuo/laitos/launcher/passwdserver"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 const (
@@ -89,6 +90,28 @@ func EncryptFile(filePath string) {
 	}
 }
 
+/*
+VerifyAuditLog is a distinct routine of laitos main program, it reads the audit log hash key from standard input,
+validates the chain of hashes in a command audit log file, and reports whether any of its entries has been tampered with.
+*/
+func VerifyAuditLog(filePath string) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Please enter the HashKey of CommandAuditLog (no echo):")
+	platform.SetTermEcho(false)
+	hashKey, _, err := reader.ReadLine()
+	platform.SetTermEcho(true)
+	if err != nil {
+		lalog.DefaultLogger.Abort("VerifyAuditLog", "main", err, "failed to read hash key")
+		return
+	}
+	numEntries, err := toolbox.VerifyAuditLog(filePath, strings.TrimSpace(string(hashKey)))
+	if err != nil {
+		lalog.DefaultLogger.Abort("VerifyAuditLog", "main", err, "the audit log has been tampered with after %d intact entries", numEntries)
+		return
+	}
+	lalog.DefaultLogger.Info("VerifyAuditLog", "main", nil, "all %d entries of the audit log are intact", numEntries)
+}
+
 /*
 StartPasswordWebServer is a distinct routine of laitos main program, it starts a simple web server to accept a password
 input in order to decrypt laitos program data and launch the daemons.
@@ -113,6 +136,8 @@ main runs one of several distinct routines according to the presented combinatio
 
 - Maintain encrypted program data files: -datautil=encrypt|decrypt
 
+- Verify the chain of hashes in command audit log file: -verifyauditlog=/path/to/audit.log
+
 - Launch a simple web server to collect program data decryption password, and proceeds to launch laitos with supervisor:
   -pwdserver -pwdserverport=12345 -pwdserverurl=/my-password-input-page
 	This routine is useful only if some program data files have been encrypted.
@@ -137,12 +162,14 @@ func main() {
 	var disableConflicts, debug, benchmark, awsLambda bool
 	var gomaxprocs int
 	flag.StringVar(&misc.ConfigFilePath, launcher.ConfigFlagName, "", "(Mandatory) path to configuration file in JSON syntax")
-	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (autounlock, dnsd, httpd, insecurehttpd, maintenance, plainsocket, serialport, simpleipsvcd, smtpd, snmpd, sockd, telegram)")
+	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (autounlock, dnsd, httpd, insecurehttpd, maintenance, plainsocket, scheduler, serialport, simpleipsvcd, smtpd, snmpd, sockd, telegram)")
 	flag.BoolVar(&disableConflicts, "disableconflicts", false, "(Optional) automatically stop and disable other daemon programs that may cause port usage conflicts")
 	flag.BoolVar(&awsLambda, "awslambda", false, "(Optional) run AWS Lambda handler to proxy HTTP requests to laitos web server")
 	flag.BoolVar(&debug, "debug", false, "(Optional) print goroutine stack traces upon receiving interrupt signal")
 	flag.BoolVar(&benchmark, "benchmark", false, fmt.Sprintf("(Optional) continuously run benchmark routines on active daemons while exposing net/http/pprof on port %d", ProfilerHTTPPort))
 	flag.IntVar(&gomaxprocs, "gomaxprocs", 0, "(Optional) set gomaxprocs")
+	var shutdownTimeoutSec int
+	flag.IntVar(&shutdownTimeoutSec, "shutdowntimeoutsec", launcher.DefaultShutdownTimeoutSec, "(Optional) upon receiving SIGTERM, wait up to this many seconds for daemons to finish ongoing work before exiting")
 	// Data unlocker (password input server) flags
 	var pwdServer bool
 	var pwdServerPort int
@@ -154,6 +181,9 @@ func main() {
 	var dataUtil, dataUtilFile string
 	flag.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: encrypt|decrypt")
 	flag.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: encrypt/decrypt file location")
+	// Command audit log verification flag
+	var verifyAuditLog string
+	flag.StringVar(&verifyAuditLog, "verifyauditlog", "", "(Optional) verify the chain of hashes in this command audit log file and exit")
 	// Internal supervisor flag
 	var isSupervisor = true
 	flag.BoolVar(&isSupervisor, launcher.SupervisorFlagName, true, "(Internal use only) launch a supervisor process to auto-restart laitos main process in case of crash")
@@ -185,6 +215,10 @@ func main() {
 		}
 		return
 	}
+	if verifyAuditLog != "" {
+		VerifyAuditLog(verifyAuditLog)
+		return
+	}
 
 	// ========================================================================
 	// AWS lambda handler starts an independent goroutine to proxy HTTP requests to laitos web server.
@@ -286,10 +320,13 @@ func main() {
 	// for a user to turn it off manually.
 	// ========================================================================
 	if isSupervisor {
+		// The main program process owns the mail spool, supervisor sends its notifications without the spool.
+		supervisorMailClient := config.MailClient
+		supervisorMailClient.SpoolDirectory = ""
 		supervisor := &launcher.Supervisor{
 			CLIFlags:               os.Args[1:],
 			NotificationRecipients: config.SupervisorNotificationRecipients,
-			MailClient:             config.MailClient,
+			MailClient:             supervisorMailClient,
 			DaemonNames:            daemonNames,
 		}
 		supervisor.Start()
@@ -310,44 +347,18 @@ func main() {
 		DisableConflicts()
 	}
 
-	for _, daemonName := range daemonNames {
-		// Daemons are started asynchronously and the order does not matter
-		switch daemonName {
-		case launcher.DNSDName:
-			go AutoRestart(logger, daemonName, config.GetDNSD().StartAndBlock)
-		case launcher.HTTPDName:
-			go AutoRestart(logger, daemonName, config.GetHTTPD().StartAndBlockWithTLS)
-		case launcher.InsecureHTTPDName:
-			/*
-				There is not an independent port settings for launching both TLS-enabled and TLS-free HTTP servers
-				at the same time. If user really wishes to launch both at the same time, the TLS-free HTTP server
-				will fallback to use port number 80.
-			*/
-			go AutoRestart(logger, daemonName, func() error {
-				return config.GetHTTPD().StartAndBlockNoTLS(80)
-			})
-		case launcher.MaintenanceName:
-			go AutoRestart(logger, daemonName, config.GetMaintenance().StartAndBlock)
-		case launcher.PhoneHomeName:
-			go AutoRestart(logger, daemonName, config.GetPhoneHomeDaemon().StartAndBlock)
-		case launcher.PlainSocketName:
-			go AutoRestart(logger, daemonName, config.GetPlainSocketDaemon().StartAndBlock)
-		case launcher.SerialPortDaemonName:
-			go AutoRestart(logger, daemonName, config.GetSerialPortDaemon().StartAndBlock)
-		case launcher.SimpleIPSvcName:
-			go AutoRestart(logger, daemonName, config.GetSimpleIPSvcD().StartAndBlock)
-		case launcher.SMTPDName:
-			go AutoRestart(logger, daemonName, config.GetMailDaemon().StartAndBlock)
-		case launcher.SNMPDName:
-			go AutoRestart(logger, daemonName, config.GetSNMPD().StartAndBlock)
-		case launcher.SOCKDName:
-			go AutoRestart(logger, daemonName, config.GetSockDaemon().StartAndBlock)
-		case launcher.TelegramName:
-			go AutoRestart(logger, daemonName, config.GetTelegramBot().StartAndBlock)
-		case launcher.AutoUnlockName:
-			go AutoRestart(logger, daemonName, config.GetAutoUnlock().StartAndBlock)
-		}
+	daemonLauncher := &launcher.DaemonLauncher{
+		ConfigFilePath:     misc.ConfigFilePath,
+		DaemonNames:        daemonNames,
+		AutoRestart:        AutoRestart,
+		ShutdownTimeoutSec: shutdownTimeoutSec,
 	}
+	if err := daemonLauncher.Start(&config, configBytes); err != nil {
+		logger.Abort("main", "", err, "failed to start daemons")
+		return
+	}
+	// Reload configuration file upon SIGHUP, which is also relayed by supervisor to the main program.
+	ReloadConfigOnHangUp(daemonLauncher)
 
 	if benchmark {
 		// Wait a short while for daemons to settle, then run benchmark in the background.
@@ -362,6 +373,6 @@ func main() {
 		go bench.RunBenchmarkAndProfiler()
 	}
 
-	// Daemons are already started in background goroutines, the main function now waits indefinitely.
-	select {}
+	// Daemons are already started in background goroutines, the main function now waits for the signal to shut down.
+	ShutdownOnTerminate(daemonLauncher, shutdownTimeoutSec)
 }
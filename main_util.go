@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	cryptoRand "crypto/rand"
 	"encoding/binary"
 	pseudoRand "math/rand"
@@ -9,9 +10,11 @@ import (
 	"os/signal"
 	runtimePprof "runtime/pprof"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/launcher"
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
@@ -26,6 +29,42 @@ func DumpGoroutinesOnInterrupt() {
 	}()
 }
 
+/*
+ReloadConfigOnHangUp installs a SIGHUP signal handler that reloads the configuration file and re-initialises the daemons
+whose configuration has changed.
+*/
+func ReloadConfigOnHangUp(daemonLauncher *launcher.DaemonLauncher) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if summary, err := daemonLauncher.Reload(); err != nil {
+				logger.Warning("ReloadConfigOnHangUp", "", err, "failed to reload configuration")
+			} else {
+				logger.Info("ReloadConfigOnHangUp", "", nil, "successfully reloaded configuration - %s", summary)
+			}
+		}
+	}()
+}
+
+/*
+ShutdownOnTerminate blocks until the program receives SIGTERM, and then shuts down all daemons gracefully, giving them
+up to the timeout to finish their ongoing work and deliver outgoing mails.
+*/
+func ShutdownOnTerminate(daemonLauncher *launcher.DaemonLauncher, timeoutSec int) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	<-c
+	logger.Info("ShutdownOnTerminate", "", nil, "received SIGTERM, shutting down daemons within %d seconds", timeoutSec)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSec)*time.Second)
+	defer cancel()
+	if err := daemonLauncher.Shutdown(ctx); err != nil {
+		logger.Warning("ShutdownOnTerminate", "", err, "daemons did not shut down gracefully")
+		return
+	}
+	logger.Info("ShutdownOnTerminate", "", nil, "all daemons have shut down")
+}
+
 /*
 ReseedPseudoRandAndContinue immediately re-seeds PRNG using cryptographic RNG, and then continues in background at
 regular interval (3 minutes). This helps some laitos daemons that use the common PRNG instance for their operations.
@@ -2,6 +2,7 @@ package misc
 
 import (
 	"fmt"
+	"sync/atomic"
 )
 
 var (
@@ -12,6 +13,7 @@ var (
 	HTTPDStats          = NewStats()
 	PlainSocketStatsTCP = NewStats()
 	PlainSocketStatsUDP = NewStats()
+	SchedulerStats      = NewStats()
 	SerialDevicesStats  = NewStats()
 	SimpleIPStatsTCP    = NewStats()
 	SimpleIPStatsUDP    = NewStats()
@@ -23,6 +25,11 @@ var (
 
 	// OutstandingMailBytes is the total size of all outstanding mails waiting to be delivered.
 	OutstandingMailBytes int64
+
+	// DNSDResponseCacheHits is the number of DNS queries answered from response cache.
+	DNSDResponseCacheHits int64
+	// DNSDResponseCacheMisses is the number of DNS queries that could not be answered from response cache.
+	DNSDResponseCacheMisses int64
 )
 
 // GetLatestStats returns statistic information from all front-end daemons in a piece of multi-line, formatted text.
@@ -32,8 +39,10 @@ func GetLatestStats() string {
 	return fmt.Sprintf(`Auto-unlock events        %s
 Commands processed        %s
 DNS server TCP|UDP        %s | %s
+DNS cache hit|miss        %d | %d
 HTTP/S server             %s
 Plain text server TCP|UDP %s | %s
+Scheduled commands        %s
 Serial port devices       %s
 Simple IP servers         %s | %s
 SMTP server:              %s
@@ -45,8 +54,10 @@ Mail to deliver:          %d KiloBytes
 		AutoUnlockStats.Format(factor, numDecimals),
 		CommandStats.Format(factor, numDecimals),
 		DNSDStatsTCP.Format(factor, numDecimals), DNSDStatsUDP.Format(factor, numDecimals),
+		atomic.LoadInt64(&DNSDResponseCacheHits), atomic.LoadInt64(&DNSDResponseCacheMisses),
 		HTTPDStats.Format(factor, numDecimals),
 		PlainSocketStatsTCP.Format(factor, numDecimals), PlainSocketStatsUDP.Format(factor, numDecimals),
+		SchedulerStats.Format(factor, numDecimals),
 		SerialDevicesStats.Format(factor, numDecimals),
 		SimpleIPStatsTCP.Format(factor, numDecimals), SimpleIPStatsUDP.Format(factor, numDecimals),
 		SMTPDStats.Format(factor, numDecimals),
@@ -17,10 +17,20 @@ import (
 	"github.com/HouzuoGuo/laitos/platform"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune`)
+var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune | dns | reload | audit | sched | mailq`)
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
+	// GetDNSQueryStats returns the statistics report of DNS queries, it is assigned when DNS daemon is initialised.
+	GetDNSQueryStats func() string `json:"-"`
+	// ReloadConfig re-reads the configuration file and re-initialises the daemons whose configuration has changed, it is assigned by the daemon launcher.
+	ReloadConfig func() (string, error) `json:"-"`
+	// GetRecentCommandAudit returns the latest entries of command audit log, it is assigned when the audit log is configured.
+	GetRecentCommandAudit func() string `json:"-"`
+	// ManageSchedules lists and edits the schedules of scheduled commands, it is assigned when the scheduler daemon is initialised.
+	ManageSchedules func(params string) (string, error) `json:"-"`
+	// ManageMailSpool lists, retries, and purges the outgoing mails in spool, it is assigned when the mail spool is configured.
+	ManageMailSpool func(params string) (string, error) `json:"-"`
 }
 
 func (info *EnvControl) IsConfigured() bool {
@@ -35,14 +45,36 @@ func (info *EnvControl) Initialise() error {
 	return nil
 }
 
+const EnvControlTrigger = ".e" // EnvControlTrigger is the trigger prefix string of EnvControl feature.
+
 func (info *EnvControl) Trigger() Trigger {
-	return ".e"
+	return EnvControlTrigger
 }
 
 func (info *EnvControl) Execute(cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
+	// Parameters of these actions may be case sensitive, e.g. schedule definitions carry an app command.
+	words := strings.SplitN(cmd.Content, " ", 2)
+	var params string
+	if len(words) > 1 {
+		params = words[1]
+	}
+	switch strings.ToLower(words[0]) {
+	case "sched":
+		if info.ManageSchedules == nil {
+			return &Result{Error: errors.New("scheduler daemon is not running")}
+		}
+		out, err := info.ManageSchedules(params)
+		return &Result{Output: out, Error: err}
+	case "mailq":
+		if info.ManageMailSpool == nil {
+			return &Result{Error: errors.New("mail spool is not configured")}
+		}
+		out, err := info.ManageMailSpool(params)
+		return &Result{Output: out, Error: err}
+	}
 	switch strings.ToLower(cmd.Content) {
 	case "lock":
 		misc.TriggerEmergencyLockDown()
@@ -63,6 +95,22 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 		return &Result{Output: GetGoroutineStacktraces()}
 	case "tune":
 		return &Result{Output: TuneLinux()}
+	case "dns":
+		if info.GetDNSQueryStats == nil {
+			return &Result{Error: errors.New("DNS daemon is not running")}
+		}
+		return &Result{Output: info.GetDNSQueryStats()}
+	case "reload":
+		if info.ReloadConfig == nil {
+			return &Result{Error: errors.New("configuration reload is not available")}
+		}
+		summary, err := info.ReloadConfig()
+		return &Result{Output: summary, Error: err}
+	case "audit":
+		if info.GetRecentCommandAudit == nil {
+			return &Result{Error: errors.New("command audit log is not configured")}
+		}
+		return &Result{Output: info.GetRecentCommandAudit()}
 	default:
 		return &Result{Error: ErrBadEnvInfoChoice}
 	}
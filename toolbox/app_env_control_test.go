@@ -40,6 +40,42 @@ func TestEnvControl_Execute(t *testing.T) {
 	if ret := info.Execute(Command{Content: "stack"}); ret.Error != nil || !strings.Contains(ret.Output, "routine") {
 		t.Fatal(ret)
 	}
+	// Test DNS query stats
+	if ret := info.Execute(Command{Content: "dns"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	info.GetDNSQueryStats = func() string { return "dns query stats" }
+	if ret := info.Execute(Command{Content: "dns"}); ret.Error != nil || ret.Output != "dns query stats" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "reload"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	info.ReloadConfig = func() (string, error) { return "reloaded dnsd", nil }
+	if ret := info.Execute(Command{Content: "reload"}); ret.Error != nil || ret.Output != "reloaded dnsd" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "audit"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	info.GetRecentCommandAudit = func() string { return "recent commands" }
+	if ret := info.Execute(Command{Content: "audit"}); ret.Error != nil || ret.Output != "recent commands" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "sched"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	info.ManageSchedules = func(params string) (string, error) { return "params: " + params, nil }
+	if ret := info.Execute(Command{Content: "Sched set a - UTC @daily .s Echo"}); ret.Error != nil || ret.Output != "params: set a - UTC @daily .s Echo" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(Command{Content: "mailq"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	info.ManageMailSpool = func(params string) (string, error) { return "mailq: " + params, nil }
+	if ret := info.Execute(Command{Content: "mailq purge 123-Ab"}); ret.Error != nil || ret.Output != "mailq: purge 123-Ab" {
+		t.Fatal(ret)
+	}
 	// Test system tuning
 	ret := info.Execute(Command{Content: "tune"})
 	fmt.Println(ret.Output)
@@ -33,6 +33,15 @@ type FeatureSet struct {
 	WolframAlpha       WolframAlpha       `json:"WolframAlpha"`
 
 	MessageProcessor MessageProcessor `json:"MessageProcessor"`
+
+	// CommandAuditLog records all app command attempts made via command processors that use this feature set.
+	CommandAuditLog AuditLog `json:"CommandAuditLog"`
+	// AuthFailureTracker penalises failed authentication attempts made via command processors that use this feature set.
+	AuthFailureTracker AuthFailureTracker `json:"AuthFailureTracker"`
+	// BackgroundJobs runs app commands in the background for all command processors that use this feature set.
+	BackgroundJobs BackgroundJobs `json:"BackgroundJobs"`
+	// CommandAliases are the short names of app commands, expanded by the ExpandAliases filter of command processors.
+	CommandAliases CommandAliases `json:"CommandAliases"`
 }
 
 //var TestFeatureSet = FeatureSet{} // Features are assigned by init_test.go
@@ -69,6 +78,25 @@ func (fs *FeatureSet) Initialise() error {
 			}
 		}
 	}
+	// Open the command audit log, and let the environment control app show its recent entries.
+	if fs.CommandAuditLog.IsConfigured() {
+		if err := fs.CommandAuditLog.Initialise(); err == nil {
+			fs.EnvControl.GetRecentCommandAudit = fs.CommandAuditLog.GetRecent
+		} else {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := fs.BackgroundJobs.Initialise(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := fs.CommandAliases.Initialise(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if fs.AuthFailureTracker.IsConfigured() {
+		if err := fs.AuthFailureTracker.Initialise(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
 	/*
 		Initialise the one and only app that references this FeatureSet. If this app was placed
 		inside the triggers map, then its initialisation routine might fail when it validates
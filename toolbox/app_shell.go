@@ -38,8 +38,10 @@ func (sh *Shell) Initialise() error {
 	return nil
 }
 
+const ShellTrigger = ".s" // ShellTrigger is the trigger prefix string of Shell feature.
+
 func (sh *Shell) Trigger() Trigger {
-	return ".s"
+	return ShellTrigger
 }
 
 func (sh *Shell) Execute(cmd Command) *Result {
@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"encoding/json"
 	"errors"
 	"github.com/HouzuoGuo/laitos/inet"
 	"os"
@@ -58,6 +59,44 @@ func TestResult(t *testing.T) {
 	}
 }
 
+func TestResult_ToJSON(t *testing.T) {
+	result := Result{Error: os.ErrInvalid, Output: "  abc  def  ", Trigger: ".s", DurationMilli: 12}
+	result.ResetCombinedText()
+	// The structured result presents the output transformed by result filters
+	lint := LintText{TrimSpaces: true, CompressSpaces: true, MaxLength: 7}
+	if err := lint.Transform(&result); err != nil {
+		t.Fatal(err)
+	}
+	serialised, err := result.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var structured StructuredResult
+	if err := json.Unmarshal(serialised, &structured); err != nil {
+		t.Fatal(err)
+	}
+	if structured != (StructuredResult{Error: os.ErrInvalid.Error(), Output: "abc def", CombinedOutput: "invalid", Trigger: ".s", DurationMilli: 12, Truncated: true, UntruncatedLength: 25}) {
+		t.Fatalf("%+v", structured)
+	}
+	// Empty output is substituted in the same way as the combined output
+	result = Result{Output: " "}
+	result.ResetCombinedText()
+	if err := (&SayEmptyOutput{}).Transform(&result); err != nil {
+		t.Fatal(err)
+	}
+	if serialised, err := result.ToJSON(); err != nil || json.Unmarshal(serialised, &structured) != nil ||
+		structured.Output != EmptyOutputText || structured.CombinedOutput != EmptyOutputText {
+		t.Fatal(err, string(serialised))
+	}
+	// Structured result is requested by the prefix
+	if input, yes := TrimPrefixStructuredResult("  .json verysecret .s echo hi "); !yes || input != "verysecret .s echo hi" {
+		t.Fatal(input, yes)
+	}
+	if input, yes := TrimPrefixStructuredResult("verysecret .s echo .json"); yes || input != "verysecret .s echo .json" {
+		t.Fatal(input, yes)
+	}
+}
+
 func TestHTTPErrorToResult(t *testing.T) {
 	resp := inet.HTTPResponse{StatusCode: 201}
 	if result := HTTPErrorToResult(resp, nil); result != nil {
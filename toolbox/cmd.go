@@ -2,8 +2,11 @@
 package toolbox
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
+	"unicode"
 
 	"github.com/HouzuoGuo/laitos/inet"
 )
@@ -11,6 +14,12 @@ import (
 const (
 	CombinedTextSeparator = "|" // Separate error and command output in the combined output
 	SelfTestTimeoutSec    = 15  // Timeout for outgoing connections among those involved in feature self tests
+
+	/*
+		PrefixStructuredResult is the magic string that a client may put in front of its input (before the password
+		PIN) to receive the command result in JSON, if the daemon supports structured result.
+	*/
+	PrefixStructuredResult = ".json"
 )
 
 var (
@@ -28,6 +37,10 @@ type Command struct {
 	TimeoutSec int
 	// Content is the app command input.
 	Content string
+	// User is the name of the user authenticated by PINAndShortcuts filter, this is used for logging.
+	User string
+	// userPermission restricts the apps available to the authenticated user, it is nil if the user has access to all apps.
+	userPermission *User
 }
 
 // Modify command content to remove leading and trailing white spaces. Return error result if command becomes empty afterwards.
@@ -49,6 +62,24 @@ func (cmd *Command) FindAndRemovePrefix(prefix string) (hasPrefix bool) {
 	return
 }
 
+/*
+FindAndRemoveWord is similar to FindAndRemovePrefix, but the prefix must be followed by a white space or nothing, so that
+a longer word that begins with the prefix does not count.
+*/
+func (cmd *Command) FindAndRemoveWord(word string) (hasWord bool) {
+	trimmedOriginal := strings.TrimSpace(cmd.Content)
+	hasWord = hasWordPrefix(trimmedOriginal, word)
+	if hasWord {
+		cmd.Content = strings.TrimSpace(trimmedOriginal[len(word):])
+	}
+	return
+}
+
+// hasWordPrefix returns true if the text begins with the word, and the word is followed by a white space or nothing.
+func hasWordPrefix(text, word string) bool {
+	return strings.HasPrefix(text, word) && (len(text) == len(word) || unicode.IsSpace(rune(text[len(word)])))
+}
+
 func (cmd *Command) Lines() []string {
 	return strings.Split(cmd.Content, "\n")
 }
@@ -70,6 +101,61 @@ type Result struct {
 	Error          error   // Result error if there is any
 	Output         string  // Human readable normal output excluding error text
 	CombinedOutput string  // Human readable error text + normal output. This is set when calling SetCombinedText() function.
+
+	Trigger           Trigger // Trigger is the prefix of the app that ran the command, it is empty if no app was run.
+	DurationMilli     int64   // DurationMilli is the time it took the command processor to process the command.
+	Truncated         bool    // Truncated is true if result filters have discarded a part of the combined output.
+	UntruncatedLength int     // UntruncatedLength is the length of the combined output before result filters discarded a part of it.
+
+	// filteredOutput is the output excluding error text, transformed by result filters in the same way as the combined output.
+	filteredOutput string
+	// untruncatedOutput is the combined output that LintText has cut short, before its excessive characters were discarded.
+	untruncatedOutput string
+	// untruncatedBeginPosition is the number of leading characters that LintText discarded from the untruncated output.
+	untruncatedBeginPosition int
+}
+
+/*
+StructuredResult is the JSON representation of a command result, offered to clients that would rather not parse the
+combined output text.
+*/
+type StructuredResult struct {
+	Error             string `json:"Error"`             // Error is the command execution error, or empty if there is none.
+	Output            string `json:"Output"`            // Output is the output of the app excluding error text, transformed by result filters.
+	CombinedOutput    string `json:"CombinedOutput"`    // CombinedOutput is the text that would have been the response in the absence of structured result.
+	Trigger           string `json:"Trigger"`           // Trigger is the prefix of the app that ran the command.
+	DurationMilli     int64  `json:"DurationMilli"`     // DurationMilli is the time it took to process the command.
+	Truncated         bool   `json:"Truncated"`         // Truncated is true if result filters have discarded a part of the combined output.
+	UntruncatedLength int    `json:"UntruncatedLength"` // UntruncatedLength is the length of the combined output before truncation.
+}
+
+// ToJSON returns the result serialised into a StructuredResult. The result filters must have already run on the result.
+func (result *Result) ToJSON() ([]byte, error) {
+	serialised, err := json.Marshal(StructuredResult{
+		Error:             result.ErrText(),
+		Output:            result.filteredOutput,
+		CombinedOutput:    result.CombinedOutput,
+		Trigger:           string(result.Trigger),
+		DurationMilli:     result.DurationMilli,
+		Truncated:         result.Truncated,
+		UntruncatedLength: result.UntruncatedLength,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Result.ToJSON: %v", err)
+	}
+	return serialised, nil
+}
+
+/*
+TrimPrefixStructuredResult removes the structured result prefix from the client input. It returns the remaining input,
+and true only if the prefix was present.
+*/
+func TrimPrefixStructuredResult(input string) (string, bool) {
+	trimmed := strings.TrimSpace(input)
+	if !strings.HasPrefix(trimmed, PrefixStructuredResult) {
+		return input, false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(trimmed, PrefixStructuredResult)), true
 }
 
 // Return error text or empty string if error is absent.
@@ -90,6 +176,7 @@ func (result *Result) ResetCombinedText() string {
 		}
 	}
 	result.CombinedOutput += result.Output
+	result.filteredOutput = result.Output
 	return result.CombinedOutput
 }
 
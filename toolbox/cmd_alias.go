@@ -0,0 +1,369 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	/*
+		PrefixCommandAlias is the magic string of the command that lists the aliases, defines an alias in the form of
+		"name $param1 $param2 = template", or removes an alias in the form of "name =".
+	*/
+	PrefixCommandAlias = ".alias"
+	// MaxAliasesPerUser is the maximum number of aliases a user may define at runtime.
+	MaxAliasesPerUser = 100
+	// AliasDefinitionSeparator separates an alias and its parameters from the command template in an alias definition.
+	AliasDefinitionSeparator = "="
+	// configAliasUserName is the owner of aliases defined in configuration, which are available to all users.
+	configAliasUserName = ""
+)
+
+/*
+aliasOwner returns the owner of the aliases defined at runtime by the user of the daemon. Each daemon has its own set of
+users, hence a user of one daemon does not share aliases with a user of the same name from another daemon.
+*/
+func aliasOwner(daemonName, userName string) string {
+	if userName == configAliasUserName {
+		return configAliasUserName
+	}
+	return daemonName + "/" + userName
+}
+
+// RegexAliasParam matches a parameter of an alias, e.g. "$city".
+var RegexAliasParam = regexp.MustCompile(`^\$[a-zA-Z0-9_]+$`)
+
+// ErrBadAliasDefinition reminds user of the proper syntax to define or remove an alias.
+var ErrBadAliasDefinition = errors.New(PrefixCommandAlias + " [name [$param1 $param2 ...] = [template]]")
+
+// ErrTooManyAliases is a command execution error indicating that the user has defined too many aliases.
+var ErrTooManyAliases = fmt.Errorf("a user may define at most %d aliases", MaxAliasesPerUser)
+
+// ErrAliasNotFound is a command execution error indicating that the alias to remove is not defined by the user.
+var ErrAliasNotFound = errors.New("the alias is not defined by this user")
+
+// alias is a name that expands into a command template, in which the alias parameters are substituted.
+type alias struct {
+	name     string
+	params   []string
+	template string
+}
+
+/*
+String returns the alias definition in the same format as the alias configuration, e.g. "wx $city = .w weather in $city".
+If the template is sensitive, then the template is hidden.
+*/
+func (a *alias) String(isSensitive func(string) bool) string {
+	template := a.template
+	if isSensitive != nil && isSensitive(template) {
+		template = HiddenCommandContent
+	}
+	return fmt.Sprintf("%s %s %s", a.getNameAndParams(), AliasDefinitionSeparator, template)
+}
+
+// getNameAndParams returns the alias name followed by its parameters, e.g. "wx $city".
+func (a *alias) getNameAndParams() string {
+	return strings.Join(append([]string{a.name}, a.params...), " ")
+}
+
+/*
+expand substitutes the parameters in the template by the words following the alias name. The last parameter takes all
+of the remaining text. If the alias does not have parameters, then the text is appended to the template.
+*/
+func (a *alias) expand(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if len(a.params) == 0 {
+		return strings.TrimSpace(a.template + " " + text), nil
+	}
+	args := make(map[string]string)
+	for i, param := range a.params {
+		if text == "" {
+			return "", fmt.Errorf("alias \"%s\" expects parameters %s", a.name, strings.Join(a.params, " "))
+		}
+		if i == len(a.params)-1 {
+			args[param] = text
+			break
+		}
+		end := strings.IndexFunc(text, unicode.IsSpace)
+		if end == -1 {
+			end = len(text)
+		}
+		args[param] = text[:end]
+		text = strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+	}
+	// Substitute the longer parameter names first, so that "$c" does not replace a part of "$city".
+	params := append([]string{}, a.params...)
+	sort.Slice(params, func(i, j int) bool {
+		return len(params[i]) > len(params[j])
+	})
+	replacements := make([]string, 0, 2*len(params))
+	for _, param := range params {
+		replacements = append(replacements, param, args[param])
+	}
+	return strings.NewReplacer(replacements...).Replace(a.template), nil
+}
+
+/*
+parseAlias parses the alias name and parameters (e.g. "wx $city") along with the template (e.g. ".w weather in $city").
+Alias names are case-insensitive, and they must not begin with a dot to avoid being mistaken for an app trigger.
+*/
+func parseAlias(nameAndParams, template string) (*alias, error) {
+	words := strings.Fields(nameAndParams)
+	template = strings.TrimSpace(template)
+	if len(words) == 0 || strings.HasPrefix(words[0], ".") || strings.HasPrefix(words[0], "$") || template == "" {
+		return nil, fmt.Errorf("alias \"%s\" must have a name that does not begin with a dot and a non-empty template", nameAndParams)
+	}
+	seen := make(map[string]bool)
+	for _, param := range words[1:] {
+		if !RegexAliasParam.MatchString(param) || seen[param] {
+			return nil, fmt.Errorf("alias \"%s\" has a malformed or duplicated parameter \"%s\"", nameAndParams, param)
+		}
+		seen[param] = true
+	}
+	return &alias{name: strings.ToLower(words[0]), params: words[1:], template: template}, nil
+}
+
+/*
+CommandAliases are short names that expand into longer app commands, they save a lot of typing when app commands are
+entered via telephone key pad or SMS. The aliases defined in configuration are available to all users, and each user
+may define their own aliases at runtime, which take precedence over the ones from configuration.
+*/
+type CommandAliases struct {
+	/*
+		Aliases are the alias definitions available to all users. Each key is an alias name optionally followed by
+		parameters, e.g. "wx $city", and the value is the app command template, e.g. ".w weather in $city".
+	*/
+	Aliases map[string]string `json:"Aliases"`
+	// FilePath is the JSON file that keeps the aliases defined by users at runtime. Without it, those are lost at restart.
+	FilePath string `json:"FilePath"`
+
+	// aliases are keyed by owner (daemon name and user name, see aliasOwner) and then alias name.
+	aliases map[string]map[string]*alias
+	mutex   *sync.Mutex
+}
+
+// Initialise parses the aliases from configuration and loads the aliases defined at runtime from the file.
+func (ca *CommandAliases) Initialise() error {
+	ca.mutex = new(sync.Mutex)
+	ca.aliases = map[string]map[string]*alias{configAliasUserName: {}}
+	for nameAndParams, template := range ca.Aliases {
+		parsed, err := parseAlias(nameAndParams, template)
+		if err != nil {
+			return fmt.Errorf("CommandAliases.Initialise: %v", err)
+		}
+		ca.aliases[configAliasUserName][parsed.name] = parsed
+	}
+	if ca.FilePath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(ca.FilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("CommandAliases.Initialise: failed to read alias file - %v", err)
+	}
+	var userAliases map[string]map[string]string
+	if err := json.Unmarshal(content, &userAliases); err != nil {
+		return fmt.Errorf("CommandAliases.Initialise: failed to deserialise alias file - %v", err)
+	}
+	for owner, definitions := range userAliases {
+		if owner == configAliasUserName {
+			continue
+		}
+		ca.aliases[owner] = make(map[string]*alias)
+		for nameAndParams, template := range definitions {
+			parsed, err := parseAlias(nameAndParams, template)
+			if err != nil {
+				return fmt.Errorf("CommandAliases.Initialise: alias file - %v", err)
+			}
+			ca.aliases[owner][parsed.name] = parsed
+		}
+	}
+	return nil
+}
+
+// lookup returns the alias of the name defined by the owner, or the one defined in configuration. The caller must hold the mutex.
+func (ca *CommandAliases) lookup(owner, name string) *alias {
+	if owner != configAliasUserName {
+		if found, exists := ca.aliases[owner][name]; exists {
+			return found
+		}
+	}
+	return ca.aliases[configAliasUserName][name]
+}
+
+/*
+Expand looks for an alias in the first word of the command content, and returns the command content expanded from the
+alias of the daemon's user. If the first word is not an alias, then the command content is returned as-is.
+*/
+func (ca *CommandAliases) Expand(daemonName, userName, content string) (string, error) {
+	content = strings.TrimSpace(content)
+	end := strings.IndexFunc(content, unicode.IsSpace)
+	if end == -1 {
+		end = len(content)
+	}
+	ca.mutex.Lock()
+	found := ca.lookup(aliasOwner(daemonName, userName), strings.ToLower(content[:end]))
+	ca.mutex.Unlock()
+	if found == nil {
+		return content, nil
+	}
+	return found.expand(content[end:])
+}
+
+/*
+Manage lists the aliases available to the command's user if the command content is empty, the listing hides the
+templates that are sensitive. Otherwise, the command content defines an alias on behalf of the user in the form of
+"name $param1 $param2 = template", or removes the user's alias in the form of "name =".
+*/
+func (ca *CommandAliases) Manage(cmd Command, isSensitive func(string) bool) *Result {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	owner := aliasOwner(cmd.DaemonName, cmd.User)
+	if cmd.Content == "" {
+		return &Result{Output: ca.list(owner, isSensitive)}
+	}
+	// The aliases from configuration cannot be altered at runtime
+	if cmd.User == configAliasUserName {
+		return &Result{Error: ErrPermissionDenied}
+	}
+	separator := strings.Index(cmd.Content, AliasDefinitionSeparator)
+	if separator == -1 {
+		return &Result{Error: ErrBadAliasDefinition}
+	}
+	nameAndParams, template := cmd.Content[:separator], strings.TrimSpace(cmd.Content[separator+1:])
+	owned, exists := ca.aliases[owner]
+	if !exists {
+		owned = make(map[string]*alias)
+		ca.aliases[owner] = owned
+	}
+	if template == "" {
+		// Remove the user's own alias
+		words := strings.Fields(nameAndParams)
+		if len(words) != 1 {
+			return &Result{Error: ErrBadAliasDefinition}
+		}
+		name := strings.ToLower(words[0])
+		if _, exists := owned[name]; !exists {
+			return &Result{Error: ErrAliasNotFound}
+		}
+		delete(owned, name)
+		if err := ca.save(); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: fmt.Sprintf("alias %s is removed", name)}
+	}
+	parsed, err := parseAlias(nameAndParams, template)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if _, exists := owned[parsed.name]; !exists && len(owned) >= MaxAliasesPerUser {
+		return &Result{Error: ErrTooManyAliases}
+	}
+	owned[parsed.name] = parsed
+	if err := ca.save(); err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("alias %s is saved", parsed.name)}
+}
+
+// list returns one line of text for each alias available to the owner, sorted by name. The caller must hold the mutex.
+func (ca *CommandAliases) list(owner string, isSensitive func(string) bool) string {
+	names := make(map[string]bool)
+	for _, listOwner := range []string{configAliasUserName, owner} {
+		for name := range ca.aliases[listOwner] {
+			names[name] = true
+		}
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+	var out bytes.Buffer
+	for _, name := range sortedNames {
+		out.WriteString(ca.lookup(owner, name).String(isSensitive))
+		out.WriteRune('\n')
+	}
+	return out.String()
+}
+
+// save writes the aliases defined at runtime into the alias file, if the file is configured. The caller must hold the mutex.
+func (ca *CommandAliases) save() error {
+	if ca.FilePath == "" {
+		return nil
+	}
+	userAliases := make(map[string]map[string]string)
+	for owner, owned := range ca.aliases {
+		if owner == configAliasUserName || len(owned) == 0 {
+			continue
+		}
+		userAliases[owner] = make(map[string]string)
+		for _, a := range owned {
+			userAliases[owner][a.getNameAndParams()] = a.template
+		}
+	}
+	content, err := json.MarshalIndent(userAliases, "", "  ")
+	if err != nil {
+		return fmt.Errorf("CommandAliases.save: failed to serialise aliases - %v", err)
+	}
+	// Write into a temporary file first, so that a crash does not leave the alias file half-written.
+	tmpPath := ca.FilePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return fmt.Errorf("CommandAliases.save: failed to write alias file - %v", err)
+	}
+	if err := os.Rename(tmpPath, ca.FilePath); err != nil {
+		return fmt.Errorf("CommandAliases.save: failed to write alias file - %v", err)
+	}
+	return nil
+}
+
+/*
+ExpandAliases is a command filter that expands the alias in the app command into the full app command. It should be
+placed after PINAndShortcuts, which tells the user whose aliases apply to the command.
+*/
+type ExpandAliases struct {
+	Aliases *CommandAliases `json:"-"`
+}
+
+func (ex *ExpandAliases) Transform(cmd Command) (Command, error) {
+	if ex.Aliases == nil || ex.Aliases.mutex == nil {
+		return cmd, nil
+	}
+	// Leave the PLT and background prefixes in place, and expand the app command that follows them.
+	var prefixes []string
+	content := strings.TrimSpace(cmd.Content)
+	for {
+		if strings.HasPrefix(content, PrefixCommandPLT) {
+			pltParams := RegexCommandWithPLT.FindStringSubmatchIndex(content[len(PrefixCommandPLT):])
+			if pltParams == nil {
+				break
+			}
+			// The last group is the app command
+			cmdBegin := len(PrefixCommandPLT) + pltParams[8]
+			prefixes = append(prefixes, content[:cmdBegin])
+			content = strings.TrimSpace(content[cmdBegin:])
+		} else if hasWordPrefix(content, PrefixCommandBackground) {
+			prefixes = append(prefixes, PrefixCommandBackground)
+			content = strings.TrimSpace(content[len(PrefixCommandBackground):])
+		} else {
+			break
+		}
+	}
+	expanded, err := ex.Aliases.Expand(cmd.DaemonName, cmd.User, content)
+	if err != nil {
+		return cmd, err
+	}
+	ret := cmd
+	ret.Content = strings.Join(append(prefixes, expanded), " ")
+	return ret, nil
+}
@@ -0,0 +1,193 @@
+package toolbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommandAliases_Expand(t *testing.T) {
+	aliases := CommandAliases{Aliases: map[string]string{".bad": ".s echo"}}
+	if err := aliases.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	aliases.Aliases = map[string]string{
+		"wx $city":       ".w weather in $city",
+		"Say":            ".s echo",
+		"both $c $city":  ".s echo $city $c",
+		"twice $a $a":    ".s echo",
+		"$notname $city": ".s echo",
+	}
+	if err := aliases.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	delete(aliases.Aliases, "twice $a $a")
+	delete(aliases.Aliases, "$notname $city")
+	if err := aliases.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for content, expanded := range map[string]string{
+		"":                       "",
+		".s echo hi":             ".s echo hi",
+		"wx new  york":           ".w weather in new  york",
+		"WX paris":               ".w weather in paris",
+		"say":                    ".s echo",
+		"say hello world":        ".s echo hello world",
+		"both first second word": ".s echo second word first",
+	} {
+		if out, err := aliases.Expand("", "", content); err != nil || out != expanded {
+			t.Fatal(content, out, err)
+		}
+	}
+	if _, err := aliases.Expand("", "", "wx"); err == nil || !strings.Contains(err.Error(), "$city") {
+		t.Fatal(err)
+	}
+}
+
+func TestCommandAliases_Manage(t *testing.T) {
+	aliasFilePath := filepath.Join(os.TempDir(), "laitos-TestCommandAliases_Manage.json")
+	defer os.Remove(aliasFilePath)
+	os.Remove(aliasFilePath)
+	aliases := CommandAliases{Aliases: map[string]string{"say": ".s echo"}, FilePath: aliasFilePath}
+	if err := aliases.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"say", "= .s echo", ".say = .s echo", "say $ = .s echo", "say x y ="} {
+		if result := aliases.Manage(Command{User: "alice", Content: content}, nil); result.Error == nil {
+			t.Fatal(content, result)
+		}
+	}
+	if result := aliases.Manage(Command{User: "alice", Content: "nope ="}, nil); result.Error != ErrAliasNotFound {
+		t.Fatal(result)
+	}
+	// User's own alias takes precedence over the one from configuration, and it is not visible to other users.
+	if result := aliases.Manage(Command{User: "alice", Content: "say $word = .s echo alice says $word"}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{User: "alice", Content: "up=.e info"}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{User: "alice"}, nil); result.Error != nil || result.Output != "say $word = .s echo alice says $word\nup = .e info\n" {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{User: "bob"}, nil); result.Error != nil || result.Output != "say = .s echo\n" {
+		t.Fatal(result)
+	}
+	if out, err := aliases.Expand("", "alice", "say hi"); err != nil || out != ".s echo alice says hi" {
+		t.Fatal(out, err)
+	}
+	if out, err := aliases.Expand("", "bob", "say hi"); err != nil || out != ".s echo hi" {
+		t.Fatal(out, err)
+	}
+	// A user of the same name from another daemon does not share the aliases
+	if out, err := aliases.Expand("httpd", "alice", "say hi"); err != nil || out != ".s echo hi" {
+		t.Fatal(out, err)
+	}
+	if result := aliases.Manage(Command{DaemonName: "httpd", User: "alice", Content: "up = .e log"}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{DaemonName: "httpd", User: "alice"}, nil); result.Error != nil || result.Output != "say = .s echo\nup = .e log\n" {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{DaemonName: "httpd", User: "alice", Content: "up ="}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+	// Sensitive templates are hidden from the listing
+	isSensitive := func(template string) bool { return strings.HasPrefix(template, ".e") }
+	if result := aliases.Manage(Command{User: "alice"}, isSensitive); result.Error != nil || result.Output != "say $word = .s echo alice says $word\nup = "+HiddenCommandContent+"\n" {
+		t.Fatal(result)
+	}
+	// Aliases from configuration cannot be changed at runtime
+	if result := aliases.Manage(Command{Content: "say = .s echo x"}, nil); result.Error != ErrPermissionDenied {
+		t.Fatal(result)
+	}
+	// The aliases defined at runtime are restored from the alias file
+	aliases = CommandAliases{FilePath: aliasFilePath}
+	if err := aliases.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result := aliases.Manage(Command{User: "alice"}, nil); result.Error != nil || result.Output != "say $word = .s echo alice says $word\nup = .e info\n" {
+		t.Fatal(result)
+	}
+	if result := aliases.Manage(Command{User: "alice", Content: "SAY ="}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+	aliases = CommandAliases{FilePath: aliasFilePath}
+	if err := aliases.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result := aliases.Manage(Command{User: "alice"}, nil); result.Error != nil || result.Output != "up = .e info\n" {
+		t.Fatal(result)
+	}
+	// Limit the number of aliases per user
+	for i := 0; i < MaxAliasesPerUser-1; i++ {
+		if result := aliases.Manage(Command{User: "alice", Content: "a" + strings.Repeat("b", i) + " = .s echo"}, nil); result.Error != nil {
+			t.Fatal(i, result)
+		}
+	}
+	if result := aliases.Manage(Command{User: "alice", Content: "c = .s echo"}, nil); result.Error != ErrTooManyAliases {
+		t.Fatal(result)
+	}
+	// Redefining an existing alias is not restricted by the limit
+	if result := aliases.Manage(Command{User: "alice", Content: "up = .e runtime"}, nil); result.Error != nil {
+		t.Fatal(result)
+	}
+}
+
+func TestExpandAliases_Transform(t *testing.T) {
+	aliases := CommandAliases{Aliases: map[string]string{"say $word": ".s echo $word"}}
+	// The filter does nothing until aliases are initialised
+	filter := ExpandAliases{Aliases: &aliases}
+	if cmd, err := filter.Transform(Command{Content: "say hi"}); err != nil || cmd.Content != "say hi" {
+		t.Fatal(cmd, err)
+	}
+	if err := aliases.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for content, expanded := range map[string]string{
+		" say hi ":                  ".s echo hi",
+		".plt 1 2 3 say hi":         ".plt 1 2 3 .s echo hi",
+		".bg say hi":                ".bg .s echo hi",
+		".plt 1, 2, 3 .bg  say  hi": ".plt 1, 2, 3 .bg .s echo hi",
+		".plt say hi":               ".plt say hi",
+	} {
+		if cmd, err := filter.Transform(Command{Content: content}); err != nil || cmd.Content != expanded {
+			t.Fatal(content, cmd.Content, err)
+		}
+	}
+	if _, err := filter.Transform(Command{Content: ".bg say"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestCommandProcessor_Aliases(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Features.CommandAliases = CommandAliases{Aliases: map[string]string{"say $word": ".s echo $word"}}
+	if err := proc.Features.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + "say hi", TimeoutSec: 10}, true); result.Error != nil || result.Output != "hi\n" || result.Command.Content != ".s echo hi" {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandAlias + " up = .s echo up", TimeoutSec: 10}, true); result.Error != nil {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + "up", TimeoutSec: 10}, true); result.Error != nil || result.Output != "up\n" {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandAlias, TimeoutSec: 10}, false); result.Error != nil || result.Output != "say $word = .s echo $word\nup = .s echo up\n" {
+		t.Fatal(result)
+	}
+	// The definition and listing of an alias that decrypts a file do not reveal the key
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandAlias + " dec $file = " + AESDecryptTrigger + " $file secretkey", TimeoutSec: 10}, true); result.Error != nil || result.Command.Content != HiddenCommandContent {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandAlias, TimeoutSec: 10}, false); result.Error != nil || strings.Contains(result.Output, "secretkey") || !strings.Contains(result.Output, "dec $file = "+HiddenCommandContent) {
+		t.Fatal(result)
+	}
+	// A word that merely begins with the alias prefix is not an alias command
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandAlias + "es", TimeoutSec: 10}, false); result.Error != ErrBadPrefix {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,286 @@
+package toolbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// AuditLogRecentEntries is the number of latest audit log entries kept in memory for display.
+	AuditLogRecentEntries = 128
+	// MaxAuditErrorLength is the maximum length of command execution error recorded in an audit log entry.
+	MaxAuditErrorLength = 1024
+	// MaxAuditLogLineLength is the maximum length of an audit log entry in the file, it accommodates the longest command content and error even if all of their characters are escaped in JSON.
+	MaxAuditLogLineLength = 6*(MaxCmdLength+MaxAuditErrorLength) + 4096
+)
+
+// AuditEntry records the outcome of an attempt to run an app command.
+type AuditEntry struct {
+	Time          string `json:"Time"`          // Time is the moment the command was received, in RFC3339 format.
+	DaemonName    string `json:"DaemonName"`    // DaemonName is the name of daemon that received the command.
+	ClientID      string `json:"ClientID"`      // ClientID identifies the origin of the command, such as an IP address.
+	User          string `json:"User"`          // User is the name of the authenticated user, it is empty if authentication failed.
+	Trigger       string `json:"Trigger"`       // Trigger is the prefix of the app that ran the command, it is empty if no app was run.
+	Content       string `json:"Content"`       // Content is the command without password PIN, sensitive content is hidden.
+	OK            bool   `json:"OK"`            // OK is true only if the command was successfully executed.
+	Error         string `json:"Error"`         // Error is the command execution error.
+	DurationMilli int64  `json:"DurationMilli"` // DurationMilli is the time it took to process the command.
+	PrevHash      string `json:"PrevHash"`      // PrevHash is the hash of the previous entry, it is empty for the very first entry.
+	Hash          string `json:"Hash"`          // Hash is calculated from all other fields of this entry, including PrevHash.
+}
+
+/*
+calculateHash returns the HMAC-SHA256 of the entry's JSON serialisation that excludes the hash itself. Without the key,
+one cannot calculate a valid chain of hashes for altered entries.
+*/
+func (entry AuditEntry) calculateHash(key string) (string, error) {
+	entry.Hash = ""
+	serialised, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(serialised)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// String returns the entry in a single line of human readable text.
+func (entry AuditEntry) String() string {
+	ret := fmt.Sprintf("%s %s-%s user=%s \"%s\" ok=%v %dms", entry.Time, entry.DaemonName, entry.ClientID, entry.User, entry.Content, entry.OK, entry.DurationMilli)
+	if entry.Error != "" {
+		ret += " err=" + entry.Error
+	}
+	return ret
+}
+
+// auditLogFile is an audit log file opened for appending.
+type auditLogFile struct {
+	file     *os.File
+	hashKey  string // hashKey keys the hashes of all entries in the file, instances of the same file must use the same key.
+	lastHash string
+	recent   *lalog.RingBuffer
+	mutex    *sync.Mutex
+}
+
+var (
+	/*
+		auditLogFiles are the audit log files opened by this program, keyed by file path. AuditLog instances of the same
+		file share the opened file in order to keep a single chain of hashes, which is the case when the daemons
+		re-initialised by configuration reload and the ones they replace are running side by side.
+	*/
+	auditLogFiles      = map[string]*auditLogFile{}
+	auditLogFilesMutex = new(sync.Mutex)
+
+	// errMalformedAuditLine is the error returned by readAuditLog when a line of the file is not an audit log entry.
+	errMalformedAuditLine = errors.New("malformed")
+)
+
+/*
+AuditLog is an append-only file of app command attempts, one JSON entry per line. Each entry carries the hash of its
+previous entry, and the hashes are keyed by a secret, therefore removing or altering an entry breaks the chain of hashes,
+which is detected by VerifyAuditLog.
+*/
+type AuditLog struct {
+	FilePath string `json:"FilePath"` // FilePath is the location of the audit log file, which is created if it does not yet exist.
+	HashKey  string `json:"HashKey"`  // HashKey is the secret that keys the hash of each entry, it must be kept away from the audit log file.
+
+	opened *auditLogFile
+}
+
+// IsConfigured returns true only if the audit log file location is specified.
+func (audit *AuditLog) IsConfigured() bool {
+	return audit.FilePath != ""
+}
+
+/*
+Initialise opens the audit log file for appending and continues the chain of hashes from its last entry. If the program
+crashed while writing the last entry, the incomplete entry is removed from the file. If the file is already opened by
+another instance, this instance must use the same hash key.
+*/
+func (audit *AuditLog) Initialise() error {
+	if len(audit.HashKey) < 16 {
+		return errors.New("AuditLog.Initialise: HashKey must be at least 16 characters long")
+	}
+	auditLogFilesMutex.Lock()
+	defer auditLogFilesMutex.Unlock()
+	if opened, exists := auditLogFiles[audit.FilePath]; exists {
+		// A different key would break the chain of hashes, the key of an opened file does not change until program restarts.
+		if !hmac.Equal([]byte(opened.hashKey), []byte(audit.HashKey)) {
+			return fmt.Errorf("AuditLog.Initialise: \"%s\" is already in use with a different HashKey", audit.FilePath)
+		}
+		audit.opened = opened
+		return nil
+	}
+	opened := &auditLogFile{hashKey: audit.HashKey, recent: lalog.NewRingBuffer(AuditLogRecentEntries), mutex: new(sync.Mutex)}
+	// Read the existing entries to find the latest hash
+	intactLength, err := readAuditLog(audit.FilePath, func(lineNum int, entry AuditEntry) error {
+		opened.lastHash = entry.Hash
+		opened.recent.Push(entry.String())
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		// Only an entry that does not parse may have been left incomplete by a crash, other errors are not recoverable.
+		if !errors.Is(err, errMalformedAuditLine) {
+			return fmt.Errorf("AuditLog.Initialise: failed to read \"%s\" - %v", audit.FilePath, err)
+		}
+		if truncErr := truncateTrailingLine(audit.FilePath, intactLength); truncErr != nil {
+			return fmt.Errorf("AuditLog.Initialise: failed to read \"%s\" - %v", audit.FilePath, err)
+		}
+		lalog.DefaultLogger.Warning("AuditLog.Initialise", audit.FilePath, err, "removed the incomplete entry at the end of file")
+	}
+	opened.file, err = os.OpenFile(audit.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("AuditLog.Initialise: failed to open \"%s\" - %v", audit.FilePath, err)
+	}
+	auditLogFiles[audit.FilePath] = opened
+	audit.opened = opened
+	return nil
+}
+
+// Add chains the entry to the previous one and appends it to the audit log file.
+func (audit *AuditLog) Add(entry AuditEntry) error {
+	if audit.opened == nil {
+		return fmt.Errorf("AuditLog.Add: the audit log \"%s\" is not initialised", audit.FilePath)
+	}
+	audit.opened.mutex.Lock()
+	defer audit.opened.mutex.Unlock()
+	if len(entry.Error) > MaxAuditErrorLength {
+		entry.Error = entry.Error[:MaxAuditErrorLength]
+	}
+	entry.PrevHash = audit.opened.lastHash
+	hash, err := entry.calculateHash(audit.opened.hashKey)
+	if err != nil {
+		return fmt.Errorf("AuditLog.Add: %v", err)
+	}
+	entry.Hash = hash
+	serialised, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("AuditLog.Add: %v", err)
+	}
+	if _, err := audit.opened.file.Write(append(serialised, '\n')); err != nil {
+		return fmt.Errorf("AuditLog.Add: failed to write into \"%s\" - %v", audit.FilePath, err)
+	}
+	audit.opened.lastHash = hash
+	audit.opened.recent.Push(entry.String())
+	return nil
+}
+
+// GetRecent returns the latest audit log entries in a multi-line text, one entry per line. Latest entry comes first.
+func (audit *AuditLog) GetRecent() string {
+	buf := new(bytes.Buffer)
+	if audit.opened == nil {
+		return ""
+	}
+	audit.opened.recent.IterateReverse(func(entry string) bool {
+		buf.WriteString(entry)
+		buf.WriteRune('\n')
+		return true
+	})
+	return buf.String()
+}
+
+/*
+readAuditLog feeds each entry of the audit log file to the function, and stops at the first error. It returns the
+length of the leading part of the file that has been read without an error.
+*/
+func readAuditLog(filePath string, fun func(lineNum int, entry AuditEntry) error) (intactLength int64, err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxAuditLogLineLength)
+	lineNum := 1
+	for ; scanner.Scan(); lineNum++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return intactLength, fmt.Errorf("line %d is %w - %v", lineNum, errMalformedAuditLine, err)
+		}
+		if err := fun(lineNum, entry); err != nil {
+			return intactLength, err
+		}
+		intactLength += int64(len(scanner.Bytes())) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return intactLength, fmt.Errorf("line %d is unreadable - %v", lineNum, err)
+	}
+	return intactLength, nil
+}
+
+/*
+truncateTrailingLine removes the content that follows the intact part of the audit log file, but only if the content is
+made of a single line, which is left behind by a crash in the middle of writing the last entry.
+*/
+func truncateTrailingLine(filePath string, intactLength int64) error {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if intactLength > int64(len(content)) {
+		return errors.New("the file is shorter than its intact part")
+	}
+	if bytes.Contains(bytes.TrimSuffix(content[intactLength:], []byte{'\n'}), []byte{'\n'}) {
+		return errors.New("more entries follow the bad line")
+	}
+	return os.Truncate(filePath, intactLength)
+}
+
+/*
+VerifyAuditLog reads the entire audit log file and validates the chain of hashes using the hash key. It returns the
+number of entries that have been verified, and an error identifying the first entry that has been tampered with.
+*/
+func VerifyAuditLog(filePath, hashKey string) (numEntries int, err error) {
+	lastHash := ""
+	_, err = readAuditLog(filePath, func(lineNum int, entry AuditEntry) error {
+		if entry.PrevHash != lastHash {
+			return fmt.Errorf("line %d does not follow the previous entry, an entry may have been removed or inserted", lineNum)
+		}
+		hash, err := entry.calculateHash(hashKey)
+		if err != nil {
+			return fmt.Errorf("line %d - %v", lineNum, err)
+		}
+		if !hmac.Equal([]byte(hash), []byte(entry.Hash)) {
+			return fmt.Errorf("line %d has been altered", lineNum)
+		}
+		lastHash = entry.Hash
+		numEntries++
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("VerifyAuditLog: %v", err)
+	}
+	return
+}
+
+// newAuditEntry returns an audit entry of a command that has been processed by the command processor.
+func newAuditEntry(begin time.Time, cmd Command, matchedFeature Feature, logCommandContent string, result *Result) AuditEntry {
+	entry := AuditEntry{
+		Time:          begin.UTC().Format(time.RFC3339),
+		DaemonName:    cmd.DaemonName,
+		ClientID:      cmd.ClientID,
+		User:          cmd.User,
+		Content:       logCommandContent,
+		DurationMilli: time.Since(begin).Milliseconds(),
+	}
+	if matchedFeature != nil {
+		entry.Trigger = string(matchedFeature.Trigger())
+	}
+	if result != nil {
+		entry.OK = result.Error == nil
+		entry.Error = result.ErrText()
+	}
+	return entry
+}
@@ -0,0 +1,158 @@
+package toolbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	auditFilePath := filepath.Join(os.TempDir(), "laitos-TestAuditLog.jsonl")
+	_ = os.Remove(auditFilePath)
+	defer os.Remove(auditFilePath)
+
+	proc := GetTestCommandProcessor()
+	proc.Features.CommandAuditLog.FilePath = auditFilePath
+	proc.Features.CommandAuditLog.HashKey = "0123456789abcdef"
+	proc.Features.AESDecrypt = GetTestAESDecrypt()
+	if err := proc.Features.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Record a failed authentication, a successful command, and a command with sensitive content
+	proc.Process(Command{DaemonName: "test", ClientID: "1.2.3.4", Content: "badpin.s echo hi", TimeoutSec: 10}, true)
+	proc.Process(Command{DaemonName: "test", ClientID: "1.2.3.4", Content: TestCommandProcessorPIN + ".s echo hi", TimeoutSec: 10}, true)
+	proc.Process(Command{DaemonName: "test", ClientID: "1.2.3.4", Content: TestCommandProcessorPIN + ".a secret key", TimeoutSec: 10}, true)
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err != nil || numEntries != 3 {
+		t.Fatal(numEntries, err)
+	}
+	content, err := ioutil.ReadFile(auditFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 ||
+		!strings.Contains(lines[0], `"User":"","Trigger":"","Content":"","OK":false,"Error":"invalid password PIN or shortcut"`) ||
+		!strings.Contains(lines[1], `"DaemonName":"test","ClientID":"1.2.3.4","User":"default","Trigger":".s","Content":".s echo hi","OK":true`) ||
+		strings.Contains(lines[2], "secret key") || strings.Contains(string(content), TestCommandProcessorPIN) {
+		t.Fatal(string(content))
+	}
+	// The environment control app shows the latest entries first
+	result := proc.Process(Command{Content: TestCommandProcessorPIN + ".e audit", TimeoutSec: 10}, false)
+	if result.Error != nil || strings.Index(result.Output, "hidden due to") > strings.Index(result.Output, ".s echo hi") {
+		t.Fatal(result)
+	}
+
+	// Upon restart the chain continues from the last entry
+	delete(auditLogFiles, auditFilePath)
+	audit := AuditLog{FilePath: auditFilePath, HashKey: "0123456789abcdef"}
+	if err := audit.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(audit.GetRecent(), ".s echo hi") {
+		t.Fatal(audit.GetRecent())
+	}
+	if err := audit.Add(AuditEntry{DaemonName: "test", Content: "after restart"}); err != nil {
+		t.Fatal(err)
+	}
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err != nil || numEntries != 5 {
+		t.Fatal(numEntries, err)
+	}
+	// Verification requires the same hash key
+	if numEntries, err := VerifyAuditLog(auditFilePath, "another hash key"); err == nil || numEntries != 0 || !strings.Contains(err.Error(), "line 1 has been altered") {
+		t.Fatal(numEntries, err)
+	}
+	// Lengthy error is shortened
+	if err := audit.Add(AuditEntry{DaemonName: "test", Error: strings.Repeat("e", 2*MaxAuditErrorLength)}); err != nil {
+		t.Fatal(err)
+	}
+	if recent := audit.GetRecent(); !strings.Contains(recent, "err="+strings.Repeat("e", MaxAuditErrorLength)+"\n") {
+		t.Fatal(recent)
+	}
+
+	// Upon restart an incomplete entry at the end of file is removed
+	file, err := os.OpenFile(auditFilePath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"Time":"incomplete`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	delete(auditLogFiles, auditFilePath)
+	if err := audit.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.Add(AuditEntry{DaemonName: "test", Content: "after crash"}); err != nil {
+		t.Fatal(err)
+	}
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err != nil || numEntries != 7 {
+		t.Fatal(numEntries, err)
+	}
+	// Another instance of the opened file, such as the one re-initialised by configuration reload, must use the same key
+	if err := (&AuditLog{FilePath: auditFilePath, HashKey: "another hash key"}).Initialise(); err == nil || !strings.Contains(err.Error(), "different HashKey") {
+		t.Fatal(err)
+	}
+	sameKey := AuditLog{FilePath: auditFilePath, HashKey: "0123456789abcdef"}
+	if err := sameKey.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sameKey.Add(AuditEntry{DaemonName: "test", Content: "same key"}); err != nil {
+		t.Fatal(err)
+	}
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err != nil || numEntries != 8 {
+		t.Fatal(numEntries, err)
+	}
+	// An unreadable last line is not mistaken for an incomplete entry
+	beforeTooLong, err := ioutil.ReadFile(auditFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(auditFilePath, append(beforeTooLong, strings.Repeat("a", MaxAuditLogLineLength+1)...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	delete(auditLogFiles, auditFilePath)
+	if err := audit.Initialise(); err == nil || !strings.Contains(err.Error(), "unreadable") {
+		t.Fatal(err)
+	}
+	if afterTooLong, err := ioutil.ReadFile(auditFilePath); err != nil || len(afterTooLong) != len(beforeTooLong)+MaxAuditLogLineLength+1 {
+		t.Fatal(err, len(afterTooLong))
+	}
+	// Hash key is mandatory
+	delete(auditLogFiles, auditFilePath)
+	if err := (&AuditLog{FilePath: auditFilePath}).Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Detect altered entry
+	tampered := strings.Replace(string(content), ".s echo hi", ".s echo ho", 1)
+	if err := ioutil.WriteFile(auditFilePath, []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err == nil || numEntries != 1 || !strings.Contains(err.Error(), "line 2 has been altered") {
+		t.Fatal(numEntries, err)
+	}
+	// Detect removed entry
+	if err := ioutil.WriteFile(auditFilePath, []byte(lines[0]+"\n"+lines[2]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if numEntries, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err == nil || numEntries != 1 || !strings.Contains(err.Error(), "line 2 does not follow") {
+		t.Fatal(numEntries, err)
+	}
+	// Detect malformed entry
+	if err := ioutil.WriteFile(auditFilePath, []byte("this is not JSON\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyAuditLog(auditFilePath, "0123456789abcdef"); err == nil || !strings.Contains(err.Error(), "line 1 is malformed") {
+		t.Fatal(err)
+	}
+	// A bad entry followed by more entries is not removed
+	if err := ioutil.WriteFile(auditFilePath, []byte(lines[0]+"\nthis is not JSON\n"+lines[2]+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	delete(auditLogFiles, auditFilePath)
+	if err := audit.Initialise(); err == nil || !strings.Contains(err.Error(), "line 2 is malformed") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package toolbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DefaultAuthMaxBackOffSec is the default upper limit of the back-off duration imposed on a client after consecutive authentication failures.
+	DefaultAuthMaxBackOffSec = 600
+	// AuthFailurePurgeThreshold is the number of tracked clients beyond which the tracker begins forgetting clients that have not failed recently.
+	AuthFailurePurgeThreshold = 1000
+)
+
+// ErrAuthBackOff is a command execution error indicating that the client must wait before attempting to authenticate again.
+var ErrAuthBackOff = errors.New("too many failed authentication attempts, try again later")
+
+// authFailures is the record of consecutive authentication failures of a client of a daemon.
+type authFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+/*
+AuthFailureTracker counts the consecutive authentication failures (incorrect password PIN, shortcut, or TOTP) of each
+client ID of each daemon. After a failure, the client must wait before it may try again, and the wait doubles with each
+consecutive failure. A successful authentication clears the client's record, so does a long period of time without
+failure. Optionally, the tracker asks for a notification after a number of consecutive failures, and triggers emergency
+lock-down when too many distinct clients fail within a short period of time - a sign of distributed password guessing.
+*/
+type AuthFailureTracker struct {
+	// BackOffSec is the wait imposed on a client after its first failure, it doubles with each consecutive failure. 0 disables back-off.
+	BackOffSec int `json:"BackOffSec"`
+	// MaxBackOffSec is the upper limit of the wait imposed on a client. It defaults to DefaultAuthMaxBackOffSec.
+	MaxBackOffSec int `json:"MaxBackOffSec"`
+	// NotifyAfterFailures is the number of consecutive failures of a client, upon which a notification Email is sent. 0 disables notification.
+	NotifyAfterFailures int `json:"NotifyAfterFailures"`
+	// LockDownDistinctClients is the number of distinct clients failing within LockDownWindowSec that triggers emergency lock-down. 0 disables lock-down.
+	LockDownDistinctClients int `json:"LockDownDistinctClients"`
+	// LockDownWindowSec is the period of time in which failures of distinct clients are counted towards emergency lock-down.
+	LockDownWindowSec int `json:"LockDownWindowSec"`
+
+	failures map[string]*authFailures
+	mutex    *sync.Mutex
+	// getNow returns the current time, it is replaced by test cases to simulate passage of time.
+	getNow func() time.Time
+	logger lalog.Logger
+}
+
+// IsConfigured returns true only if any of back-off, notification, and lock-down is enabled.
+func (tracker *AuthFailureTracker) IsConfigured() bool {
+	return tracker.BackOffSec > 0 || tracker.NotifyAfterFailures > 0 || tracker.LockDownDistinctClients > 0
+}
+
+// Initialise validates configuration and clears the record of failures.
+func (tracker *AuthFailureTracker) Initialise() error {
+	tracker.logger = lalog.Logger{ComponentName: "AuthFailureTracker"}
+	if tracker.BackOffSec < 0 || tracker.MaxBackOffSec < 0 || tracker.NotifyAfterFailures < 0 || tracker.LockDownDistinctClients < 0 || tracker.LockDownWindowSec < 0 {
+		return fmt.Errorf("AuthFailureTracker.Initialise: the numbers must not be negative")
+	}
+	if tracker.MaxBackOffSec == 0 {
+		tracker.MaxBackOffSec = DefaultAuthMaxBackOffSec
+	}
+	if tracker.LockDownDistinctClients > 0 && tracker.LockDownWindowSec == 0 {
+		return fmt.Errorf("AuthFailureTracker.Initialise: LockDownWindowSec must be specified for LockDownDistinctClients")
+	}
+	tracker.failures = make(map[string]*authFailures)
+	tracker.mutex = new(sync.Mutex)
+	if tracker.getNow == nil {
+		tracker.getNow = time.Now
+	}
+	return nil
+}
+
+// IsBlocked returns true if the client of the daemon must continue to wait before it may try to authenticate again.
+func (tracker *AuthFailureTracker) IsBlocked(daemonName, clientID string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	record, exists := tracker.failures[daemonName+"-"+clientID]
+	return exists && tracker.getNow().Before(record.blockedUntil)
+}
+
+// Succeed clears the record of failures of the client of the daemon.
+func (tracker *AuthFailureTracker) Succeed(daemonName, clientID string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.failures, daemonName+"-"+clientID)
+}
+
+/*
+Fail records an authentication failure of the client of the daemon, and imposes a back-off on the client. It returns
+true if the number of consecutive failures of the client has just reached the notification threshold. If too many
+distinct clients have failed within the lock-down window, the function triggers emergency lock-down.
+*/
+func (tracker *AuthFailureTracker) Fail(daemonName, clientID string) (shouldNotify bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := tracker.getNow()
+	tracker.purge(now)
+	key := daemonName + "-" + clientID
+	record, exists := tracker.failures[key]
+	// A client that has not failed for a long time starts afresh
+	if !exists || record.lastFailure.Before(tracker.getForgetBefore(now)) {
+		record = &authFailures{}
+		tracker.failures[key] = record
+	}
+	record.count++
+	record.lastFailure = now
+	if tracker.BackOffSec > 0 {
+		backOff := tracker.MaxBackOffSec
+		// Double the wait for each consecutive failure, and avoid overflowing the shift.
+		if record.count <= 30 && tracker.BackOffSec<<uint(record.count-1) < tracker.MaxBackOffSec {
+			backOff = tracker.BackOffSec << uint(record.count-1)
+		}
+		record.blockedUntil = now.Add(time.Duration(backOff) * time.Second)
+		tracker.logger.Warning("Fail", key, nil, "client must wait %d seconds after %d consecutive failures", backOff, record.count)
+	}
+	if tracker.LockDownDistinctClients > 0 {
+		windowStart := now.Add(-time.Duration(tracker.LockDownWindowSec) * time.Second)
+		numClients := 0
+		for _, otherRecord := range tracker.failures {
+			if !otherRecord.lastFailure.Before(windowStart) {
+				numClients++
+			}
+		}
+		if numClients >= tracker.LockDownDistinctClients && !misc.EmergencyLockDown {
+			tracker.logger.Warning("Fail", key, nil, "%d distinct clients failed to authenticate within %d seconds, triggering emergency lock-down", numClients, tracker.LockDownWindowSec)
+			misc.TriggerEmergencyLockDown()
+		}
+	}
+	return tracker.NotifyAfterFailures > 0 && record.count == tracker.NotifyAfterFailures
+}
+
+// getForgetBefore returns the moment before which the failures of a client are forgotten.
+func (tracker *AuthFailureTracker) getForgetBefore(now time.Time) time.Time {
+	forgetAfter := 2 * tracker.MaxBackOffSec
+	if tracker.LockDownWindowSec > forgetAfter {
+		forgetAfter = tracker.LockDownWindowSec
+	}
+	return now.Add(-time.Duration(forgetAfter) * time.Second)
+}
+
+/*
+purge forgets the clients that have neither failed nor been blocked recently, in order to limit memory usage. The caller
+must hold the mutex.
+*/
+func (tracker *AuthFailureTracker) purge(now time.Time) {
+	if len(tracker.failures) < AuthFailurePurgeThreshold {
+		return
+	}
+	forgetBefore := tracker.getForgetBefore(now)
+	for key, record := range tracker.failures {
+		if record.lastFailure.Before(forgetBefore) && now.After(record.blockedUntil) {
+			delete(tracker.failures, key)
+		}
+	}
+}
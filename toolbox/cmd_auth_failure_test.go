@@ -0,0 +1,106 @@
+package toolbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+func TestAuthFailureTracker(t *testing.T) {
+	tracker := AuthFailureTracker{}
+	if tracker.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	tracker = AuthFailureTracker{LockDownDistinctClients: 3}
+	if err := tracker.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	now := time.Now()
+	tracker = AuthFailureTracker{BackOffSec: 2, MaxBackOffSec: 5, NotifyAfterFailures: 3, getNow: func() time.Time { return now }}
+	if !tracker.IsConfigured() {
+		t.Fatal("should be configured")
+	}
+	if err := tracker.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// The back-off doubles with each consecutive failure, up to the maximum.
+	for i, backOffSec := range []int{2, 4, 5, 5} {
+		if tracker.IsBlocked("d", "client") {
+			t.Fatal(i)
+		}
+		if shouldNotify := tracker.Fail("d", "client"); shouldNotify != (i == 2) {
+			t.Fatal(i, shouldNotify)
+		}
+		now = now.Add(time.Duration(backOffSec)*time.Second - time.Millisecond)
+		if !tracker.IsBlocked("d", "client") || tracker.IsBlocked("d", "other client") || tracker.IsBlocked("other daemon", "client") {
+			t.Fatal(i)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	// Success clears the record of failures
+	tracker.Succeed("d", "client")
+	tracker.Fail("d", "client")
+	if !tracker.IsBlocked("d", "client") {
+		t.Fatal("should be blocked")
+	}
+	now = now.Add(2 * time.Second)
+	if tracker.IsBlocked("d", "client") {
+		t.Fatal("should not be blocked")
+	}
+	// Failures are forgotten after a long time
+	tracker.Fail("d", "client")
+	now = now.Add(time.Hour)
+	tracker.Fail("d", "client")
+	now = now.Add(2 * time.Second)
+	if tracker.IsBlocked("d", "client") {
+		t.Fatal("should not be blocked")
+	}
+}
+
+func TestAuthFailureTracker_LockDown(t *testing.T) {
+	defer func() {
+		misc.EmergencyLockDown = false
+	}()
+	now := time.Now()
+	tracker := AuthFailureTracker{LockDownDistinctClients: 3, LockDownWindowSec: 10, getNow: func() time.Time { return now }}
+	if err := tracker.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// Failures of the same client and failures outside of the window do not count towards lock-down
+	tracker.Fail("d", "1")
+	now = now.Add(11 * time.Second)
+	tracker.Fail("d", "2")
+	tracker.Fail("d", "2")
+	tracker.Fail("d", "3")
+	if misc.EmergencyLockDown || tracker.IsBlocked("d", "2") {
+		t.Fatal("should not have locked down or blocked")
+	}
+	tracker.Fail("e", "2")
+	if !misc.EmergencyLockDown {
+		t.Fatal("should have locked down")
+	}
+}
+
+func TestCommandProcessor_AuthFailureTracker(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Features.AuthFailureTracker = AuthFailureTracker{BackOffSec: 1, MaxBackOffSec: 1}
+	if err := proc.Features.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result := proc.Process(Command{DaemonName: "d", ClientID: "1", Content: "badpin.s echo hi", TimeoutSec: 10}, true); result.Error != ErrPINAndShortcutNotFound {
+		t.Fatal(result)
+	}
+	// The correct PIN does not help while the client waits out its penalty
+	if result := proc.Process(Command{DaemonName: "d", ClientID: "1", Content: TestCommandProcessorPIN + ".s echo hi", TimeoutSec: 10}, true); result.Error != ErrAuthBackOff {
+		t.Fatal(result)
+	}
+	// Other clients are not affected
+	if result := proc.Process(Command{DaemonName: "d", ClientID: "2", Content: TestCommandProcessorPIN + ".s echo hi", TimeoutSec: 10}, true); result.Error != nil || result.Output != "hi\n" {
+		t.Fatal(result)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if result := proc.Process(Command{DaemonName: "d", ClientID: "1", Content: TestCommandProcessorPIN + ".s echo hi", TimeoutSec: 10}, true); result.Error != nil || result.Output != "hi\n" {
+		t.Fatal(result)
+	}
+}
@@ -0,0 +1,161 @@
+package toolbox
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// ChatMarkupMarkdown presents the command result as a preformatted block in Markdown, e.g. Telegram's MarkdownV2.
+	ChatMarkupMarkdown = "markdown"
+	// ChatMarkupHTML presents the command result as a preformatted block in HTML.
+	ChatMarkupHTML = "html"
+
+	// gsm7Alphabet is the GSM 03.38 basic character set followed by the characters of its extension table.
+	gsm7Alphabet = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà" +
+		"^{}\\[~]|€"
+)
+
+// gsm7Transliteration maps common characters outside of GSM 03.38 character set to their look-alikes within the set.
+var gsm7Transliteration = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '“': "\"", '”': "\"", '„': "\"", '«': "\"", '»': "\"",
+	'–': "-", '—': "-", '…': "...", '`': "'", '\t': " ", '•': "*", '·': ".",
+	'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ç': "c", 'ê': "e", 'ë': "e", 'ē': "e",
+	'í': "i", 'î': "i", 'ï': "i", 'ó': "o", 'ô': "o", 'õ': "o", 'ú': "u", 'û': "u", 'ý': "y", 'ÿ': "y",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'È': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ù': "U", 'Ú': "U", 'Û': "U", 'Ý': "Y",
+}
+
+/*
+ChannelProfile adapts the command result to the constraints of the channel that delivers it to the user, such as the
+character set and segment size of SMS, or the markup of a chat bot. It works on the combined output after LintText,
+hence it should be placed after LintText among the result filters.
+*/
+type ChannelProfile struct {
+	/*
+		TruncateAtWord discards the partial word at the end of combined output that has been cut short by LintText, and
+		ends the output with a hint of the PLT prefix that retrieves the remainder of the output.
+	*/
+	TruncateAtWord bool `json:"TruncateAtWord"`
+	// GSM7 transliterates characters outside of the GSM 03.38 character set used by SMS, the rest become question marks.
+	GSM7 bool `json:"GSM7"`
+	/*
+		SegmentLength splits longer output into segments of this many characters, each segment begins with a counter
+		such as "(1/3)". 153 characters fit into a segment of concatenated SMS. 0 disables segmentation.
+	*/
+	SegmentLength int `json:"SegmentLength"`
+	// ChatMarkup presents the output as a preformatted block in either "markdown" or "html", special characters are escaped.
+	ChatMarkup string `json:"ChatMarkup"`
+}
+
+// Transform adapts the combined output of the result to the channel.
+func (profile *ChannelProfile) Transform(result *Result) error {
+	// Only the output cut short by MaxLength of LintText continues in a PLT command, cutting by BeginPosition alone does not.
+	if profile.TruncateAtWord && result.Truncated && result.untruncatedOutput != "" {
+		result.CombinedOutput = profile.truncateAtWord(result)
+	}
+	if profile.GSM7 {
+		result.CombinedOutput = TransliterateGSM7(result.CombinedOutput)
+	}
+	if profile.SegmentLength > 0 {
+		result.CombinedOutput = SegmentText(result.CombinedOutput, profile.SegmentLength)
+	}
+	switch profile.ChatMarkup {
+	case ChatMarkupMarkdown:
+		// Within a preformatted block of MarkdownV2, only back-quote and backslash need escaping.
+		result.CombinedOutput = "```\n" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(result.CombinedOutput) + "\n```"
+	case ChatMarkupHTML:
+		result.CombinedOutput = "<pre>" + html.EscapeString(result.CombinedOutput) + "</pre>"
+	}
+	return nil
+}
+
+/*
+truncateAtWord cuts the output truncated by LintText at the last word boundary, and makes room for a hint of the PLT
+prefix that continues from where the output ends. The returned text is no longer than the truncated output.
+*/
+func (profile *ChannelProfile) truncateAtWord(result *Result) string {
+	maxLength := len(result.CombinedOutput)
+	untruncated := result.untruncatedOutput
+	// The command is unknown if the result filters are not run by the command processor
+	timeoutSec := result.Command.TimeoutSec
+	if timeoutSec < 1 {
+		timeoutSec = 1
+	}
+	getHint := func(position int) string {
+		return fmt.Sprintf(" (more: %s %d %d %d)", PrefixCommandPLT, result.untruncatedBeginPosition+position, maxLength, timeoutSec)
+	}
+	// Make room for the hint of the largest position
+	cutAt := maxLength - len(getHint(maxLength))
+	if cutAt < maxLength/2 {
+		// The hint would take up too much room
+		return result.CombinedOutput
+	}
+	// Cut at the last space, unless the word is exceedingly long.
+	if lastSpace := strings.LastIndexFunc(untruncated[:cutAt+1], unicode.IsSpace); lastSpace > cutAt/2 {
+		cutAt = lastSpace
+	}
+	// Avoid cutting a multi-byte character in half
+	for cutAt > 0 && !utf8.RuneStart(untruncated[cutAt]) {
+		cutAt--
+	}
+	return strings.TrimRightFunc(untruncated[:cutAt], unicode.IsSpace) + getHint(cutAt)
+}
+
+func (_ *ChannelProfile) SetLogger(_ lalog.Logger) {
+}
+
+// TransliterateGSM7 replaces characters outside of GSM 03.38 character set by their look-alikes or question marks.
+func TransliterateGSM7(text string) string {
+	var out strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(gsm7Alphabet, r) {
+			out.WriteRune(r)
+		} else if replacement, exists := gsm7Transliteration[r]; exists {
+			out.WriteString(replacement)
+		} else {
+			out.WriteRune('?')
+		}
+	}
+	return out.String()
+}
+
+/*
+SegmentText splits the text into segments of the specified number of characters, each segment begins with a counter
+such as "(1/3) ". The segments are concatenated in the return value. Text that fits into a single segment is returned
+as-is.
+*/
+func SegmentText(text string, segmentLength int) string {
+	runes := []rune(text)
+	if len(runes) <= segmentLength {
+		return text
+	}
+	// The counter takes more room as the number of segments grows
+	numSegments := 1
+	for {
+		counterLength := len(fmt.Sprintf("(%d/%d) ", numSegments, numSegments))
+		if counterLength >= segmentLength {
+			return text
+		}
+		perSegment := segmentLength - counterLength
+		if needed := (len(runes) + perSegment - 1) / perSegment; needed > numSegments {
+			numSegments = needed
+			continue
+		}
+		var out strings.Builder
+		for i := 0; i < numSegments; i++ {
+			end := (i + 1) * perSegment
+			if end > len(runes) {
+				end = len(runes)
+			}
+			out.WriteString(fmt.Sprintf("(%d/%d) ", i+1, numSegments))
+			out.WriteString(string(runes[i*perSegment : end]))
+		}
+		return out.String()
+	}
+}
@@ -0,0 +1,105 @@
+package toolbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransliterateGSM7(t *testing.T) {
+	if out := TransliterateGSM7("“Héllo” – naïve 😀 {€}"); out != "\"Héllo\" - naive ? {€}" {
+		t.Fatal(out)
+	}
+}
+
+func TestSegmentText(t *testing.T) {
+	// Text that fits into a single segment is not altered
+	if out := SegmentText("abc", 3); out != "abc" {
+		t.Fatal(out)
+	}
+	// The segment is too short to accommodate the counter
+	if out := SegmentText("abcdefghij", 6); out != "abcdefghij" {
+		t.Fatal(out)
+	}
+	if out := SegmentText("abcdefghij", 8); out != "(1/5) ab(2/5) cd(3/5) ef(4/5) gh(5/5) ij" {
+		t.Fatal(out)
+	}
+	if out := SegmentText("abcdefghijkl", 9); out != "(1/4) abc(2/4) def(3/4) ghi(4/4) jkl" {
+		t.Fatal(out)
+	}
+	// The counter grows longer when there are ten or more segments
+	if out := SegmentText(strings.Repeat("0123456789", 4), 10); !strings.HasPrefix(out, "(1/20) 01(2/20) 23") || !strings.HasSuffix(out, "(19/20) 67(20/20) 89") {
+		t.Fatal(out)
+	}
+}
+
+func TestChannelProfile_Transform(t *testing.T) {
+	// Do nothing if no option is turned on
+	profile := ChannelProfile{}
+	result := &Result{CombinedOutput: "a`b\\c <d>&"}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "a`b\\c <d>&" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	profile.ChatMarkup = ChatMarkupMarkdown
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "```\na\\`b\\\\c <d>&\n```" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	profile.ChatMarkup = ChatMarkupHTML
+	result.CombinedOutput = "a`b\\c <d>&"
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "<pre>a`b\\c &lt;d&gt;&amp;</pre>" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// GSM 7-bit characters and segments
+	profile = ChannelProfile{GSM7: true, SegmentLength: 8}
+	result.CombinedOutput = "“ab” – cdé"
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "(1/5) \"a(2/5) b\"(3/5)  -(4/5)  c(5/5) dé" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+}
+
+func TestChannelProfile_TruncateAtWord(t *testing.T) {
+	lint := LintText{MaxLength: 50}
+	profile := ChannelProfile{TruncateAtWord: true}
+	// Output that is not truncated is left alone
+	result := &Result{Command: Command{TimeoutSec: 10}, CombinedOutput: "the quick brown fox"}
+	if err := lint.Transform(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "the quick brown fox" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// Cut at the last word that fits along with the hint
+	result.CombinedOutput = "the quick brown fox jumps over the lazy dog and keeps running far away"
+	if err := lint.Transform(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "the quick brown fox jumps (more: .plt 25 50 10)" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// The position in the hint accounts for the characters discarded from the beginning
+	lint.BeginPosition = 16
+	result.CombinedOutput = "the quick brown fox jumps over the lazy dog and keeps running far away"
+	if err := lint.Transform(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "fox jumps over the lazy dog (more: .plt 43 50 10)" || len(result.CombinedOutput) > lint.MaxLength {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// A long word is cut in the middle
+	lint.BeginPosition = 0
+	result.CombinedOutput = strings.Repeat("0123456789", 5) + " abc"
+	if err := lint.Transform(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != "0123456789012345678901234567 (more: .plt 28 50 10)" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// Output cut only at the beginning is left alone
+	lint = LintText{BeginPosition: 10, MaxLength: 200}
+	result = &Result{Command: Command{TimeoutSec: 10}, CombinedOutput: strings.Repeat("word ", 40)}
+	if err := lint.Transform(result); err != nil || !result.Truncated {
+		t.Fatal(err, result)
+	}
+	if err := profile.Transform(result); err != nil || result.CombinedOutput != strings.Repeat("word ", 38) {
+		t.Fatal(err, result.CombinedOutput)
+	}
+}
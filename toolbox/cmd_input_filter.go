@@ -5,6 +5,7 @@ import (
 	"crypto/subtle"
 	"errors"
 	"strings"
+	"sync"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 )
@@ -17,21 +18,98 @@ type CommandFilter interface {
 	Transform(Command) (Command, error)
 }
 
+const (
+	// DefaultUserName identifies the commands authenticated by the password PIN of PINAndShortcuts, which have access to all apps.
+	DefaultUserName = "default"
+	// ShortcutUserName identifies the commands expanded from shortcuts of PINAndShortcuts, which have access to all apps.
+	ShortcutUserName = "shortcut"
+	// AllowAllCommands is an entry of User.AllowedCommands that permits the user to run all app commands.
+	AllowAllCommands = "*"
+)
+
 /*
-LastTOTP and LastTOTPCommandContent track the command executed and successfully authenticated via TOTP instead of password PIN entry.
-A successfully authenticated TOTP may only be used to execute a single command - one or more times while the TOTP remains valid.
+User is a named credential accepted by PINAndShortcuts in addition to its password PIN. Whereas the password PIN grants
+access to all apps, a user may only run the app commands that are permitted to the user.
 */
-var LastTOTP, LastTOTPCommandContent string
+type User struct {
+	// PIN is the user's own password PIN, it is used in the same way as the password PIN of PINAndShortcuts.
+	PIN string `json:"PIN"`
+	/*
+		TOTPSeed is an optional base32 secret shared with an authenticator app. If it is present, the user must enter the
+		six-digit code from the app right after the PIN, and the PIN alone is no longer accepted.
+	*/
+	TOTPSeed string `json:"TOTPSeed"`
+	/*
+		AllowedCommands are the app commands the user may run. Each entry is an app trigger (e.g. ".s"), optionally
+		followed by the leading words of its parameters (e.g. ".e info"). An entry "*" permits all app commands.
+	*/
+	AllowedCommands []string `json:"AllowedCommands"`
+}
+
+// IsAllowed returns true only if the user is permitted to run the app of the trigger with the parameters.
+func (user *User) IsAllowed(trigger Trigger, params string) bool {
+	paramWords := strings.Fields(strings.ToLower(params))
+	for _, allowed := range user.AllowedCommands {
+		allowedWords := strings.Fields(strings.ToLower(allowed))
+		if len(allowedWords) == 0 {
+			continue
+		}
+		if allowedWords[0] == AllowAllCommands {
+			return true
+		}
+		if allowedWords[0] != strings.ToLower(string(trigger)) || len(allowedWords)-1 > len(paramWords) {
+			continue
+		}
+		matched := true
+		for i, word := range allowedWords[1:] {
+			if paramWords[i] != word {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
 
 /*
 Match prefix PIN (or pre-defined shortcuts) against lines among input command. Return the matched line trimmed
 and without PIN prefix, or expanded shortcut if found.
 To successfully expend shortcut, the shortcut must occupy the entire line, without extra prefix or suffix.
+Besides the password PIN, the PINs and TOTP codes of named users are matched too, and the command is restricted to the
+permission of the matched user.
 Return error if neither PIN nor pre-defined shortcuts matched any line of input command.
 */
 type PINAndShortcuts struct {
 	PIN       string            `json:"PIN"`
 	Shortcuts map[string]string `json:"Shortcuts"`
+	Users     map[string]*User  `json:"Users"`
+	/*
+		SeparateTOTPStore keeps track of the consumed TOTP codes in a store of this filter's own. By default, all filters
+		share the same store, so that a TOTP code used with one daemon cannot be used with another daemon to run a
+		different command.
+	*/
+	SeparateTOTPStore bool `json:"SeparateTOTPStore"`
+
+	totpStore *TOTPStore
+}
+
+// separateTOTPStoreMutex protects the lazy creation of separate TOTP stores.
+var separateTOTPStoreMutex = new(sync.Mutex)
+
+// getTOTPStore returns the store that keeps track of the TOTP codes consumed via this filter.
+func (pin *PINAndShortcuts) getTOTPStore() *TOTPStore {
+	if !pin.SeparateTOTPStore {
+		return SharedTOTPStore
+	}
+	separateTOTPStoreMutex.Lock()
+	defer separateTOTPStoreMutex.Unlock()
+	if pin.totpStore == nil {
+		pin.totpStore = NewTOTPStore()
+	}
+	return pin.totpStore
 }
 
 var ErrPINAndShortcutNotFound = errors.New("invalid password PIN or shortcut")
@@ -48,19 +126,19 @@ The TOTP number set is calculated this way:
 2. List 2 = the previous, current, and upcoming TOTP 2FA codes based on the password PIN string reversed.
 3. For each string from list 1, concatenate it with each string from list 2, and return the concatenation results in a set.
 */
-func (pin *PINAndShortcuts) getTOTP() (ret map[string]bool) {
+func getTOTP(pin string) (ret map[string]bool) {
 	ret = map[string]bool{}
-	if pin.PIN == "" {
+	if pin == "" {
 		return
 	}
 	// Calculate TOTP using password PIN - list 1
-	prev1, current1, next1, err := GetTwoFACodes(pin.PIN)
+	prev1, current1, next1, err := GetTwoFACodes(pin)
 	if err != nil {
 		lalog.DefaultLogger.Info("getTOTP", "", err, "failed to calculate TOTP")
 		return
 	}
 	// Reverse the password PIN
-	reversed := []rune(pin.PIN)
+	reversed := []rune(pin)
 	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
 		reversed[i], reversed[j] = reversed[j], reversed[i]
 	}
@@ -84,13 +162,74 @@ func (pin *PINAndShortcuts) getTOTP() (ret map[string]bool) {
 	return
 }
 
-func (pin *PINAndShortcuts) Transform(cmd Command) (Command, error) {
-	if pin.PIN == "" && (pin.Shortcuts == nil || len(pin.Shortcuts) == 0) {
-		return Command{}, errors.New("PINAndShortcut must use a password PIN, shortcut(s), or both.")
+// getSeedTOTP returns the previous, current, and upcoming six-digit codes that an authenticator app calculates from the seed.
+func getSeedTOTP(seed string) (ret map[string]bool) {
+	ret = map[string]bool{}
+	prev, current, next, err := GetTwoFACodes(seed)
+	if err != nil {
+		lalog.DefaultLogger.Info("getSeedTOTP", "", err, "failed to calculate TOTP")
+		return
+	}
+	ret[prev] = true
+	ret[current] = true
+	ret[next] = true
+	return
+}
+
+/*
+matchPIN looks for the password PIN or user PIN that prefixes the line, and returns the name and permission of the
+matched user, as well as the length of the matched PIN. The longest PIN wins in case that a PIN is the prefix of another.
+The users who have a TOTP seed are left to matchTOTP, because their PIN alone is not sufficient.
+*/
+func (pin *PINAndShortcuts) matchPIN(line string) (userName string, user *User, pinLength int) {
+	if pin.PIN != "" && len(line) > len(pin.PIN) && subtle.ConstantTimeCompare([]byte(line[:len(pin.PIN)]), []byte(pin.PIN)) == 1 {
+		userName, pinLength = DefaultUserName, len(pin.PIN)
+	}
+	for name, candidate := range pin.Users {
+		if candidate == nil || candidate.PIN == "" || candidate.TOTPSeed != "" || len(candidate.PIN) <= pinLength {
+			continue
+		}
+		if len(line) > len(candidate.PIN) && subtle.ConstantTimeCompare([]byte(line[:len(candidate.PIN)]), []byte(candidate.PIN)) == 1 {
+			userName, user, pinLength = name, candidate, len(candidate.PIN)
+		}
 	}
-	// Calculate password-derived TOTP codes that can be used in place of password PIN
-	totpCodes := pin.getTOTP()
+	return
+}
 
+/*
+matchTOTP looks for the TOTP code that prefixes the line, and returns the name and permission of the matched user, the
+matched code, and the length of the prefix that carries the code. The code is either made of two TOTP numbers derived
+from a password PIN, or a single TOTP number derived from a user's TOTP seed, which must follow the user's PIN.
+*/
+func (pin *PINAndShortcuts) matchTOTP(line string) (userName string, user *User, code string, prefixLength int) {
+	for name, candidate := range pin.Users {
+		if candidate == nil || candidate.PIN == "" || candidate.TOTPSeed == "" || len(line) <= len(candidate.PIN)+6 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(line[:len(candidate.PIN)]), []byte(candidate.PIN)) == 1 {
+			if seedCode := line[len(candidate.PIN) : len(candidate.PIN)+6]; getSeedTOTP(candidate.TOTPSeed)[seedCode] {
+				return name, candidate, seedCode, len(candidate.PIN) + 6
+			}
+		}
+	}
+	if len(line) > 12 {
+		if getTOTP(pin.PIN)[line[:12]] {
+			return DefaultUserName, nil, line[:12], 12
+		}
+		for name, candidate := range pin.Users {
+			// The TOTP derived from PIN alone is not sufficient for the users who have a TOTP seed
+			if candidate != nil && candidate.TOTPSeed == "" && getTOTP(candidate.PIN)[line[:12]] {
+				return name, candidate, line[:12], 12
+			}
+		}
+	}
+	return
+}
+
+func (pin *PINAndShortcuts) Transform(cmd Command) (Command, error) {
+	if pin.PIN == "" && len(pin.Shortcuts) == 0 && len(pin.Users) == 0 {
+		return Command{}, errors.New("PINAndShortcut must use a password PIN, shortcut(s), user(s), or a combination of them.")
+	}
 	// Among the input lines, look for a shortcut match, password PIN match, or TOTP code match, and leave command alone for further processing.
 	for _, line := range cmd.Lines() {
 		line = strings.TrimSpace(line)
@@ -100,33 +239,32 @@ func (pin *PINAndShortcuts) Transform(cmd Command) (Command, error) {
 				ret := cmd
 				// Toolbox command comes from the shortcut's configuration
 				ret.Content = shortcut
+				ret.User, ret.userPermission = ShortcutUserName, nil
 				return ret, nil
 			}
 		}
-		// Look for a password PIN match
-		if pin.PIN != "" {
-			if len(line) > len(pin.PIN) && subtle.ConstantTimeCompare([]byte(line[:len(pin.PIN)]), []byte(pin.PIN)) == 1 {
-				ret := cmd
-				// Remove matched password from the input, leave the app command in-place.
-				ret.Content = line[len(pin.PIN):]
-				return ret, nil
-			}
-			// Look for a TOTP code match. The code is made of two TOTP numbers with six digits each.
-			if len(line) > 12 {
-				totpInput := line[:12]
-				if totpCodes[totpInput] {
-					// Prevent a TOTP from executing more than one commands in short succession
-					if totpInput == LastTOTP && cmd.Content != LastTOTPCommandContent {
-						return cmd, ErrTOTPAlreadyUsed
-					}
-					ret := cmd
-					LastTOTP = totpInput
-					LastTOTPCommandContent = cmd.Content
-					// Remove matched TOTP from the input, leave the toolbox command in-place.
-					ret.Content = line[12:]
-					return ret, nil
-				}
+		/*
+			Look for a TOTP code match before the password PIN, so that the PIN of another user does not take the PIN and
+			TOTP code of a user who has a TOTP seed for a longer PIN.
+		*/
+		if userName, user, totpInput, prefixLength := pin.matchTOTP(line); prefixLength > 0 {
+			// Prevent a TOTP from executing more than one command
+			if !pin.getTOTPStore().Consume(userName, totpInput, cmd.Content) {
+				return cmd, ErrTOTPAlreadyUsed
 			}
+			ret := cmd
+			// Remove matched TOTP from the input, leave the toolbox command in-place.
+			ret.Content = line[prefixLength:]
+			ret.User, ret.userPermission = userName, user
+			return ret, nil
+		}
+		// Look for a password PIN match
+		if userName, user, pinLength := pin.matchPIN(line); pinLength > 0 {
+			ret := cmd
+			// Remove matched password from the input, leave the app command in-place.
+			ret.Content = line[pinLength:]
+			ret.User, ret.userPermission = userName, user
+			return ret, nil
 		}
 	}
 	// Cannot match a shortcut, password, or TOTP code, the command must not be processed further.
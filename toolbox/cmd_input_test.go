@@ -7,13 +7,11 @@ import (
 
 func TestGetTOTP(t *testing.T) {
 	// Empty PIN results in no TOTP codes returned
-	pin := PINAndShortcuts{}
-	if codes := pin.getTOTP(); len(codes) != 0 {
+	if codes := getTOTP(""); len(codes) != 0 {
 		t.Fatal(codes)
 	}
 	// Validate code length
-	pin.PIN = "abcdefg"
-	codes := pin.getTOTP()
+	codes := getTOTP("abcdefg")
 	if len(codes) != 9 {
 		t.Fatal(codes)
 	}
@@ -92,6 +90,118 @@ func TestPINAndShortcuts_Transform(t *testing.T) {
 	if out, err := pin.Transform(Command{Content: current1 + current2 + "alpha"}); err != ErrTOTPAlreadyUsed {
 		t.Fatal(out, err)
 	}
+	// The consumed TOTP is shared with the filters of other daemons
+	otherDaemonPIN := &PINAndShortcuts{PIN: "mypin"}
+	if out, err := otherDaemonPIN.Transform(Command{Content: current1 + current2 + "beta"}); err != ErrTOTPAlreadyUsed {
+		t.Fatal(out, err)
+	}
+	// Unless the filter keeps a separate store
+	otherDaemonPIN.SeparateTOTPStore = true
+	if out, err := otherDaemonPIN.Transform(Command{Content: current1 + current2 + "beta"}); err != nil || out.Content != "beta" {
+		t.Fatal(out, err)
+	}
+	if out, err := otherDaemonPIN.Transform(Command{Content: current1 + current2 + "gamma"}); err != ErrTOTPAlreadyUsed {
+		t.Fatal(out, err)
+	}
+}
+
+func TestPINAndShortcuts_TransformUsers(t *testing.T) {
+	alice := &User{PIN: "alicepin", AllowedCommands: []string{".s"}}
+	bob := &User{PIN: "bobbypin", TOTPSeed: "JBSWY3DPEHPK3PXP", AllowedCommands: []string{".e info"}}
+	dave := &User{PIN: "alicepin3", AllowedCommands: []string{".e info"}}
+	// An empty user does not match anything
+	pin := PINAndShortcuts{Users: map[string]*User{"alice": alice, "bob": bob, "carol": nil, "dave": dave}}
+	// Users alone are sufficient for the filter to work
+	if out, err := pin.Transform(Command{Content: "badpin.s echo"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(out, err)
+	}
+	if out, err := pin.Transform(Command{Content: "alicepin.s echo"}); err != nil || out.Content != ".s echo" || out.User != "alice" || out.userPermission != alice {
+		t.Fatal(out, err)
+	}
+	// The longest matching PIN wins
+	if out, err := pin.Transform(Command{Content: "alicepin3.e info"}); err != nil || out.Content != ".e info" || out.User != "dave" || out.userPermission != dave {
+		t.Fatal(out, err)
+	}
+	// The PIN alone is not sufficient for a user who has a TOTP seed
+	if out, err := pin.Transform(Command{Content: "bobbypin.e info"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(out, err)
+	}
+	// The password PIN grants access to all apps
+	pin.PIN = "mypin"
+	if out, err := pin.Transform(Command{Content: "mypin.s echo"}); err != nil || out.User != DefaultUserName || out.userPermission != nil {
+		t.Fatal(out, err)
+	}
+	// Match TOTP derived from user PIN
+	_, current1, _, err := GetTwoFACodes("alicepin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, current2, _, err := GetTwoFACodes("nipecila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := pin.Transform(Command{Content: current1 + current2 + ".s date"}); err != nil || out.Content != ".s date" || out.User != "alice" {
+		t.Fatal(out, err)
+	}
+	// Match TOTP generated by authenticator app from user's seed
+	_, current, _, err := GetTwoFACodes("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := pin.Transform(Command{Content: "bobbypin" + current + ".e info"}); err != nil || out.Content != ".e info" || out.User != "bob" || out.userPermission != bob {
+		t.Fatal(out, err)
+	}
+	if out, err := pin.Transform(Command{Content: "bobbypin" + current + ".e runtime"}); err != ErrTOTPAlreadyUsed {
+		t.Fatal(out, err)
+	}
+	// The code alone, or the TOTP derived from the PIN, is not sufficient for a user who has a TOTP seed
+	if out, err := pin.Transform(Command{Content: current + ".e info"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(out, err)
+	}
+	_, bobCurrent1, _, err := GetTwoFACodes("bobbypin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, bobCurrent2, _, err := GetTwoFACodes("nipybbob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := pin.Transform(Command{Content: bobCurrent1 + bobCurrent2 + ".e info"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(out, err)
+	}
+	// Shortcuts are identified separately
+	pin.Shortcuts = map[string]string{"abc": ".e info"}
+	if out, err := pin.Transform(Command{Content: "abc"}); err != nil || out.User != ShortcutUserName || out.userPermission != nil {
+		t.Fatal(out, err)
+	}
+}
+
+func TestUser_IsAllowed(t *testing.T) {
+	user := User{AllowedCommands: []string{"", ".s", " .e  info ", ".i  Get Mail"}}
+	for _, allowed := range []struct {
+		trigger Trigger
+		params  string
+	}{{".s", ""}, {".s", "rm -rf /"}, {".e", "info"}, {".e", " INFO  abc"}, {".i", "get mail 1"}} {
+		if !user.IsAllowed(allowed.trigger, allowed.params) {
+			t.Fatal("should have been allowed", allowed)
+		}
+	}
+	for _, denied := range []struct {
+		trigger Trigger
+		params  string
+	}{{".e", ""}, {".e", "kill"}, {".e", "information"}, {".i", "get"}, {".w", "info"}} {
+		if user.IsAllowed(denied.trigger, denied.params) {
+			t.Fatal("should have been denied", denied)
+		}
+	}
+	user.AllowedCommands = append(user.AllowedCommands, AllowAllCommands)
+	if !user.IsAllowed(".e", "kill") {
+		t.Fatal("should have been allowed")
+	}
+	user.AllowedCommands = nil
+	if user.IsAllowed(".s", "") {
+		t.Fatal("should have been denied")
+	}
 }
 
 func TestTranslateSequences_Transform(t *testing.T) {
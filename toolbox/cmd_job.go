@@ -0,0 +1,239 @@
+package toolbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	/*
+		PrefixCommandBackground is the magic string to prefix an app command, in order to run it in the background and
+		fetch its result later.
+	*/
+	PrefixCommandBackground = ".bg"
+	/*
+		PrefixCommandJob is the magic string of the command that lists the background jobs, or fetches the result of a
+		background job.
+	*/
+	PrefixCommandJob = ".job"
+
+	// DefaultMaxJobs is the default maximum number of background jobs to keep track of.
+	DefaultMaxJobs = 20
+	// DefaultJobRetentionSec is the default number of seconds to keep the result of a completed job.
+	DefaultJobRetentionSec = 3600
+	// DefaultJobTimeoutSec is the default timeout of an app command running in the background.
+	DefaultJobTimeoutSec = 600
+)
+
+// ErrTooManyJobs is a command execution error indicating that the job table is full of running jobs.
+var ErrTooManyJobs = errors.New("too many background jobs are running, try again later")
+
+// ErrJobNotFound is a command execution error indicating that the job ID is unknown, or the job has expired.
+var ErrJobNotFound = errors.New("the job does not exist or has expired")
+
+// ErrBadJobQuery reminds user of the proper syntax to query background jobs.
+var ErrBadJobQuery = errors.New(PrefixCommandJob + " [job ID [position [length]]]")
+
+// backgroundJob is an app command running or having run in the background.
+type backgroundJob struct {
+	id          string
+	daemonName  string
+	user        string
+	logContent  string
+	submittedAt time.Time
+	completedAt time.Time
+	result      *Result
+}
+
+// isDone returns true if the job has completed.
+func (job *backgroundJob) isDone() bool {
+	return job.result != nil
+}
+
+/*
+BackgroundJobs keeps track of app commands running in the background, which are not bound by the timeout of the daemon
+that received the command. A job is identified by a random number, its result may be fetched by the user who submitted
+the job until the retention period expires.
+*/
+type BackgroundJobs struct {
+	MaxJobs       int `json:"MaxJobs"`       // MaxJobs is the maximum number of jobs to keep track of, running and completed.
+	RetentionSec  int `json:"RetentionSec"`  // RetentionSec is the number of seconds to keep the result of a completed job.
+	JobTimeoutSec int `json:"JobTimeoutSec"` // JobTimeoutSec is the timeout of an app command running in the background.
+
+	jobs  map[string]*backgroundJob
+	mutex *sync.Mutex
+}
+
+// Initialise sets default configuration values and clears the job table.
+func (bg *BackgroundJobs) Initialise() error {
+	if bg.MaxJobs < 1 {
+		bg.MaxJobs = DefaultMaxJobs
+	}
+	if bg.RetentionSec < 1 {
+		bg.RetentionSec = DefaultJobRetentionSec
+	}
+	if bg.JobTimeoutSec < 1 {
+		bg.JobTimeoutSec = DefaultJobTimeoutSec
+	}
+	bg.jobs = make(map[string]*backgroundJob)
+	bg.mutex = new(sync.Mutex)
+	return nil
+}
+
+// purgeExpired forgets the completed jobs that have passed the retention period. The caller must hold the mutex.
+func (bg *BackgroundJobs) purgeExpired() {
+	for id, job := range bg.jobs {
+		if job.isDone() && time.Since(job.completedAt) > time.Duration(bg.RetentionSec)*time.Second {
+			delete(bg.jobs, id)
+		}
+	}
+}
+
+/*
+makeRoom forgets the expired jobs, and the oldest completed job if the job table remains full. It returns false if the
+job table is full of running jobs. The caller must hold the mutex.
+*/
+func (bg *BackgroundJobs) makeRoom() bool {
+	bg.purgeExpired()
+	if len(bg.jobs) < bg.MaxJobs {
+		return true
+	}
+	var oldest *backgroundJob
+	for _, job := range bg.jobs {
+		if job.isDone() && (oldest == nil || job.completedAt.Before(oldest.completedAt)) {
+			oldest = job
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(bg.jobs, oldest.id)
+	return true
+}
+
+/*
+Submit runs the function in the background on behalf of the command's user, and returns the ID of the new job. The
+log content describes the job in job listing.
+*/
+func (bg *BackgroundJobs) Submit(cmd Command, logContent string, fun func() *Result) (string, error) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+	if !bg.makeRoom() {
+		return "", ErrTooManyJobs
+	}
+	// Job IDs are numbers that are easy to type on a telephone key pad, and they are too many to be guessed.
+	var id string
+	randBytes := make([]byte, 8)
+	for {
+		if _, err := rand.Read(randBytes); err != nil {
+			return "", fmt.Errorf("BackgroundJobs.Submit: failed to read random number - %v", err)
+		}
+		id = strconv.FormatUint(binary.BigEndian.Uint64(randBytes), 10)
+		if _, exists := bg.jobs[id]; !exists {
+			break
+		}
+	}
+	job := &backgroundJob{
+		id:          id,
+		daemonName:  cmd.DaemonName,
+		user:        cmd.User,
+		logContent:  logContent,
+		submittedAt: time.Now(),
+	}
+	bg.jobs[id] = job
+	go func() {
+		result := fun()
+		bg.mutex.Lock()
+		job.result = result
+		job.completedAt = time.Now()
+		bg.mutex.Unlock()
+	}()
+	return id, nil
+}
+
+/*
+isJobVisible returns true if the job may be seen by the command's user, who must be the user that submitted the job. Each
+daemon has its own users, hence the user of the same name from another daemon does not see the job.
+*/
+func isJobVisible(job *backgroundJob, cmd Command) bool {
+	return job.daemonName == cmd.DaemonName && job.user == cmd.User
+}
+
+/*
+Query lists the jobs visible to the command's user if the command content is empty. Otherwise, the command content is
+a job ID optionally followed by position and length, and the function returns the job's status, or the portion of job's
+output at the position.
+*/
+func (bg *BackgroundJobs) Query(cmd Command) *Result {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+	bg.purgeExpired()
+	params := strings.Fields(cmd.Content)
+	if len(params) == 0 {
+		return &Result{Output: bg.list(cmd)}
+	}
+	if len(params) > 3 {
+		return &Result{Error: ErrBadJobQuery}
+	}
+	job, exists := bg.jobs[params[0]]
+	if !exists || !isJobVisible(job, cmd) {
+		return &Result{Error: ErrJobNotFound}
+	}
+	if !job.isDone() {
+		return &Result{Output: fmt.Sprintf("job %s has been running for %d seconds", job.id, int(time.Since(job.submittedAt).Seconds()))}
+	}
+	// Page through the output in the same way as PLT
+	output := job.result.Output
+	position, length := 0, len(output)
+	var intErr error
+	if len(params) > 1 {
+		if position, intErr = strconv.Atoi(params[1]); intErr != nil || position < 0 {
+			return &Result{Error: ErrBadJobQuery}
+		}
+	}
+	if len(params) > 2 {
+		if length, intErr = strconv.Atoi(params[2]); intErr != nil || length < 0 {
+			return &Result{Error: ErrBadJobQuery}
+		}
+	}
+	if position > len(output) {
+		position = len(output)
+	}
+	if position+length > len(output) {
+		length = len(output) - position
+	}
+	return &Result{Error: job.result.Error, Output: output[position : position+length]}
+}
+
+// list returns one line of text for each job visible to the command's user, the latest job comes first. The caller must hold the mutex.
+func (bg *BackgroundJobs) list(cmd Command) string {
+	visible := make([]*backgroundJob, 0, len(bg.jobs))
+	for _, job := range bg.jobs {
+		if isJobVisible(job, cmd) {
+			visible = append(visible, job)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		return visible[i].submittedAt.After(visible[j].submittedAt)
+	})
+	var out bytes.Buffer
+	for _, job := range visible {
+		status := "running"
+		if job.isDone() {
+			status = "ok"
+			if job.result.Error != nil {
+				status = "failed"
+			}
+		}
+		out.WriteString(fmt.Sprintf("%s %s %s %s\n", job.id, status, job.submittedAt.Format("15:04:05"), job.logContent))
+	}
+	return out.String()
+}
@@ -0,0 +1,120 @@
+package toolbox
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackgroundJobs(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.Features.BackgroundJobs = BackgroundJobs{RetentionSec: 4}
+	if err := proc.Features.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	jobIDRegex := regexp.MustCompile(`job (\d+) has started`)
+	submit := func(content string) string {
+		result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandBackground + content, TimeoutSec: 1}, true)
+		match := jobIDRegex.FindStringSubmatch(result.Output)
+		if result.Error != nil || len(match) != 2 {
+			t.Fatal(result)
+		}
+		return match[1]
+	}
+	query := func(content string) *Result {
+		return proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandJob + content, TimeoutSec: 1}, false)
+	}
+	// The job is not bound by the timeout of the command that submitted it
+	slowJob := submit(" .s sleep 2; echo slow")
+	if result := query(" " + slowJob); result.Error != nil || !strings.Contains(result.Output, "has been running for") {
+		t.Fatal(result)
+	}
+	failedJob := submit(" .s echo abcdefg; false")
+	time.Sleep(2500 * time.Millisecond)
+	if result := query(" " + slowJob); result.Error != nil || result.Output != "slow\n" {
+		t.Fatal(result)
+	}
+	// Page through the output
+	if result := query(" " + failedJob + " 2 3"); result.Error == nil || result.Output != "cde" {
+		t.Fatal(result)
+	}
+	if result := query(" " + failedJob + " 100"); result.Error == nil || result.Output != "" {
+		t.Fatal(result)
+	}
+	if result := query(" " + failedJob + " a"); result.Error != ErrBadJobQuery {
+		t.Fatal(result)
+	}
+	if result := query(""); result.Error != nil || !strings.Contains(result.Output, slowJob+" ok") || !strings.Contains(result.Output, failedJob+" failed") {
+		t.Fatal(result)
+	}
+	// A word that merely begins with the job prefixes is not a job command
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + PrefixCommandBackground + "x", TimeoutSec: 1}, false); result.Error != ErrBadPrefix {
+		t.Fatal(result)
+	}
+	for content, isJob := range map[string]bool{PrefixCommandJob: true, PrefixCommandJob + " 1": true, PrefixCommandJob + "s": false} {
+		cmd := Command{Content: content}
+		if cmd.FindAndRemoveWord(PrefixCommandJob) != isJob {
+			t.Fatal(content)
+		}
+	}
+	// Completed jobs expire after the retention period
+	time.Sleep(4 * time.Second)
+	if result := query(" " + slowJob); result.Error != ErrJobNotFound {
+		t.Fatal(result)
+	}
+}
+
+func TestBackgroundJobs_Limits(t *testing.T) {
+	bg := BackgroundJobs{MaxJobs: 2}
+	if err := bg.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	block := make(chan struct{})
+	defer close(block)
+	slow := func() *Result {
+		<-block
+		return &Result{}
+	}
+	fast := func() *Result {
+		return &Result{Output: "fast"}
+	}
+	fastID, err := bg.Submit(Command{User: "alice", userPermission: &User{}}, "fast", fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bg.Submit(Command{}, "slow", slow); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// Users only see their own jobs, even if they are not restricted to a subset of apps.
+	for _, other := range []Command{
+		{Content: fastID, User: "bob", userPermission: &User{}},
+		{Content: fastID, User: "bob"},
+		{Content: fastID, User: "alice", DaemonName: "httpd", userPermission: &User{}},
+	} {
+		if result := bg.Query(other); result.Error != ErrJobNotFound {
+			t.Fatal(other, result)
+		}
+		if result := bg.Query(Command{User: other.User, DaemonName: other.DaemonName}); result.Error != nil || strings.Contains(result.Output, fastID) {
+			t.Fatal(other, result)
+		}
+	}
+	if result := bg.Query(Command{Content: fastID, User: "alice", userPermission: &User{}}); result.Error != nil || result.Output != "fast" {
+		t.Fatal(result)
+	}
+	if len(fastID) < 10 {
+		t.Fatal("job ID is too short", fastID)
+	}
+	// The oldest completed job makes room for the new job
+	if _, err := bg.Submit(Command{}, "slow", slow); err != nil {
+		t.Fatal(err)
+	}
+	if result := bg.Query(Command{Content: fastID, User: "alice", userPermission: &User{}}); result.Error != ErrJobNotFound {
+		t.Fatal(result)
+	}
+	// The job table is full of running jobs
+	if _, err := bg.Submit(Command{}, "slow", slow); err != ErrTooManyJobs {
+		t.Fatal(err)
+	}
+}
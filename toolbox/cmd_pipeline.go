@@ -0,0 +1,159 @@
+package toolbox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// PipelineSequenceSeparator separates app commands that run one after another regardless of the outcome.
+	PipelineSequenceSeparator = ';'
+	// PipelinePipeSeparator separates app commands where the output of the former is appended to the parameters of the latter.
+	PipelinePipeSeparator = '|'
+	// MaxPipelineSteps is the maximum number of app commands a pipeline may run.
+	MaxPipelineSteps = 10
+)
+
+// ErrPipelineTimeout is the error of a pipeline step that did not get to run because the pipeline has run out of time.
+var ErrPipelineTimeout = errors.New("the pipeline has run out of time")
+
+// ErrPipelineInputFailed is the error of a pipeline step that did not get to run because its input command failed.
+var ErrPipelineInputFailed = errors.New("the command piping into this one has failed")
+
+// ErrPipelineTooLong is a command execution error indicating that the pipeline has too many steps.
+var ErrPipelineTooLong = fmt.Errorf("a pipeline may run at most %d app commands", MaxPipelineSteps)
+
+// ErrPipelineUnsafeTarget is a command execution error indicating that the pipeline pipes output into an app that must not take it as parameters.
+var ErrPipelineUnsafeTarget = errors.New("output may not be piped into shell, environment control, AES decryption, or 2FA apps")
+
+/*
+unsafePipeTargets are the triggers of apps that must not take the output of another app command as parameters. The
+output may come from an outsider (e.g. a mail or RSS feed), and it must not be able to run a system command, control the
+program, or reveal secrets.
+*/
+var unsafePipeTargets = map[Trigger]bool{ShellTrigger: true, EnvControlTrigger: true, AESDecryptTrigger: true, TwoFATrigger: true}
+
+// pipelineStep is an app command among a pipeline.
+type pipelineStep struct {
+	trigger Trigger // trigger is the prefix of the app to run.
+	params  string  // params is the app command without the trigger prefix.
+	piped   bool    // piped is true if the output of the previous step is appended to the parameters.
+}
+
+// findTriggerAt returns the longest configured trigger that appears at the beginning of the text and is followed by a space or nothing.
+func findTriggerAt(text string, features map[Trigger]Feature) (ret Trigger) {
+	for trigger := range features {
+		if len(trigger) <= len(ret) || !strings.HasPrefix(text, string(trigger)) {
+			continue
+		}
+		if len(text) == len(trigger) || unicode.IsSpace(rune(text[len(trigger)])) {
+			ret = trigger
+		}
+	}
+	return
+}
+
+/*
+parsePipeline splits the command content into pipeline steps. A separator only counts if it is followed by the trigger
+of a configured app, hence the separator characters may still be used as parameters of app commands. A shell command
+takes the remainder of the content, because the separators are also part of shell syntax. The function returns nil if
+the command content is not a pipeline, i.e. it has only one step.
+*/
+func parsePipeline(content string, features map[Trigger]Feature) (steps []pipelineStep) {
+	content = strings.TrimSpace(content)
+	trigger := findTriggerAt(content, features)
+	if trigger == "" {
+		return nil
+	}
+	current := pipelineStep{trigger: trigger}
+	paramsStart := len(trigger)
+	for i := paramsStart; i < len(content) && current.trigger != ShellTrigger; i++ {
+		if content[i] != PipelineSequenceSeparator && content[i] != PipelinePipeSeparator {
+			continue
+		}
+		rest := strings.TrimLeftFunc(content[i+1:], unicode.IsSpace)
+		nextTrigger := findTriggerAt(rest, features)
+		if nextTrigger == "" {
+			continue
+		}
+		current.params = strings.TrimSpace(content[paramsStart:i])
+		steps = append(steps, current)
+		current = pipelineStep{trigger: nextTrigger, piped: content[i] == PipelinePipeSeparator}
+		paramsStart = len(content) - len(rest) + len(nextTrigger)
+		i = paramsStart - 1
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	current.params = strings.TrimSpace(content[paramsStart:])
+	return append(steps, current)
+}
+
+/*
+runPipeline runs the pipeline steps one after another within the timeout of the command, and returns the result of each
+step in a combined output. A step piped from a failed step does not run. The combined result carries an error if any of
+the steps failed.
+*/
+func (proc *CommandProcessor) runPipeline(cmd Command, steps []pipelineStep) *Result {
+	if len(steps) > MaxPipelineSteps {
+		return &Result{Error: ErrPipelineTooLong}
+	}
+	for _, step := range steps {
+		if step.piped && unsafePipeTargets[step.trigger] {
+			return &Result{Error: ErrPipelineUnsafeTarget}
+		}
+	}
+	deadline := time.Now().Add(time.Duration(cmd.TimeoutSec) * time.Second)
+	var out bytes.Buffer
+	var prevResult *Result
+	numFailed := 0
+	for i, step := range steps {
+		stepCmd := cmd
+		stepCmd.Content = step.params
+		stepCmd.TimeoutSec = int(time.Until(deadline).Seconds())
+		feature := proc.Features.LookupByTrigger[step.trigger]
+		var result *Result
+		if step.piped && (prevResult == nil || prevResult.Error != nil) {
+			result = &Result{Error: ErrPipelineInputFailed}
+		} else if stepCmd.TimeoutSec < 1 {
+			result = &Result{Error: ErrPipelineTimeout}
+		} else {
+			if step.piped {
+				stepCmd.Content = strings.TrimSpace(stepCmd.Content + " " + strings.TrimSpace(prevResult.Output))
+			}
+			if cmd.userPermission != nil && !cmd.userPermission.IsAllowed(step.trigger, stepCmd.Content) {
+				result = &Result{Error: ErrPermissionDenied}
+			} else {
+				result = feature.Execute(stepCmd)
+			}
+		}
+		if result.Error != nil {
+			numFailed++
+		}
+		result.ResetCombinedText()
+		if i > 0 {
+			out.WriteRune('\n')
+		}
+		out.WriteString(fmt.Sprintf("[%d %s] %s", i+1, step.trigger, strings.TrimSpace(result.CombinedOutput)))
+		prevResult = result
+	}
+	ret := &Result{Output: out.String()}
+	if numFailed > 0 {
+		ret.Error = fmt.Errorf("%d of %d app commands in the pipeline failed", numFailed, len(steps))
+	}
+	return ret
+}
+
+// isSensitivePipeline returns true if any of the steps decrypts AES-encrypted content or generates 2FA codes.
+func isSensitivePipeline(steps []pipelineStep) bool {
+	for _, step := range steps {
+		if step.trigger == AESDecryptTrigger || step.trigger == TwoFATrigger {
+			return true
+		}
+	}
+	return false
+}
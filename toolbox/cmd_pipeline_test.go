@@ -0,0 +1,77 @@
+package toolbox
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePipeline(t *testing.T) {
+	features := map[Trigger]Feature{".s": &Shell{}, ".e": &EnvControl{}, ".bp": &BrowserPhantomJS{}}
+	// Not a pipeline
+	for _, content := range []string{"", "abc", ".s echo a; echo b | cat", ".s echo a;.sh", "abc; .s echo a", ".s echo a; .e info | .s cat"} {
+		if steps := parsePipeline(content, features); steps != nil {
+			t.Fatal(content, steps)
+		}
+	}
+	steps := parsePipeline(" .e info;.bp a;b | .e |.s echo a; .e info | cat ", features)
+	expected := []pipelineStep{
+		{trigger: ".e", params: "info"},
+		{trigger: ".bp", params: "a;b"},
+		{trigger: ".e", params: "", piped: true},
+		// Shell command takes the remainder
+		{trigger: ".s", params: "echo a; .e info | cat", piped: true},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("%+v", steps)
+	}
+}
+
+func TestCommandProcessor_Pipeline(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	// Sequence continues after a failure
+	result := proc.Process(Command{Content: TestCommandProcessorPIN + ".c ukarcc; .e doesnotexist; .s echo a; echo b", TimeoutSec: 10}, false)
+	if result.Error == nil || result.Error.Error() != "1 of 3 app commands in the pipeline failed" ||
+		!strings.HasPrefix(result.Output, "[1 .c] ") || !strings.Contains(result.Output, "ukarcc@hmcg.gov.uk\n[2 .e] ") ||
+		!strings.HasSuffix(result.Output, "\n[3 .s] a\nb") {
+		t.Fatalf("%+v", result)
+	}
+	// Pipe output into the next command
+	result = proc.Process(Command{Content: TestCommandProcessorPIN + ".c ukarcc | .c", TimeoutSec: 10}, false)
+	if result.Error != nil || strings.Count(result.Output, "ukarcc@hmcg.gov.uk") != 2 {
+		t.Fatalf("%+v", result)
+	}
+	// Output may not be piped into shell or environment control apps
+	for _, target := range []string{".s echo", ".e"} {
+		result = proc.Process(Command{Content: TestCommandProcessorPIN + ".c ukarcc | " + target, TimeoutSec: 10}, false)
+		if result.Error != ErrPipelineUnsafeTarget {
+			t.Fatalf("%s: %+v", target, result)
+		}
+	}
+	// Do not pipe from a failed command
+	result = proc.Process(Command{Content: TestCommandProcessorPIN + ".e doesnotexist | .c", TimeoutSec: 10}, false)
+	if result.Error == nil || !strings.Contains(result.Output, "[2 .c] "+ErrPipelineInputFailed.Error()) {
+		t.Fatalf("%+v", result)
+	}
+	// Steps that do not get to run before the pipeline times out
+	result = proc.Process(Command{Content: TestCommandProcessorPIN + ".c ukarcc; .s sleep 3", TimeoutSec: 2}, false)
+	if result.Error == nil || !strings.Contains(result.Output, "[2 .s] ") {
+		t.Fatalf("%+v", result)
+	}
+	// Result filters apply to the pipeline's combined result
+	result = proc.Process(Command{Content: TestCommandProcessorPIN + ".c ukarcc; .s echo 01234567890123456789", TimeoutSec: 10}, true)
+	if result.Error != nil || len(result.CombinedOutput) > 35 || !strings.HasPrefix(result.CombinedOutput, "[1 .c] ") {
+		t.Fatalf("%+v", result)
+	}
+	// Each step is subject to the user's permission
+	proc.CommandFilters[0].(*PINAndShortcuts).Users = map[string]*User{"alice": {PIN: "alicepin", AllowedCommands: []string{".s echo"}}}
+	result = proc.Process(Command{Content: "alicepin.e info; .s echo a", TimeoutSec: 10}, false)
+	if result.Error == nil || result.Output != "[1 .e] "+ErrPermissionDenied.Error()+"\n[2 .s] a" {
+		t.Fatalf("%+v", result)
+	}
+	// Too many steps
+	result = proc.Process(Command{Content: TestCommandProcessorPIN + strings.Repeat(".c ;", MaxPipelineSteps+1), TimeoutSec: 10}, false)
+	if result.Error != ErrPipelineTooLong {
+		t.Fatalf("%+v", result)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,9 +34,15 @@ const (
 	MaxCmdLength = 1024 * 1024
 )
 
+// HiddenCommandContent replaces the content of app commands that decrypt AES-encrypted content or generate 2FA codes in logs.
+const HiddenCommandContent = "<hidden due to AESDecryptTrigger or TwoFATrigger>"
+
 // ErrBadPrefix is a command execution error triggered if the command does not contain a valid toolbox feature trigger.
 var ErrBadPrefix = errors.New("bad prefix or feature is not configured")
 
+// ErrPermissionDenied is a command execution error triggered if the authenticated user is not permitted to run the command.
+var ErrPermissionDenied = errors.New("the user is not permitted to run this command")
+
 // ErrBadPLT reminds user of the proper syntax to invoke PLT magic.
 var ErrBadPLT = errors.New(PrefixCommandPLT + " P L T command")
 
@@ -110,7 +117,7 @@ func (proc *CommandProcessor) IsEmpty() bool {
 	}
 	for _, cmdFilter := range proc.CommandFilters {
 		// An empty processor does not have a PIN
-		if pinFilter, ok := cmdFilter.(*PINAndShortcuts); ok && pinFilter.PIN == "" {
+		if pinFilter, ok := cmdFilter.(*PINAndShortcuts); ok && pinFilter.PIN == "" && len(pinFilter.Users) == 0 {
 			return true
 		}
 	}
@@ -138,12 +145,13 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 		seenPIN := false
 		for _, cmdBridge := range proc.CommandFilters {
 			if pin, yes := cmdBridge.(*PINAndShortcuts); yes {
-				if pin.PIN == "" && (pin.Shortcuts == nil || len(pin.Shortcuts) == 0) {
-					errs = append(errs, errors.New(ErrBadProcessorConfig+"Defined in PINAndShortcuts there has to be password PIN, command shortcuts, or both."))
+				if pin.PIN == "" && len(pin.Shortcuts) == 0 && len(pin.Users) == 0 {
+					errs = append(errs, errors.New(ErrBadProcessorConfig+"Defined in PINAndShortcuts there has to be password PIN, command shortcuts, users, or a combination of them."))
 				}
 				if pin.PIN != "" && len(pin.PIN) < 7 {
 					errs = append(errs, errors.New(ErrBadProcessorConfig+"Password PIN must be at least 7 characters long"))
 				}
+				errs = append(errs, checkUsers(pin)...)
 				seenPIN = true
 				break
 			}
@@ -173,6 +181,121 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 	return
 }
 
+// checkUsers returns errors found among the user names, credentials, and permissions defined in PINAndShortcuts.
+func checkUsers(pin *PINAndShortcuts) (errs []error) {
+	errs = make([]error, 0)
+	seenPINs := map[string]bool{pin.PIN: true}
+	for name, user := range pin.Users {
+		if name == "" || name == DefaultUserName || name == ShortcutUserName {
+			errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"User name \"%s\" is reserved", name))
+		}
+		if user == nil {
+			errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"User \"%s\" must not be empty", name))
+			continue
+		}
+		if user.PIN == "" {
+			errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"User \"%s\" must have a password PIN, with or without a TOTP seed", name))
+		}
+		if user.PIN != "" {
+			if len(user.PIN) < 7 {
+				errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"Password PIN of user \"%s\" must be at least 7 characters long", name))
+			}
+			if seenPINs[user.PIN] {
+				errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"Password PIN of user \"%s\" is already used", name))
+			}
+			seenPINs[user.PIN] = true
+		}
+		if user.TOTPSeed != "" {
+			if _, _, _, err := GetTwoFACodes(user.TOTPSeed); err != nil {
+				errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"TOTP seed of user \"%s\" is not a valid base32 secret", name))
+			}
+		}
+		if len(user.AllowedCommands) == 0 {
+			errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"User \"%s\" must be allowed to run at least one command", name))
+		}
+	}
+	return
+}
+
+/*
+trackAuthentication informs the authentication failure tracker of the outcome of command filters, and sends a
+notification via the NotifyViaEmail result filter when the client has failed too many times in a row.
+*/
+func (proc *CommandProcessor) trackAuthentication(cmd Command, filterDisapproval error) {
+	if proc.Features == nil || !proc.Features.AuthFailureTracker.IsConfigured() {
+		return
+	}
+	tracker := &proc.Features.AuthFailureTracker
+	if filterDisapproval == nil {
+		tracker.Succeed(cmd.DaemonName, cmd.ClientID)
+		return
+	}
+	if filterDisapproval != ErrPINAndShortcutNotFound {
+		return
+	}
+	if tracker.Fail(cmd.DaemonName, cmd.ClientID) {
+		for _, resultFilter := range proc.ResultFilters {
+			if notify, isNotify := resultFilter.(*NotifyViaEmail); isNotify {
+				notify.NotifyAuthFailure(cmd.DaemonName, cmd.ClientID, tracker.NotifyAfterFailures)
+			}
+		}
+	}
+}
+
+// isSensitive returns true if the app command or any app command of the pipeline decrypts AES-encrypted content or generates 2FA codes.
+func (proc *CommandProcessor) isSensitive(content string) bool {
+	content = strings.TrimSpace(content)
+	return strings.HasPrefix(content, AESDecryptTrigger) || strings.HasPrefix(content, TwoFATrigger) ||
+		isSensitivePipeline(parsePipeline(content, proc.Features.LookupByTrigger))
+}
+
+/*
+runAppCommand runs the app command or the pipeline of app commands that has passed the command filters. It returns the
+result, as well as the app that ran the command, which is nil in case of a pipeline or an unknown app.
+*/
+func (proc *CommandProcessor) runAppCommand(cmd Command, logCommandContent string, runResultFilters bool) (ret *Result, matchedFeature Feature) {
+	// Run several app commands in a pipeline, the result filters apply only to the pipeline's combined result.
+	if steps := parsePipeline(cmd.Content, proc.Features.LookupByTrigger); steps != nil {
+		proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "user \"%s\" is running pipeline of %d commands \"%s\"", cmd.User, len(steps), logCommandContent)
+		return proc.runPipeline(cmd, steps), nil
+	}
+	// Look for command's prefix among configured features
+	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
+		if cmd.FindAndRemovePrefix(string(prefix)) {
+			matchedFeature = configuredFeature
+			break
+		}
+	}
+	// Unknown command prefix or the requested feature is not configured
+	if matchedFeature == nil {
+		return &Result{Error: ErrBadPrefix}, nil
+	}
+	// The authenticated user may be restricted to a subset of app commands
+	if cmd.userPermission != nil && !cmd.userPermission.IsAllowed(matchedFeature.Trigger(), cmd.Content) {
+		proc.logger.Warning("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "user \"%s\" is not permitted to run \"%s\"", cmd.User, logCommandContent)
+		return &Result{Error: ErrPermissionDenied}, matchedFeature
+	}
+	// Run the feature
+	proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "user \"%s\" is running \"%s\" (post-process result? %v)", cmd.User, logCommandContent, runResultFilters)
+	defer func() {
+		proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "user \"%s\" completed \"%s\" (ok? %v post-process reslt? %v)", cmd.User, logCommandContent, ret.Error == nil, runResultFilters)
+	}()
+	return matchedFeature.Execute(cmd), matchedFeature
+}
+
+// submitJob runs the app command in the background with the job timeout, and returns the job ID.
+func (proc *CommandProcessor) submitJob(cmd Command, logCommandContent string) *Result {
+	cmd.TimeoutSec = proc.Features.BackgroundJobs.JobTimeoutSec
+	id, err := proc.Features.BackgroundJobs.Submit(cmd, logCommandContent, func() *Result {
+		ret, _ := proc.runAppCommand(cmd, logCommandContent, false)
+		return ret
+	})
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("job %s has started", id)}
+}
+
 /*
 Process applies filters to the command, invokes toolbox feature functions to process the content, and then applies
 filters to the execution result and return.
@@ -181,6 +304,18 @@ settings, and it may optionally discard a number of characters from the beginnin
 */
 func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *Result) {
 	proc.initialiseOnce()
+	// Record the command attempt and its outcome in the audit log
+	beginTime := time.Now()
+	var matchedFeature Feature
+	var logCommandContent string
+	if proc.Features != nil && proc.Features.CommandAuditLog.IsConfigured() {
+		defer func() {
+			entry := newAuditEntry(beginTime, cmd, matchedFeature, logCommandContent, ret)
+			if err := proc.Features.CommandAuditLog.Add(entry); err != nil {
+				proc.logger.Warning("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), err, "failed to record the command in audit log")
+			}
+		}()
+	}
 	// Refuse to execute a command if global lock down has been triggered
 	if misc.EmergencyLockDown {
 		return &Result{Error: misc.ErrEmergencyLockDown}
@@ -193,6 +328,10 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 	if len(cmd.Content) > MaxCmdLength {
 		return &Result{Error: ErrCommandTooLong}
 	}
+	// Refuse to execute a command if the client is still waiting out the penalty of its authentication failures
+	if proc.Features != nil && proc.Features.AuthFailureTracker.IsConfigured() && proc.Features.AuthFailureTracker.IsBlocked(cmd.DaemonName, cmd.ClientID) {
+		return &Result{Error: ErrAuthBackOff}
+	}
 	/*
 		Hacky workaround - do not run result filter for the store&forward message processor, which runs an app command
 		with its own command processor and its own result filters.
@@ -204,18 +343,18 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 	// Put execution duration into statistics
 	beginTimeNano := time.Now().UnixNano()
 	var filterDisapproval error
-	var matchedFeature Feature
 	var overrideLintText LintText
 	var hasOverrideLintText bool
-	var logCommandContent string
 	// Walk the command through all filters
 	for _, cmdBridge := range proc.CommandFilters {
 		cmd, filterDisapproval = cmdBridge.Transform(cmd)
 		if filterDisapproval != nil {
+			proc.trackAuthentication(cmd, filterDisapproval)
 			ret = &Result{Error: filterDisapproval}
 			goto result
 		}
 	}
+	proc.trackAuthentication(cmd, nil)
 	// If filters approve, then the command execution is to be tracked in stats.
 	defer func() {
 		misc.CommandStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
@@ -269,28 +408,26 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 		content.
 	*/
 	logCommandContent = cmd.Content
-	// Look for command's prefix among configured features
-	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
-		if cmd.FindAndRemovePrefix(string(prefix)) {
-			// Hacky workaround - do not log content of AES decryption commands as they can reveal encryption key
-			if prefix == AESDecryptTrigger || prefix == TwoFATrigger {
-				logCommandContent = "<hidden due to AESDecryptTrigger or TwoFATrigger>"
-			}
-			matchedFeature = configuredFeature
-			break
+	if cmd.FindAndRemoveWord(PrefixCommandBackground) {
+		// Run the app command in the background and respond with the job ID right away
+		if proc.isSensitive(cmd.Content) {
+			logCommandContent = HiddenCommandContent
 		}
+		ret = proc.submitJob(cmd, logCommandContent)
+	} else if cmd.FindAndRemoveWord(PrefixCommandJob) {
+		ret = proc.Features.BackgroundJobs.Query(cmd)
+	} else if cmd.FindAndRemoveWord(PrefixCommandAlias) {
+		// The alias template may be an app command that reveals secrets, such as decrypting a file with the key.
+		if separator := strings.Index(cmd.Content, AliasDefinitionSeparator); separator != -1 && proc.isSensitive(cmd.Content[separator+1:]) {
+			logCommandContent = HiddenCommandContent
+		}
+		ret = proc.Features.CommandAliases.Manage(cmd, proc.isSensitive)
+	} else {
+		if proc.isSensitive(cmd.Content) {
+			logCommandContent = HiddenCommandContent
+		}
+		ret, matchedFeature = proc.runAppCommand(cmd, logCommandContent, runResultFilters)
 	}
-	// Unknown command prefix or the requested feature is not configured
-	if matchedFeature == nil {
-		ret = &Result{Error: ErrBadPrefix}
-		goto result
-	}
-	// Run the feature
-	proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "running \"%s\" (post-process result? %v)", logCommandContent, runResultFilters)
-	defer func() {
-		proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "completed \"%s\" (ok? %v post-process reslt? %v)", logCommandContent, ret.Error == nil, runResultFilters)
-	}()
-	ret = matchedFeature.Execute(cmd)
 result:
 	// Command in the result structure is mainly used for logging purpose
 	ret.Command = cmd
@@ -300,6 +437,9 @@ result:
 		after triggering filters, and before triggering features.
 	*/
 	ret.Command.Content = logCommandContent
+	if matchedFeature != nil {
+		ret.Trigger = matchedFeature.Trigger()
+	}
 	// Set combined text for easier retrieval of result+error in one text string
 	ret.ResetCombinedText()
 	// Walk through result filters
@@ -314,6 +454,7 @@ result:
 			}
 		}
 	}
+	ret.DurationMilli = time.Since(beginTime).Milliseconds()
 	return
 }
 
@@ -331,6 +472,7 @@ func GetTestCommandProcessor() *CommandProcessor {
 	commandBridges := []CommandFilter{
 		&PINAndShortcuts{PIN: TestCommandProcessorPIN},
 		&TranslateSequences{Sequences: [][]string{{"alpha", "beta"}}},
+		&ExpandAliases{Aliases: &features.CommandAliases},
 	}
 	// Prepare realistic result bridges
 	resultBridges := []ResultFilter{
@@ -44,7 +44,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	// Run a failing command - be aware of the word substitution conducted by command filter
 	cmd = Command{TimeoutSec: 5, Content: "mypin.secho alpha; does-not-exist"}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta; does-not-exist"}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta; does-not-exist", User: DefaultUserName}) ||
 		result.Error == nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != result.Error.Error()[0:2] {
 		t.Fatalf("%+v", result)
 	}
@@ -52,7 +52,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	// Run a command that does not trigger a configured feature
 	cmd = Command{TimeoutSec: 5, Content: "mypin.tz"}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".tz"}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".tz", User: DefaultUserName}) ||
 		result.Error != ErrBadPrefix || result.Output != "" || result.CombinedOutput != ErrBadPrefix.Error()[0:2] {
 		t.Fatalf("%+v", result)
 	}
@@ -60,14 +60,18 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	// Run a successful command - be aware of the word substitution conducted by command filter
 	cmd = Command{TimeoutSec: 5, Content: "mypin.secho alpha"}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta"}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta", User: DefaultUserName}) ||
 		result.Error != nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != "be" {
 		t.Fatalf("%+v", result)
 	}
+	// The result carries the app's trigger and truncation info, which are presented in structured result.
+	if result.Trigger != ".s" || !result.Truncated || result.UntruncatedLength != 4 {
+		t.Fatalf("%+v", result)
+	}
 	// Test the tolerance to extra spaces in feature prefix matcher
 	cmd = Command{TimeoutSec: 5, Content: " mypin .s echo alpha "}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".s echo beta"}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".s echo beta", User: DefaultUserName}) ||
 		result.Error != nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != "be" {
 		t.Fatalf("%+v", result)
 	}
@@ -75,14 +79,14 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	// Override PLT but PLT parameter values are not given
 	cmd = Command{TimeoutSec: 5, Content: "mypin  .plt   sadf asdf "}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ""}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: "", User: DefaultUserName}) ||
 		result.Error != ErrBadPLT || result.Output != "" || result.CombinedOutput != ErrBadPLT.Error()[0:2] {
 		t.Fatalf("%v | %v | %v |%+v", result.Error, result.Output, result.CombinedOutput, result.Command)
 	}
 	// Override PLT using good PLT parameter values
 	cmd = Command{TimeoutSec: 1, Content: "mypin  .plt  2, 5. 4  .s  sleep 2 ; echo 0123456789 "}
 	result = proc.Process(cmd, true)
-	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 4, Content: "  .s  sleep 2 ; echo 0123456789"}) ||
+	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 4, Content: "  .s  sleep 2 ; echo 0123456789", User: DefaultUserName}) ||
 		result.Error != nil || !strings.Contains(result.Output, "0123456789") || result.CombinedOutput != "23456" {
 		t.Fatalf("%v | %v | %v | %+v", result.Error, result.Output, result.CombinedOutput, result.Command)
 	}
@@ -96,6 +100,29 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	misc.EmergencyLockDown = false
 }
 
+func TestCommandProcessor_UserPermission(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	proc.CommandFilters[0].(*PINAndShortcuts).Users = map[string]*User{
+		"alice": {PIN: "alicepin", AllowedCommands: []string{".e info"}},
+	}
+	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if result := proc.Process(Command{Content: "alicepin.e info", TimeoutSec: 10}, false); result.Error != nil || result.Command.User != "alice" {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: "alicepin.s echo abc", TimeoutSec: 10}, false); result.Error != ErrPermissionDenied || result.Command.User != "alice" {
+		t.Fatal(result)
+	}
+	if result := proc.Process(Command{Content: "alicepin.plt 0 10 10 .e kill", TimeoutSec: 10}, false); result.Error != ErrPermissionDenied {
+		t.Fatal(result)
+	}
+	// The password PIN continues to grant access to all apps
+	if result := proc.Process(Command{Content: TestCommandProcessorPIN + ".s echo abc", TimeoutSec: 10}, false); result.Error != nil || result.Command.User != DefaultUserName {
+		t.Fatal(result)
+	}
+}
+
 func TestCommandProcessor_LengthLimit(t *testing.T) {
 	proc := GetTestCommandProcessor()
 
@@ -198,6 +225,29 @@ func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
 		t.Fatal(errs)
 	}
+	// Users are checked for their credentials and permissions
+	proc.CommandFilters = []CommandFilter{&PINAndShortcuts{Users: map[string]*User{
+		DefaultUserName: {PIN: "very-long-pin", AllowedCommands: []string{".s"}},
+		"a":             {PIN: "short", TOTPSeed: "not base32!", AllowedCommands: []string{".s"}},
+		"b":             {},
+		"c":             nil,
+		"d":             {TOTPSeed: "JBSWY3DPEHPK3PXP", AllowedCommands: []string{".s"}},
+	}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 8 {
+		t.Fatal(errs)
+	}
+	// Good users without password PIN
+	proc.CommandFilters = []CommandFilter{&PINAndShortcuts{Users: map[string]*User{
+		"a": {PIN: "very-long-pin", AllowedCommands: []string{"*"}},
+		"b": {PIN: "another-long-pin", TOTPSeed: "JBSWY3DPEHPK3PXP", AllowedCommands: []string{".e info"}},
+	}}}
+	if proc.IsEmpty() {
+		t.Fatal("should not be empty")
+	}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	proc.CommandFilters = []CommandFilter{&PINAndShortcuts{PIN: "very-long-pin"}}
 	// No linter bridge
 	proc.ResultFilters = []ResultFilter{}
 	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
@@ -2,6 +2,7 @@ package toolbox
 
 import (
 	"bytes"
+	"fmt"
 	"regexp"
 	"strings"
 	"unicode"
@@ -20,7 +21,8 @@ type ResultFilter interface {
 }
 
 /*
-Lint combined text string in the following order (each step is turned on by respective attribute)
+Lint combined text string, as well as the output presented in structured result, in the following order (each step is
+turned on by respective attribute)
 1. Trim all leading and trailing spaces from lines.
 2. Compress all lines into a single line, joint by a semicolon.
 3. Retain only printable & visible, 7-bit ASCII characters.
@@ -38,7 +40,30 @@ type LintText struct {
 }
 
 func (lint *LintText) Transform(result *Result) error {
-	ret := result.CombinedOutput
+	ret := lint.tidy(result.CombinedOutput)
+	// Cut leading characters
+	untruncatedLength := len(ret)
+	result.untruncatedOutput, result.untruncatedBeginPosition = "", 0
+	ret = lint.cutLeading(ret)
+	// Cut trailing characters
+	if lint.MaxLength > 0 && len(ret) > lint.MaxLength {
+		// Let channel profile look for a better place to cut
+		result.untruncatedOutput = ret
+		result.untruncatedBeginPosition = lint.BeginPosition
+	}
+	ret = lint.cutTrailing(ret)
+	if len(ret) < untruncatedLength {
+		result.Truncated = true
+		result.UntruncatedLength = untruncatedLength
+	}
+	result.CombinedOutput = ret
+	// The output presented in structured result goes through the same linting
+	result.filteredOutput = lint.cutTrailing(lint.cutLeading(lint.tidy(result.filteredOutput)))
+	return nil
+}
+
+// tidy returns the text with spaces, line breaks, and characters transformed, but without cutting its length.
+func (lint *LintText) tidy(ret string) string {
 	// Trim spaces from beginning and end of each line, preserve line breaks.
 	if lint.TrimSpaces {
 		var out bytes.Buffer
@@ -68,22 +93,26 @@ func (lint *LintText) Transform(result *Result) error {
 	if lint.CompressSpaces {
 		ret = RegexConsecutiveSpaces.ReplaceAllString(ret, " ")
 	}
-	// Cut leading characters
+	return ret
+}
+
+// cutLeading returns the text without its leading characters up to BeginPosition.
+func (lint *LintText) cutLeading(ret string) string {
 	if lint.BeginPosition > 0 {
 		if len(ret) > lint.BeginPosition {
-			ret = ret[lint.BeginPosition:]
-		} else {
-			ret = ""
+			return ret[lint.BeginPosition:]
 		}
+		return ""
 	}
-	// Cut trailing characters
-	if lint.MaxLength > 0 {
-		if len(ret) > lint.MaxLength {
-			ret = ret[0:lint.MaxLength]
-		}
+	return ret
+}
+
+// cutTrailing returns the text without its excessive characters beyond MaxLength.
+func (lint *LintText) cutTrailing(ret string) string {
+	if lint.MaxLength > 0 && len(ret) > lint.MaxLength {
+		return ret[0:lint.MaxLength]
 	}
-	result.CombinedOutput = ret
-	return nil
+	return ret
 }
 
 func (_ *LintText) SetLogger(_ lalog.Logger) {
@@ -114,11 +143,25 @@ func (notify *NotifyViaEmail) Transform(result *Result) error {
 	return nil
 }
 
+// NotifyAuthFailure sends a notification Email about the consecutive authentication failures of a client.
+func (notify *NotifyViaEmail) NotifyAuthFailure(daemonName, clientID string, numFailures int) {
+	if !notify.IsConfigured() {
+		return
+	}
+	go func() {
+		subject := inet.OutgoingMailSubjectKeyword + "-auth-failure-" + daemonName + "-" + clientID
+		body := fmt.Sprintf("Client \"%s\" of daemon \"%s\" has failed to authenticate %d times in a row.", clientID, daemonName, numFailures)
+		if err := notify.MailClient.Send(subject, body, notify.Recipients...); err != nil {
+			notify.logger.Warning("NotifyAuthFailure", daemonName+"-"+clientID, err, "failed to send notification")
+		}
+	}()
+}
+
 func (notify *NotifyViaEmail) SetLogger(logger lalog.Logger) {
 	notify.logger = logger
 }
 
-// If there is no graph character among the combined output, replace it by "EMPTY OUTPUT".
+// If there is no graph character among the combined output (or the output of structured result), replace it by "EMPTY OUTPUT".
 type SayEmptyOutput struct {
 }
 
@@ -129,6 +172,9 @@ func (empty *SayEmptyOutput) Transform(result *Result) error {
 	if !RegexGraphChar.MatchString(result.CombinedOutput) {
 		result.CombinedOutput = EmptyOutputText
 	}
+	if !RegexGraphChar.MatchString(result.filteredOutput) {
+		result.filteredOutput = EmptyOutputText
+	}
 	return nil
 }
 
@@ -47,6 +47,9 @@ func TestLintText_Transform(t *testing.T) {
 	if err := lint.Transform(result); err != nil || result.CombinedOutput != "def 123 45" {
 		t.Fatal(err, result.CombinedOutput)
 	}
+	if !result.Truncated || result.UntruncatedLength != 23 {
+		t.Fatalf("%+v", result)
+	}
 }
 
 func TestLintText_Transform_RetainLineBreaks(t *testing.T) {
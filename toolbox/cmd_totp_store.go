@@ -0,0 +1,62 @@
+package toolbox
+
+import (
+	"sync"
+	"time"
+)
+
+// TOTPValiditySec is the number of seconds during which a TOTP code is accepted - the previous, current, and upcoming 30-second intervals.
+const TOTPValiditySec = 90
+
+// SharedTOTPStore is the store of consumed TOTP codes used by all PINAndShortcuts filters that do not keep a store of their own.
+var SharedTOTPStore = NewTOTPStore()
+
+// consumedTOTP is a TOTP code that has been used to authenticate a command.
+type consumedTOTP struct {
+	commandContent string
+	expiry         time.Time
+}
+
+/*
+TOTPStore remembers the TOTP codes that have been used to authenticate commands, so that each code may only authenticate
+a single command of the user. The same command may be repeated with the same code, which happens when a client such as
+a DNS resolver retries a query. Different users may coincidentally have the same code, and they do not interfere with
+each other. A code is forgotten when it can no longer be accepted.
+*/
+type TOTPStore struct {
+	consumed map[string]consumedTOTP // consumed codes are keyed by user name and code
+	mutex    *sync.Mutex
+	// getNow returns the current time, it is replaced by test cases to simulate passage of time.
+	getNow func() time.Time
+}
+
+// NewTOTPStore returns an initialised TOTP store that has not seen any code.
+func NewTOTPStore() *TOTPStore {
+	return &TOTPStore{
+		consumed: make(map[string]consumedTOTP),
+		mutex:    new(sync.Mutex),
+		getNow:   time.Now,
+	}
+}
+
+/*
+Consume records the code of the user as used by the command content. It returns false if the user's code has already
+been used by a different command content, in which case the command must not be authenticated.
+*/
+func (store *TOTPStore) Consume(userName, code, commandContent string) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := store.getNow()
+	// Forget the codes that can no longer be accepted
+	for key, entry := range store.consumed {
+		if !now.Before(entry.expiry) {
+			delete(store.consumed, key)
+		}
+	}
+	key := userName + "\x00" + code
+	if entry, exists := store.consumed[key]; exists {
+		return entry.commandContent == commandContent
+	}
+	store.consumed[key] = consumedTOTP{commandContent: commandContent, expiry: now.Add(TOTPValiditySec * time.Second)}
+	return true
+}
@@ -0,0 +1,56 @@
+package toolbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPStore(t *testing.T) {
+	now := time.Now()
+	store := NewTOTPStore()
+	store.getNow = func() time.Time { return now }
+	if !store.Consume("alice", "111111", ".e info") || !store.Consume("alice", "222222", ".e log") {
+		t.Fatal("should have consumed new codes")
+	}
+	// A code may be repeatedly used by the same command, but not by a different command.
+	if !store.Consume("alice", "111111", ".e info") || store.Consume("alice", "111111", ".e log") {
+		t.Fatal("should have accepted the same command and refused the different command")
+	}
+	// Another user's identical code is independent
+	if !store.Consume("bob", "111111", ".e log") {
+		t.Fatal("should have consumed the code of another user")
+	}
+	// An older code cannot be replayed after a newer code has been used
+	if !store.Consume("alice", "333333", ".s echo hi") || store.Consume("alice", "111111", ".s echo hi") {
+		t.Fatal("should have refused the replayed code")
+	}
+	// Codes are forgotten after they are no longer acceptable
+	now = now.Add(TOTPValiditySec*time.Second - time.Millisecond)
+	if store.Consume("alice", "222222", ".s echo hi") {
+		t.Fatal("should have refused the code")
+	}
+	now = now.Add(time.Millisecond)
+	if !store.Consume("alice", "222222", ".s echo hi") || len(store.consumed) != 1 {
+		t.Fatal("should have forgotten the expired codes", store.consumed)
+	}
+}
+
+func TestTOTPStore_Concurrent(t *testing.T) {
+	store := NewTOTPStore()
+	succeeded := make(chan bool, 100)
+	for i := 0; i < 100; i++ {
+		go func(i int) {
+			succeeded <- store.Consume("alice", "123456", string(rune('a'+i%26))+"command")
+		}(i)
+	}
+	numSucceeded := 0
+	for i := 0; i < 100; i++ {
+		if <-succeeded {
+			numSucceeded++
+		}
+	}
+	// Only the command that consumed the code first, and its repetitions, may succeed.
+	if numSucceeded < 1 || numSucceeded > 4 {
+		t.Fatal(numSucceeded)
+	}
+}